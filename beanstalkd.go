@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type BeanstalkdOptions struct {
+	URI string `desc:"A URI or unix socket path for connecting to beanstalkd (e.g. localhost:11300)."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+const beanstalkdTimeout = 5 * time.Second
+
+var errBeanstalkdNotFound = errors.New("not found")
+
+type Beanstalkd struct {
+	scheme, host string
+	conn         net.Conn
+	r            *bufio.Reader
+	totalJobs    uint64
+	primed       bool
+
+	jobs      *prometheus.GaugeVec
+	waiting   *prometheus.GaugeVec
+	jobsTotal prometheus.Counter
+}
+
+func NewBeanstalkd(opts BeanstalkdOptions) (*Beanstalkd, error) {
+	scheme, host, err := collector.ParseURI(opts.URI)
+	if err != nil {
+		return nil, err
+	}
+	e := &Beanstalkd{
+		scheme: scheme,
+		host:   host,
+
+		jobs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "beanstalkd_jobs",
+			Help: "Number of jobs in a tube.",
+		}, []string{"tube", "state"}),
+		waiting: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "beanstalkd_tube_waiting_clients",
+			Help: "Number of clients waiting for a job in a tube.",
+		}, []string{"tube"}),
+		jobsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "beanstalkd_jobs_total",
+			Help: "Total number of created jobs.",
+		}),
+	}
+	e.updateStats()
+	return e, nil
+}
+
+func (e *Beanstalkd) Close() error {
+	if e.conn == nil {
+		return nil
+	}
+	err := e.conn.Close()
+	e.conn = nil
+	return err
+}
+
+// Check requests the server stats.
+func (e *Beanstalkd) Check(ctx context.Context) error {
+	_, err := e.command("stats")
+	return err
+}
+
+func (e *Beanstalkd) Describe(ch chan<- *prometheus.Desc) {
+	e.jobs.Describe(ch)
+	e.waiting.Describe(ch)
+	e.jobsTotal.Describe(ch)
+}
+
+func (e *Beanstalkd) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Beanstalkd) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	stats, err := e.updateStats()
+	if err != nil {
+		Error.Println("beanstalkd:", err)
+		return err
+	}
+	e.jobsTotal.Add(float64(stats.TotalJobs))
+	e.jobs.Reset()
+	e.waiting.Reset()
+	for tube, stat := range stats.Tubes {
+		e.jobs.WithLabelValues(tube, "ready").Set(float64(stat["current-jobs-ready"]))
+		e.jobs.WithLabelValues(tube, "reserved").Set(float64(stat["current-jobs-reserved"]))
+		e.jobs.WithLabelValues(tube, "delayed").Set(float64(stat["current-jobs-delayed"]))
+		e.jobs.WithLabelValues(tube, "buried").Set(float64(stat["current-jobs-buried"]))
+		e.waiting.WithLabelValues(tube).Set(float64(stat["current-waiting"]))
+	}
+	e.jobs.Collect(ch)
+	e.waiting.Collect(ch)
+	e.jobsTotal.Collect(ch)
+	Debug.Println("collect duration for beanstalkd:", time.Since(t))
+	return nil
+}
+
+// command sends a command and returns the body of an OK response. The connection is reused and closed on error so that the next command reconnects.
+func (e *Beanstalkd) command(cmd string) ([]byte, error) {
+	if e.conn == nil {
+		conn, err := net.DialTimeout(e.scheme, e.host, 1*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		e.conn = conn
+		e.r = bufio.NewReader(conn)
+	}
+
+	b, err := e.roundTrip(cmd)
+	if err != nil {
+		if err != errBeanstalkdNotFound {
+			e.Close()
+		}
+		return nil, fmt.Errorf("%v: %w", cmd, err)
+	}
+	return b, nil
+}
+
+func (e *Beanstalkd) roundTrip(cmd string) ([]byte, error) {
+	e.conn.SetDeadline(time.Now().Add(beanstalkdTimeout))
+	if _, err := e.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		return nil, err
+	}
+	line, err := e.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	if line == "NOT_FOUND\r\n" {
+		return nil, errBeanstalkdNotFound
+	} else if _, err := fmt.Sscanf(line, "OK %d\r\n", &n); err != nil {
+		return nil, fmt.Errorf("unexpected response: %v", strings.TrimSpace(line))
+	}
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(e.r, b); err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// beanstalkdParseYAML parses the flat YAML dictionaries and lists returned by beanstalkd.
+func beanstalkdParseYAML(b []byte) (map[string]string, []string) {
+	dict := map[string]string{}
+	list := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "- ") {
+			list = append(list, strings.TrimSpace(line[2:]))
+		} else if key, val, ok := strings.Cut(line, ":"); ok {
+			dict[strings.TrimSpace(key)] = strings.TrimSpace(val)
+		}
+	}
+	return dict, list
+}
+
+type beanstalkdStats struct {
+	TotalJobs uint64
+	Tubes     map[string]map[string]uint64
+}
+
+func (e *Beanstalkd) updateStats() (beanstalkdStats, error) {
+	b, err := e.command("stats")
+	if err != nil {
+		return beanstalkdStats{}, err
+	}
+	stats, _ := beanstalkdParseYAML(b)
+	totalJobs, _ := strconv.ParseUint(stats["total-jobs"], 10, 64)
+
+	b, err = e.command("list-tubes")
+	if err != nil {
+		return beanstalkdStats{}, err
+	}
+	_, tubes := beanstalkdParseYAML(b)
+
+	cur := beanstalkdStats{
+		TotalJobs: totalJobs,
+		Tubes:     map[string]map[string]uint64{},
+	}
+	for _, tube := range tubes {
+		b, err := e.command("stats-tube " + tube)
+		if errors.Is(err, errBeanstalkdNotFound) {
+			continue // tube was removed in the meantime
+		} else if err != nil {
+			return beanstalkdStats{}, err
+		}
+		stats, _ := beanstalkdParseYAML(b)
+		cur.Tubes[tube] = map[string]uint64{}
+		for key, val := range stats {
+			if n, err := strconv.ParseUint(val, 10, 64); err == nil {
+				cur.Tubes[tube][key] = n
+			}
+		}
+	}
+
+	diff := cur
+	if !e.primed || totalJobs < e.totalJobs {
+		diff.TotalJobs = 0
+	} else {
+		diff.TotalJobs -= e.totalJobs
+	}
+	e.totalJobs = totalJobs
+	e.primed = true
+	return diff, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestBuildOS vets the whole module for the non-Linux platforms, which have their own peer credential and node collector files.
+func TestBuildOS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("cross-compiling is slow")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not available")
+	}
+	for _, goos := range []string{"freebsd", "darwin", "windows"} {
+		t.Run(goos, func(t *testing.T) {
+			cmd := exec.Command(gobin, "vet", "./...")
+			cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH=amd64", "CGO_ENABLED=0")
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("go vet: %v\n%s", err, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	breakerFailures   = 3                // consecutive failures before backing off
+	breakerMinBackoff = 10 * time.Second // first cool-down, doubled for every failure after
+	breakerMaxBackoff = 10 * time.Minute
+)
+
+// ErrBackoff is returned instead of attempting a backend that is backed off after consecutive failures.
+var ErrBackoff = errors.New("backing off")
+
+// Breaker skips attempts to a persistently failing backend. After a number of consecutive failures it backs off for an exponentially increasing cool-down, after which a single attempt is made again. The first success resets it.
+type Breaker struct {
+	name string
+	log  Log
+
+	mu       sync.Mutex
+	failures int
+	until    time.Time
+}
+
+// NewBreaker returns a breaker for the backend called name in its log messages.
+func NewBreaker(name string, log Log) *Breaker {
+	return &Breaker{name: name, log: log.WithDefaults()}
+}
+
+// Allow returns ErrBackoff during the cool-down, otherwise the backend should be attempted and the result passed to Done.
+func (b *Breaker) Allow() error {
+	if backoff := b.Backoff(); 0 < backoff {
+		return fmt.Errorf("%w for %v", ErrBackoff, backoff.Round(time.Second))
+	}
+	return nil
+}
+
+// Done records the result of an attempt.
+func (b *Breaker) Done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if breakerFailures <= b.failures {
+			b.log.Info.Printf("%v: recovered after %v consecutive failures", b.name, b.failures)
+		}
+		b.failures = 0
+		b.until = time.Time{}
+		return
+	}
+
+	b.failures++
+	if breakerFailures <= b.failures {
+		backoff := breakerMaxBackoff
+		if n := b.failures - breakerFailures; n < 16 {
+			backoff = min(breakerMinBackoff<<n, breakerMaxBackoff)
+		}
+		b.until = time.Now().Add(backoff)
+		b.log.Warning.Printf("%v: backing off for %v after %v consecutive failures", b.name, backoff, b.failures)
+	}
+}
+
+// Backoff returns the remaining cool-down, or zero if the backend is attempted.
+func (b *Breaker) Backoff() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(0, time.Until(b.until))
+}
+
+// Breakers holds a breaker per backend of a collector.
+type Breakers struct {
+	name string
+	log  Log
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+func NewBreakers(name string, log Log) *Breakers {
+	return &Breakers{
+		name:     name,
+		log:      log,
+		breakers: map[string]*Breaker{},
+	}
+}
+
+// Get returns the breaker of a backend.
+func (b *Breakers) Get(backend string) *Breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.breakers[backend]
+	if !ok {
+		breaker = NewBreaker(b.name+" "+backend, b.log)
+		b.breakers[backend] = breaker
+	}
+	return breaker
+}
+
+// Backoff returns the longest remaining cool-down of the backends.
+func (b *Breakers) Backoff() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	backoff := time.Duration(0)
+	for _, breaker := range b.breakers {
+		backoff = max(backoff, breaker.Backoff())
+	}
+	return backoff
+}
@@ -0,0 +1,174 @@
+package collector
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// NewTLSConfig returns a TLS client configuration that trusts the certificates in caFile, if given, besides the system's certificates.
+func NewTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// IsTLSError returns true if the error occurred during the TLS handshake.
+func IsTLSError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	return errors.As(err, &certErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr)
+}
+
+// StatusError is returned for HTTP responses with a status code other than 200.
+type StatusError struct {
+	StatusCode int
+}
+
+func (err StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d %s", err.StatusCode, http.StatusText(err.StatusCode))
+}
+
+// Client fetches a page over HTTP, such as the status page of a backend.
+type Client struct {
+	client *http.Client
+	uri    string
+
+	Header http.Header // sent with every request
+}
+
+// NewClient returns an HTTP client for an http:// or https:// URI, or for a unix: URI of the form unix:///run/nginx.sock:/stub_status where the request path follows the socket path after a colon. The request path defaults to / for Unix sockets.
+func NewClient(uri string) (*Client, error) {
+	network, addr := "tcp", ""
+	if strings.HasPrefix(uri, "unix:") {
+		socket, requestPath := SplitSocketPath(unixPath(uri))
+		if requestPath == "" {
+			var query string
+			if socket, query, _ = strings.Cut(socket, "?"); query != "" {
+				requestPath = "/?" + query
+			}
+		}
+		if strings.HasPrefix(socket, "@") {
+			if err := checkAbstractSocket(socket); err != nil {
+				return nil, fmt.Errorf("invalid URI %q: %w", uri, err)
+			}
+		} else if !path.IsAbs(socket) {
+			return nil, fmt.Errorf("invalid URI %q: socket path must be absolute, e.g. unix:///run/nginx.sock:/stub_status", uri)
+		}
+		if requestPath == "" {
+			requestPath = "/"
+		}
+		network, addr = "unix", socket
+		uri = "http://localhost" + requestPath
+	} else {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URI %q: %w", uri, err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid URI %q: scheme %q not supported, expected http, https or unix", uri, u.Scheme)
+		} else if u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid URI %q: missing host, e.g. %v://localhost", uri, u.Scheme)
+		}
+		addr = u.Host
+		if u.Port() == "" {
+			if u.Scheme == "http" {
+				addr = net.JoinHostPort(u.Hostname(), "80")
+			} else {
+				addr = net.JoinHostPort(u.Hostname(), "443")
+			}
+		}
+	}
+
+	d := net.Dialer{
+		Timeout:   1 * time.Second,  // timeout in establishing connection only
+		KeepAlive: 30 * time.Second, // time between keep-alive probes
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return &Client{
+		client: &http.Client{
+			Transport: tr,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse // don't follow redirects
+			},
+		},
+		uri:    uri,
+		Header: http.Header{},
+	}, nil
+}
+
+// SetTLSConfig sets the TLS configuration for https:// URIs, such as to verify the server against a CA or to authenticate with a client certificate.
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.client.Transport.(*http.Transport).TLSClientConfig = config
+}
+
+func (c *Client) Get(ctx context.Context) ([]byte, error) {
+	req, err := c.NewRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// NewRequest returns a GET request for the client's URI including the client's headers.
+func (c *Client) NewRequest(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, vals := range c.Header {
+		req.Header[key] = vals
+	}
+	return req, nil
+}
+
+// Do sends the request and returns the response body. A StatusError is returned for status codes other than 200.
+func (c *Client) Do(req *http.Request) ([]byte, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, StatusError{resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// Fetcher fetches a page, such as the status page of a backend.
+type Fetcher interface {
+	Get(context.Context) ([]byte, error)
+}
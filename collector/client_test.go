@@ -0,0 +1,114 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		uri string
+		req string // request URI, or error substring when err is set
+		err bool
+	}{
+		{"http://localhost/stub_status", "http://localhost/stub_status", false},
+		{"https://127.0.0.1:8443/status?full", "https://127.0.0.1:8443/status?full", false},
+		{"unix:///run/nginx.sock:/stub_status", "http://localhost/stub_status", false},
+		{"unix:/run/nginx.sock:/stub_status", "http://localhost/stub_status", false},
+		{"unix:///run/php-fpm.sock", "http://localhost/", false},
+		{"unix:///run/php-fpm.sock?json", "http://localhost/?json", false},
+		{"unix:run/nginx.sock:/stub_status", "socket path must be absolute", true},
+		{"unix://./nginx.sock", "socket path must be absolute", true},
+		{"unix:@", "name is empty", true},
+		{"unix:@" + strings.Repeat("x", 107), "longer than 107 bytes", true},
+		{"http:///stub_status", "missing host", true},
+		{"https://:8443", "missing host", true},
+		{"ftp://localhost/status", `scheme "ftp" not supported`, true},
+		{"localhost:8080", "not supported", true},
+		{"http://local host/", "invalid URI", true},
+	}
+	if runtime.GOOS == "linux" {
+		tests = append(tests, struct {
+			uri string
+			req string
+			err bool
+		}{"unix:@nginx:/stub_status", "http://localhost/stub_status", false})
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			c, err := NewClient(tt.uri)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %v, expected error containing %q", c.uri, tt.req)
+				} else if !strings.Contains(err.Error(), tt.req) {
+					t.Fatalf("got error %q, expected it to contain %q", err, tt.req)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if c.uri != tt.req {
+				t.Errorf("got request URI %v, expected %v", c.uri, tt.req)
+			}
+		})
+	}
+}
+
+func serveUnix(t *testing.T, socket string) {
+	t.Helper()
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RequestURI())
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func TestClientUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dex") // short path, since socket paths are limited to 107 bytes
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "nginx.sock")
+	serveUnix(t, socket)
+
+	tests := []struct {
+		uri  string
+		body string
+	}{
+		{"unix://" + socket + ":/stub_status", "/stub_status"},
+		{"unix:" + socket, "/"},
+		{"unix://" + socket + "?json&full", "/?json&full"},
+	}
+	if runtime.GOOS == "linux" {
+		abstract := fmt.Sprintf("@dex_exporter_test_%d", os.Getpid())
+		serveUnix(t, abstract)
+		tests = append(tests, struct {
+			uri  string
+			body string
+		}{"unix:" + abstract + ":/status", "/status"})
+	}
+	for _, tt := range tests {
+		c, err := NewClient(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := c.Get(context.Background())
+		if err != nil {
+			t.Errorf("%v: %v", tt.uri, err)
+		} else if string(body) != tt.body {
+			t.Errorf("%v: requested %v, expected %v", tt.uri, string(body), tt.body)
+		}
+	}
+}
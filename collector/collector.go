@@ -0,0 +1,79 @@
+// Package collector contains the helpers shared by the collectors of the exporter, and the interfaces through which the exporter uses collectors beyond prometheus.Collector. The collectors themselves are in its subpackages, such as collector/node, and can be registered with a prometheus.Registry directly or gated on systemd services with the exporter package.
+package collector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrNotSupported is returned by collectors that are not available on this operating system.
+var ErrNotSupported = errors.New("not supported on this operating system")
+
+// Logger logs the messages of a level, *log.Logger implements it.
+type Logger interface {
+	Println(v ...any)
+	Printf(format string, v ...any)
+}
+
+// Log holds the loggers per level that collectors log to. Nil loggers discard their messages.
+type Log struct {
+	Error   Logger
+	Warning Logger
+	Info    Logger
+	Debug   Logger
+}
+
+var discard = log.New(io.Discard, "", 0)
+
+// WithDefaults returns the loggers where nil loggers are replaced by one that discards.
+func (l Log) WithDefaults() Log {
+	for _, logger := range []*Logger{&l.Error, &l.Warning, &l.Info, &l.Debug} {
+		if *logger == nil {
+			*logger = discard
+		}
+	}
+	return l
+}
+
+// ReadTimer is implemented by collectors that don't read their backend during collection, and returns the time the backend was last read.
+type ReadTimer interface {
+	ReadTime() time.Time
+}
+
+// ContextCollector is implemented by collectors that abort requests to their backend when the context is done, such as at the scrape timeout. It returns an error if the collection was not (fully) successful.
+type ContextCollector interface {
+	CollectContext(context.Context, chan<- prometheus.Metric) error
+}
+
+// Backoffer is implemented by collectors that skip their backend after consecutive failures, and returns the remaining cool-down.
+type Backoffer interface {
+	Backoff() time.Duration
+}
+
+// Checker is implemented by collectors that can verify the connectivity to their backend.
+type Checker interface {
+	Check(context.Context) error
+}
+
+// SanityRule is an invariant on the samples of a metric. Samples that violate it are dropped from the scrape.
+type SanityRule struct {
+	Metric string
+
+	// the sample with label Label set to Lesser may not exceed the sample with Greater, when their other labels are equal
+	Label   string
+	Lesser  string
+	Greater string
+
+	// MaxRate is the maximum increase per second of a counter, zero disables
+	MaxRate float64
+}
+
+// SanityRuler is implemented by collectors that have invariants on their metrics.
+type SanityRuler interface {
+	SanityRules() []SanityRule
+}
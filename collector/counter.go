@@ -0,0 +1,55 @@
+package collector
+
+import (
+	"strings"
+)
+
+// Counter is the type of a counter value, such as a uint64 count or float64 seconds.
+type Counter interface {
+	~uint32 | ~uint64 | ~float64
+}
+
+// CounterDelta returns the increase of a counter, where a smaller value means the counter was reset and counted up from zero again. A uint64 counter practically never wraps around, so a wrap is treated as a reset too.
+func CounterDelta[T Counter](prev, cur T) T {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// CounterTracker keeps the last value of counters, identified by one or more keys, to return their increase between observations.
+type CounterTracker struct {
+	prev map[string]uint64
+}
+
+func NewCounterTracker() *CounterTracker {
+	return &CounterTracker{
+		prev: map[string]uint64{},
+	}
+}
+
+// Delta returns the increase of the counter since its previous observation. It returns false for the first observation, which only sets the baseline.
+func (t *CounterTracker) Delta(cur uint64, keys ...string) (uint64, bool) {
+	key := strings.Join(keys, "\x00")
+	prev, ok := t.prev[key]
+	t.prev[key] = cur
+	if !ok {
+		return 0, false
+	}
+	return CounterDelta(prev, cur), true
+}
+
+// Last returns the previous observation of the counter, or false if it wasn't observed yet.
+func (t *CounterTracker) Last(keys ...string) (uint64, bool) {
+	prev, ok := t.prev[strings.Join(keys, "\x00")]
+	return prev, ok
+}
+
+// Forget removes the baselines of all counters whose first key equals key, so that a new instance under the same name doesn't produce a bogus increase.
+func (t *CounterTracker) Forget(key string) {
+	for k := range t.prev {
+		if k == key || strings.HasPrefix(k, key+"\x00") {
+			delete(t.prev, k)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package collector
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur uint64
+		delta     uint64
+	}{
+		{"unchanged", 5, 5, 0},
+		{"increase", 5, 8, 3},
+		{"from zero", 0, 8, 8},
+		{"reset", 100, 7, 7},
+		{"reset to zero", 100, 0, 0},
+		{"wrap", math.MaxUint64 - 2, 3, 3},
+		{"near max", math.MaxUint64 - 10, math.MaxUint64, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if delta := CounterDelta(tt.prev, tt.cur); delta != tt.delta {
+				t.Errorf("CounterDelta(%d, %d): got %d, expected %d", tt.prev, tt.cur, delta, tt.delta)
+			}
+		})
+	}
+}
+
+func TestCounterDeltaFloat(t *testing.T) {
+	tests := []struct {
+		prev, cur float64
+		delta     float64
+	}{
+		{1.5, 4.0, 2.5},
+		{4.0, 4.0, 0.0},
+		{400.0, 12.5, 12.5}, // a CPU went offline
+	}
+	for _, tt := range tests {
+		if delta := CounterDelta(tt.prev, tt.cur); delta != tt.delta {
+			t.Errorf("CounterDelta(%v, %v): got %v, expected %v", tt.prev, tt.cur, delta, tt.delta)
+		}
+	}
+}
+
+func TestCounterTracker(t *testing.T) {
+	type observation struct {
+		keys  []string
+		cur   uint64
+		delta uint64
+		ok    bool
+	}
+	tests := []struct {
+		name   string
+		forget string // forgotten before the last observation
+		obs    []observation
+	}{
+		{"first sets baseline", "", []observation{
+			{[]string{"a"}, 10, 0, false},
+		}},
+		{"increase", "", []observation{
+			{[]string{"a"}, 10, 0, false},
+			{[]string{"a"}, 15, 5, true},
+			{[]string{"a"}, 15, 0, true},
+		}},
+		{"reset", "", []observation{
+			{[]string{"a"}, 10, 0, false},
+			{[]string{"a"}, 4, 4, true},
+			{[]string{"a"}, 6, 2, true},
+		}},
+		{"separate keys", "", []observation{
+			{[]string{"a", "hits"}, 10, 0, false},
+			{[]string{"a", "misses"}, 3, 0, false},
+			{[]string{"a", "hits"}, 12, 2, true},
+			{[]string{"a", "misses"}, 4, 1, true},
+		}},
+		{"joined keys are distinct", "", []observation{
+			{[]string{"a", "bc"}, 10, 0, false},
+			{[]string{"ab", "c"}, 20, 0, false},
+			{[]string{"a", "bc"}, 11, 1, true},
+		}},
+		{"forget", "a", []observation{
+			{[]string{"a", "hits"}, 10, 0, false},
+			{[]string{"a", "hits"}, 100, 0, false},
+		}},
+		{"forget other", "ab", []observation{
+			{[]string{"a", "hits"}, 10, 0, false},
+			{[]string{"a", "hits"}, 12, 2, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters := NewCounterTracker()
+			for i, o := range tt.obs {
+				if i == len(tt.obs)-1 && tt.forget != "" {
+					counters.Forget(tt.forget)
+				}
+				delta, ok := counters.Delta(o.cur, o.keys...)
+				if delta != o.delta || ok != o.ok {
+					t.Errorf("observation %d of %v: got %d %v, expected %d %v", i, o.keys, delta, ok, o.delta, o.ok)
+				}
+				if last, ok := counters.Last(o.keys...); !ok || last != o.cur {
+					t.Errorf("observation %d of %v: last is %d %v, expected %d", i, o.keys, last, ok, o.cur)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types, see the FastCGI specification.
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1 // role of the begin request record
+	fcgiKeepConn  = 1 // flag of the begin request record
+	fcgiRequestID = 1 // requests are not multiplexed
+)
+
+// Connection outcomes of a FastCGI request as returned by FastCGIClient.GetConn.
+const (
+	ConnReused = "reused"
+	ConnNew    = "new"
+	ConnFailed = "failed"
+)
+
+// FastCGIClient fetches a page from a FastCGI responder, for status pages that are not served over HTTP. By default every request dials a new connection, see SetIdleTimeout to keep it open.
+type FastCGIClient struct {
+	network string
+	addr    string
+	path    string
+	query   string
+
+	mu          sync.Mutex
+	idleTimeout time.Duration
+	conn        net.Conn // kept open between requests, nil if closed
+	lastUsed    time.Time
+}
+
+// NewFastCGIClient returns a client for the page at path of the FastCGI responder at uri. The path may include a query such as /status?full.
+func NewFastCGIClient(uri, path string) (*FastCGIClient, error) {
+	network, addr, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	} else if strings.Contains(addr, "://") {
+		return nil, fmt.Errorf("unsupported protocol: %v", uri)
+	}
+	path, query, _ := strings.Cut(path, "?")
+	return &FastCGIClient{
+		network: network,
+		addr:    addr,
+		path:    path,
+		query:   query,
+	}, nil
+}
+
+// SetIdleTimeout keeps the connection open after a request with the FCGI_KEEP_CONN flag, and reuses it for the next request if that follows within timeout. Note that PHP-FPM occupies a process of the pool for as long as the connection is open. Zero dials a new connection for every request.
+func (c *FastCGIClient) SetIdleTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	c.idleTimeout = timeout
+	c.mu.Unlock()
+}
+
+// Close closes the connection that is kept open, if any.
+func (c *FastCGIClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeConn()
+}
+
+func (c *FastCGIClient) closeConn() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *FastCGIClient) Get(ctx context.Context) ([]byte, error) {
+	body, _, err := c.GetConn(ctx)
+	return body, err
+}
+
+// GetConn fetches the page and returns whether the kept connection was reused, a new connection was dialed, or the connection failed. A kept connection that turns out to be closed by the responder is replaced by a new connection transparently. A StatusError is returned for status codes other than 200.
+func (c *FastCGIClient) GetConn(ctx context.Context) ([]byte, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keep := 0 < c.idleTimeout
+	if c.conn != nil && (!keep || c.idleTimeout < time.Since(c.lastUsed)) {
+		c.closeConn()
+	}
+	if c.conn != nil {
+		stdout, err := c.roundTrip(ctx, c.conn, keep)
+		if err == nil {
+			c.lastUsed = time.Now()
+			body, err := parseCGIResponse(stdout)
+			return body, ConnReused, err
+		}
+		c.closeConn()
+		if ctx.Err() != nil {
+			return nil, ConnFailed, ctx.Err()
+		}
+		// the responder may have closed the connection, retry on a new one
+	}
+
+	d := net.Dialer{
+		Timeout: 1 * time.Second, // timeout in establishing connection only
+	}
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return nil, ConnFailed, err
+	}
+	stdout, err := c.roundTrip(ctx, conn, keep)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ConnFailed, ctx.Err()
+		}
+		return nil, ConnFailed, err
+	} else if keep {
+		c.conn = conn
+		c.lastUsed = time.Now()
+	} else {
+		conn.Close()
+	}
+	body, err := parseCGIResponse(stdout)
+	return body, ConnNew, err
+}
+
+// roundTrip sends a GET request over the connection and returns the standard output of the responder up to the end of the request.
+func (c *FastCGIClient) roundTrip(ctx context.Context, conn net.Conn, keep bool) ([]byte, error) {
+	// the deadline is reset as the connection may be reused, moving it to the past aborts blocked reads and writes
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	flags := byte(0)
+	if keep {
+		flags = fcgiKeepConn
+	}
+	requestURI := c.path
+	if c.query != "" {
+		requestURI += "?" + c.query
+	}
+	params := []string{
+		"GATEWAY_INTERFACE", "CGI/1.1",
+		"REQUEST_METHOD", "GET",
+		"SCRIPT_FILENAME", c.path,
+		"SCRIPT_NAME", c.path,
+		"DOCUMENT_URI", c.path,
+		"REQUEST_URI", requestURI,
+		"QUERY_STRING", c.query,
+		"SERVER_PROTOCOL", "HTTP/1.1",
+		"CONTENT_LENGTH", "0",
+	}
+	var content []byte
+	for i := 0; i+1 < len(params); i += 2 {
+		content = appendFCGILength(content, len(params[i]))
+		content = appendFCGILength(content, len(params[i+1]))
+		content = append(content, params[i]...)
+		content = append(content, params[i+1]...)
+	}
+
+	var req []byte
+	req = appendFCGIRecord(req, fcgiBeginRequest, []byte{0, fcgiResponder, flags, 0, 0, 0, 0, 0})
+	for 0 < len(content) {
+		n := min(len(content), 0xffff)
+		req = appendFCGIRecord(req, fcgiParams, content[:n])
+		content = content[n:]
+	}
+	req = appendFCGIRecord(req, fcgiParams, nil)
+	req = appendFCGIRecord(req, fcgiStdin, nil)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// records are read unbuffered so that nothing of the next request is consumed
+	var stdout, stderr []byte
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		} else if header[0] != 1 {
+			return nil, fmt.Errorf("unsupported FastCGI version %d", header[0])
+		}
+		n := int(binary.BigEndian.Uint16(header[4:6]))
+		record := make([]byte, n+int(header[6]))
+		if _, err := io.ReadFull(conn, record); err != nil {
+			return nil, err
+		} else if binary.BigEndian.Uint16(header[2:4]) != fcgiRequestID {
+			continue
+		}
+		switch header[1] {
+		case fcgiStdout:
+			stdout = append(stdout, record[:n]...)
+		case fcgiStderr:
+			stderr = append(stderr, record[:n]...)
+		case fcgiEndRequest:
+			if n < 5 {
+				return nil, fmt.Errorf("bad FastCGI end request record")
+			} else if status := record[4]; status != 0 {
+				return nil, fmt.Errorf("FastCGI request rejected with protocol status %d", status)
+			} else if len(stdout) == 0 && 0 < len(stderr) {
+				return nil, fmt.Errorf("FastCGI error: %s", bytes.TrimSpace(stderr))
+			}
+			return stdout, nil
+		}
+	}
+}
+
+func appendFCGIRecord(b []byte, typ byte, content []byte) []byte {
+	b = append(b, 1, typ)
+	b = binary.BigEndian.AppendUint16(b, fcgiRequestID)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(content)))
+	b = append(b, 0, 0) // padding length and reserved
+	return append(b, content...)
+}
+
+// appendFCGILength appends the length of a name or value of a name-value pair, which takes four bytes with the high bit set if it doesn't fit in seven bits.
+func appendFCGILength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+// parseCGIResponse returns the body of a CGI response after its headers. A StatusError is returned if the Status header has a code other than 200.
+func parseCGIResponse(b []byte) ([]byte, error) {
+	header, body, ok := bytes.Cut(b, []byte("\r\n\r\n"))
+	if !ok {
+		if header, body, ok = bytes.Cut(b, []byte("\n\n")); !ok {
+			return nil, fmt.Errorf("bad CGI response: missing headers")
+		}
+	}
+	for _, line := range strings.Split(string(header), "\n") {
+		key, val, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(key), "Status") {
+			code, _, _ := strings.Cut(strings.TrimSpace(val), " ")
+			if status, err := strconv.Atoi(code); err == nil && status != 200 {
+				return nil, StatusError{status}
+			}
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,109 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveFastCGI serves a FastCGI responder on the listener that replies with the request URI, or with 404 for /missing.
+func serveFastCGI(t *testing.T, ln net.Listener) {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, r.URL.RequestURI())
+	}))
+}
+
+func TestFastCGIClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveFastCGI(t, ln)
+
+	dir, err := os.MkdirTemp("", "dex") // short path, since socket paths are limited to 107 bytes
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "fcgi.sock")
+	unixLn, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveFastCGI(t, unixLn)
+
+	for _, uri := range []string{ln.Addr().String(), "tcp://" + ln.Addr().String(), "unix://" + socket} {
+		t.Run(uri, func(t *testing.T) {
+			for _, path := range []string{"/stub_status", "/status?full&json"} {
+				c, err := NewFastCGIClient(uri, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, conn, err := c.GetConn(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				} else if string(body) != path || conn != ConnNew {
+					t.Errorf("got %v over a %v connection, expected %v over a new one", string(body), conn, path)
+				}
+			}
+
+			c, err := NewFastCGIClient(uri, "/missing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statusErr StatusError
+			if _, err := c.Get(context.Background()); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+				t.Errorf("missing page: got error %v, expected status 404", err)
+			}
+		})
+	}
+
+	c, err := NewFastCGIClient("http://"+ln.Addr().String(), "/stub_status")
+	if err == nil {
+		c.Close()
+		t.Errorf("http:// URI: expected error")
+	}
+}
+
+func TestFastCGIClientKeepConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveFastCGI(t, ln)
+
+	c, err := NewFastCGIClient(ln.Addr().String(), "/stub_status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetIdleTimeout(time.Minute)
+	for i, expected := range []string{ConnNew, ConnReused, ConnReused} {
+		if body, conn, err := c.GetConn(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if string(body) != "/stub_status" || conn != expected {
+			t.Errorf("request %d: got %v over a %v connection, expected a %v one", i, string(body), conn, expected)
+		}
+	}
+
+	// a kept connection that fails is replaced
+	c.conn.Close()
+	if _, conn, err := c.GetConn(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if conn != ConnNew {
+		t.Errorf("after the responder closed: got a %v connection, expected a new one", conn)
+	}
+}
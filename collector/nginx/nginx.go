@@ -0,0 +1,450 @@
+// Package nginx collects the connection and request metrics of NGINX servers from their stub_status page or the NGINX Plus API, and the reload times of the master process.
+package nginx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type Options struct {
+	URI     []string `desc:"A URI or unix socket path for scraping NGINX metrics, can be repeated and can contain globs for unix sockets. The stub_status page must be available through the URI, for unix sockets its request path follows the socket path after a colon (e.g. unix:///run/nginx.sock:/stub_status, defaults to /). Append =name to set the server label."`
+	Service []string `desc:"Systemd service name for a server as name=service (e.g. edge=nginx-edge), by default servers are gated on the nginx service."`
+
+	FastCGIURI  []string `name:"fastcgi-uri" desc:"A URI or unix socket path of a FastCGI pass-through to the stub_status page, for servers that don't expose it over HTTP. Can be repeated like --nginx.uri."`
+	FastCGIPath string   `name:"fastcgi-path" desc:"Path of the stub_status page requested over FastCGI."`
+
+	PlusAPIURI []string `name:"plus-api-uri" desc:"A URI or unix socket path of the NGINX Plus API (e.g. http://localhost:8080/api) to scrape connections, server zones, and upstream peers instead of the stub_status page. Can be repeated like --nginx.uri, but a service can't have both."`
+
+	ConfigPath string `name:"config-path" desc:"Path of the NGINX configuration file, whose modification time is compared to the last reload."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+// ServiceOptions groups the URIs by the systemd service they depend on.
+func (opts Options) ServiceOptions() map[string]Options {
+	services := map[string]string{}
+	for _, service := range opts.Service {
+		if name, unit := collector.SplitAlias(service); unit != "" {
+			services[name] = unit
+		}
+	}
+	serviceOpts := map[string]Options{}
+	get := func(uri string) (string, Options) {
+		service := "nginx"
+		if _, name := collector.SplitAlias(uri); name != "" && services[name] != "" {
+			service = services[name]
+		}
+		o, ok := serviceOpts[service]
+		if !ok {
+			o = opts
+			o.URI = nil
+			o.FastCGIURI = nil
+			o.PlusAPIURI = nil
+		}
+		return service, o
+	}
+
+	for _, uri := range opts.URI {
+		service, o := get(uri)
+		o.URI = append(o.URI, uri)
+		serviceOpts[service] = o
+	}
+	for _, uri := range opts.FastCGIURI {
+		service, o := get(uri)
+		o.FastCGIURI = append(o.FastCGIURI, uri)
+		serviceOpts[service] = o
+	}
+	for _, uri := range opts.PlusAPIURI {
+		service, o := get(uri)
+		o.PlusAPIURI = append(o.PlusAPIURI, uri)
+		serviceOpts[service] = o
+	}
+	return serviceOpts
+}
+
+type Collector struct {
+	service     string
+	log         collector.Log
+	configPath  string
+	uris        collector.URIGlobs
+	fastcgiURIs collector.URIGlobs
+	fastcgiPath string
+	plusURIs    collector.URIGlobs
+	fetchers    map[string]collector.Fetcher
+	plusAPIs    map[string]*plusAPI
+	counters    *collector.CounterTracker
+	breakers    *collector.Breakers
+
+	up          *prometheus.GaugeVec
+	req         *prometheus.CounterVec
+	accepted    *prometheus.CounterVec
+	dropped     *prometheus.CounterVec
+	conn        *prometheus.GaugeVec
+	masterStart *prometheus.GaugeVec
+	lastReload  *prometheus.GaugeVec
+	configMtime *prometheus.GaugeVec
+
+	// NGINX Plus API only
+	zoneReq   *prometheus.CounterVec
+	zoneResp  *prometheus.CounterVec
+	peerState *prometheus.GaugeVec
+	peerConn  *prometheus.GaugeVec
+	peerResp  *prometheus.CounterVec
+}
+
+// New returns the collector for the NGINX servers of a systemd service, which are scraped either through their stub_status page or through the NGINX Plus API.
+func New(service string, opts Options, log collector.Log) (*Collector, error) {
+	log = log.WithDefaults()
+	if 0 < len(opts.PlusAPIURI) && (0 < len(opts.URI) || 0 < len(opts.FastCGIURI)) {
+		return nil, fmt.Errorf("nginx: --nginx.plus-api-uri can't be combined with --nginx.uri or --nginx.fastcgi-uri for the same service %v", service)
+	}
+	uris, err := collector.ParseURIGlobs(opts.URI, log)
+	if err != nil {
+		return nil, err
+	}
+	fastcgiURIs, err := collector.ParseURIGlobs(opts.FastCGIURI, log)
+	if err != nil {
+		return nil, err
+	}
+	plusURIs, err := collector.ParseURIGlobs(opts.PlusAPIURI, log)
+	if err != nil {
+		return nil, err
+	}
+	e := &Collector{
+		service:     service,
+		log:         log,
+		configPath:  opts.ConfigPath,
+		uris:        uris,
+		fastcgiURIs: fastcgiURIs,
+		fastcgiPath: opts.FastCGIPath,
+		plusURIs:    plusURIs,
+		fetchers:    map[string]collector.Fetcher{},
+		plusAPIs:    map[string]*plusAPI{},
+		counters:    collector.NewCounterTracker(),
+		breakers:    collector.NewBreakers("nginx", log),
+
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nginx_up",
+			Help: "Stub_status page or NGINX Plus API of the server could be fetched.",
+		}, []string{"server"}),
+		req: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nginx_requests_total",
+			Help: "Total number of requests.",
+		}, []string{"server"}),
+		accepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nginx_accepted_connections_total",
+			Help: "Total number of accepted client connections.",
+		}, []string{"server"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nginx_dropped_connections_total",
+			Help: "Total number of accepted client connections that were not handled, such as when the worker_connections limit was reached.",
+		}, []string{"server"}),
+		conn: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nginx_connections",
+			Help: "Number of client connections.",
+		}, []string{"server", "state"}),
+		masterStart: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nginx_master_start_time_seconds",
+			Help: "Start time of the master process since unix epoch in seconds.",
+		}, []string{"service"}),
+		lastReload: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nginx_last_reload_time_seconds",
+			Help: "Start time of the oldest worker process since unix epoch in seconds, which is the time of the last reload.",
+		}, []string{"service"}),
+		configMtime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nginx_config_mtime_seconds",
+			Help: "Modification time of the configuration file since unix epoch in seconds.",
+		}, []string{"service"}),
+
+		zoneReq: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nginx_plus_server_zone_requests_total",
+			Help: "Total number of client requests of the server zone.",
+		}, []string{"server", "zone"}),
+		zoneResp: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nginx_plus_server_zone_responses_total",
+			Help: "Total number of responses to clients of the server zone by status class.",
+		}, []string{"server", "zone", "code"}),
+		peerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nginx_plus_upstream_peer_state",
+			Help: "State of the upstream peer, one for the current state and zero for the others.",
+		}, []string{"server", "upstream", "peer", "state"}),
+		peerConn: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nginx_plus_upstream_peer_active_connections",
+			Help: "Number of active connections to the upstream peer.",
+		}, []string{"server", "upstream", "peer"}),
+		peerResp: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nginx_plus_upstream_peer_responses_total",
+			Help: "Total number of responses of the upstream peer by status class.",
+		}, []string{"server", "upstream", "peer", "code"}),
+	}
+	for _, server := range e.servers() {
+		if server.plus {
+			api, err := newPlusAPI(server.uri)
+			if err != nil {
+				return nil, err
+			}
+			e.plusAPIs[server.uri] = api
+		} else if _, err := e.fetcher(server); err != nil {
+			return nil, err
+		}
+	}
+	e.updateStats(context.Background())
+	return e, nil
+}
+
+func (e *Collector) Close() error {
+	return nil
+}
+
+// Check fetches the stub_status page or the NGINX Plus API connections of all servers.
+func (e *Collector) Check(ctx context.Context) error {
+	for _, server := range e.servers() {
+		if server.plus {
+			api, ok := e.plusAPIs[server.uri]
+			if !ok {
+				continue // not yet updated
+			}
+			if err := api.Get(ctx, "/connections", &plusConnections{}); err != nil {
+				return fmt.Errorf("%v: %w", server.name, err)
+			}
+		} else if _, err := e.getStats(ctx, server); err != nil {
+			return fmt.Errorf("%v: %w", server.name, err)
+		}
+	}
+	return nil
+}
+
+// Backoff returns the longest remaining cool-down of the servers after consecutive failures.
+func (e *Collector) Backoff() time.Duration {
+	return e.breakers.Backoff()
+}
+
+func (e *Collector) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+	e.req.Describe(ch)
+	e.accepted.Describe(ch)
+	e.dropped.Describe(ch)
+	e.conn.Describe(ch)
+	e.masterStart.Describe(ch)
+	e.lastReload.Describe(ch)
+	e.configMtime.Describe(ch)
+	e.zoneReq.Describe(ch)
+	e.zoneResp.Describe(ch)
+	e.peerState.Describe(ch)
+	e.peerConn.Describe(ch)
+	e.peerResp.Describe(ch)
+}
+
+func (e *Collector) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Collector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	e.up.Reset()
+	e.conn.Reset()
+	e.peerState.Reset()
+	e.peerConn.Reset()
+	stats, err := e.updateStats(ctx)
+	if errors.Is(err, collector.ErrBackoff) {
+		e.log.Debug.Println(err)
+	} else if err != nil {
+		e.log.Error.Println(err)
+	}
+	for server, stat := range stats {
+		e.req.WithLabelValues(server).Add(math.Max(0.0, float64(stat.Requests)))
+		e.accepted.WithLabelValues(server).Add(float64(stat.Accepted))
+		e.dropped.WithLabelValues(server).Add(float64(stat.Accepted - stat.Handled))
+		e.conn.WithLabelValues(server, "active").Set(float64(stat.Active))
+		e.conn.WithLabelValues(server, "reading").Set(float64(stat.Reading))
+		e.conn.WithLabelValues(server, "writing").Set(float64(stat.Writing))
+		e.conn.WithLabelValues(server, "waiting").Set(float64(stat.Waiting))
+	}
+	e.up.Collect(ch)
+	e.req.Collect(ch)
+	e.accepted.Collect(ch)
+	e.dropped.Collect(ch)
+	e.conn.Collect(ch)
+	e.zoneReq.Collect(ch)
+	e.zoneResp.Collect(ch)
+	e.peerState.Collect(ch)
+	e.peerConn.Collect(ch)
+	e.peerResp.Collect(ch)
+
+	e.masterStart.Reset()
+	e.lastReload.Reset()
+	if master, reload, err := nginxStartTimes(e.service); err != nil {
+		e.log.Debug.Println("nginx:", err)
+	} else {
+		e.masterStart.WithLabelValues(e.service).Set(float64(master.UnixNano()) / 1e9)
+		if !reload.IsZero() {
+			e.lastReload.WithLabelValues(e.service).Set(float64(reload.UnixNano()) / 1e9)
+		}
+	}
+	e.configMtime.Reset()
+	if e.configPath != "" {
+		if info, err := os.Stat(e.configPath); err != nil {
+			e.log.Debug.Println("nginx:", err)
+		} else {
+			e.configMtime.WithLabelValues(e.service).Set(float64(info.ModTime().UnixNano()) / 1e9)
+		}
+	}
+	e.masterStart.Collect(ch)
+	e.lastReload.Collect(ch)
+	e.configMtime.Collect(ch)
+	e.log.Debug.Println("collect duration for nginx:", time.Since(t))
+	return err
+}
+
+const templateMetrics string = `Active connections: %d
+server accepts handled requests
+%d %d %d
+Reading: %d Writing: %d Waiting: %d
+`
+
+type nginxStats struct {
+	Active   uint64
+	Accepted uint64
+	Handled  uint64
+	Requests uint64
+	Reading  uint64
+	Writing  uint64
+	Waiting  uint64
+}
+
+type nginxServer struct {
+	uri     string
+	name    string
+	fastcgi bool
+	plus    bool
+}
+
+// servers returns the servers whose stub_status page is fetched over HTTP and over FastCGI, and those with an NGINX Plus API.
+func (e *Collector) servers() []nginxServer {
+	servers := []nginxServer{}
+	for _, uri := range e.uris.Get() {
+		servers = append(servers, nginxServer{uri, e.uris.Name(uri), false, false})
+	}
+	for _, uri := range e.fastcgiURIs.Get() {
+		servers = append(servers, nginxServer{uri, e.fastcgiURIs.Name(uri), true, false})
+	}
+	for _, uri := range e.plusURIs.Get() {
+		servers = append(servers, nginxServer{uri, e.plusURIs.Name(uri), false, true})
+	}
+	return servers
+}
+
+func (e *Collector) fetcher(server nginxServer) (collector.Fetcher, error) {
+	key := server.uri
+	if server.fastcgi {
+		key = "fastcgi " + key
+	}
+	if fetcher, ok := e.fetchers[key]; ok {
+		return fetcher, nil
+	}
+
+	var fetcher collector.Fetcher
+	var err error
+	if server.fastcgi {
+		fetcher, err = collector.NewFastCGIClient(server.uri, e.fastcgiPath)
+	} else {
+		fetcher, err = collector.NewClient(server.uri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.fetchers[key] = fetcher
+	return fetcher, nil
+}
+
+// updateStats returns the stats per stub_status server since the last update, updates the metrics of NGINX Plus API servers, and sets whether the servers are up. The first error is returned after all servers have been tried. Servers that failed consecutively are backed off.
+func (e *Collector) updateStats(ctx context.Context) (map[string]nginxStats, error) {
+	var firstErr error
+	diffs := map[string]nginxStats{}
+	for _, server := range e.servers() {
+		breaker := e.breakers.Get(server.name)
+		err := breaker.Allow()
+		var cur nginxStats
+		if err == nil && server.plus {
+			err = e.updatePlus(ctx, server)
+			breaker.Done(err)
+		} else if err == nil {
+			cur, err = e.getStats(ctx, server)
+			breaker.Done(err)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("nginx %v: %w", server.name, err)
+			}
+			e.up.WithLabelValues(server.name).Set(0.0)
+			continue
+		}
+		e.up.WithLabelValues(server.name).Set(1.0)
+		if server.plus {
+			continue
+		}
+
+		if diff, ok := e.delta(server.uri, cur); ok {
+			diffs[server.name] = diff
+		}
+	}
+	return diffs, firstErr
+}
+
+// delta returns the increase of the counters of a server since the last update, or false for the first update which only sets the baseline. All counters count from zero again when NGINX restarts, so if any of them decreased the current values are the increase, even of counters that have since exceeded their previous value.
+func (e *Collector) delta(uri string, cur nginxStats) (nginxStats, bool) {
+	restarted := false
+	counters := map[string]uint64{"accepted": cur.Accepted, "handled": cur.Handled, "requests": cur.Requests}
+	for name, value := range counters {
+		if prev, ok := e.counters.Last(uri, name); ok && value < prev {
+			restarted = true
+		}
+	}
+
+	diff := cur
+	diff.Accepted, _ = e.counters.Delta(cur.Accepted, uri, "accepted")
+	diff.Handled, _ = e.counters.Delta(cur.Handled, uri, "handled")
+	requests, ok := e.counters.Delta(cur.Requests, uri, "requests")
+	diff.Requests = requests
+	if restarted {
+		e.log.Debug.Printf("nginx %v: counters were reset", uri)
+		diff.Accepted, diff.Handled, diff.Requests = cur.Accepted, cur.Handled, cur.Requests
+	}
+	if diff.Accepted < diff.Handled {
+		diff.Handled = diff.Accepted // not read atomically by stub_status
+	}
+	return diff, ok
+}
+
+func (e *Collector) getStats(ctx context.Context, server nginxServer) (nginxStats, error) {
+	fetcher, err := e.fetcher(server)
+	if err != nil {
+		return nginxStats{}, err
+	}
+	b, err := fetcher.Get(ctx)
+	if err != nil {
+		return nginxStats{}, err
+	}
+
+	cur := nginxStats{}
+	if _, err := fmt.Fscanf(bytes.NewReader(b), templateMetrics,
+		&cur.Active,
+		&cur.Accepted,
+		&cur.Handled,
+		&cur.Requests,
+		&cur.Reading,
+		&cur.Writing,
+		&cur.Waiting); err != nil {
+		e.log.Debug.Printf("data from stub_status:\n%v", string(b))
+		return nginxStats{}, fmt.Errorf("failed to scan template metrics: %w", err)
+	}
+	return cur, nil
+}
@@ -0,0 +1,87 @@
+package nginx
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// nginxStartTimes returns the start times of the NGINX master process of the systemd service and of its oldest worker, which are replaced on every reload. A master process outside of any systemd service is used if it is the only one, such as in containers. The reload time is zero if there are no workers.
+func nginxStartTimes(service string) (time.Time, time.Time, error) {
+	procs, err := procfs.AllProcs()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	unit := service + ".service"
+	var master, other *procfs.Proc
+	numOther := 0
+	workers := map[int][]procfs.Proc{}
+	for _, proc := range procs {
+		if comm, err := proc.Comm(); err != nil || comm != "nginx" {
+			continue
+		}
+		cmdline, err := proc.CmdLine()
+		if err != nil {
+			continue
+		}
+		title := strings.Join(cmdline, " ")
+		if strings.HasPrefix(title, "nginx: master process") {
+			inService, inUnit := false, false
+			if cgroups, err := proc.Cgroups(); err == nil {
+				for _, cgroup := range cgroups {
+					if path.Base(cgroup.Path) == unit {
+						inUnit = true
+					} else if strings.HasSuffix(cgroup.Path, ".service") {
+						inService = true
+					}
+				}
+			}
+			if inUnit {
+				proc := proc
+				master = &proc
+			} else if !inService {
+				proc := proc
+				other = &proc
+				numOther++
+			}
+		} else if title == "nginx: worker process" {
+			// workers that are shutting down after a reload change their title
+			if stat, err := proc.Stat(); err == nil {
+				workers[stat.PPID] = append(workers[stat.PPID], proc)
+			}
+		}
+	}
+	if master == nil && numOther == 1 {
+		master = other
+	} else if master == nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("master process of %v not found", unit)
+	}
+
+	masterStart, err := procStartTime(*master)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	var reload time.Time
+	for _, worker := range workers[master.PID] {
+		if start, err := procStartTime(worker); err == nil && (reload.IsZero() || start.Before(reload)) {
+			reload = start
+		}
+	}
+	return masterStart, reload, nil
+}
+
+func procStartTime(proc procfs.Proc) (time.Time, error) {
+	stat, err := proc.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	start, err := stat.StartTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(start*float64(time.Second))), nil
+}
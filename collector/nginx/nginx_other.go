@@ -0,0 +1,14 @@
+//go:build !linux
+
+package nginx
+
+import (
+	"time"
+
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// nginxStartTimes reads the processes from procfs, which is only available on Linux.
+func nginxStartTimes(service string) (time.Time, time.Time, error) {
+	return time.Time{}, time.Time{}, collector.ErrNotSupported
+}
@@ -0,0 +1,104 @@
+package nginx
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// fakeStubStatus serves a stub_status page with the given counters.
+type fakeStubStatus struct {
+	mu                          sync.Mutex
+	accepted, handled, requests uint64
+}
+
+func (s *fakeStubStatus) Set(accepted, handled, requests uint64) {
+	s.mu.Lock()
+	s.accepted, s.handled, s.requests = accepted, handled, requests
+	s.mu.Unlock()
+}
+
+func (s *fakeStubStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, templateMetrics, 3, s.accepted, s.handled, s.requests, 0, 1, 2)
+}
+
+func TestRestartCounters(t *testing.T) {
+	status := &fakeStubStatus{}
+	status.Set(100, 100, 500)
+	srv := httptest.NewServer(status)
+	defer srv.Close()
+
+	e, err := New("nginx", Options{URI: []string{srv.URL + "/stub_status"}}, collector.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := e.uris.Name(srv.URL + "/stub_status")
+
+	tests := []struct {
+		name                        string
+		accepted, handled, requests uint64
+		total                       [3]float64 // exported accepted, dropped and requests
+	}{
+		{"first scrape", 100, 100, 500, [3]float64{0, 0, 0}},
+		{"increase", 110, 108, 520, [3]float64{10, 2, 20}},
+		{"restart", 5, 5, 3000, [3]float64{15, 2, 3020}}, // requests exceeded their previous value
+		{"after restart", 8, 7, 3010, [3]float64{18, 3, 3030}},
+		{"unchanged", 8, 7, 3010, [3]float64{18, 3, 3030}},
+		{"handled read after accepted", 9, 10, 3011, [3]float64{19, 3, 3031}},
+		{"restart again", 1, 1, 1, [3]float64{20, 3, 3032}},
+	}
+	for _, tt := range tests {
+		status.Set(tt.accepted, tt.handled, tt.requests)
+		ch := make(chan prometheus.Metric, 100)
+		if err := e.CollectContext(context.Background(), ch); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		total := [3]float64{
+			testutil.ToFloat64(e.accepted.WithLabelValues(server)),
+			testutil.ToFloat64(e.dropped.WithLabelValues(server)),
+			testutil.ToFloat64(e.req.WithLabelValues(server)),
+		}
+		if total != tt.total {
+			t.Errorf("%v: got accepted, dropped and requests %v, expected %v", tt.name, total, tt.total)
+		}
+	}
+}
+
+func newFakeNginx(t *testing.T, active int) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, templateMetrics, active, 10, 10, 20, 1, 2, 3)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestNginxVanishedServer(t *testing.T) {
+	a := newFakeNginx(t, 4)
+	b := newFakeNginx(t, 8)
+	e, err := New("nginx", Options{URI: []string{a.URL + "=a", b.URL + "=b"}}, collector.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.CollectAndCount(e, "nginx_connections"); n != 8 {
+		t.Fatalf("got %d connection series, expected 8", n)
+	}
+
+	b.Close()
+	if n := testutil.CollectAndCount(e, "nginx_connections"); n != 4 {
+		t.Errorf("got %d connection series after a server stopped, expected 4", n)
+	}
+	if v := testutil.ToFloat64(e.conn.WithLabelValues("a", "active")); v != 4.0 {
+		t.Errorf("active connections of the remaining server is %v, expected 4", v)
+	}
+}
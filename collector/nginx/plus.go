@@ -0,0 +1,210 @@
+package nginx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// plusMaxVersion is the highest version of the NGINX Plus API that is understood, the endpoints that are used are the same since version 1.
+const plusMaxVersion = 9
+
+// plusPeerStates are the states of an upstream peer as reported by the NGINX Plus API.
+var plusPeerStates = []string{"up", "draining", "down", "unavail", "checking", "unhealthy"}
+
+// plusStatusClasses are the response status classes as reported by the NGINX Plus API.
+var plusStatusClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+type plusResponses map[string]uint64 // by status class, ignores the codes and total fields
+
+func (r *plusResponses) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*r = plusResponses{}
+	for _, class := range plusStatusClasses {
+		if v, ok := raw[class]; ok {
+			var n uint64
+			if err := json.Unmarshal(v, &n); err != nil {
+				return fmt.Errorf("responses %v: %w", class, err)
+			}
+			(*r)[class] = n
+		}
+	}
+	return nil
+}
+
+type plusConnections struct {
+	Accepted uint64 `json:"accepted"`
+	Dropped  uint64 `json:"dropped"`
+	Active   uint64 `json:"active"`
+	Idle     uint64 `json:"idle"`
+}
+
+type plusServerZone struct {
+	Requests  uint64        `json:"requests"`
+	Responses plusResponses `json:"responses"`
+}
+
+type plusUpstream struct {
+	Peers []struct {
+		Server    string        `json:"server"`
+		State     string        `json:"state"`
+		Active    uint64        `json:"active"`
+		Responses plusResponses `json:"responses"`
+	} `json:"peers"`
+}
+
+// plusAPI fetches the endpoints of an NGINX Plus API, of which the version is discovered on first use.
+type plusAPI struct {
+	uri     string // of the API root, e.g. http://localhost:8080/api
+	version int    // zero if not yet discovered
+	clients map[string]*collector.Client
+}
+
+func newPlusAPI(uri string) (*plusAPI, error) {
+	uri = strings.TrimSuffix(uri, "/")
+	if strings.HasPrefix(uri, "unix:") {
+		if _, requestPath := collector.SplitSocketPath(uri[len("unix:"):]); requestPath == "" {
+			uri += ":/api"
+		}
+	}
+	api := &plusAPI{
+		uri:     uri,
+		clients: map[string]*collector.Client{},
+	}
+	if _, err := api.client(""); err != nil {
+		return nil, err
+	}
+	return api, nil
+}
+
+func (api *plusAPI) client(path string) (*collector.Client, error) {
+	if client, ok := api.clients[path]; ok {
+		return client, nil
+	}
+	client, err := collector.NewClient(api.uri + path)
+	if err != nil {
+		return nil, err
+	}
+	client.Header.Set("Accept", "application/json")
+	api.clients[path] = client
+	return client, nil
+}
+
+func (api *plusAPI) get(ctx context.Context, path string, v any) error {
+	client, err := api.client(path)
+	if err != nil {
+		return err
+	}
+	b, err := client.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	} else if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	return nil
+}
+
+// discover sets the highest API version that is supported by both NGINX and the collector, from the list of versions at the API root.
+func (api *plusAPI) discover(ctx context.Context) error {
+	versions := []int{}
+	if err := api.get(ctx, "/", &versions); err != nil {
+		return err
+	}
+	version := 0
+	for _, v := range versions {
+		if version < v && v <= plusMaxVersion {
+			version = v
+		}
+	}
+	if version == 0 {
+		return fmt.Errorf("no supported API version in %v, expected at most version %d", versions, plusMaxVersion)
+	}
+	api.version = version
+	return nil
+}
+
+// Get fetches an endpoint of the API, such as /connections. The version is discovered again after a 404 Not Found, such as after NGINX was upgraded.
+func (api *plusAPI) Get(ctx context.Context, endpoint string, v any) error {
+	if api.version == 0 {
+		if err := api.discover(ctx); err != nil {
+			return err
+		}
+	}
+	err := api.get(ctx, fmt.Sprintf("/%d%v", api.version, endpoint), v)
+	var statusErr collector.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		api.version = 0
+	}
+	return err
+}
+
+// updatePlus fetches the connection, server zone, and upstream stats of the NGINX Plus API of a server and updates the metrics. Counters are increased by their difference since the last update, the first update only sets the baselines.
+func (e *Collector) updatePlus(ctx context.Context, server nginxServer) error {
+	api, ok := e.plusAPIs[server.uri]
+	if !ok {
+		var err error
+		if api, err = newPlusAPI(server.uri); err != nil {
+			return err
+		}
+		e.plusAPIs[server.uri] = api
+	}
+
+	conns := plusConnections{}
+	if err := api.Get(ctx, "/connections", &conns); err != nil {
+		return err
+	}
+	zones := map[string]plusServerZone{}
+	if err := api.Get(ctx, "/http/server_zones", &zones); err != nil {
+		return err
+	}
+	upstreams := map[string]plusUpstream{}
+	if err := api.Get(ctx, "/http/upstreams", &upstreams); err != nil {
+		return err
+	}
+
+	if diff, ok := e.counters.Delta(conns.Accepted, server.uri, "accepted"); ok {
+		e.accepted.WithLabelValues(server.name).Add(float64(diff))
+	}
+	if diff, ok := e.counters.Delta(conns.Dropped, server.uri, "dropped"); ok {
+		e.dropped.WithLabelValues(server.name).Add(float64(diff))
+	}
+	e.conn.WithLabelValues(server.name, "active").Set(float64(conns.Active))
+	e.conn.WithLabelValues(server.name, "idle").Set(float64(conns.Idle))
+
+	for zone, stats := range zones {
+		if diff, ok := e.counters.Delta(stats.Requests, server.uri, "zone", zone, "requests"); ok {
+			e.zoneReq.WithLabelValues(server.name, zone).Add(float64(diff))
+		}
+		for class, n := range stats.Responses {
+			if diff, ok := e.counters.Delta(n, server.uri, "zone", zone, class); ok {
+				e.zoneResp.WithLabelValues(server.name, zone, class).Add(float64(diff))
+			}
+		}
+	}
+	for upstream, stats := range upstreams {
+		for _, peer := range stats.Peers {
+			for _, state := range plusPeerStates {
+				value := 0.0
+				if peer.State == state {
+					value = 1.0
+				}
+				e.peerState.WithLabelValues(server.name, upstream, peer.Server, state).Set(value)
+			}
+			e.peerConn.WithLabelValues(server.name, upstream, peer.Server).Set(float64(peer.Active))
+			for class, n := range peer.Responses {
+				if diff, ok := e.counters.Delta(n, server.uri, "peer", upstream, peer.Server, class); ok {
+					e.peerResp.WithLabelValues(server.name, upstream, peer.Server, class).Add(float64(diff))
+				}
+			}
+		}
+	}
+	return nil
+}
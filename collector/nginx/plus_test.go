@@ -0,0 +1,120 @@
+package nginx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// fakePlusAPI serves the endpoints of the NGINX Plus API for the given versions.
+type fakePlusAPI struct {
+	mu        sync.Mutex
+	versions  []int
+	requests  uint64
+	peerState string
+}
+
+func (s *fakePlusAPI) Set(versions []int, requests uint64, peerState string) {
+	s.mu.Lock()
+	s.versions, s.requests, s.peerState = versions, requests, peerState
+	s.mu.Unlock()
+}
+
+func (s *fakePlusAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path == "/api/" {
+		json.NewEncoder(w).Encode(s.versions)
+		return
+	}
+	endpoint := ""
+	for _, version := range s.versions {
+		if prefix := fmt.Sprintf("/api/%d/", version); strings.HasPrefix(r.URL.Path, prefix) {
+			endpoint = r.URL.Path[len(prefix)-1:]
+		}
+	}
+	switch endpoint {
+	case "/connections":
+		fmt.Fprintf(w, `{"accepted":%d,"dropped":0,"active":3,"idle":1}`, s.requests/2)
+	case "/http/server_zones":
+		fmt.Fprintf(w, `{"shop":{"requests":%d,"responses":{"1xx":0,"2xx":%d,"5xx":1,"codes":{"200":%d},"total":%d}}}`, s.requests, s.requests-1, s.requests-1, s.requests)
+	case "/http/upstreams":
+		fmt.Fprintf(w, `{"backend":{"peers":[{"server":"10.0.0.1:80","state":%q,"active":2,"responses":{"2xx":%d}}]}}`, s.peerState, s.requests)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPlusAPI(t *testing.T) {
+	api := &fakePlusAPI{}
+	api.Set([]int{7, 8, 9, 10}, 100, "up")
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	uri := srv.URL + "/api"
+	e, err := New("nginx", Options{PlusAPIURI: []string{uri}}, collector.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := e.plusURIs.Name(uri)
+
+	tests := []struct {
+		name     string
+		versions []int
+		requests uint64
+		state    string
+		err      bool
+		version  int
+		zoneReq  float64
+		peerResp float64
+	}{
+		{"first scrape", []int{7, 8, 9, 10}, 100, "up", false, 9, 0, 0},
+		{"increase", []int{7, 8, 9, 10}, 150, "unhealthy", false, 9, 50, 50},
+		{"downgraded", []int{7, 8}, 160, "up", true, 0, 50, 50},
+		{"rediscovered", []int{7, 8}, 170, "up", false, 8, 70, 70},
+	}
+	for _, tt := range tests {
+		api.Set(tt.versions, tt.requests, tt.state)
+		ch := make(chan prometheus.Metric, 100)
+		if err := e.CollectContext(context.Background(), ch); (err != nil) != tt.err {
+			t.Fatalf("%v: got error %v, expected error %v", tt.name, err, tt.err)
+		}
+		if version := e.plusAPIs[uri].version; version != tt.version {
+			t.Errorf("%v: got API version %d, expected %d", tt.name, version, tt.version)
+		}
+		if v := testutil.ToFloat64(e.zoneReq.WithLabelValues(server, "shop")); v != tt.zoneReq {
+			t.Errorf("%v: got %v zone requests, expected %v", tt.name, v, tt.zoneReq)
+		}
+		if v := testutil.ToFloat64(e.peerResp.WithLabelValues(server, "backend", "10.0.0.1:80", "2xx")); v != tt.peerResp {
+			t.Errorf("%v: got %v peer responses, expected %v", tt.name, v, tt.peerResp)
+		}
+		if !tt.err {
+			for _, state := range plusPeerStates {
+				expected := 0.0
+				if state == tt.state {
+					expected = 1.0
+				}
+				if v := testutil.ToFloat64(e.peerState.WithLabelValues(server, "backend", "10.0.0.1:80", state)); v != expected {
+					t.Errorf("%v: peer state %v is %v, expected %v", tt.name, state, v, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestPlusAPIExclusive(t *testing.T) {
+	opts := Options{URI: []string{"http://localhost/stub_status"}, PlusAPIURI: []string{"http://localhost:8080/api"}}
+	if _, err := New("nginx", opts, collector.Log{}); err == nil {
+		t.Errorf("expected error for both stub_status and NGINX Plus API URIs")
+	}
+}
@@ -0,0 +1,18 @@
+// Package node collects the statistics of the host from procfs and sysfs, such as CPU, memory, network, disks and filesystems, and the OOM kills from the kernel log. It is only supported on Linux, elsewhere the constructors return collector.ErrNotSupported.
+package node
+
+var defaultVMStatFields = []string{"pswpin", "pswpout", "pgmajfault", "oom_kill"}
+
+type Options struct {
+	VMStatFields      []string `name:"vmstat-fields" desc:"Additional fields of /proc/vmstat to export, on top of pswpin, pswpout, pgmajfault and oom_kill."`
+	TopProcesses      int      `desc:"Export memory and CPU usage of the top N process names by resident memory, other processes are summed under the name (other processes). Zero disables."`
+	FSReportAllMounts bool     `name:"fs-report-all-mounts" desc:"Report disk sizes for every mount point, instead of once per device using the shortest mount point (e.g. for bind mounts and btrfs subvolumes)."`
+	TimeStepThreshold float64  `name:"time-step-threshold" desc:"Seconds the realtime clock must jump between collections to count as a step change."`
+	LegacyDiskMetric  bool     `name:"legacy-disk-metric" desc:"Also export the disk sizes in kilobytes as node_disk_kilobytes, which is deprecated in favor of node_disk_bytes and will be removed in the next release."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+type OOMOptions struct {
+	Enable bool `desc:"Count the processes killed by the OOM killer by following the kernel log in /dev/kmsg. Falls back to the oom_kill counter of /proc/vmstat without process names when /dev/kmsg is not readable."`
+}
@@ -0,0 +1,1722 @@
+//go:build linux
+
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+	"github.com/prometheus/procfs/blockdevice"
+	"github.com/prometheus/procfs/btrfs"
+	"github.com/prometheus/procfs/xfs"
+	"github.com/tdewolff/dex_exporter/collector"
+	"golang.org/x/sys/unix"
+)
+
+// Collector reads the kernel statistics from procfs and sysfs.
+type Collector struct {
+	log          collector.Log
+	proc         procfs.FS
+	blockdevice  blockdevice.FS
+	xfs          xfs.FS
+	btrfs        btrfs.FS
+	cpuStat      procfs.CPUStat
+	netStats     procfs.NetDev
+	diskioStats  map[string]blockdevice.IOStats
+	xfsStats     map[string]xfsCounters
+	vmstatStats  *collector.CounterTracker
+	processStats map[int]float64
+	processNames map[string]bool // exported in node_process_cpu_seconds_total
+
+	vmstatFields map[string]bool
+	topProcesses int
+	allMounts    bool
+	statfs       *statfsGuard
+
+	// offsets between the realtime and monotonic clocks
+	clockStart    time.Duration
+	clockLast     time.Duration
+	stepThreshold time.Duration
+
+	// static host information read at startup
+	info []prometheus.Metric
+
+	cpu         *prometheus.CounterVec
+	mem         *prometheus.GaugeVec
+	swap        *prometheus.GaugeVec
+	net         *prometheus.CounterVec
+	netUp       *prometheus.GaugeVec
+	netSpeed    *prometheus.GaugeVec
+	netMTU      *prometheus.GaugeVec
+	bondSlaves  *prometheus.GaugeVec
+	bondActive  *prometheus.GaugeVec
+	bondSlaveUp *prometheus.GaugeVec
+	bridgePorts *prometheus.GaugeVec
+	netAddrs    *prometheus.GaugeVec
+	netDefault  *prometheus.GaugeVec
+	netRoutes   *prometheus.GaugeVec
+	disk        *prometheus.GaugeVec
+	diskLegacy  *prometheus.GaugeVec // nil unless enabled
+	diskTimeout *prometheus.GaugeVec
+	diskSkipped *prometheus.GaugeVec
+	fsInfo      *prometheus.GaugeVec
+	diskio      *prometheus.CounterVec
+	diskTemp    *prometheus.GaugeVec
+	xfsExtents  *prometheus.CounterVec
+	xfsForces   *prometheus.CounterVec
+	xfsCalls    *prometheus.CounterVec
+	btrfsAlloc  *prometheus.GaugeVec
+	rpcLatency  *prometheus.Desc
+	fuseWaiting *prometheus.GaugeVec
+	fuseCongest *prometheus.GaugeVec
+	vmstat      *prometheus.CounterVec
+	timeDrift   prometheus.Gauge
+	timeSteps   prometheus.Counter
+	clocksource *prometheus.GaugeVec
+
+	processMem *prometheus.GaugeVec
+	processCPU *prometheus.CounterVec
+}
+
+func New(opts Options, log collector.Log) (*Collector, error) {
+	proc, err := procfs.NewFS("/proc")
+	if err != nil {
+		return nil, err
+	}
+	blockdev, err := blockdevice.NewFS("/proc", "/sys")
+	if err != nil {
+		return nil, err
+	}
+	xfsFS, err := xfs.NewFS("/proc", "/sys")
+	if err != nil {
+		return nil, err
+	}
+	btrfsFS, err := btrfs.NewFS("/sys")
+	if err != nil {
+		return nil, err
+	}
+
+	vmstatFields := map[string]bool{}
+	for _, field := range append(defaultVMStatFields, opts.VMStatFields...) {
+		vmstatFields[field] = true
+	}
+
+	e := &Collector{
+		log:          log.WithDefaults(),
+		proc:         proc,
+		blockdevice:  blockdev,
+		xfs:          xfsFS,
+		btrfs:        btrfsFS,
+		diskioStats:  map[string]blockdevice.IOStats{},
+		xfsStats:     map[string]xfsCounters{},
+		vmstatStats:  collector.NewCounterTracker(),
+		processStats: map[int]float64{},
+		processNames: map[string]bool{},
+		vmstatFields: vmstatFields,
+		topProcesses: opts.TopProcesses,
+		allMounts:    opts.FSReportAllMounts,
+		statfs:       &statfsGuard{log: log.WithDefaults(), bad: map[string]time.Time{}},
+
+		stepThreshold: time.Duration(opts.TimeStepThreshold * float64(time.Second)),
+
+		cpu: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_cpu_seconds_total",
+			Help: "Total CPU time in seconds.",
+		}, []string{"mode"}),
+		mem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_mem_bytes",
+			Help: "Memory size in bytes.",
+		}, []string{"type"}),
+		swap: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_swap_bytes",
+			Help: "Swap size in bytes.",
+		}, []string{"type"}),
+		net: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_net_bytes_total",
+			Help: "Network traffic in bytes.",
+		}, []string{"interface", "type"}),
+		netUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_net_up",
+			Help: "Network interface operational state is up.",
+		}, []string{"interface"}),
+		netSpeed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_net_speed_bits",
+			Help: "Network interface link speed in bits per second.",
+		}, []string{"interface"}),
+		netMTU: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_net_mtu_bytes",
+			Help: "Network interface MTU in bytes.",
+		}, []string{"interface"}),
+		bondSlaves: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_bonding_slaves",
+			Help: "Number of slaves of the bonding interface.",
+		}, []string{"master"}),
+		bondActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_bonding_active_slaves",
+			Help: "Number of slaves of the bonding interface with MII status up.",
+		}, []string{"master"}),
+		bondSlaveUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_bonding_slave_up",
+			Help: "MII status of the bonding slave is up.",
+		}, []string{"master", "slave"}),
+		bridgePorts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_bridge_ports",
+			Help: "Number of ports of the bridge.",
+		}, []string{"bridge"}),
+		netAddrs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_network_address_assigned",
+			Help: "Number of addresses assigned to the network interface.",
+		}, []string{"interface", "family"}),
+		netDefault: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_network_default_route",
+			Help: "Main routing table has a default route.",
+		}, []string{"family"}),
+		netRoutes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_network_routes",
+			Help: "Number of routes in the routing table.",
+		}, []string{"table"}),
+		disk: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_disk_bytes",
+			Help: "Hard disk size in bytes.",
+		}, []string{"device", "mount", "type"}),
+		diskTimeout: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_disk_stat_timeout",
+			Help: "Reading the disk size of the mount point timed out in the last collection.",
+		}, []string{"mount"}),
+		diskSkipped: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_disk_stat_skipped",
+			Help: "Reading the disk size of the mount point was skipped in the last collection, during the cool-down after a timeout (cooldown) or since too many earlier reads are stuck (pending).",
+		}, []string{"mount", "reason"}),
+		fsInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_filesystem_info",
+			Help: "Filesystem type and mount options of the mount point, limited to " + strings.Join(mountOptions, ", ") + ", always one.",
+		}, []string{"device", "mount", "fstype", "options"}),
+		diskio: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_diskio_seconds_total",
+			Help: "Hard disk time in seconds.",
+		}, []string{"device", "type"}),
+		diskTemp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_disk_temperature_celsius",
+			Help: "Hard disk temperature in degrees Celsius, from the drivetemp hwmon driver.",
+		}, []string{"device"}),
+		xfsExtents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_xfs_extents_total",
+			Help: "Total number of extents allocated or freed by the XFS filesystem.",
+		}, []string{"device", "mount", "type"}),
+		xfsForces: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_xfs_log_forces_total",
+			Help: "Total number of log forces of the XFS filesystem.",
+		}, []string{"device", "mount"}),
+		xfsCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_xfs_calls_total",
+			Help: "Total number of read or write system calls on the XFS filesystem.",
+		}, []string{"device", "mount", "type"}),
+		btrfsAlloc: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_btrfs_allocation_bytes",
+			Help: "Used and total bytes of the data, metadata and system block groups of the btrfs filesystem.",
+		}, []string{"device", "mount", "block_group", "type"}),
+		rpcLatency: prometheus.NewDesc("node_mount_rpc_latency_seconds", "Cumulative time NFS RPC requests spent queued for transmission (queue) or waiting for the reply after transmission (rtt) in seconds, and the number of requests.", []string{"mount", "op", "type"}, nil),
+		fuseWaiting: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_fuse_requests_waiting",
+			Help: "Number of requests of the FUSE mount waiting for the userspace filesystem.",
+		}, []string{"mount"}),
+		fuseCongest: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_fuse_congestion_threshold",
+			Help: "Number of background requests of the FUSE mount above which it is marked congested.",
+		}, []string{"mount"}),
+		vmstat: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_vmstat_total",
+			Help: "Virtual memory statistics such as pages swapped in/out, major page faults and OOM kills.",
+		}, []string{"type"}),
+		timeDrift: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "node_time_drift_seconds",
+			Help: "Change of the realtime clock relative to the monotonic clock since the exporter started in seconds, caused by step changes.",
+		}),
+		timeSteps: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "node_time_step_changes_total",
+			Help: "Total number of step changes of the realtime clock between collections larger than the threshold.",
+		}),
+		clocksource: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_clocksource_info",
+			Help: "Current clocksource of the kernel.",
+		}, []string{"source"}),
+		processMem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_process_memory_bytes",
+			Help: "Resident memory size in bytes per process name.",
+		}, []string{"name"}),
+		processCPU: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_process_cpu_seconds_total",
+			Help: "Total CPU time in seconds per process name.",
+		}, []string{"name"}),
+	}
+	if opts.LegacyDiskMetric {
+		e.diskLegacy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_disk_kilobytes",
+			Help: "Deprecated: hard disk size in kilobytes, use node_disk_bytes.",
+		}, []string{"device", "mount", "type"})
+	}
+	e.info = e.readHostInfo()
+	if e.clockStart, err = clockOffset(); err != nil {
+		return nil, err
+	}
+	e.clockLast = e.clockStart
+	e.updateCPUStat()
+	e.updateNetStats()
+	e.updateDiskIOStats()
+	e.updateVMStats()
+	if 0 < e.topProcesses {
+		e.updateProcessStats()
+	}
+	return e, nil
+}
+
+func (e *Collector) Close() error {
+	return nil
+}
+
+// Check reads the kernel statistics from procfs.
+func (e *Collector) Check(ctx context.Context) error {
+	_, err := e.proc.Stat()
+	return err
+}
+
+// SanityRules allows a margin on the maximum rates, since the time between reading the counters varies.
+func (e *Collector) SanityRules() []collector.SanityRule {
+	return []collector.SanityRule{
+		{Metric: "node_mem_bytes", Label: "type", Lesser: "used", Greater: "total"},
+		{Metric: "node_mem_bytes", Label: "type", Lesser: "available", Greater: "total"},
+		{Metric: "node_mem_bytes", Label: "type", Lesser: "free", Greater: "total"},
+		{Metric: "node_swap_bytes", Label: "type", Lesser: "used", Greater: "total"},
+		{Metric: "node_disk_bytes", Label: "type", Lesser: "used", Greater: "total"},
+		{Metric: "node_disk_bytes", Label: "type", Lesser: "available", Greater: "total"},
+		{Metric: "node_disk_kilobytes", Label: "type", Lesser: "used", Greater: "total"},
+		{Metric: "node_disk_kilobytes", Label: "type", Lesser: "available", Greater: "total"},
+		{Metric: "node_btrfs_allocation_bytes", Label: "type", Lesser: "used", Greater: "total"},
+		{Metric: "node_cpu_seconds_total", MaxRate: 2.0 * float64(runtime.NumCPU())},
+		{Metric: "node_net_bytes_total", MaxRate: 2.0 * 12.5e9}, // 100 Gbit/s
+	}
+}
+
+func (e *Collector) Describe(ch chan<- *prometheus.Desc) {
+	e.cpu.Describe(ch)
+	e.mem.Describe(ch)
+	e.swap.Describe(ch)
+	e.net.Describe(ch)
+	e.netUp.Describe(ch)
+	e.netSpeed.Describe(ch)
+	e.netMTU.Describe(ch)
+	e.bondSlaves.Describe(ch)
+	e.bondActive.Describe(ch)
+	e.bondSlaveUp.Describe(ch)
+	e.bridgePorts.Describe(ch)
+	e.netAddrs.Describe(ch)
+	e.netDefault.Describe(ch)
+	e.netRoutes.Describe(ch)
+	e.disk.Describe(ch)
+	if e.diskLegacy != nil {
+		e.diskLegacy.Describe(ch)
+	}
+	e.diskTimeout.Describe(ch)
+	e.diskSkipped.Describe(ch)
+	e.fsInfo.Describe(ch)
+	e.diskio.Describe(ch)
+	e.diskTemp.Describe(ch)
+	e.xfsExtents.Describe(ch)
+	e.xfsForces.Describe(ch)
+	e.xfsCalls.Describe(ch)
+	e.btrfsAlloc.Describe(ch)
+	ch <- e.rpcLatency
+	e.fuseWaiting.Describe(ch)
+	e.fuseCongest.Describe(ch)
+	e.vmstat.Describe(ch)
+	e.timeDrift.Describe(ch)
+	e.timeSteps.Describe(ch)
+	e.clocksource.Describe(ch)
+	if 0 < e.topProcesses {
+		e.processMem.Describe(ch)
+		e.processCPU.Describe(ch)
+	}
+	for _, metric := range e.info {
+		ch <- metric.Desc()
+	}
+}
+
+func (e *Collector) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+// CollectContext returns the errors of the parts that could not be read, the other parts are still collected.
+func (e *Collector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	errs := []error{}
+	for _, metric := range e.info {
+		ch <- metric
+	}
+	cpuStat, err := e.updateCPUStat()
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		e.cpu.WithLabelValues("system").Add(math.Max(0.0, cpuStat.System))
+		e.cpu.WithLabelValues("user").Add(math.Max(0.0, cpuStat.User+cpuStat.Nice))
+		e.cpu.WithLabelValues("iowait").Add(math.Max(0.0, cpuStat.Iowait))
+		e.cpu.WithLabelValues("idle").Add(math.Max(0.0, cpuStat.Idle))
+		e.cpu.WithLabelValues("rest").Add(math.Max(0.0, cpuStat.IRQ+cpuStat.SoftIRQ+cpuStat.Steal+cpuStat.Guest+cpuStat.GuestNice))
+		e.cpu.Collect(ch)
+	}
+	e.log.Debug.Println("collect duration for node_cpu:", time.Since(t))
+
+	t = time.Now()
+	memStat, err := e.proc.Meminfo()
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		e.mem.WithLabelValues("total").Set(float64(*memStat.MemTotal))
+		e.mem.WithLabelValues("used").Set(float64(*memStat.MemTotal - *memStat.MemAvailable))
+		e.mem.WithLabelValues("free").Set(float64(*memStat.MemFree))
+		e.mem.WithLabelValues("shared").Set(float64(*memStat.Shmem))
+		e.mem.WithLabelValues("buffers").Set(float64(*memStat.Buffers))
+		e.mem.WithLabelValues("cache").Set(float64(*memStat.Cached + *memStat.SReclaimable))
+		e.mem.WithLabelValues("available").Set(float64(*memStat.MemAvailable))
+		e.mem.Collect(ch)
+
+		e.swap.WithLabelValues("total").Set(float64(*memStat.SwapTotal))
+		e.swap.WithLabelValues("used").Set(float64(*memStat.SwapTotal - *memStat.SwapFree))
+		e.swap.Collect(ch)
+	}
+	e.log.Debug.Println("collect duration for node_mem/node_swap:", time.Since(t))
+
+	t = time.Now()
+	netStats, err := e.updateNetStats()
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		for netif, stat := range netStats {
+			if netif != "lo" {
+				e.net.WithLabelValues(netif, "rx").Add(math.Max(0.0, float64(stat.RxBytes)))
+				e.net.WithLabelValues(netif, "tx").Add(math.Max(0.0, float64(stat.TxBytes)))
+			}
+		}
+		e.net.Collect(ch)
+	}
+
+	netLinks, err := readNetLinks("/sys/class/net")
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		e.netUp.Reset()
+		e.netSpeed.Reset()
+		e.netMTU.Reset()
+		for netif, link := range netLinks {
+			if netif != "lo" {
+				up := 0.0
+				if link.Up {
+					up = 1.0
+				}
+				e.netUp.WithLabelValues(netif).Set(up)
+				if 0 <= link.Speed {
+					e.netSpeed.WithLabelValues(netif).Set(float64(link.Speed) * 1e6)
+				}
+				e.netMTU.WithLabelValues(netif).Set(float64(link.MTU))
+			}
+		}
+		e.netUp.Collect(ch)
+		e.netSpeed.Collect(ch)
+		e.netMTU.Collect(ch)
+	}
+
+	bonds, err := readBonding("/proc/net/bonding")
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		e.bondSlaves.Reset()
+		e.bondActive.Reset()
+		e.bondSlaveUp.Reset()
+		for master, slaves := range bonds {
+			active := 0
+			for slave, up := range slaves {
+				if up {
+					active++
+					e.bondSlaveUp.WithLabelValues(master, slave).Set(1.0)
+				} else {
+					e.bondSlaveUp.WithLabelValues(master, slave).Set(0.0)
+				}
+			}
+			e.bondSlaves.WithLabelValues(master).Set(float64(len(slaves)))
+			e.bondActive.WithLabelValues(master).Set(float64(active))
+		}
+		e.bondSlaves.Collect(ch)
+		e.bondActive.Collect(ch)
+		e.bondSlaveUp.Collect(ch)
+	}
+
+	bridges, err := readBridges("/sys/class/net")
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		e.bridgePorts.Reset()
+		for bridge, ports := range bridges {
+			e.bridgePorts.WithLabelValues(bridge).Set(float64(ports))
+		}
+		e.bridgePorts.Collect(ch)
+	}
+
+	if err := e.collectNetworkConfig(ch); err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	}
+	e.log.Debug.Println("collect duration for node_net:", time.Since(t))
+
+	t = time.Now()
+	diskStats, skipped, err := readDiskStats("/proc/mounts", e.allMounts, e.statfs)
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		e.diskTimeout.Reset()
+		e.diskSkipped.Reset()
+		for mount, reason := range skipped {
+			if reason == statfsTimedOut {
+				e.diskTimeout.WithLabelValues(mount).Set(1.0)
+			} else {
+				e.diskSkipped.WithLabelValues(mount, reason).Set(1.0)
+			}
+		}
+		e.diskTimeout.Collect(ch)
+		e.diskSkipped.Collect(ch)
+
+		e.disk.Reset()
+		if e.diskLegacy != nil {
+			e.diskLegacy.Reset()
+		}
+		e.fsInfo.Reset()
+		for disk, stat := range diskStats {
+			dev := disk.device
+			mount := disk.mount
+			e.fsInfo.WithLabelValues(dev, mount, stat.FSType, stat.Options).Set(1.0)
+			e.disk.WithLabelValues(dev, mount, "total").Set(float64(stat.Total))
+			e.disk.WithLabelValues(dev, mount, "used").Set(float64(stat.Total - stat.Available))
+			e.disk.WithLabelValues(dev, mount, "free").Set(float64(stat.Free))
+			e.disk.WithLabelValues(dev, mount, "available").Set(float64(stat.Available))
+			if e.diskLegacy != nil {
+				e.diskLegacy.WithLabelValues(dev, mount, "total").Set(float64(stat.Total / 1000))
+				e.diskLegacy.WithLabelValues(dev, mount, "used").Set(float64(stat.Total/1000 - stat.Available/1000))
+				e.diskLegacy.WithLabelValues(dev, mount, "free").Set(float64(stat.Free / 1000))
+				e.diskLegacy.WithLabelValues(dev, mount, "available").Set(float64(stat.Available / 1000))
+			}
+		}
+		e.disk.Collect(ch)
+		if e.diskLegacy != nil {
+			e.diskLegacy.Collect(ch)
+		}
+		e.fsInfo.Collect(ch)
+	}
+	e.log.Debug.Println("collect duration for node_disk:", time.Since(t))
+
+	t = time.Now()
+	ioStats, err := e.updateDiskIOStats()
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		for _, stat := range ioStats {
+			device := stat.Info.DeviceName
+			e.diskio.WithLabelValues(device, "total").Add(float64(stat.IOStats.IOsTotalTicks) / 1000.0)
+			e.diskio.WithLabelValues(device, "read").Add(float64(stat.IOStats.ReadTicks) / 1000.0)
+			e.diskio.WithLabelValues(device, "write").Add(float64(stat.IOStats.WriteTicks) / 1000.0)
+		}
+		e.diskio.Collect(ch)
+	}
+	e.log.Debug.Println("collect duration for node_diskio:", time.Since(t))
+
+	t = time.Now()
+	driveTemps, err := e.readDriveTemps("/sys/class/hwmon")
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		e.diskTemp.Reset()
+		for device, temp := range driveTemps {
+			e.diskTemp.WithLabelValues(device).Set(temp)
+		}
+		e.diskTemp.Collect(ch)
+	}
+	e.log.Debug.Println("collect duration for node_disk_temperature:", time.Since(t))
+
+	t = time.Now()
+	if err := e.collectFilesystems(ch); err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	}
+	e.log.Debug.Println("collect duration for node_xfs and node_btrfs:", time.Since(t))
+
+	t = time.Now()
+	if err := e.collectNetworkMounts(ch); err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	}
+	e.log.Debug.Println("collect duration for node_mount and node_fuse:", time.Since(t))
+
+	t = time.Now()
+	vmStats, err := e.updateVMStats()
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		for field, n := range vmStats {
+			e.vmstat.WithLabelValues(field).Add(float64(n))
+		}
+		e.vmstat.Collect(ch)
+	}
+	e.log.Debug.Println("collect duration for node_vmstat:", time.Since(t))
+
+	t = time.Now()
+	if offset, err := clockOffset(); err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		step := offset - e.clockLast
+		if step < 0 {
+			step = -step
+		}
+		if e.stepThreshold < step {
+			e.log.Warning.Printf("realtime clock stepped by %v", offset-e.clockLast)
+			e.timeSteps.Inc()
+		}
+		e.clockLast = offset
+		e.timeDrift.Set((offset - e.clockStart).Seconds())
+		e.timeDrift.Collect(ch)
+		e.timeSteps.Collect(ch)
+	}
+
+	clocksources, err := readClocksources("/sys/devices/system/clocksource")
+	if err != nil {
+		e.log.Error.Println(err)
+		errs = append(errs, err)
+	} else {
+		e.clocksource.Reset()
+		for _, source := range clocksources {
+			e.clocksource.WithLabelValues(source).Set(1.0)
+		}
+		e.clocksource.Collect(ch)
+	}
+	e.log.Debug.Println("collect duration for node_time:", time.Since(t))
+
+	if 0 < e.topProcesses {
+		t = time.Now()
+		processStats, err := e.updateProcessStats()
+		if err != nil {
+			e.log.Error.Println(err)
+			errs = append(errs, err)
+		} else {
+			e.setProcessStats(processStats)
+			e.processMem.Collect(ch)
+			e.processCPU.Collect(ch)
+		}
+		e.log.Debug.Println("collect duration for node_process:", time.Since(t))
+	}
+	return errors.Join(errs...)
+}
+
+// setProcessStats sets the memory and CPU time of the top process names by memory, and sums the others.
+func (e *Collector) setProcessStats(stats map[string]processStat) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return stats[names[j]].Memory < stats[names[i]].Memory
+	})
+
+	other := processStat{}
+	top := map[string]bool{processOther: true}
+	e.processMem.Reset()
+	for i, name := range names {
+		stat := stats[name]
+		if i < e.topProcesses {
+			top[name] = true
+			e.processMem.WithLabelValues(name).Set(float64(stat.Memory))
+			e.processCPU.WithLabelValues(name).Add(math.Max(0.0, stat.CPU))
+		} else {
+			other.Memory += stat.Memory
+			other.CPU += stat.CPU
+		}
+	}
+	e.processMem.WithLabelValues(processOther).Set(float64(other.Memory))
+	e.processCPU.WithLabelValues(processOther).Add(math.Max(0.0, other.CPU))
+	for name := range e.processNames {
+		if !top[name] {
+			e.processCPU.DeleteLabelValues(name) // dropped out of the top, its CPU time counts under other from now on
+		}
+	}
+	e.processNames = top
+}
+
+func (e *Collector) updateCPUStat() (procfs.CPUStat, error) {
+	stat, err := e.proc.Stat()
+	if err != nil {
+		return procfs.CPUStat{}, err
+	}
+
+	cur := procfs.CPUStat{}
+	for _, cpu := range stat.CPU {
+		cur.User += cpu.User
+		cur.Nice += cpu.Nice
+		cur.System += cpu.System
+		cur.Idle += cpu.Idle
+		cur.Iowait += cpu.Iowait
+		cur.IRQ += cpu.IRQ
+		cur.SoftIRQ += cpu.SoftIRQ
+		cur.Steal += cpu.Steal
+		cur.Guest += cpu.Guest
+		cur.GuestNice += cpu.GuestNice
+	}
+
+	// the sums decrease when a CPU goes offline, which counts as a reset
+	diff := procfs.CPUStat{
+		User:      collector.CounterDelta(e.cpuStat.User, cur.User),
+		Nice:      collector.CounterDelta(e.cpuStat.Nice, cur.Nice),
+		System:    collector.CounterDelta(e.cpuStat.System, cur.System),
+		Idle:      collector.CounterDelta(e.cpuStat.Idle, cur.Idle),
+		Iowait:    collector.CounterDelta(e.cpuStat.Iowait, cur.Iowait),
+		IRQ:       collector.CounterDelta(e.cpuStat.IRQ, cur.IRQ),
+		SoftIRQ:   collector.CounterDelta(e.cpuStat.SoftIRQ, cur.SoftIRQ),
+		Steal:     collector.CounterDelta(e.cpuStat.Steal, cur.Steal),
+		Guest:     collector.CounterDelta(e.cpuStat.Guest, cur.Guest),
+		GuestNice: collector.CounterDelta(e.cpuStat.GuestNice, cur.GuestNice),
+	}
+	e.cpuStat = cur
+	return diff, nil
+}
+
+func (e *Collector) updateNetStats() (procfs.NetDev, error) {
+	cur, err := e.proc.NetDev()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := procfs.NetDev{}
+	for netif, stat := range e.netStats {
+		c, ok := cur[netif]
+		if !ok {
+			continue // interface was removed
+		}
+		diff[netif] = procfs.NetDevLine{
+			RxBytes:      collector.CounterDelta(stat.RxBytes, c.RxBytes),
+			RxPackets:    collector.CounterDelta(stat.RxPackets, c.RxPackets),
+			RxErrors:     collector.CounterDelta(stat.RxErrors, c.RxErrors),
+			RxDropped:    collector.CounterDelta(stat.RxDropped, c.RxDropped),
+			RxFIFO:       collector.CounterDelta(stat.RxFIFO, c.RxFIFO),
+			RxFrame:      collector.CounterDelta(stat.RxFrame, c.RxFrame),
+			RxCompressed: collector.CounterDelta(stat.RxCompressed, c.RxCompressed),
+			RxMulticast:  collector.CounterDelta(stat.RxMulticast, c.RxMulticast),
+			TxBytes:      collector.CounterDelta(stat.TxBytes, c.TxBytes),
+			TxPackets:    collector.CounterDelta(stat.TxPackets, c.TxPackets),
+			TxErrors:     collector.CounterDelta(stat.TxErrors, c.TxErrors),
+			TxDropped:    collector.CounterDelta(stat.TxDropped, c.TxDropped),
+			TxFIFO:       collector.CounterDelta(stat.TxFIFO, c.TxFIFO),
+			TxCollisions: collector.CounterDelta(stat.TxCollisions, c.TxCollisions),
+			TxCarrier:    collector.CounterDelta(stat.TxCarrier, c.TxCarrier),
+			TxCompressed: collector.CounterDelta(stat.TxCompressed, c.TxCompressed),
+		}
+	}
+	e.netStats = cur
+	return diff, err
+}
+
+func (e *Collector) updateDiskIOStats() ([]blockdevice.Diskstats, error) {
+	stats, err := e.blockdevice.ProcDiskstats()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := []blockdevice.Diskstats{}
+	for _, cur := range stats {
+		stat, ok := e.diskioStats[cur.Info.DeviceName]
+		e.diskioStats[cur.Info.DeviceName] = cur.IOStats
+		if !ok {
+			continue // device was added
+		}
+		diff = append(diff, blockdevice.Diskstats{
+			Info: cur.Info,
+			IOStats: blockdevice.IOStats{
+				ReadIOs:                collector.CounterDelta(stat.ReadIOs, cur.IOStats.ReadIOs),
+				ReadMerges:             collector.CounterDelta(stat.ReadMerges, cur.IOStats.ReadMerges),
+				ReadSectors:            collector.CounterDelta(stat.ReadSectors, cur.IOStats.ReadSectors),
+				ReadTicks:              collector.CounterDelta(stat.ReadTicks, cur.IOStats.ReadTicks),
+				WriteIOs:               collector.CounterDelta(stat.WriteIOs, cur.IOStats.WriteIOs),
+				WriteMerges:            collector.CounterDelta(stat.WriteMerges, cur.IOStats.WriteMerges),
+				WriteSectors:           collector.CounterDelta(stat.WriteSectors, cur.IOStats.WriteSectors),
+				WriteTicks:             collector.CounterDelta(stat.WriteTicks, cur.IOStats.WriteTicks),
+				IOsInProgress:          cur.IOStats.IOsInProgress,
+				IOsTotalTicks:          collector.CounterDelta(stat.IOsTotalTicks, cur.IOStats.IOsTotalTicks),
+				WeightedIOTicks:        collector.CounterDelta(stat.WeightedIOTicks, cur.IOStats.WeightedIOTicks),
+				DiscardIOs:             collector.CounterDelta(stat.DiscardIOs, cur.IOStats.DiscardIOs),
+				DiscardMerges:          collector.CounterDelta(stat.DiscardMerges, cur.IOStats.DiscardMerges),
+				DiscardSectors:         collector.CounterDelta(stat.DiscardSectors, cur.IOStats.DiscardSectors),
+				DiscardTicks:           collector.CounterDelta(stat.DiscardTicks, cur.IOStats.DiscardTicks),
+				FlushRequestsCompleted: collector.CounterDelta(stat.FlushRequestsCompleted, cur.IOStats.FlushRequestsCompleted),
+				TimeSpentFlushing:      collector.CounterDelta(stat.TimeSpentFlushing, cur.IOStats.TimeSpentFlushing),
+			},
+			IoStatsCount: cur.IoStatsCount,
+		})
+	}
+	return diff, nil
+}
+
+func (e *Collector) updateVMStats() (map[string]uint64, error) {
+	cur, err := readVMStat("/proc/vmstat", e.vmstatFields, e.log)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := map[string]uint64{}
+	for field, n := range cur {
+		if d, ok := e.vmstatStats.Delta(n, field); ok {
+			diff[field] = d
+		}
+	}
+	return diff, nil
+}
+
+// readVMStat returns the given fields of /proc/vmstat.
+func readVMStat(filename string, fields map[string]bool, log collector.Log) (map[string]uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.Fields(scanner.Text())
+		if len(line) != 2 || !fields[line[0]] {
+			continue
+		}
+		n, err := strconv.ParseUint(line[1], 10, 64)
+		if err != nil {
+			log.Warning.Printf("vmstat: key %v: %v is not an integer", line[0], line[1])
+			continue
+		}
+		stats[line[0]] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+const pfKthread = 0x00200000 // PF_KTHREAD in include/linux/sched.h
+
+// processOther is the name under which the processes outside the top are summed, which is longer than the 15 bytes of a process name (TASK_COMM_LEN) so that it can't be taken by a process.
+const processOther = "(other processes)"
+
+type processStat struct {
+	Memory uint64
+	CPU    float64
+}
+
+// updateProcessStats aggregates resident memory and CPU time per process name, reading only /proc/[pid]/stat and /proc/[pid]/statm for each process.
+func (e *Collector) updateProcessStats() (map[string]processStat, error) {
+	procs, err := e.proc.AllProcs()
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := uint64(os.Getpagesize())
+	cpus := make(map[int]float64, len(procs))
+	stats := map[string]processStat{}
+	for _, p := range procs {
+		stat, err := p.Stat()
+		if err != nil {
+			continue // process has exited
+		} else if stat.Flags&pfKthread != 0 {
+			continue
+		}
+
+		b, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", p.PID))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) < 2 {
+			continue
+		}
+		resident, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		cpu := stat.CPUTime()
+		cpus[p.PID] = cpu
+		prev := e.processStats[p.PID]
+		if cpu < prev {
+			prev = 0.0 // PID was reused
+		}
+
+		s := stats[stat.Comm]
+		s.Memory += resident * pageSize
+		s.CPU += cpu - prev
+		stats[stat.Comm] = s
+	}
+	e.processStats = cpus
+	return stats, nil
+}
+
+type netLink struct {
+	Up    bool
+	Speed int64 // in Mb/s, -1 if unknown
+	MTU   uint64
+}
+
+// readNetLinks reads the link state of each network interface from sysfs. Virtual interfaces have an unknown speed, either reading -1 or failing with EINVAL.
+func readNetLinks(dir string) (map[string]netLink, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	links := map[string]netLink{}
+	for _, entry := range entries {
+		netif := entry.Name()
+		operstate, err := os.ReadFile(filepath.Join(dir, netif, "operstate"))
+		if err != nil {
+			continue // interface was removed
+		}
+		b, err := os.ReadFile(filepath.Join(dir, netif, "mtu"))
+		if err != nil {
+			continue
+		}
+		mtu, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v: bad mtu: %w", netif, err)
+		}
+
+		speed := int64(-1)
+		if b, err := os.ReadFile(filepath.Join(dir, netif, "speed")); err == nil {
+			if n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && 0 <= n {
+				speed = n
+			}
+		}
+		links[netif] = netLink{
+			Up:    strings.TrimSpace(string(operstate)) == "up",
+			Speed: speed,
+			MTU:   mtu,
+		}
+	}
+	return links, nil
+}
+
+// readBonding returns the MII status of each slave per bonding interface. It returns no interfaces if the bonding module is not loaded.
+func readBonding(dir string) (map[string]map[string]bool, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	bonds := map[string]map[string]bool{}
+	for _, entry := range entries {
+		master := entry.Name()
+		f, err := os.Open(filepath.Join(dir, master))
+		if err != nil {
+			continue // interface was removed
+		}
+
+		// the slave's MII status follows its interface name
+		slave := ""
+		slaves := map[string]bool{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, val, ok := strings.Cut(scanner.Text(), ":")
+			if !ok {
+				continue
+			}
+			val = strings.TrimSpace(val)
+			if key == "Slave Interface" {
+				slave = val
+				slaves[slave] = false
+			} else if key == "MII Status" && slave != "" {
+				slaves[slave] = val == "up"
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%v: %w", master, err)
+		}
+		bonds[master] = slaves
+	}
+	return bonds, nil
+}
+
+// readBridges returns the number of ports per bridge interface.
+func readBridges(dir string) (map[string]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	bridges := map[string]int{}
+	for _, entry := range entries {
+		ports, err := os.ReadDir(filepath.Join(dir, entry.Name(), "brif"))
+		if err != nil {
+			continue // not a bridge
+		}
+		bridges[entry.Name()] = len(ports)
+	}
+	return bridges, nil
+}
+
+// netFamilies are the exported address families.
+var netFamilies = map[uint8]string{
+	syscall.AF_INET:  "ipv4",
+	syscall.AF_INET6: "ipv6",
+}
+
+// netTables are the names of the reserved routing tables, other tables are named by their number.
+var netTables = map[uint32]string{
+	253: "default",
+	254: "main",
+	255: "local",
+}
+
+// collectNetworkConfig exports the number of addresses per interface, whether there is a default route, and the number of routes per table, each from a single netlink dump. The IPv6 default route is only exported when the host has any IPv6 address, so that hosts with IPv6 disabled don't report it missing.
+func (e *Collector) collectNetworkConfig(ch chan<- prometheus.Metric) error {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	names := map[uint32]string{}
+	for _, iface := range interfaces {
+		names[uint32(iface.Index)] = iface.Name
+	}
+
+	addrs, err := readNetlinkAddresses()
+	if err != nil {
+		return fmt.Errorf("netlink addresses: %w", err)
+	}
+	routes, err := readNetlinkRoutes()
+	if err != nil {
+		return fmt.Errorf("netlink routes: %w", err)
+	}
+
+	// interfaces that lost all their addresses are exported as zero
+	families := map[string]bool{}
+	for _, addr := range addrs {
+		families[netFamilies[addr.family]] = true
+	}
+	e.netAddrs.Reset()
+	for _, iface := range interfaces {
+		for family := range families {
+			if iface.Name != "lo" {
+				e.netAddrs.WithLabelValues(iface.Name, family).Set(0.0)
+			}
+		}
+	}
+	for _, addr := range addrs {
+		if name, ok := names[addr.index]; ok && name != "lo" {
+			e.netAddrs.WithLabelValues(name, netFamilies[addr.family]).Add(1.0)
+		}
+	}
+
+	e.netDefault.Reset()
+	e.netRoutes.Reset()
+	for family := range families {
+		e.netDefault.WithLabelValues(family).Set(0.0)
+	}
+	for _, route := range routes {
+		table, ok := netTables[route.table]
+		if !ok {
+			table = strconv.FormatUint(uint64(route.table), 10)
+		}
+		e.netRoutes.WithLabelValues(table).Add(1.0)
+		if route.table == syscall.RT_TABLE_MAIN && route.dstLen == 0 && route.typ == syscall.RTN_UNICAST {
+			e.netDefault.WithLabelValues(netFamilies[route.family]).Set(1.0)
+		}
+	}
+	e.netAddrs.Collect(ch)
+	e.netDefault.Collect(ch)
+	e.netRoutes.Collect(ch)
+	return nil
+}
+
+type netlinkAddress struct {
+	family uint8
+	index  uint32
+}
+
+// readNetlinkAddresses returns the IPv4 and IPv6 addresses of all interfaces.
+func readNetlinkAddresses() ([]netlinkAddress, error) {
+	msgs, err := netlinkDump(syscall.RTM_GETADDR)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []netlinkAddress{}
+	for _, msg := range msgs {
+		// struct ifaddrmsg
+		if msg.Header.Type != syscall.RTM_NEWADDR || len(msg.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		} else if _, ok := netFamilies[msg.Data[0]]; !ok {
+			continue
+		}
+		addrs = append(addrs, netlinkAddress{
+			family: msg.Data[0],
+			index:  binary.NativeEndian.Uint32(msg.Data[4:8]),
+		})
+	}
+	return addrs, nil
+}
+
+type netlinkRoute struct {
+	family uint8
+	table  uint32
+	dstLen uint8
+	typ    uint8
+}
+
+// readNetlinkRoutes returns the IPv4 and IPv6 routes of all tables.
+func readNetlinkRoutes() ([]netlinkRoute, error) {
+	msgs, err := netlinkDump(syscall.RTM_GETROUTE)
+	if err != nil {
+		return nil, err
+	}
+	routes := []netlinkRoute{}
+	for _, msg := range msgs {
+		// struct rtmsg, tables above 255 are only given by the RTA_TABLE attribute
+		if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+			continue
+		} else if _, ok := netFamilies[msg.Data[0]]; !ok {
+			continue
+		}
+		route := netlinkRoute{
+			family: msg.Data[0],
+			dstLen: msg.Data[1],
+			table:  uint32(msg.Data[4]),
+			typ:    msg.Data[7],
+		}
+		if attrs, err := syscall.ParseNetlinkRouteAttr(&msg); err == nil {
+			for _, attr := range attrs {
+				if attr.Attr.Type == syscall.RTA_TABLE && len(attr.Value) == 4 {
+					route.table = binary.NativeEndian.Uint32(attr.Value)
+				}
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// netlinkDump dumps the routing information base of all address families.
+func netlinkDump(proto int) ([]syscall.NetlinkMessage, error) {
+	b, err := syscall.NetlinkRIB(proto, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	return syscall.ParseNetlinkMessage(b)
+}
+
+type xfsCounters struct {
+	disk
+
+	extentsAllocated, extentsFreed uint32
+	logForces                      uint32
+	reads, writes                  uint32
+}
+
+// collectFilesystems exports the XFS statistics and btrfs allocations, labelled by the device and mount point as in node_disk_bytes.
+func (e *Collector) collectFilesystems(ch chan<- prometheus.Metric) error {
+	mounts, err := readKernelMounts("/proc/mounts")
+	if err != nil {
+		return err
+	}
+
+	xfsStats, err := e.xfs.SysStats()
+	if err != nil {
+		return fmt.Errorf("xfs: %w", err)
+	}
+	prev := e.xfsStats
+	e.xfsStats = map[string]xfsCounters{}
+	for _, stat := range xfsStats {
+		mount, ok := mounts[stat.Name]
+		if !ok {
+			continue
+		}
+		cur := xfsCounters{
+			disk:             mount,
+			extentsAllocated: stat.ExtentAllocation.ExtentsAllocated,
+			extentsFreed:     stat.ExtentAllocation.ExtentsFreed,
+			logForces:        stat.LogOperation.Force,
+			reads:            stat.ReadWrite.Read,
+			writes:           stat.ReadWrite.Write,
+		}
+		e.xfsStats[stat.Name] = cur
+		p, ok := prev[stat.Name]
+		if !ok || p.disk != cur.disk {
+			p = cur // set baseline
+		}
+
+		// the counters are 32-bit and wrap around
+		diff := func(prev, cur uint32) float64 {
+			return float64(cur - prev)
+		}
+		e.xfsExtents.WithLabelValues(mount.device, mount.mount, "allocated").Add(diff(p.extentsAllocated, cur.extentsAllocated))
+		e.xfsExtents.WithLabelValues(mount.device, mount.mount, "freed").Add(diff(p.extentsFreed, cur.extentsFreed))
+		e.xfsForces.WithLabelValues(mount.device, mount.mount).Add(diff(p.logForces, cur.logForces))
+		e.xfsCalls.WithLabelValues(mount.device, mount.mount, "read").Add(diff(p.reads, cur.reads))
+		e.xfsCalls.WithLabelValues(mount.device, mount.mount, "write").Add(diff(p.writes, cur.writes))
+	}
+	for name, p := range prev {
+		if cur, ok := e.xfsStats[name]; !ok || cur.disk != p.disk {
+			labels := prometheus.Labels{"device": p.device, "mount": p.mount}
+			e.xfsExtents.DeletePartialMatch(labels)
+			e.xfsForces.DeletePartialMatch(labels)
+			e.xfsCalls.DeletePartialMatch(labels)
+		}
+	}
+	e.xfsExtents.Collect(ch)
+	e.xfsForces.Collect(ch)
+	e.xfsCalls.Collect(ch)
+
+	btrfsStats, err := e.btrfs.Stats()
+	if err != nil {
+		return fmt.Errorf("btrfs: %w", err)
+	}
+	e.btrfsAlloc.Reset()
+	for _, stat := range btrfsStats {
+		// filesystems are identified by UUID, find the device it is mounted from
+		devices := make([]string, 0, len(stat.Devices))
+		for device := range stat.Devices {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		var mount disk
+		for _, device := range devices {
+			if m, ok := mounts[device]; ok {
+				mount = m
+				break
+			}
+		}
+		if mount.device == "" {
+			continue
+		}
+
+		for blockGroup, alloc := range map[string]*btrfs.AllocationStats{
+			"data":     stat.Allocation.Data,
+			"metadata": stat.Allocation.Metadata,
+			"system":   stat.Allocation.System,
+		} {
+			if alloc != nil {
+				e.btrfsAlloc.WithLabelValues(mount.device, mount.mount, blockGroup, "used").Set(float64(alloc.UsedBytes))
+				e.btrfsAlloc.WithLabelValues(mount.device, mount.mount, blockGroup, "total").Set(float64(alloc.TotalBytes))
+			}
+		}
+	}
+	e.btrfsAlloc.Collect(ch)
+	return nil
+}
+
+// collectNetworkMounts exports the RPC latencies of NFS mounts and the waiting requests of FUSE mounts, which are missed by statfs and diskstats. Both are skipped when the kernel lacks the files.
+func (e *Collector) collectNetworkMounts(ch chan<- prometheus.Metric) error {
+	self, err := e.proc.Self()
+	if err != nil {
+		return err
+	}
+
+	mountStats, err := self.MountStats()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("mountstats: %w", err)
+	}
+	for _, mount := range mountStats {
+		stats, ok := mount.Stats.(*procfs.MountStatsNFS)
+		if !ok {
+			continue
+		}
+		for _, op := range stats.Operations {
+			if op.Requests == 0 {
+				continue
+			}
+			ch <- prometheus.MustNewConstSummary(e.rpcLatency, op.Requests, float64(op.CumulativeQueueMilliseconds)/1000.0, nil, mount.Mount, op.Operation, "queue")
+			ch <- prometheus.MustNewConstSummary(e.rpcLatency, op.Requests, float64(op.CumulativeTotalResponseMilliseconds)/1000.0, nil, mount.Mount, op.Operation, "rtt")
+		}
+	}
+
+	conns, err := readFuseConnections("/sys/fs/fuse/connections")
+	if err != nil {
+		return fmt.Errorf("fuse: %w", err)
+	}
+	e.fuseWaiting.Reset()
+	e.fuseCongest.Reset()
+	if len(conns) != 0 {
+		mountInfo, err := self.MountInfo()
+		if err != nil {
+			return fmt.Errorf("mountinfo: %w", err)
+		}
+
+		// the connections are named by the device number of the superblock, use its shortest mount point
+		mounts := map[string]string{}
+		for _, info := range mountInfo {
+			var major, minor uint32
+			if _, err := fmt.Sscanf(info.MajorMinorVer, "%d:%d", &major, &minor); err != nil {
+				continue
+			}
+			dev := strconv.FormatUint(uint64(major)<<20|uint64(minor), 10)
+			if mount, ok := mounts[dev]; !ok || len(info.MountPoint) < len(mount) {
+				mounts[dev] = info.MountPoint
+			}
+		}
+		for dev, conn := range conns {
+			if mount, ok := mounts[dev]; ok {
+				e.fuseWaiting.WithLabelValues(mount).Set(float64(conn.waiting))
+				e.fuseCongest.WithLabelValues(mount).Set(float64(conn.congestionThreshold))
+			}
+		}
+	}
+	e.fuseWaiting.Collect(ch)
+	e.fuseCongest.Collect(ch)
+	return nil
+}
+
+type fuseConnection struct {
+	waiting             uint64
+	congestionThreshold uint64
+}
+
+// readFuseConnections returns the FUSE connections by their device number, none if the fusectl filesystem is not mounted.
+func readFuseConnections(dir string) (map[string]fuseConnection, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	conns := map[string]fuseConnection{}
+	for _, entry := range entries {
+		conn := fuseConnection{}
+		for filename, n := range map[string]*uint64{
+			"waiting":              &conn.waiting,
+			"congestion_threshold": &conn.congestionThreshold,
+		} {
+			b, err := os.ReadFile(filepath.Join(dir, entry.Name(), filename))
+			if errors.Is(err, os.ErrNotExist) {
+				// the connection was closed
+				continue
+			} else if err != nil {
+				return nil, err
+			} else if *n, err = strconv.ParseUint(string(bytes.TrimSpace(b)), 10, 64); err != nil {
+				return nil, fmt.Errorf("%v: %w", filename, err)
+			}
+		}
+		conns[entry.Name()] = conn
+	}
+	return conns, nil
+}
+
+// mountEntry is a line of /proc/mounts.
+type mountEntry struct {
+	device  string
+	mount   string
+	fstype  string
+	options []string
+}
+
+// mountOptions are the mount options that are exported in node_filesystem_info, which are limited to keep the number of label values bounded.
+var mountOptions = []string{"ro", "noatime", "nodiratime", "discard", "sync", "noexec", "nosuid", "nodev"}
+
+// Options returns the options of the entry that are in mountOptions, comma-separated in the order of mountOptions.
+func (m mountEntry) Options() string {
+	options := []string{}
+	for _, option := range mountOptions {
+		for _, o := range m.options {
+			if o == option {
+				options = append(options, option)
+				break
+			}
+		}
+	}
+	return strings.Join(options, ",")
+}
+
+// readMounts parses the mounts of a file such as /proc/mounts, of which the fields are the device, mount point, filesystem type and mount options.
+func readMounts(filename string) ([]mountEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []mountEntry{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%v:%v: bad mount point", filename, n)
+		}
+		mounts = append(mounts, mountEntry{
+			device:  unescapeMount(fields[0]),
+			mount:   unescapeMount(fields[1]),
+			fstype:  unescapeMount(fields[2]),
+			options: strings.Split(unescapeMount(fields[3]), ","),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMount replaces the octal escapes of /proc/mounts, which escapes spaces, tabs, newlines and backslashes (e.g. \040 for a space).
+func unescapeMount(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b = append(b, (s[i+1]-'0')<<6|(s[i+2]-'0')<<3|(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+func isOctal(c byte) bool {
+	return '0' <= c && c <= '7'
+}
+
+// readKernelMounts returns the device and shortest mount point of mounted block devices by their kernel name (e.g. sda1 or dm-0), which is how XFS and btrfs name devices in sysfs.
+func readKernelMounts(filename string) (map[string]disk, error) {
+	entries, err := readMounts(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := map[string]disk{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.device, "/dev/") {
+			continue
+		}
+
+		// resolve symlinks such as /dev/mapper/vg-root to /dev/dm-0
+		name := filepath.Base(entry.device)
+		if target, err := filepath.EvalSymlinks(entry.device); err == nil {
+			name = filepath.Base(target)
+		}
+		if prev, ok := mounts[name]; !ok || len(entry.mount) < len(prev.mount) {
+			mounts[name] = disk{device: entry.device, mount: entry.mount}
+		}
+	}
+	return mounts, nil
+}
+
+// readDriveTemps returns the temperature in degrees Celsius per block device of the hwmon devices of the drivetemp driver. Disks that are spun down return EAGAIN and are skipped, so that they are not woken up.
+func (e *Collector) readDriveTemps(dir string) (map[string]float64, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]float64{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	temps := map[string]float64{}
+	for _, entry := range entries {
+		hwmon := filepath.Join(dir, entry.Name())
+		if name, err := os.ReadFile(filepath.Join(hwmon, "name")); err != nil || strings.TrimSpace(string(name)) != "drivetemp" {
+			continue
+		}
+
+		// the device symlink points to the SCSI device, which has the block device as its child
+		devices, err := os.ReadDir(filepath.Join(hwmon, "device", "block"))
+		if err != nil || len(devices) == 0 {
+			e.log.Debug.Printf("drivetemp %v: no block device: %v", entry.Name(), err)
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(hwmon, "temp1_input"))
+		if errors.Is(err, unix.EAGAIN) {
+			continue
+		} else if err != nil {
+			e.log.Debug.Printf("drivetemp %v: %v", devices[0].Name(), err)
+			continue
+		}
+		millidegrees, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			e.log.Debug.Printf("drivetemp %v: %v", devices[0].Name(), err)
+			continue
+		}
+		temps[devices[0].Name()] = float64(millidegrees) / 1000.0
+	}
+	return temps, nil
+}
+
+// clockOffset returns the difference between the realtime clock and the monotonic clock including suspend, which changes only when the realtime clock is stepped (e.g. an NTP jump or a manual date change) since both are slewed alike.
+func clockOffset() (time.Duration, error) {
+	var realtime, boottime unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_REALTIME, &realtime); err != nil {
+		return 0, fmt.Errorf("clock_gettime: %w", err)
+	} else if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &boottime); err != nil {
+		return 0, fmt.Errorf("clock_gettime: %w", err)
+	}
+	return time.Duration(realtime.Nano() - boottime.Nano()), nil
+}
+
+// readClocksources returns the current clocksource of each clocksource device, of which there is usually only one.
+func readClocksources(dir string) ([]string, error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "clocksource*", "current_clocksource"))
+	if err != nil {
+		return nil, err
+	}
+	sources := []string{}
+	for _, filename := range filenames {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		} else if source := string(bytes.TrimSpace(b)); source != "" {
+			sources = append(sources, source)
+		}
+	}
+	return sources, nil
+}
+
+// readHostInfo returns the uname, OS release and machine ID info metrics. Since the machine ID should be kept confidential, only a truncated hash is exported.
+func (e *Collector) readHostInfo() []prometheus.Metric {
+	info := []prometheus.Metric{}
+	uname := unix.Utsname{}
+	if err := unix.Uname(&uname); err != nil {
+		e.log.Warning.Println("uname:", err)
+	} else {
+		desc := prometheus.NewDesc("node_uname_info", "Kernel information from uname.", []string{"sysname", "release", "version", "machine", "nodename"}, nil)
+		info = append(info, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1.0,
+			unix.ByteSliceToString(uname.Sysname[:]),
+			unix.ByteSliceToString(uname.Release[:]),
+			unix.ByteSliceToString(uname.Version[:]),
+			unix.ByteSliceToString(uname.Machine[:]),
+			unix.ByteSliceToString(uname.Nodename[:])))
+	}
+
+	release, err := readOSRelease("/etc/os-release")
+	if errors.Is(err, os.ErrNotExist) {
+		release, err = readOSRelease("/usr/lib/os-release")
+	}
+	if err != nil {
+		e.log.Warning.Println(err)
+	} else {
+		desc := prometheus.NewDesc("node_os_info", "Operating system information from os-release.", []string{"id", "version_id", "pretty_name"}, nil)
+		info = append(info, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1.0, release["ID"], release["VERSION_ID"], release["PRETTY_NAME"]))
+	}
+
+	if b, err := os.ReadFile("/etc/machine-id"); err == nil && 0 < len(bytes.TrimSpace(b)) {
+		hash := sha256.Sum256(bytes.TrimSpace(b))
+		desc := prometheus.NewDesc("node_machine_info", "Machine identity, with a truncated SHA-256 hash of /etc/machine-id.", []string{"machine_id"}, nil)
+		info = append(info, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1.0, hex.EncodeToString(hash[:8])))
+	}
+	return info
+}
+
+// readOSRelease parses lines such as PRETTY_NAME="Debian GNU/Linux 12 (bookworm)".
+func readOSRelease(filename string) (map[string]string, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	release := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		key, val, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(val); err == nil {
+			val = unquoted
+		} else {
+			val = strings.Trim(val, "'")
+		}
+		release[key] = val
+	}
+	return release, nil
+}
+
+type disk struct {
+	device string
+	mount  string
+}
+
+type diskStat struct {
+	Total     uint64
+	Free      uint64
+	Available uint64
+
+	FSType  string
+	Options string // see mountEntry.Options
+}
+
+const (
+	statfsTimeout    = 2 * time.Second
+	statfsCooldown   = 5 * time.Minute
+	statfsMaxPending = 16
+)
+
+// reasons that statfs returned no disk size
+const (
+	statfsTimedOut = "timeout"
+	statfsCooling  = "cooldown"
+	statfsPending  = "pending"
+)
+
+// statfsGuard calls statfs with a timeout, since it blocks indefinitely on hung network filesystems. Mount points that timed out are skipped for a cool-down period. Calls stuck in the kernel cannot be cancelled, so the number of pending calls is capped.
+type statfsGuard struct {
+	log     collector.Log
+	mu      sync.Mutex
+	bad     map[string]time.Time
+	pending int
+	capped  bool
+}
+
+// Statfs returns the reason if the call timed out or the mount point is skipped, or an empty string otherwise.
+func (g *statfsGuard) Statfs(mount string) (unix.Statfs_t, string, error) {
+	g.mu.Lock()
+	if t, ok := g.bad[mount]; ok && time.Since(t) < statfsCooldown {
+		g.mu.Unlock()
+		return unix.Statfs_t{}, statfsCooling, nil
+	} else if statfsMaxPending <= g.pending {
+		if !g.capped {
+			g.log.Warning.Printf("statfs: %v calls are stuck, skipping mount points until they return", g.pending)
+			g.capped = true
+		}
+		g.mu.Unlock()
+		return unix.Statfs_t{}, statfsPending, nil
+	}
+	delete(g.bad, mount)
+	g.pending++
+	g.mu.Unlock()
+
+	type result struct {
+		buf unix.Statfs_t
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		buf := unix.Statfs_t{}
+		err := unix.Statfs(mount, &buf)
+		g.mu.Lock()
+		g.pending--
+		if g.pending < statfsMaxPending {
+			g.capped = false
+		}
+		g.mu.Unlock()
+		done <- result{buf, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.buf, "", res.err
+	case <-time.After(statfsTimeout):
+		g.log.Warning.Printf("statfs: %v timed out, skipping for %v", mount, statfsCooldown)
+		g.mu.Lock()
+		g.bad[mount] = time.Now()
+		g.mu.Unlock()
+		return unix.Statfs_t{}, statfsTimedOut, nil
+	}
+}
+
+// diskFSTypes are the filesystems without a device under /dev/ that store data on disk, such as the overlay filesystems of containers.
+var diskFSTypes = map[string]bool{"overlay": true, "btrfs": true, "zfs": true}
+
+// readDiskStats reads the size of each mounted filesystem. Unless allMounts is set, a filesystem that is mounted multiple times is reported once using the shortest mount point. It also returns the mount points for which statfs timed out or was skipped, with the reason.
+func readDiskStats(filename string, allMounts bool, guard *statfsGuard) (map[disk]diskStat, map[string]string, error) {
+	entries, err := readMounts(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skipped := map[string]string{}
+	stats := map[disk]diskStat{}
+	for _, mount := range diskMounts(entries, allMounts, filesystemID) {
+		buf, reason, err := guard.Statfs(mount.mount)
+		if err != nil {
+			return nil, nil, err
+		} else if reason != "" {
+			skipped[mount.mount] = reason
+			continue
+		}
+		stats[disk{strings.TrimPrefix(mount.device, "/dev/"), mount.mount}] = diskStat{
+			Total:     uint64(buf.Bsize) * buf.Blocks,
+			Free:      uint64(buf.Bsize) * buf.Bfree,
+			Available: uint64(buf.Bsize) * buf.Bavail,
+			FSType:    mount.fstype,
+			Options:   mount.Options(),
+		}
+	}
+	return stats, skipped, nil
+}
+
+// diskMounts returns the mounts of filesystems on disk, which are devices under /dev/ and the filesystems of diskFSTypes. Unless allMounts is set, the mounts of the same filesystem by its ID are merged into the shortest mount point, such as for bind mounts and btrfs subvolumes.
+func diskMounts(entries []mountEntry, allMounts bool, id func(mountEntry) string) []mountEntry {
+	mounts := []mountEntry{}
+	canonical := map[string]int{} // filesystem ID => index of mount point
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.device, "/dev/") && !diskFSTypes[entry.fstype] {
+			continue
+		}
+		if !allMounts {
+			id := id(entry)
+			if i, ok := canonical[id]; ok {
+				if len(entry.mount) < len(mounts[i].mount) || len(entry.mount) == len(mounts[i].mount) && entry.mount < mounts[i].mount {
+					mounts[i].mount = entry.mount
+					mounts[i].fstype = entry.fstype
+					mounts[i].options = entry.options
+				}
+				continue
+			}
+			canonical[id] = len(mounts)
+		}
+		mounts = append(mounts, entry)
+	}
+	return mounts
+}
+
+// filesystemID returns the ID of the filesystem of a mount, which is the device number of a device under /dev/ so that all btrfs subvolumes of a device are the same, and otherwise the device number of the mount point, which is shared only by bind mounts.
+func filesystemID(entry mountEntry) string {
+	if strings.HasPrefix(entry.device, "/dev/") {
+		return deviceID(entry.device)
+	}
+	buf := unix.Stat_t{}
+	if err := unix.Stat(entry.mount, &buf); err != nil {
+		return entry.device + " " + entry.mount
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(buf.Dev)), unix.Minor(uint64(buf.Dev)))
+}
+
+// deviceID returns the major:minor number of a device node, so that different names for the same device (e.g. /dev/mapper/root and /dev/dm-0) are equal. It returns the name if the device cannot be stat'ed.
+func deviceID(device string) string {
+	buf := unix.Stat_t{}
+	if err := unix.Stat(device, &buf); err != nil || buf.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return device
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(buf.Rdev)), unix.Minor(uint64(buf.Rdev)))
+}
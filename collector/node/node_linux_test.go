@@ -0,0 +1,192 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+func newTestCollector(t *testing.T, opts Options) *Collector {
+	t.Helper()
+	e, err := New(opts, collector.Log{})
+	if err != nil {
+		t.Skip("procfs not available:", err)
+	}
+	return e
+}
+
+// checkProcessCPU checks that exactly the expected process names have their CPU time exported.
+func checkProcessCPU(t *testing.T, e *Collector, expected map[string]float64) {
+	t.Helper()
+	if n := testutil.CollectAndCount(e.processCPU); n != len(expected) {
+		t.Errorf("got %d process names, expected %d", n, len(expected))
+	}
+	for name, v := range expected {
+		if cpu := testutil.ToFloat64(e.processCPU.WithLabelValues(name)); cpu != v {
+			t.Errorf("%v: got %v, expected %v", name, cpu, v)
+		}
+	}
+}
+
+func TestProcessTop(t *testing.T) {
+	e := newTestCollector(t, Options{TopProcesses: 2})
+	e.processCPU.Reset()
+	e.processNames = map[string]bool{}
+
+	e.setProcessStats(map[string]processStat{
+		"postgres": {Memory: 300, CPU: 1.0},
+		"nginx":    {Memory: 200, CPU: 2.0},
+		"other":    {Memory: 100, CPU: 4.0},
+		"cron":     {Memory: 10, CPU: 8.0},
+	})
+	checkProcessCPU(t, e, map[string]float64{"postgres": 1.0, "nginx": 2.0, processOther: 12.0})
+
+	// a process named other is a process in its own right
+	e.setProcessStats(map[string]processStat{
+		"postgres": {Memory: 300, CPU: 1.0},
+		"other":    {Memory: 250, CPU: 4.0},
+		"nginx":    {Memory: 200, CPU: 2.0},
+	})
+	checkProcessCPU(t, e, map[string]float64{"postgres": 2.0, "other": 4.0, processOther: 14.0}) // nginx dropped out of the top
+}
+
+func TestStatfsGuard(t *testing.T) {
+	g := &statfsGuard{log: collector.Log{}.WithDefaults(), bad: map[string]time.Time{}}
+	if _, reason, err := g.Statfs("/"); err != nil || reason != "" {
+		t.Fatalf("/: got %q %v, expected to be read", reason, err)
+	}
+
+	g.bad["/mnt/nfs"] = time.Now()
+	if _, reason, _ := g.Statfs("/mnt/nfs"); reason != statfsCooling {
+		t.Errorf("mount in cool-down: got %q, expected %q", reason, statfsCooling)
+	}
+	g.bad["/mnt/nfs"] = time.Now().Add(-statfsCooldown)
+	if _, reason, _ := g.Statfs("/mnt/nfs"); reason == statfsCooling {
+		t.Errorf("mount after cool-down: still skipped")
+	}
+
+	g.pending = statfsMaxPending
+	if _, reason, _ := g.Statfs("/"); reason != statfsPending {
+		t.Errorf("too many pending calls: got %q, expected %q", reason, statfsPending)
+	}
+}
+
+const testMounts = `/dev/sda1 / ext4 rw,relatime 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+tmpfs /run tmpfs rw,nosuid,nodev,size=1607564k,mode=755 0 0
+/dev/sda1 /var/lib/docker/volumes ext4 rw,relatime 0 0
+/dev/sda1 /srv ext4 ro,relatime 0 0
+/dev/sdb2 /home btrfs rw,relatime,space_cache=v2,subvolid=257,subvol=/@home 0 0
+/dev/sdb2 /data btrfs rw,noatime,space_cache=v2,subvolid=5,subvol=/ 0 0
+/dev/sdb2 /var/log btrfs rw,relatime,space_cache=v2,subvolid=258,subvol=/@log 0 0
+overlay /var/lib/docker/overlay2/3f1c/merged overlay rw,relatime,lowerdir=/var/lib/docker/overlay2/l/ABC,upperdir=/var/lib/docker/overlay2/3f1c/diff,workdir=/var/lib/docker/overlay2/3f1c/work 0 0
+overlay /var/lib/docker/overlay2/9e2a/merged overlay rw,relatime,lowerdir=/var/lib/docker/overlay2/l/DEF,upperdir=/var/lib/docker/overlay2/9e2a/diff,workdir=/var/lib/docker/overlay2/9e2a/work 0 0
+overlay /mnt/app overlay rw,relatime,lowerdir=/var/lib/docker/overlay2/l/ABC,upperdir=/var/lib/docker/overlay2/3f1c/diff,workdir=/var/lib/docker/overlay2/3f1c/work 0 0
+`
+
+func TestDiskMounts(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mounts")
+	if err := os.WriteFile(filename, []byte(testMounts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readMounts(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// devices are identified by name, other filesystems by the device number of their mount point
+	ids := map[string]string{
+		"/var/lib/docker/overlay2/3f1c/merged": "0:51",
+		"/var/lib/docker/overlay2/9e2a/merged": "0:52",
+		"/mnt/app":                             "0:51", // bind mount of 3f1c
+	}
+	id := func(entry mountEntry) string {
+		if id, ok := ids[entry.mount]; ok {
+			return id
+		}
+		return entry.device
+	}
+
+	tests := []struct {
+		allMounts bool
+		mounts    []string
+	}{
+		{false, []string{"/", "/data", "/mnt/app", "/var/lib/docker/overlay2/9e2a/merged"}},
+		{true, []string{"/", "/data", "/home", "/mnt/app", "/srv", "/var/lib/docker/overlay2/3f1c/merged", "/var/lib/docker/overlay2/9e2a/merged", "/var/lib/docker/volumes", "/var/log"}},
+	}
+	for _, tt := range tests {
+		mounts := []string{}
+		fstypes := map[string]string{}
+		for _, mount := range diskMounts(entries, tt.allMounts, id) {
+			mounts = append(mounts, mount.mount)
+			fstypes[mount.mount] = mount.fstype
+		}
+		sort.Strings(mounts)
+		if fmt.Sprint(mounts) != fmt.Sprint(tt.mounts) {
+			t.Errorf("all mounts %v: got %v, expected %v", tt.allMounts, mounts, tt.mounts)
+		}
+		if fstypes["/data"] != "btrfs" || fstypes["/mnt/app"] != "overlay" {
+			t.Errorf("all mounts %v: got filesystem types %v", tt.allMounts, fstypes)
+		}
+	}
+}
+
+func TestUnescapeMount(t *testing.T) {
+	tests := []struct {
+		s, expected string
+	}{
+		{"/mnt/data", "/mnt/data"},
+		{`/mnt/my\040disk`, "/mnt/my disk"},
+		{`/mnt/tab\011name`, "/mnt/tab\tname"},
+		{`/mnt/new\012line`, "/mnt/new\nline"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`/mnt/two\040\040spaces`, "/mnt/two  spaces"},
+		{`/mnt/end\040`, "/mnt/end "},
+		{`\040start`, " start"},
+		{`/mnt/short\04`, `/mnt/short\04`},
+		{`/mnt/bad\089`, `/mnt/bad\089`},
+		{`/mnt/trailing\`, `/mnt/trailing\`},
+	}
+	for _, tt := range tests {
+		if s := unescapeMount(tt.s); s != tt.expected {
+			t.Errorf("%v: got %q, expected %q", tt.s, s, tt.expected)
+		}
+	}
+}
+
+func TestReadMounts(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mounts")
+	mounts := "/dev/sdc1 /media/USB\\040Stick vfat rw,nosuid,nodev,relatime 0 0\n" +
+		"//nas/share /mnt/nas\\011backup cifs ro,noexec 0 0\n" +
+		"/dev/sda1 / ext4 rw 0 0\n"
+	if err := os.WriteFile(filename, []byte(mounts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readMounts(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []mountEntry{
+		{"/dev/sdc1", "/media/USB Stick", "vfat", []string{"rw", "nosuid", "nodev", "relatime"}},
+		{"//nas/share", "/mnt/nas\tbackup", "cifs", []string{"ro", "noexec"}},
+		{"/dev/sda1", "/", "ext4", []string{"rw"}},
+	}
+	if fmt.Sprintf("%q", entries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("got %q, expected %q", entries, expected)
+	}
+	if options := entries[0].Options(); options != "nosuid,nodev" {
+		t.Errorf("got options %v, expected nosuid,nodev", options)
+	}
+
+	if err := os.WriteFile(filename, []byte("/dev/sda1 /\n"), 0o644); err != nil {
+		t.Fatal(err)
+	} else if _, err := readMounts(filename); err == nil {
+		t.Errorf("truncated line: expected error")
+	}
+}
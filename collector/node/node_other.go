@@ -0,0 +1,27 @@
+//go:build !linux
+
+package node
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// Collector reads the kernel statistics from procfs, which is only available on Linux.
+type Collector struct{}
+
+func New(opts Options, log collector.Log) (*Collector, error) {
+	return nil, fmt.Errorf("node: %w", collector.ErrNotSupported)
+}
+
+func (e *Collector) Close() error {
+	return nil
+}
+
+func (e *Collector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (e *Collector) Collect(ch chan<- prometheus.Metric) {
+}
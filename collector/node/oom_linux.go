@@ -0,0 +1,174 @@
+//go:build linux
+
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// oomKillRegexp matches the victim of the global and the memory cgroup OOM killer, for both older (Kill process) and newer (Killed process) kernels.
+var oomKillRegexp = regexp.MustCompile(`(?:Out of memory|Memory cgroup out of memory): Kill(?:ed)? process \d+ \((.*?)\)`)
+
+// OOM counts the processes killed by the OOM killer by following /dev/kmsg, starting at the end of the kernel ring buffer so that kills from before the exporter started are not counted. When /dev/kmsg is not readable, such as without CAP_SYSLOG or in containers, the oom_kill counter of /proc/vmstat is exported instead without process names.
+type OOM struct {
+	log  collector.Log
+	kmsg *os.File
+
+	mu   sync.Mutex
+	seq  uint64
+	err  error
+	done chan struct{}
+
+	desc  *prometheus.Desc
+	kills *prometheus.CounterVec
+}
+
+func NewOOM(opts OOMOptions, log collector.Log) (*OOM, error) {
+	e := &OOM{
+		log:  log.WithDefaults(),
+		done: make(chan struct{}),
+
+		desc: prometheus.NewDesc("node_oom_kills_total", "Total number of processes killed by the OOM killer.", []string{"process"}, nil),
+		kills: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_oom_kills_total",
+			Help: "Total number of processes killed by the OOM killer.",
+		}, []string{"process"}),
+	}
+
+	// the file is opened non-blocking by the os package, so that Close interrupts the reader
+	var err error
+	if e.kmsg, err = os.Open("/dev/kmsg"); err != nil {
+		e.log.Warning.Printf("oom: %v, falling back to the oom_kill counter of /proc/vmstat", err)
+		close(e.done)
+		if _, err := e.vmstatKills(); err != nil {
+			return nil, fmt.Errorf("oom: %w", err)
+		}
+		return e, nil
+	} else if _, err := e.kmsg.Seek(0, io.SeekEnd); err != nil {
+		e.kmsg.Close()
+		return nil, fmt.Errorf("oom: %w", err)
+	}
+	go e.run()
+	return e, nil
+}
+
+// Close stops following /dev/kmsg.
+func (e *OOM) Close() error {
+	if e.kmsg != nil {
+		e.kmsg.Close()
+	}
+	<-e.done
+	return nil
+}
+
+// Check opens /dev/kmsg, or reads /proc/vmstat when falling back.
+func (e *OOM) Check(ctx context.Context) error {
+	if e.kmsg == nil {
+		_, err := e.vmstatKills()
+		return err
+	}
+	f, err := os.Open("/dev/kmsg")
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (e *OOM) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.desc
+}
+
+func (e *OOM) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+// CollectContext returns an error when /dev/kmsg can no longer be read, the counters are still exported.
+func (e *OOM) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	if e.kmsg == nil {
+		kills, err := e.vmstatKills()
+		if err != nil {
+			return err
+		}
+		ch <- prometheus.MustNewConstMetric(e.desc, prometheus.CounterValue, float64(kills), "")
+		return nil
+	}
+	e.kills.Collect(ch)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+func (e *OOM) vmstatKills() (uint64, error) {
+	vmstat, err := readVMStat("/proc/vmstat", map[string]bool{"oom_kill": true}, e.log)
+	if err != nil {
+		return 0, err
+	} else if _, ok := vmstat["oom_kill"]; !ok {
+		return 0, fmt.Errorf("oom_kill not in /proc/vmstat")
+	}
+	return vmstat["oom_kill"], nil
+}
+
+// run reads a record from /dev/kmsg per read, until the file is closed.
+func (e *OOM) run() {
+	defer close(e.done)
+	b := make([]byte, 8192)
+	for {
+		n, err := e.kmsg.Read(b)
+		if errors.Is(err, syscall.EPIPE) {
+			// records were overwritten before they were read, the next read continues at the oldest record
+			e.log.Debug.Println("oom: kernel log overrun")
+			continue
+		} else if errors.Is(err, os.ErrClosed) {
+			return
+		} else if err != nil {
+			e.log.Error.Println("oom:", err)
+			e.mu.Lock()
+			e.err = fmt.Errorf("reading /dev/kmsg: %w", err)
+			e.mu.Unlock()
+			return
+		}
+		e.parseRecord(b[:n])
+	}
+}
+
+// parseRecord parses a record of the form "priority,sequence,timestamp,flags;message", followed by continuation lines. Records with a sequence number that was already seen are skipped, since reads continue at the oldest record after an overrun.
+func (e *OOM) parseRecord(b []byte) {
+	header, message, ok := bytes.Cut(b, []byte{';'})
+	if !ok {
+		return
+	}
+	fields := bytes.SplitN(header, []byte{','}, 4)
+	if len(fields) < 3 {
+		return
+	}
+	seq, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	if seq <= e.seq && e.seq != 0 {
+		e.mu.Unlock()
+		return
+	}
+	e.seq = seq
+	e.mu.Unlock()
+
+	message, _, _ = bytes.Cut(message, []byte{'\n'})
+	if m := oomKillRegexp.FindSubmatch(message); m != nil {
+		e.log.Warning.Printf("oom: killed process %s", m[1])
+		e.kills.WithLabelValues(string(m[1])).Inc()
+	}
+}
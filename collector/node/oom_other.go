@@ -0,0 +1,27 @@
+//go:build !linux
+
+package node
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// OOM follows the kernel log in /dev/kmsg, which is only available on Linux.
+type OOM struct{}
+
+func NewOOM(opts OOMOptions, log collector.Log) (*OOM, error) {
+	return nil, fmt.Errorf("oom: %w", collector.ErrNotSupported)
+}
+
+func (e *OOM) Close() error {
+	return nil
+}
+
+func (e *OOM) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (e *OOM) Collect(ch chan<- prometheus.Metric) {
+}
@@ -0,0 +1,878 @@
+// Package redis collects the INFO statistics of Redis servers and of its forks Valkey and KeyDB, with support for Redis Sentinel and Redis Cluster.
+package redis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+const redisSentinelCacheTTL = 10 * time.Second
+const redisClusterWorkers = 4
+const redisClusterTimeout = 2 * time.Second
+
+type Options struct {
+	URI         string  `desc:"A URI or unix socket path for connecting to the Redis server."`
+	SentinelURI string  `desc:"A URI or unix socket path for connecting to Redis Sentinel, which is asked for the current master address before scraping."`
+	MasterName  string  `desc:"Name of the master monitored by Redis Sentinel."`
+	Cluster     bool    `desc:"Discover all nodes of a Redis Cluster through the URI and scrape each of them."`
+	TLSCA       string  `desc:"Path to CA certificate to verify the server certificate of rediss:// URIs."`
+	TLSInsecure bool    `desc:"Skip verification of the server certificate of rediss:// URIs."`
+	Timeout     float64 `desc:"Seconds to wait for connecting and for each command to be written and replied."`
+
+	ResolveInterval float64 `name:"resolve-interval" desc:"Seconds between resolving the hostname of the URI again while connected, reconnecting when its address changed. It is always resolved again when reconnecting. Zero disables."`
+
+	CountPrefix   []string `name:"count-prefix" desc:"Key prefix whose keys are counted with SCAN as prefix or prefix=name, can be repeated (e.g. cache:sessions:=sessions)."`
+	CountInterval float64  `name:"count-interval" desc:"Seconds between counting the keys of the prefixes in the background, scrapes return the last count."`
+	CountBudget   float64  `name:"count-budget" desc:"Seconds that counting the keys of all prefixes may take, after which it is aborted and the counts of the prefix being scanned and the remaining prefixes are partial."`
+	ScanOnReplica bool     `name:"scan-on-replica" desc:"Count the keys of the prefixes on the replica of --redis.replica-uri instead of on the scraped server."`
+	ReplicaURI    string   `name:"replica-uri" desc:"A URI or unix socket path of a replica for --redis.scan-on-replica."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+// redisParseURI parses Redis URIs including the redis:// and rediss:// schemes, the latter requiring TLS.
+func redisParseURI(uri string) (string, string, bool, error) {
+	useTLS := false
+	if strings.HasPrefix(uri, "rediss://") {
+		uri = "tcp://" + uri[9:]
+		useTLS = true
+	} else if strings.HasPrefix(uri, "redis://") {
+		uri = "tcp://" + uri[8:]
+	}
+	scheme, host, err := collector.ParseURI(uri)
+	return scheme, host, useTLS, err
+}
+
+type Collector struct {
+	log         collector.Log
+	client      redigo.Conn
+	clientAddr  string
+	dialOptions []redigo.DialOption
+	timeout     time.Duration
+	resolver    *collector.HostResolver
+	counters    *collector.CounterTracker
+	breaker     *collector.Breaker
+
+	sentinel     redigo.Conn
+	masterName   string
+	masterAddr   string
+	masterUpdate time.Time
+
+	cluster      bool
+	clusterNodes map[string]redigo.Conn
+	rediscover   bool
+
+	// keys are counted per prefix with SCAN in the background, on the replica if set
+	prefixes      []redisPrefix
+	countInterval time.Duration
+	countBudget   time.Duration
+	countCancel   context.CancelFunc
+	countDone     chan struct{}
+	scanURI       string      // of the replica or the server, empty to scan the master of Sentinel
+	scanner       redigo.Conn // only used by the counting goroutine
+	scannerAddr   string
+	countMu       sync.Mutex
+	counts        map[string]redisPrefixCount // by name
+	master        string                      // address of the master of Sentinel
+
+	up        prometheus.Gauge
+	mem       *prometheus.GaugeVec
+	key       *prometheus.CounterVec
+	role      *prometheus.GaugeVec
+	info      *prometheus.GaugeVec
+	threads   *prometheus.GaugeVec
+	threadOps *prometheus.CounterVec
+	ping      *prometheus.GaugeVec
+	latency   *prometheus.GaugeVec
+	failovers prometheus.Counter
+
+	clusterState      prometheus.Gauge
+	clusterSlots      prometheus.Gauge
+	clusterKnownNodes prometheus.Gauge
+
+	prefixKeys    *prometheus.GaugeVec
+	prefixPartial *prometheus.GaugeVec
+}
+
+func New(opts Options, log collector.Log) (*Collector, error) {
+	log = log.WithDefaults()
+	labels := []string{}
+	if opts.Cluster {
+		labels = append(labels, "node")
+	}
+	e := &Collector{
+		log:          log,
+		resolver:     collector.NewHostResolver(time.Duration(opts.ResolveInterval * float64(time.Second))),
+		counters:     collector.NewCounterTracker(),
+		breaker:      collector.NewBreaker("redis", log),
+		masterName:   opts.MasterName,
+		cluster:      opts.Cluster,
+		clusterNodes: map[string]redigo.Conn{},
+		rediscover:   true,
+
+		prefixes:      parsePrefixes(opts.CountPrefix),
+		countInterval: time.Duration(opts.CountInterval * float64(time.Second)),
+		countBudget:   time.Duration(opts.CountBudget * float64(time.Second)),
+
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "redis_up",
+			Help: "Redis server is reachable, in cluster mode any of its nodes.",
+		}),
+		mem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "redis_mem_bytes",
+			Help: "Memory size in bytes.",
+		}, append([]string{"type"}, labels...)),
+		key: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redis_key_total",
+			Help: "Key hits or misses.",
+		}, append([]string{"type"}, labels...)),
+		role: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "redis_role",
+			Help: "Replication role of the scraped instance.",
+		}, append([]string{"role"}, labels...)),
+		info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "redis_info",
+			Help: "Server flavor (redis, valkey or keydb) and version of the scraped instance.",
+		}, append([]string{"flavor", "version"}, labels...)),
+		threads: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "redis_server_threads",
+			Help: "Number of worker threads of a KeyDB server.",
+		}, labels),
+		threadOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redis_thread_ops_total",
+			Help: "Reads or writes handled per I/O thread, for servers that report them in the Threads section.",
+		}, append([]string{"thread", "type"}, labels...)),
+		ping: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "redis_ping_duration_seconds",
+			Help: "Round-trip time of a PING at the start of the scrape in seconds.",
+		}, labels),
+		latency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "redis_latency_spike_seconds",
+			Help: "Latency of the most recent spike per event in seconds, from LATENCY LATEST when the latency monitor is enabled.",
+		}, append([]string{"event"}, labels...)),
+		failovers: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "redis_failovers_total",
+			Help: "Number of times the master address resolved by Redis Sentinel changed.",
+		}),
+		clusterState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "redis_cluster_state",
+			Help: "Redis Cluster state is ok.",
+		}),
+		clusterSlots: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "redis_cluster_slots_assigned",
+			Help: "Number of slots assigned to nodes in the Redis Cluster.",
+		}),
+		clusterKnownNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "redis_cluster_known_nodes",
+			Help: "Number of nodes known to the Redis Cluster.",
+		}),
+		prefixKeys: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "redis_prefix_keys",
+			Help: "Number of keys starting with the prefix as counted by SCAN at the last count, which is approximate.",
+		}, []string{"prefix"}),
+		prefixPartial: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "redis_prefix_keys_partial",
+			Help: "Whether the last count of the keys of the prefix was aborted for exceeding the time budget of counting, so that it's too low.",
+		}, []string{"prefix"}),
+	}
+	if opts.Cluster && opts.SentinelURI != "" {
+		return nil, fmt.Errorf("redis: cluster mode can not be used with Sentinel")
+	} else if opts.Cluster && 0 < len(opts.CountPrefix) {
+		return nil, fmt.Errorf("redis: counting keys per prefix can not be used in cluster mode")
+	} else if opts.ScanOnReplica && opts.ReplicaURI == "" {
+		return nil, fmt.Errorf("redis: --redis.scan-on-replica requires --redis.replica-uri")
+	} else if 0 < len(opts.CountPrefix) && opts.CountBudget <= 0.0 {
+		return nil, fmt.Errorf("redis: --redis.count-budget must be positive")
+	} else if 0 < len(opts.CountPrefix) && opts.CountInterval <= 0.0 {
+		return nil, fmt.Errorf("redis: --redis.count-interval must be positive")
+	}
+	if opts.ScanOnReplica {
+		e.scanURI = opts.ReplicaURI
+	} else if opts.SentinelURI == "" {
+		e.scanURI = opts.URI
+	}
+	if 0.0 < opts.Timeout {
+		timeout := time.Duration(opts.Timeout * float64(time.Second))
+		e.timeout = timeout
+		e.dialOptions = append(e.dialOptions,
+			redigo.DialConnectTimeout(timeout),
+			redigo.DialReadTimeout(timeout),
+			redigo.DialWriteTimeout(timeout))
+	}
+
+	if opts.SentinelURI != "" {
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("redis: master name must be set when using Sentinel")
+		}
+		scheme, host, useTLS, err := redisParseURI(opts.SentinelURI)
+		if err != nil {
+			return nil, err
+		} else if err := e.setTLS(useTLS, opts); err != nil {
+			return nil, err
+		}
+		e.sentinel, err = e.dial(scheme, host)
+		if err != nil {
+			return nil, fmt.Errorf("redis sentinel: %w", err)
+		}
+		if _, err := e.resolveMaster(); err != nil {
+			e.sentinel.Close()
+			return nil, err
+		}
+	} else {
+		scheme, host, useTLS, err := redisParseURI(opts.URI)
+		if err != nil {
+			return nil, err
+		} else if err := e.setTLS(useTLS, opts); err != nil {
+			return nil, err
+		}
+		resolved := host
+		if scheme != "unix" {
+			if resolved, _, err = e.resolver.Resolve(context.Background(), host, host); err != nil {
+				return nil, fmt.Errorf("redis: %w", err)
+			}
+		}
+		e.client, err = e.dialResolved(scheme, host, resolved)
+		if err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		e.clientAddr = opts.URI
+	}
+	if e.cluster {
+		e.updateClusterStats()
+	} else {
+		e.updateStats()
+	}
+	if 0 < len(e.prefixes) {
+		e.startCounting()
+	}
+	return e, nil
+}
+
+func (e *Collector) setTLS(useTLS bool, opts Options) error {
+	if !useTLS {
+		return nil
+	}
+	config, err := collector.NewTLSConfig(opts.TLSCA, opts.TLSInsecure)
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	e.dialOptions = append(e.dialOptions, redigo.DialUseTLS(true), redigo.DialTLSConfig(config))
+	return nil
+}
+
+func (e *Collector) dial(network, addr string, options ...redigo.DialOption) (redigo.Conn, error) {
+	return redigo.Dial(network, addr, append(options, e.dialOptions...)...)
+}
+
+// dialResolved dials the resolved address of a hostname, while TLS verifies the server certificate against the hostname.
+func (e *Collector) dialResolved(network, addr, resolved string) (redigo.Conn, error) {
+	if resolved == addr {
+		return e.dial(network, addr)
+	}
+	d := net.Dialer{
+		Timeout:   e.timeout,
+		KeepAlive: 5 * time.Minute,
+	}
+	if d.Timeout == 0 {
+		d.Timeout = 30 * time.Second
+	}
+	return e.dial(network, addr, redigo.DialContextFunc(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, network, resolved)
+	}))
+}
+
+func (e *Collector) Close() error {
+	if e.countCancel != nil {
+		e.countCancel()
+		<-e.countDone
+	}
+	if e.scanner != nil {
+		e.scanner.Close()
+	}
+	if e.sentinel != nil {
+		e.sentinel.Close()
+	}
+	for _, conn := range e.clusterNodes {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	if e.client == nil {
+		return nil
+	}
+	return e.client.Close()
+}
+
+// Check sends a PING to the Redis server.
+func (e *Collector) Check(ctx context.Context) error {
+	if err := e.connect(); err != nil {
+		return err
+	}
+	_, err := redigo.DoContext(e.client, ctx, "PING")
+	return err
+}
+
+// Backoff returns the remaining cool-down after consecutive failures to reach Redis.
+func (e *Collector) Backoff() time.Duration {
+	return e.breaker.Backoff()
+}
+
+// ResolvedIPs returns the IP address that the hostname of the URI resolved to when last connecting.
+func (e *Collector) ResolvedIPs() map[string]string {
+	return e.resolver.ResolvedIPs()
+}
+
+func (e *Collector) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+	e.mem.Describe(ch)
+	e.key.Describe(ch)
+	e.role.Describe(ch)
+	e.info.Describe(ch)
+	e.threads.Describe(ch)
+	e.threadOps.Describe(ch)
+	e.ping.Describe(ch)
+	e.latency.Describe(ch)
+	if e.sentinel != nil {
+		e.failovers.Describe(ch)
+	}
+	if e.cluster {
+		e.clusterState.Describe(ch)
+		e.clusterSlots.Describe(ch)
+		e.clusterKnownNodes.Describe(ch)
+	}
+	if 0 < len(e.prefixes) {
+		e.prefixKeys.Describe(ch)
+		e.prefixPartial.Describe(ch)
+	}
+}
+
+func (e *Collector) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Collector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	var stats map[string]redisStats
+	err := e.breaker.Allow()
+	if err != nil {
+		err = fmt.Errorf("redis: %w", err)
+		e.log.Debug.Println(err)
+	} else {
+		if e.cluster {
+			stats, err = e.updateClusterStats()
+		} else {
+			var stat redisStats
+			if stat, err = e.updateStats(); err == nil {
+				stats = map[string]redisStats{"": stat}
+			}
+		}
+		if err != nil {
+			e.log.Error.Println(err)
+		}
+
+		// unreachable cluster nodes don't count as failures while others are reachable
+		if 0 < len(stats) {
+			e.breaker.Done(nil)
+		} else {
+			e.breaker.Done(err)
+		}
+	}
+	e.up.Set(0.0)
+	if 0 < len(stats) {
+		e.up.Set(1.0)
+	}
+	e.up.Collect(ch)
+	if stats != nil {
+		e.mem.Reset()
+		e.role.Reset()
+		e.info.Reset()
+		e.threads.Reset()
+		e.ping.Reset()
+		e.latency.Reset()
+		for node, stat := range stats {
+			e.mem.WithLabelValues(e.labels("used", node)...).Set(float64(stat.MemoryUsed))
+			e.mem.WithLabelValues(e.labels("total", node)...).Set(float64(stat.MemoryTotal))
+			e.key.WithLabelValues(e.labels("hits", node)...).Add(float64(stat.KeyHits))
+			e.key.WithLabelValues(e.labels("misses", node)...).Add(float64(stat.KeyMisses))
+			e.role.WithLabelValues(e.labels(stat.Role, node)...).Set(1.0)
+			e.info.WithLabelValues(append([]string{stat.Flavor}, e.labels(stat.Version, node)...)...).Set(1.0)
+			for thread, ops := range stat.ThreadOps {
+				e.threadOps.WithLabelValues(append([]string{thread}, e.labels("reads", node)...)...).Add(float64(ops.Reads))
+				e.threadOps.WithLabelValues(append([]string{thread}, e.labels("writes", node)...)...).Add(float64(ops.Writes))
+			}
+			nodeLabels := []string{}
+			if e.cluster {
+				nodeLabels = append(nodeLabels, node)
+			}
+			e.ping.WithLabelValues(nodeLabels...).Set(stat.Ping.Seconds())
+			if stat.Threads != 0 {
+				e.threads.WithLabelValues(nodeLabels...).Set(float64(stat.Threads))
+			}
+			for event, latency := range stat.Latency {
+				e.latency.WithLabelValues(e.labels(event, node)...).Set(latency.Seconds())
+			}
+		}
+		e.mem.Collect(ch)
+		e.key.Collect(ch)
+		e.role.Collect(ch)
+		e.info.Collect(ch)
+		e.threads.Collect(ch)
+		e.threadOps.Collect(ch)
+		e.ping.Collect(ch)
+		e.latency.Collect(ch)
+	}
+	if e.sentinel != nil {
+		e.failovers.Collect(ch)
+	}
+	if e.cluster {
+		e.clusterState.Collect(ch)
+		e.clusterSlots.Collect(ch)
+		e.clusterKnownNodes.Collect(ch)
+	}
+	if 0 < len(e.prefixes) {
+		e.countMu.Lock()
+		counts := e.counts
+		e.countMu.Unlock()
+
+		e.prefixKeys.Reset()
+		e.prefixPartial.Reset()
+		for name, count := range counts {
+			e.prefixKeys.WithLabelValues(name).Set(float64(count.keys))
+			partial := 0.0
+			if count.partial {
+				partial = 1.0
+			}
+			e.prefixPartial.WithLabelValues(name).Set(partial)
+		}
+		e.prefixKeys.Collect(ch)
+		e.prefixPartial.Collect(ch)
+	}
+	e.log.Debug.Println("collect duration for redis:", time.Since(t))
+	return err
+}
+
+func (e *Collector) labels(label, node string) []string {
+	if e.cluster {
+		return []string{label, node}
+	}
+	return []string{label}
+}
+
+// resolveMaster asks Sentinel for the current master address, which is cached for a short while. A connection to the new master is made when its address changed.
+func (e *Collector) resolveMaster() (string, error) {
+	if e.masterAddr != "" && time.Since(e.masterUpdate) < redisSentinelCacheTTL {
+		return e.masterAddr, nil
+	}
+
+	reply, err := redigo.Strings(e.sentinel.Do("SENTINEL", "get-master-addr-by-name", e.masterName))
+	if err != nil {
+		return "", fmt.Errorf("redis sentinel: %w", err)
+	} else if len(reply) != 2 {
+		return "", fmt.Errorf("redis sentinel: unknown master %v", e.masterName)
+	}
+	addr := net.JoinHostPort(reply[0], reply[1])
+	if addr != e.masterAddr {
+		if e.masterAddr != "" {
+			e.log.Info.Printf("redis sentinel: master %v changed from %v to %v", e.masterName, e.masterAddr, addr)
+			e.failovers.Inc()
+		}
+		e.masterAddr = addr
+	}
+	e.masterUpdate = time.Now()
+	return addr, nil
+}
+
+func (e *Collector) connect() error {
+	if e.sentinel == nil {
+		scheme, host, _, _ := redisParseURI(e.clientAddr)
+		healthy := e.client.Err() == nil
+		resolved := host
+		if scheme != "unix" && (!healthy || e.resolver.Due(host)) {
+			var changed bool
+			var err error
+			if resolved, changed, err = e.resolver.Resolve(context.Background(), host, host); err != nil {
+				if healthy {
+					e.log.Debug.Println("redis:", err)
+					return nil // keep the working connection
+				}
+				return err
+			} else if changed {
+				e.log.Info.Printf("redis: %v resolves to %v now, reconnecting", host, resolved)
+			} else if healthy {
+				return nil
+			}
+		} else if healthy {
+			return nil
+		}
+
+		// the connection broke, such as when Redis restarted, or the hostname resolves to another address, such as after a DNS failover
+		client, err := e.dialResolved(scheme, host, resolved)
+		if err != nil {
+			return err
+		}
+		e.client.Close()
+		e.client = client
+		return nil
+	}
+
+	addr, err := e.resolveMaster()
+	if err != nil {
+		return err
+	} else if e.client != nil && e.clientAddr == addr {
+		return nil
+	} else if e.client != nil {
+		e.client.Close()
+		e.client = nil
+	}
+
+	client, err := e.dial("tcp", addr)
+	if err != nil {
+		e.masterUpdate = time.Time{} // ask Sentinel again next time
+		return err
+	}
+	e.client = client
+	e.clientAddr = addr
+	e.countMu.Lock()
+	e.master = addr
+	e.countMu.Unlock()
+	return nil
+}
+
+type redisStats struct {
+	Role        string
+	Flavor      string
+	Version     string
+	Threads     uint64 // zero if not reported
+	ThreadOps   map[string]redisThreadOps
+	MemoryUsed  uint64
+	MemoryTotal uint64
+	KeyHits     uint64
+	KeyMisses   uint64
+	Ping        time.Duration
+	Latency     map[string]time.Duration // most recent spike per event
+}
+
+func (e *Collector) updateStats() (redisStats, error) {
+	if err := e.connect(); err != nil {
+		return redisStats{}, err
+	}
+
+	cur, err := e.readInfo(e.client)
+	if err != nil {
+		if e.sentinel != nil {
+			e.masterUpdate = time.Time{}
+		}
+		return redisStats{}, err
+	}
+	return e.diffStats(e.clientAddr, cur), nil
+}
+
+// diffStats returns the difference with the previous stats of the instance. Baselines are kept per instance so that a failover doesn't produce bogus differences.
+func (e *Collector) diffStats(addr string, cur redisStats) redisStats {
+	diff := cur
+	diff.KeyHits, _ = e.counters.Delta(cur.KeyHits, addr, "hits")
+	diff.KeyMisses, _ = e.counters.Delta(cur.KeyMisses, addr, "misses")
+	diff.ThreadOps = map[string]redisThreadOps{}
+	for thread, ops := range cur.ThreadOps {
+		reads, _ := e.counters.Delta(ops.Reads, addr, "thread", thread, "reads")
+		writes, _ := e.counters.Delta(ops.Writes, addr, "thread", thread, "writes")
+		diff.ThreadOps[thread] = redisThreadOps{reads, writes}
+	}
+	return diff
+}
+
+type redisThreadOps struct {
+	Reads  uint64
+	Writes uint64
+}
+
+// readInfo times a PING and reads INFO ALL and LATENCY LATEST.
+func (e *Collector) readInfo(conn redigo.Conn) (redisStats, error) {
+	t := time.Now()
+	if _, err := conn.Do("PING"); err != nil {
+		return redisStats{}, err
+	}
+	cur := redisStats{
+		Ping: time.Since(t),
+	}
+
+	reply, err := conn.Do("INFO", "ALL")
+	if err != nil {
+		return redisStats{}, err
+	}
+
+	info, ok := reply.([]byte)
+	if !ok {
+		return redisStats{}, fmt.Errorf("redis: reply to INFO ALL is not a []byte")
+	}
+
+	// the flavor is detected from fields that only Valkey and KeyDB add, which otherwise report a compatible redis_version
+	section := ""
+	server := map[string]string{}
+	cur.ThreadOps = map[string]redisThreadOps{}
+	for _, line := range strings.Split(string(info), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			section = strings.TrimSpace(line[1:])
+			if section == "KeyDB" {
+				server["keydb"] = "1"
+			}
+			continue
+		}
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+
+		key, val := split[0], split[1]
+		if section == "Server" {
+			server[key] = val
+		} else if section == "Threads" {
+			if ops, ok := redisParseThreadOps(val); ok {
+				cur.ThreadOps[key] = ops
+			}
+			continue
+		}
+		switch key {
+		case "role":
+			cur.Role = val
+		case "used_memory":
+			cur.MemoryUsed, _ = redisParseUint64(val)
+		case "maxmemory":
+			cur.MemoryTotal, _ = redisParseUint64(val)
+		case "keyspace_hits":
+			cur.KeyHits, _ = redisParseUint64(val)
+		case "keyspace_misses":
+			cur.KeyMisses, _ = redisParseUint64(val)
+		case "server_threads":
+			cur.Threads, _ = redisParseUint64(val)
+			server["keydb"] = "1"
+		}
+	}
+
+	cur.Flavor, cur.Version = "redis", server["redis_version"]
+	if name := server["server_name"]; name != "" {
+		cur.Flavor = strings.ToLower(name)
+	} else if server["valkey_version"] != "" {
+		cur.Flavor = "valkey"
+	} else if server["keydb"] != "" {
+		cur.Flavor = "keydb"
+	}
+	if version := server[cur.Flavor+"_version"]; version != "" {
+		cur.Version = version
+	}
+
+	cur.Latency, err = redisLatencyLatest(conn)
+	if err != nil {
+		// the latency monitor is not supported or the command is renamed
+		e.log.Debug.Println("redis: LATENCY LATEST:", err)
+	}
+	return cur, nil
+}
+
+// redisLatencyLatest parses the reply of LATENCY LATEST, an array of event name, timestamp, latest and maximum latency in milliseconds per event. The array is empty when the latency monitor is disabled.
+func redisLatencyLatest(conn redigo.Conn) (map[string]time.Duration, error) {
+	events, err := redigo.Values(conn.Do("LATENCY", "LATEST"))
+	if err != nil {
+		return nil, err
+	}
+	latency := map[string]time.Duration{}
+	for _, event := range events {
+		fields, err := redigo.Values(event, nil)
+		if err != nil || len(fields) < 3 {
+			continue
+		}
+		name, err := redigo.String(fields[0], nil)
+		if err != nil {
+			continue
+		}
+		ms, err := redigo.Int64(fields[2], nil)
+		if err != nil {
+			continue
+		}
+		latency[name] = time.Duration(ms) * time.Millisecond
+	}
+	return latency, nil
+}
+
+// discoverClusterNodes lists all masters and replicas of the cluster and connects to new nodes.
+func (e *Collector) discoverClusterNodes() error {
+	reply, err := redigo.String(e.client.Do("CLUSTER", "NODES"))
+	if err != nil {
+		return fmt.Errorf("redis cluster: %w", err)
+	}
+
+	addrs := map[string]bool{}
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		flags := "," + fields[2] + ","
+		if strings.Contains(flags, ",noaddr,") || strings.Contains(flags, ",handshake,") {
+			continue
+		} else if !strings.Contains(flags, ",master,") && !strings.Contains(flags, ",slave,") {
+			continue
+		}
+		addr := fields[1]
+		if at := strings.IndexAny(addr, "@,"); at != -1 {
+			addr = addr[:at]
+		}
+		addrs[addr] = true
+	}
+
+	for addr, conn := range e.clusterNodes {
+		if !addrs[addr] {
+			if conn != nil {
+				conn.Close()
+			}
+			delete(e.clusterNodes, addr)
+			e.counters.Forget(addr)
+		}
+	}
+	for addr := range addrs {
+		if _, ok := e.clusterNodes[addr]; !ok {
+			e.clusterNodes[addr] = nil // connect lazily
+		}
+	}
+	e.rediscover = false
+	return nil
+}
+
+func (e *Collector) updateClusterInfo() error {
+	reply, err := redigo.String(e.client.Do("CLUSTER", "INFO"))
+	if err != nil {
+		return fmt.Errorf("redis cluster: %w", err)
+	}
+	for _, line := range strings.Split(reply, "\n") {
+		split := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+		key, val := split[0], split[1]
+		switch key {
+		case "cluster_state":
+			state := 0.0
+			if val == "ok" {
+				state = 1.0
+			}
+			e.clusterState.Set(state)
+		case "cluster_slots_assigned":
+			if n, ok := redisParseUint64(val); ok {
+				e.clusterSlots.Set(float64(n))
+			}
+		case "cluster_known_nodes":
+			if n, ok := redisParseUint64(val); ok {
+				e.clusterKnownNodes.Set(float64(n))
+			}
+		}
+	}
+	return nil
+}
+
+// updateClusterStats scrapes all cluster nodes concurrently using a bounded number of workers.
+func (e *Collector) updateClusterStats() (map[string]redisStats, error) {
+	if err := e.connect(); err != nil {
+		return nil, err
+	} else if err := e.updateClusterInfo(); err != nil {
+		return nil, err
+	}
+	if e.rediscover {
+		if err := e.discoverClusterNodes(); err != nil {
+			return nil, err
+		}
+	}
+
+	type result struct {
+		addr  string
+		conn  redigo.Conn
+		stats redisStats
+		err   error
+	}
+
+	jobs := make(chan string)
+	results := make(chan result, len(e.clusterNodes))
+	wg := sync.WaitGroup{}
+	for i := 0; i < redisClusterWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr := range jobs {
+				var err error
+				conn := e.clusterNodes[addr]
+				if conn == nil {
+					conn, err = e.dial("tcp", addr,
+						redigo.DialConnectTimeout(redisClusterTimeout),
+						redigo.DialReadTimeout(redisClusterTimeout),
+						redigo.DialWriteTimeout(redisClusterTimeout))
+					if err != nil {
+						results <- result{addr: addr, err: err}
+						continue
+					}
+				}
+				stats, err := e.readInfo(conn)
+				if err != nil {
+					conn.Close()
+					conn = nil
+				}
+				results <- result{addr, conn, stats, err}
+			}
+		}()
+	}
+	for addr := range e.clusterNodes {
+		jobs <- addr
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	var firstErr error
+	stats := map[string]redisStats{}
+	for r := range results {
+		e.clusterNodes[r.addr] = r.conn
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("redis cluster node %v: %w", r.addr, r.err)
+			}
+			e.rediscover = true
+			continue
+		}
+		stats[r.addr] = e.diffStats(r.addr, r.stats)
+	}
+	return stats, firstErr
+}
+
+// redisParseUint64 parses an integer field. Fields in other formats, such as "1.5M" used by KeyDB, are skipped.
+func redisParseUint64(val string) (uint64, bool) {
+	n, err := strconv.ParseUint(val, 10, 64)
+	return n, err == nil
+}
+
+// redisParseThreadOps parses the reads and writes of a thread in the Threads section, such as "clients=3,reads=120,writes=118".
+func redisParseThreadOps(val string) (redisThreadOps, bool) {
+	ops := redisThreadOps{}
+	found := 0
+	for _, field := range strings.Split(val, ",") {
+		key, val, _ := strings.Cut(field, "=")
+		n, ok := redisParseUint64(val)
+		if !ok {
+			continue
+		} else if key == "reads" {
+			ops.Reads = n
+			found++
+		} else if key == "writes" {
+			ops.Writes = n
+			found++
+		}
+	}
+	return ops, found == 2
+}
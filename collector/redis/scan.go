@@ -0,0 +1,162 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// redisScanCount is the number of keys that SCAN inspects per call, which is a hint to Redis.
+const redisScanCount = 1000
+
+type redisPrefix struct {
+	prefix string
+	name   string
+}
+
+type redisPrefixCount struct {
+	keys    uint64
+	partial bool
+}
+
+// parsePrefixes parses prefixes with an optional name as prefix=name, the name defaults to the prefix.
+func parsePrefixes(prefixes []string) []redisPrefix {
+	list := []redisPrefix{}
+	for _, prefix := range prefixes {
+		prefix, name := collector.SplitAlias(prefix)
+		if name == "" {
+			name = prefix
+		}
+		list = append(list, redisPrefix{prefix, name})
+	}
+	return list
+}
+
+// escapeGlob escapes the characters that are special in the glob pattern of SCAN MATCH.
+func escapeGlob(s string) string {
+	sb := strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// startCounting counts the keys of the prefixes in the background right away and after every interval, until the collector is closed.
+func (e *Collector) startCounting() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.countCancel = cancel
+	e.countDone = make(chan struct{})
+	go func() {
+		defer close(e.countDone)
+		ticker := time.NewTicker(e.countInterval)
+		defer ticker.Stop()
+		for {
+			if err := e.countPrefixes(ctx); err != nil && ctx.Err() == nil {
+				e.log.Error.Println(err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// scanConn returns the connection to scan on, which is the replica with --redis.scan-on-replica and otherwise the scraped server. It is separate from the connection of the scrapes, since counting runs concurrently.
+func (e *Collector) scanConn() (redigo.Conn, error) {
+	network, addr := "tcp", ""
+	if e.scanURI != "" {
+		scheme, host, _, err := redisParseURI(e.scanURI)
+		if err != nil {
+			return nil, err
+		}
+		network, addr = scheme, host
+	} else {
+		e.countMu.Lock()
+		addr = e.master
+		e.countMu.Unlock()
+		if addr == "" {
+			return nil, fmt.Errorf("master %v is not yet known", e.masterName)
+		}
+	}
+
+	if e.scanner != nil && e.scannerAddr == addr && e.scanner.Err() == nil {
+		return e.scanner, nil
+	} else if e.scanner != nil {
+		e.scanner.Close() // the connection broke, such as when Redis restarted, or the master changed
+		e.scanner = nil
+	}
+	conn, err := e.dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	e.scanner, e.scannerAddr = conn, addr
+	return conn, nil
+}
+
+// countPrefixes counts the keys of each prefix with SCAN. Counting is aborted when it takes longer than the budget, after which the counts of the prefix being scanned and of the remaining prefixes are partial, so that counting never occupies Redis for long.
+func (e *Collector) countPrefixes(ctx context.Context) error {
+	conn, err := e.scanConn()
+	if err != nil {
+		return fmt.Errorf("redis count: %w", err)
+	}
+	deadline := time.Now().Add(e.countBudget)
+	counts := make(map[string]redisPrefixCount, len(e.prefixes))
+	partial := []string{}
+	for _, prefix := range e.prefixes {
+		count := redisPrefixCount{partial: true}
+		if time.Now().Before(deadline) {
+			if count, err = scanPrefix(ctx, conn, prefix.prefix, deadline); err != nil {
+				return fmt.Errorf("redis count %v: %w", prefix.name, err)
+			}
+		}
+		if count.partial {
+			partial = append(partial, prefix.name)
+		}
+		counts[prefix.name] = count
+	}
+	if 0 < len(partial) {
+		e.log.Warning.Printf("redis count: counting exceeded the budget of %v, the counts of %v are partial", e.countBudget, strings.Join(partial, ", "))
+	}
+
+	e.countMu.Lock()
+	e.counts = counts
+	e.countMu.Unlock()
+	return nil
+}
+
+// scanPrefix returns the number of keys starting with prefix, which is partial if the deadline passed before the scan finished. SCAN may return a key more than once if the keyspace is rehashed during the scan, so the count is approximate.
+func scanPrefix(ctx context.Context, conn redigo.Conn, prefix string, deadline time.Time) (redisPrefixCount, error) {
+	count := redisPrefixCount{}
+	cursor := "0"
+	for {
+		reply, err := redigo.Values(redigo.DoContext(conn, ctx, "SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", redisScanCount))
+		if err != nil {
+			return redisPrefixCount{}, err
+		} else if len(reply) != 2 {
+			return redisPrefixCount{}, fmt.Errorf("unexpected reply to SCAN of length %d", len(reply))
+		}
+		if cursor, err = redigo.String(reply[0], nil); err != nil {
+			return redisPrefixCount{}, err
+		}
+		keys, err := redigo.Values(reply[1], nil)
+		if err != nil {
+			return redisPrefixCount{}, err
+		}
+		count.keys += uint64(len(keys))
+		if cursor == "0" {
+			return count, nil
+		} else if time.Now().After(deadline) {
+			count.partial = true
+			return count, nil
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// fakeScanServer replies to SCAN with one key per call after a delay. Each scan finishes after the given number of calls, or never if zero.
+func fakeScanServer(t *testing.T, delay time.Duration, calls int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for n := 1; ; n++ {
+					// read an array of bulk strings
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					args, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					for i := 0; i < 2*args; i++ {
+						if _, err := r.ReadString('\n'); err != nil {
+							return
+						}
+					}
+
+					time.Sleep(delay)
+					cursor := strconv.Itoa(n)
+					if n == calls {
+						cursor = "0"
+						n = 0 // the next scan starts
+					}
+					fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n*1\r\n$3\r\nkey\r\n", len(cursor), cursor)
+				}
+			}()
+		}
+	}()
+	return "redis://" + ln.Addr().String()
+}
+
+func TestCountPrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		calls   int
+		budget  time.Duration
+		keys    []uint64
+		partial []bool
+	}{
+		{"within budget", 3, time.Second, []uint64{3, 3, 3}, []bool{false, false, false}},
+		{"exceeds budget", 0, 50 * time.Millisecond, []uint64{0, 0, 0}, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Collector{
+				log:         collector.Log{}.WithDefaults(),
+				prefixes:    parsePrefixes([]string{"a:", "b:", "c:"}),
+				countBudget: tt.budget,
+				scanURI:     fakeScanServer(t, 10*time.Millisecond, tt.calls),
+			}
+			defer func() {
+				if e.scanner != nil {
+					e.scanner.Close()
+				}
+			}()
+
+			t0 := time.Now()
+			if err := e.countPrefixes(context.Background()); err != nil {
+				t.Fatal(err)
+			} else if 2*tt.budget < time.Since(t0) {
+				t.Errorf("counting took %v, exceeding the budget of %v", time.Since(t0), tt.budget)
+			}
+			for i, prefix := range e.prefixes {
+				count := e.counts[prefix.name]
+				if 0 < tt.keys[i] && count.keys != tt.keys[i] {
+					t.Errorf("%v: got %d keys, expected %d", prefix.name, count.keys, tt.keys[i])
+				}
+				if count.partial != tt.partial[i] {
+					t.Errorf("%v: got partial %v, expected %v", prefix.name, count.partial, tt.partial[i])
+				}
+			}
+			if !tt.partial[0] {
+				return
+			} else if e.counts["a:"].keys == 0 {
+				t.Errorf("first prefix: got no keys before exceeding the budget")
+			} else if e.counts["c:"].keys != 0 {
+				t.Errorf("last prefix: got %d keys while the budget was exceeded", e.counts["c:"].keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ResolveTimeout is the maximum duration of resolving a hostname.
+const ResolveTimeout = 2 * time.Second
+
+// ResolvedIPer is implemented by collectors that resolve the hostnames of their backends, and returns the IP address currently used per backend.
+type ResolvedIPer interface {
+	ResolvedIPs() map[string]string
+}
+
+type resolvedHost struct {
+	addr string // ip:port
+	time time.Time
+}
+
+// HostResolver resolves the hostnames of backends and remembers their addresses, so that collectors that keep connections open can reconnect when a hostname points elsewhere, such as after a DNS failover.
+type HostResolver struct {
+	resolver *net.Resolver
+	interval time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]resolvedHost // by backend
+}
+
+// NewHostResolver returns a resolver after which hostnames are due to be resolved again after interval, zero only resolves when reconnecting.
+func NewHostResolver(interval time.Duration) *HostResolver {
+	return &HostResolver{
+		resolver: net.DefaultResolver,
+		interval: interval,
+		hosts:    map[string]resolvedHost{},
+	}
+}
+
+// Resolve returns the address of addr of the form host:port with the host resolved to an IP address, preferring the address that was resolved before if it's still listed. It returns whether the address changed since the previous resolve of the backend.
+func (r *HostResolver) Resolve(ctx context.Context, backend, addr string) (string, bool, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false, err
+	}
+	var ips []string
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []string{ip.String()}
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, ResolveTimeout)
+		defer cancel()
+		if ips, err = r.resolver.LookupHost(ctx, host); err != nil {
+			return "", false, err
+		} else if len(ips) == 0 {
+			return "", false, fmt.Errorf("no addresses for %v", host)
+		}
+		sort.Strings(ips)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev, ok := r.hosts[backend]
+	resolved := net.JoinHostPort(ips[0], port)
+	for _, ip := range ips {
+		if ok && net.JoinHostPort(ip, port) == prev.addr {
+			resolved = prev.addr
+		}
+	}
+	r.hosts[backend] = resolvedHost{resolved, time.Now()}
+	return resolved, ok && resolved != prev.addr, nil
+}
+
+// Due returns whether the backend should be resolved again since the interval has passed.
+func (r *HostResolver) Due(backend string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev, ok := r.hosts[backend]
+	return !ok || 0 < r.interval && r.interval <= time.Since(prev.time)
+}
+
+// Forget removes the address of a backend that is no longer used.
+func (r *HostResolver) Forget(backend string) {
+	r.mu.Lock()
+	delete(r.hosts, backend)
+	r.mu.Unlock()
+}
+
+// ResolvedIPs returns the last resolved IP address per backend.
+func (r *HostResolver) ResolvedIPs() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ips := make(map[string]string, len(r.hosts))
+	for backend, host := range r.hosts {
+		ips[backend], _, _ = net.SplitHostPort(host.addr)
+	}
+	return ips
+}
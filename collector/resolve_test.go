@@ -0,0 +1,54 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHostResolver(t *testing.T) {
+	r := NewHostResolver(time.Minute)
+	if !r.Due("redis") {
+		t.Errorf("unresolved backend is not due")
+	}
+
+	tests := []struct {
+		addr     string
+		resolved string
+		changed  bool
+	}{
+		{"10.0.0.1:6379", "10.0.0.1:6379", false},
+		{"10.0.0.1:6379", "10.0.0.1:6379", false},
+		{"10.0.0.2:6379", "10.0.0.2:6379", true}, // failed over
+		{"[::1]:6379", "[::1]:6379", true},
+	}
+	for _, tt := range tests {
+		resolved, changed, err := r.Resolve(context.Background(), "redis", tt.addr)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.addr, err)
+		} else if resolved != tt.resolved || changed != tt.changed {
+			t.Errorf("%v: got %v changed %v, expected %v changed %v", tt.addr, resolved, changed, tt.resolved, tt.changed)
+		}
+	}
+	if _, _, err := r.Resolve(context.Background(), "redis", "localhost"); err == nil {
+		t.Errorf("address without port: expected error")
+	}
+
+	if r.Due("redis") {
+		t.Errorf("backend is due within the interval")
+	}
+	r.hosts["redis"] = resolvedHost{r.hosts["redis"].addr, time.Now().Add(-time.Minute)}
+	if !r.Due("redis") {
+		t.Errorf("backend is not due after the interval")
+	}
+
+	r.Resolve(context.Background(), "memcache", "10.0.0.3:11211")
+	if ips := fmt.Sprint(r.ResolvedIPs()); ips != "map[memcache:10.0.0.3 redis:::1]" {
+		t.Errorf("got resolved IPs %v", ips)
+	}
+	r.Forget("redis")
+	if ips := fmt.Sprint(r.ResolvedIPs()); ips != "map[memcache:10.0.0.3]" {
+		t.Errorf("got resolved IPs %v after forgetting redis", ips)
+	}
+}
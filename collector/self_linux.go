@@ -0,0 +1,96 @@
+//go:build linux
+
+package collector
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/procfs"
+)
+
+// SelfCPUSeconds returns the CPU time consumed by the exporter in seconds.
+func SelfCPUSeconds() (float64, error) {
+	self, err := procfs.Self()
+	if err != nil {
+		return 0.0, err
+	}
+	stat, err := self.Stat()
+	if err != nil {
+		return 0.0, err
+	}
+	return stat.CPUTime(), nil
+}
+
+// SelfPeakRSS returns the peak resident memory of the exporter in bytes, and resets the peak so that the next call returns the peak since this call. If resetting fails, such as before Linux 4.0, it is the peak since the exporter started.
+func SelfPeakRSS() (uint64, error) {
+	b, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	var rss uint64
+	found := false
+	for _, line := range strings.Split(string(b), "\n") {
+		if value, ok := strings.CutPrefix(line, "VmHWM:"); ok {
+			kb, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "kB")), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("VmHWM: %w", err)
+			}
+			rss, found = kb*1024, true
+			break
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("VmHWM not in /proc/self/status")
+	}
+	os.WriteFile("/proc/self/clear_refs", []byte("5"), 0)
+	return rss, nil
+}
+
+// CgroupLimits returns the lowest memory limit in bytes and CPU quota in CPUs of the cgroup of the exporter and its ancestors, which are zero when unlimited. Only cgroup v2 is supported.
+func CgroupLimits() (uint64, float64, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return 0, 0.0, err
+	}
+	dir := ""
+	for _, line := range strings.Split(string(b), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			dir = path
+		}
+	}
+	if dir == "" {
+		return 0, 0.0, fmt.Errorf("not in a cgroup v2 hierarchy")
+	}
+
+	var memory uint64
+	var cpus float64
+	for {
+		path := filepath.Join("/sys/fs/cgroup", dir)
+		if b, err := os.ReadFile(filepath.Join(path, "memory.max")); err == nil {
+			// max when unlimited
+			if n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err == nil && (memory == 0 || n < memory) {
+				memory = n
+			}
+		}
+		if b, err := os.ReadFile(filepath.Join(path, "cpu.max")); err == nil {
+			// quota and period in microseconds, where the quota is max when unlimited
+			fields := strings.Fields(string(b))
+			if len(fields) == 2 {
+				quota, errQuota := strconv.ParseFloat(fields[0], 64)
+				period, errPeriod := strconv.ParseFloat(fields[1], 64)
+				if errQuota == nil && errPeriod == nil && 0.0 < period && (cpus == 0.0 || quota/period < cpus) {
+					cpus = quota / period
+				}
+			}
+		}
+		if dir == "/" || dir == "." || dir == "" {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return memory, cpus, nil
+}
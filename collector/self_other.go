@@ -0,0 +1,15 @@
+//go:build !linux
+
+package collector
+
+func SelfCPUSeconds() (float64, error) {
+	return 0.0, ErrNotSupported
+}
+
+func SelfPeakRSS() (uint64, error) {
+	return 0, ErrNotSupported
+}
+
+func CgroupLimits() (uint64, float64, error) {
+	return 0, 0.0, ErrNotSupported
+}
@@ -0,0 +1,189 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ParseURI returns the network and address of a URI. Unix sockets are given as unix:///path/to/socket or as unix:@name for abstract sockets, TCP addresses as host:port with an optional tcp://, tcp4:// or tcp6:// scheme to select the IP version, where IPv6 hosts must be bracketed. URIs with other schemes (e.g. http://) are returned as is. A request path after the socket path is dropped, see SplitSocketPath.
+func ParseURI(uri string) (string, string, error) {
+	if strings.HasPrefix(uri, "unix:") {
+		uri, _ = SplitSocketPath(unixPath(uri))
+		if strings.HasPrefix(uri, "@") {
+			return "unix", uri, checkAbstractSocket(uri)
+		} else if !path.IsAbs(uri) {
+			return "", "", fmt.Errorf("Unix socket path is not an absolute path")
+		}
+		return "unix", uri, nil
+	}
+
+	network, addr := "tcp", uri
+	if colon := strings.Index(uri, "://"); colon != -1 {
+		switch scheme := uri[:colon]; scheme {
+		case "tcp", "tcp4", "tcp6":
+			network, addr = scheme, strings.TrimSuffix(uri[colon+3:], "/")
+		default:
+			return "tcp", uri, nil
+		}
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid address %v: %w", uri, err)
+	} else if strings.ContainsAny(host, "[]") {
+		return "", "", fmt.Errorf("invalid address %v: bad brackets", uri)
+	} else if ip := net.ParseIP(host); ip != nil {
+		if network == "tcp4" && ip.To4() == nil {
+			return "", "", fmt.Errorf("invalid address %v: not an IPv4 address", uri)
+		} else if network == "tcp6" && ip.To4() != nil && !strings.Contains(host, ":") {
+			return "", "", fmt.Errorf("invalid address %v: not an IPv6 address", uri)
+		}
+	}
+	return network, addr, nil
+}
+
+// checkAbstractSocket returns an error if the name of an abstract Unix socket, given as @name, is invalid. Abstract sockets have no file and are only available on Linux.
+func checkAbstractSocket(name string) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("abstract Unix socket %v: only supported on Linux", name)
+	} else if name == "@" {
+		return fmt.Errorf("abstract Unix socket name is empty, e.g. unix:@dex_exporter")
+	} else if 108 <= len(name) {
+		return fmt.Errorf("abstract Unix socket name %v is longer than 107 bytes", name)
+	} else if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("abstract Unix socket name %q contains a NUL byte", name)
+	}
+	return nil
+}
+
+// unixPath returns the path of a unix: URI, which may be given as unix:///path or unix:/path.
+func unixPath(uri string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(uri, "unix:"), "//")
+}
+
+// SplitSocketPath splits the path of a unix: URI into the socket path and the HTTP request path, given as /run/nginx.sock:/stub_status. The request path is empty if not given.
+func SplitSocketPath(p string) (string, string) {
+	if i := strings.Index(p, ":/"); i != -1 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// SplitAlias splits an optional alias from a value of the form value=alias. The alias may not contain characters that occur in URIs or paths.
+func SplitAlias(s string) (string, string) {
+	if eq := strings.LastIndexByte(s, '='); eq != -1 && eq+1 < len(s) && !strings.ContainsAny(s[eq+1:], ":/?&") {
+		return s[:eq], s[eq+1:]
+	}
+	return s, ""
+}
+
+// URIName returns a short name for a URI, being the host for network URIs or the path for Unix sockets.
+func URIName(uri string) string {
+	if strings.HasPrefix(uri, "unix:") {
+		socket, _ := SplitSocketPath(unixPath(uri))
+		return socket
+	} else if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		return u.Host
+	}
+	_, host, _ := ParseURI(uri)
+	return host
+}
+
+type URIGlobs struct {
+	log      Log
+	literals []string
+	globs    []string          // socket path globs, optionally followed by a request path
+	sockets  map[string]string // literal Unix socket URIs and their paths
+	names    map[string]string
+}
+
+// ParseURIGlobs parses URIs where Unix socket paths can contain globs or be a directory. Socket paths that don't exist yet are accepted, since the service may start after the exporter. A request path after the socket path is kept for the expanded sockets. Abstract sockets are used as is.
+func ParseURIGlobs(uris []string, log Log) (URIGlobs, error) {
+	log = log.WithDefaults()
+	var literals, globs []string
+	sockets := map[string]string{}
+	names := map[string]string{}
+	for i := range uris {
+		uri, name := SplitAlias(uris[i])
+		scheme, host, err := ParseURI(uri)
+		if err != nil {
+			return URIGlobs{}, err
+		}
+		if scheme == "unix" && !strings.HasPrefix(host, "@") {
+			requestPath := unixPath(uri)[len(host):] // empty or a colon followed by the request path
+			if strings.ContainsRune(host, '*') {
+				globs = append(globs, host+requestPath)
+				continue
+			} else if info, err := os.Stat(host); errors.Is(err, os.ErrNotExist) {
+				log.Warning.Printf("socket %v does not exist yet", host)
+			} else if err != nil {
+				return URIGlobs{}, err
+			} else if info.IsDir() {
+				globs = append(globs, path.Join(host, "*")+requestPath)
+				continue
+			}
+			sockets[uri] = host
+		}
+		literals = append(literals, uri)
+		if name != "" {
+			names[uri] = name
+		}
+	}
+	for _, uriGlob := range globs {
+		if _, err := filepath.Glob(socketGlob(uriGlob)); err != nil {
+			return URIGlobs{}, err
+		}
+	}
+	log.Debug.Println("uris:", literals, "globs:", globs)
+	return URIGlobs{log, literals, globs, sockets, names}, nil
+}
+
+// Get returns the URIs, where globs are expanded and Unix sockets that don't exist are skipped.
+func (z URIGlobs) Get() []string {
+	uris := []string{}
+	for _, uri := range z.literals {
+		if host, ok := z.sockets[uri]; ok {
+			if info, err := os.Stat(host); err != nil {
+				z.log.Debug.Printf("socket %v: %v", host, err)
+				continue
+			} else if info.IsDir() {
+				matches, _ := filepath.Glob(path.Join(host, "*"))
+				for _, match := range matches {
+					uris = append(uris, "unix://"+match+unixPath(uri)[len(host):])
+				}
+				continue
+			}
+		}
+		uris = append(uris, uri)
+	}
+	for _, uriGlob := range z.globs {
+		pattern := socketGlob(uriGlob)
+		matches, _ := filepath.Glob(pattern)
+		z.log.Debug.Println(uriGlob, "=>", matches)
+		for _, match := range matches {
+			uris = append(uris, "unix://"+match+uriGlob[len(pattern):])
+		}
+	}
+	return uris
+}
+
+// socketGlob returns the socket path glob without the request path.
+func socketGlob(uriGlob string) string {
+	pattern, _ := SplitSocketPath(uriGlob)
+	return pattern
+}
+
+// Name returns the alias of the URI if given, or otherwise its host or socket path.
+func (z URIGlobs) Name(uri string) string {
+	if name, ok := z.names[uri]; ok {
+		return name
+	}
+	return URIName(uri)
+}
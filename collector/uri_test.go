@@ -0,0 +1,60 @@
+package collector
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	tests := []struct {
+		uri     string
+		network string
+		addr    string
+		err     bool
+	}{
+		{"localhost:9900", "tcp", "localhost:9900", false},
+		{":9900", "tcp", ":9900", false},
+		{"0.0.0.0:9900", "tcp", "0.0.0.0:9900", false},
+		{"[::]:9900", "tcp", "[::]:9900", false},
+		{"[::1]:9900", "tcp", "[::1]:9900", false},
+		{"tcp://127.0.0.1:9900", "tcp", "127.0.0.1:9900", false},
+		{"tcp://localhost:9900/", "tcp", "localhost:9900", false},
+		{"tcp4://0.0.0.0:9900", "tcp4", "0.0.0.0:9900", false},
+		{"tcp4://:9900", "tcp4", ":9900", false},
+		{"tcp6://[::]:9900", "tcp6", "[::]:9900", false},
+		{"tcp6://[::ffff:127.0.0.1]:9900", "tcp6", "[::ffff:127.0.0.1]:9900", false},
+		{"unix:///run/dex_exporter.sock", "unix", "/run/dex_exporter.sock", false},
+		{"unix:/run/dex_exporter.sock", "unix", "/run/dex_exporter.sock", false},
+		{"unix:///run/nginx.sock:/stub_status", "unix", "/run/nginx.sock", false},
+		{"http://localhost/status", "tcp", "http://localhost/status", false},
+		{"localhost", "", "", true},
+		{"::1:9900", "", "", true},
+		{"[::1:9900", "", "", true},
+		{"tcp4://[::]:9900", "", "", true},
+		{"tcp6://127.0.0.1:9900", "", "", true},
+		{"unix:run/dex_exporter.sock", "", "", true},
+		{"unix:@", "", "", true},
+	}
+	if runtime.GOOS == "linux" {
+		tests = append(tests, struct {
+			uri     string
+			network string
+			addr    string
+			err     bool
+		}{"unix:@dex_exporter", "unix", "@dex_exporter", false})
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			network, addr, err := ParseURI(tt.uri)
+			if tt.err {
+				if err == nil {
+					t.Errorf("got %v %v, expected error", network, addr)
+				}
+			} else if err != nil {
+				t.Error(err)
+			} else if network != tt.network || addr != tt.addr {
+				t.Errorf("got %v %v, expected %v %v", network, addr, tt.network, tt.addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConfigOptions are the option structs of the exporter by their flag prefix.
+type ConfigOptions map[string]interface{}
+
+// Encode returns the JSON encoding of each of the option structs.
+func (o ConfigOptions) Encode() (map[string][]byte, error) {
+	encoded := make(map[string][]byte, len(o))
+	for name, opts := range o {
+		b, err := json.Marshal(opts)
+		if err != nil {
+			return nil, fmt.Errorf("config %v: %w", name, err)
+		}
+		encoded[name] = b
+	}
+	return encoded, nil
+}
+
+// ConfigInfo exports a hash of the effective configuration and which option groups are set, so that exporters running with stale flags can be detected.
+type ConfigInfo struct {
+	hash prometheus.Gauge
+	info prometheus.Gauge
+}
+
+// NewConfigInfo returns the configuration metrics for the options after parsing, where the defaults are the encoded options before parsing. An option group is set if it differs from its defaults. Only whether a group is set is exported, never its values.
+func NewConfigInfo(options ConfigOptions, defaults map[string][]byte) (*ConfigInfo, error) {
+	encoded, err := options.Encode()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(encoded))
+	for name := range encoded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	labels := prometheus.Labels{}
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write(encoded[name])
+		h.Write([]byte{0})
+		labels[name+"_set"] = fmt.Sprint(!bytes.Equal(encoded[name], defaults[name]))
+	}
+
+	// use 48 bits so that the hash is represented exactly by a float64
+	sum := h.Sum(nil)
+	hash := binary.BigEndian.Uint64(sum[:8]) >> 16
+
+	c := &ConfigInfo{
+		hash: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dex_config_hash",
+			Help: "Hash of the effective configuration of the exporter, which changes whenever any option changes.",
+		}),
+		info: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "dex_config_info",
+			Help:        "Which option groups of the exporter are set, by their flag prefix.",
+			ConstLabels: labels,
+		}),
+	}
+	c.hash.Set(float64(hash))
+	c.info.Set(1.0)
+	return c, nil
+}
+
+func (c *ConfigInfo) Describe(ch chan<- *prometheus.Desc) {
+	c.hash.Describe(ch)
+	c.info.Describe(ch)
+}
+
+func (c *ConfigInfo) Collect(ch chan<- prometheus.Metric) {
+	c.hash.Collect(ch)
+	c.info.Collect(ch)
+}
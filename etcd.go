@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type EtcdOptions struct {
+	URI         string `desc:"A URI for connecting to the etcd client endpoint (e.g. https://localhost:2379)."`
+	TLSCert     string `desc:"Path to the client certificate for https:// URIs."`
+	TLSKey      string `desc:"Path to the client key for https:// URIs."`
+	TLSCA       string `desc:"Path to CA certificate to verify the server certificate of https:// URIs."`
+	TLSInsecure bool   `desc:"Skip verification of the server certificate of https:// URIs."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+// etcdMetrics are re-exported from the exposition of etcd.
+var etcdMetrics = map[string]bool{
+	"etcd_server_has_leader":                  true,
+	"etcd_server_leader_changes_seen_total":   true,
+	"etcd_server_proposals_failed_total":      true,
+	"etcd_server_proposals_pending":           true,
+	"etcd_mvcc_db_total_size_in_bytes":        true,
+	"etcd_mvcc_db_total_size_in_use_in_bytes": true,
+}
+
+// Etcd checks the health of an etcd member and re-exports a subset of its metrics.
+type Etcd struct {
+	health  *collector.Client
+	metrics *collector.Client
+
+	up      prometheus.Gauge
+	healthy prometheus.Gauge
+}
+
+func NewEtcd(opts EtcdOptions) (*Etcd, error) {
+	tlsConfig, err := collector.NewTLSConfig(opts.TLSCA, opts.TLSInsecure)
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("etcd: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	uri := strings.TrimSuffix(opts.URI, "/")
+	health, err := collector.NewClient(uri + "/health")
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+	health.SetTLSConfig(tlsConfig)
+	metrics, err := collector.NewClient(uri + "/metrics")
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+	metrics.SetTLSConfig(tlsConfig)
+	metrics.Header.Set("Accept", string(expfmt.FmtText))
+	return &Etcd{
+		health:  health,
+		metrics: metrics,
+
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "etcd_up",
+			Help: "Etcd health endpoint is reachable.",
+		}),
+		healthy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "etcd_healthy",
+			Help: "Etcd member reports to be healthy.",
+		}),
+	}, nil
+}
+
+func (e *Etcd) Close() error {
+	return nil
+}
+
+// Check requests the health endpoint.
+func (e *Etcd) Check(ctx context.Context) error {
+	_, err := e.health.Get(ctx)
+	return err
+}
+
+// Describe only describes etcd_up and etcd_healthy, since the re-exported metrics depend on the etcd version.
+func (e *Etcd) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+	e.healthy.Describe(ch)
+}
+
+func (e *Etcd) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Etcd) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	healthy, err := e.getHealth(ctx)
+	if err != nil {
+		Error.Println("etcd:", err)
+		e.up.Set(0.0)
+		e.healthy.Set(0.0)
+	} else {
+		e.up.Set(1.0)
+		if healthy {
+			e.healthy.Set(1.0)
+		} else {
+			e.healthy.Set(0.0)
+		}
+	}
+	e.up.Collect(ch)
+	e.healthy.Collect(ch)
+
+	if metricsErr := e.collectMetrics(ctx, ch); metricsErr != nil {
+		Error.Println("etcd:", metricsErr)
+		err = errors.Join(err, metricsErr)
+	}
+	Debug.Println("collect duration for etcd:", time.Since(t))
+	return err
+}
+
+// getHealth parses the response {"health":"true","reason":""}, where etcd responds with 503 when unhealthy.
+func (e *Etcd) getHealth(ctx context.Context) (bool, error) {
+	b, err := e.health.Get(ctx)
+	var statusErr collector.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == 503 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	health := struct {
+		Health string `json:"health"`
+		Reason string `json:"reason"`
+	}{}
+	if err := json.Unmarshal(b, &health); err != nil {
+		return false, err
+	} else if health.Health != "true" {
+		Debug.Println("etcd: unhealthy:", health.Reason)
+	}
+	return health.Health == "true", nil
+}
+
+func (e *Etcd) collectMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	b, err := e.metrics.Get(ctx)
+	if err != nil {
+		return err
+	}
+	parser := expfmt.TextParser{}
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for name, mf := range mfs {
+		if !etcdMetrics[name] {
+			continue
+		}
+		for _, m := range mf.Metric {
+			metric, err := proxyMetric(name, "", mf, m)
+			if err != nil {
+				Debug.Println("etcd:", err)
+				continue
+			}
+			ch <- metric
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type EximOptions struct {
+	Mainlog string `desc:"Path to the Exim main log (e.g. /var/log/exim4/mainlog)."`
+	Binary  string `desc:"Path to the exim binary used to inspect the queue."`
+	Service string `desc:"Systemd service name the Exim collector depends on."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+const eximTimeout = 5 * time.Second
+
+type Exim struct {
+	binary string
+	log    *LogTail
+
+	queue    prometheus.Gauge
+	queueAge prometheus.Gauge
+	messages *prometheus.CounterVec
+}
+
+func NewExim(opts EximOptions) (*Exim, error) {
+	binary, err := exec.LookPath(opts.Binary)
+	if err != nil {
+		Warning.Printf("exim: binary %v not found, queue metrics are disabled", opts.Binary)
+		binary = ""
+	}
+	log, err := NewLogTail(opts.Mainlog)
+	if err != nil {
+		return nil, fmt.Errorf("exim: %w", err)
+	}
+
+	e := &Exim{
+		binary: binary,
+		log:    log,
+
+		queue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "exim_queue_messages",
+			Help: "Number of messages in the queue.",
+		}),
+		queueAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "exim_queue_oldest_message_age_seconds",
+			Help: "Age of the oldest message in the queue in seconds.",
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exim_messages_total",
+			Help: "Total number of delivered, deferred or bounced messages.",
+		}, []string{"result"}),
+	}
+	for _, result := range []string{"delivered", "deferred", "bounced"} {
+		e.messages.WithLabelValues(result)
+	}
+	return e, nil
+}
+
+func (e *Exim) Close() error {
+	return e.log.Close()
+}
+
+// Check counts the queue and reads the main log.
+func (e *Exim) Check(ctx context.Context) error {
+	if e.binary != "" {
+		if _, err := e.run(ctx, "-bpc"); err != nil {
+			return err
+		}
+	}
+	_, err := e.log.Lines()
+	return err
+}
+
+func (e *Exim) Describe(ch chan<- *prometheus.Desc) {
+	e.messages.Describe(ch)
+	if e.binary != "" {
+		e.queue.Describe(ch)
+		e.queueAge.Describe(ch)
+	}
+}
+
+func (e *Exim) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Exim) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	err := e.updateMessages()
+	if err != nil {
+		Error.Println("exim:", err)
+	}
+	e.messages.Collect(ch)
+
+	if e.binary != "" {
+		if queueErr := e.updateQueue(ctx); queueErr != nil {
+			Error.Println("exim:", queueErr)
+			err = queueErr
+		} else {
+			e.queue.Collect(ch)
+			e.queueAge.Collect(ch)
+		}
+	}
+	Debug.Println("collect duration for exim:", time.Since(t))
+	return err
+}
+
+func (e *Exim) run(ctx context.Context, arg string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, eximTimeout)
+	defer cancel()
+	b, err := exec.CommandContext(ctx, e.binary, arg).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v %v: %w", e.binary, arg, err)
+	}
+	return b, nil
+}
+
+func (e *Exim) updateQueue(ctx context.Context) error {
+	b, err := e.run(ctx, "-bpc")
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseUint(string(bytes.TrimSpace(b)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad queue count: %w", err)
+	}
+
+	oldest := time.Duration(0)
+	if 0 < n {
+		if b, err = e.run(ctx, "-bp"); err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			// message lines start with the age, recipient lines are indented
+			line := scanner.Text()
+			if line == "" || line[0] == ' ' || line[0] == '\t' {
+				continue
+			}
+			fields := strings.Fields(line)
+			if age, ok := eximParseAge(fields[0]); ok && oldest < age {
+				oldest = age
+			}
+		}
+	}
+	e.queue.Set(float64(n))
+	e.queueAge.Set(oldest.Seconds())
+	return nil
+}
+
+// eximParseAge parses queue ages such as 45s, 25m, 2h, 3d or 1w.
+func eximParseAge(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	unit := time.Duration(0)
+	switch s[len(s)-1] {
+	case 's':
+		unit = time.Second
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func (e *Exim) updateMessages() error {
+	lines, err := e.log.Lines()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		// date time message-id flag ...
+		fields := strings.SplitN(line, " ", 5)
+		if len(fields) < 4 {
+			continue
+		}
+		switch fields[3] {
+		case "=>":
+			e.messages.WithLabelValues("delivered").Inc()
+		case "==":
+			e.messages.WithLabelValues("deferred").Inc()
+		case "**":
+			e.messages.WithLabelValues("bounced").Inc()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+package exporter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// Deriver adds gauges that are derived from the other metrics of a scrape by arithmetic expressions, such as used memory as a ratio of the total. Expressions are a subset of PromQL: numbers, selectors like node_mem_bytes{type="used"} with = and != matchers, parentheses, and the operators + - * / between them. Labels matched with = are dropped from the series of a selector since they are constant. Series of two operands must have identical labels, or identical labels of on(label, ...) or ignoring(label, ...) after the operator, and series that don't match are dropped. A rule whose evaluation fails, such as for matching multiple series with the same labels, is disabled with a warning.
+type Deriver struct {
+	log collector.Log
+
+	mu    sync.Mutex
+	rules []*deriveRule
+}
+
+type deriveRule struct {
+	name     string
+	text     string
+	expr     deriveNode
+	disabled bool
+}
+
+// NewDeriver parses rules of the form name=expr, where name is the name of the derived gauge.
+func NewDeriver(rules []string, log collector.Log) (*Deriver, error) {
+	d := &Deriver{
+		log: log.WithDefaults(),
+	}
+	names := map[string]bool{}
+	for _, rule := range rules {
+		name, text, ok := strings.Cut(rule, "=")
+		name, text = strings.TrimSpace(name), strings.TrimSpace(text)
+		if !ok || !isMetricName(name) || text == "" {
+			return nil, fmt.Errorf("derived metric %v must be of the form name=expr", rule)
+		} else if names[name] {
+			return nil, fmt.Errorf("derived metric %v is given more than once", name)
+		}
+		expr, err := parseDeriveExpr(text)
+		if err != nil {
+			return nil, fmt.Errorf("derived metric %v: %w", name, err)
+		}
+		names[name] = true
+		d.rules = append(d.rules, &deriveRule{
+			name: name,
+			text: text,
+			expr: expr,
+		})
+	}
+	return d, nil
+}
+
+// Derive evaluates the rules over the metric families and returns them with the derived gauges added, sorted by name.
+func (d *Deriver) Derive(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.rules) == 0 {
+		return mfs
+	}
+
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	for _, rule := range d.rules {
+		if rule.disabled {
+			continue
+		}
+		mf, err := rule.eval(families)
+		if err != nil {
+			d.log.Warning.Printf("derived metric %v disabled: %v", rule.name, err)
+			rule.disabled = true
+			continue
+		} else if mf != nil {
+			mfs = append(mfs, mf)
+		}
+	}
+	sort.Slice(mfs, func(i, j int) bool {
+		return mfs[i].GetName() < mfs[j].GetName()
+	})
+	return mfs
+}
+
+// Gatherer returns a gatherer that adds the derived gauges to the gathered families.
+func (d *Deriver) Gatherer(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := gatherer.Gather()
+		return d.Derive(mfs), err
+	})
+}
+
+// eval returns the family of the derived gauge, or nil if the expression has no series.
+func (rule *deriveRule) eval(families map[string]*dto.MetricFamily) (*dto.MetricFamily, error) {
+	if _, ok := families[rule.name]; ok {
+		return nil, fmt.Errorf("metric %v already exists", rule.name)
+	}
+	v, err := rule.expr.eval(families)
+	if err != nil {
+		return nil, err
+	}
+	if v.scalar {
+		v.samples = []deriveSample{{labels: map[string]string{}, value: v.value}}
+	} else if len(v.samples) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(v.samples, func(i, j int) bool {
+		return labelSignature(v.samples[i].labels) < labelSignature(v.samples[j].labels)
+	})
+	name, help := rule.name, "Derived from "+rule.text+"."
+	mf := &dto.MetricFamily{
+		Name: &name,
+		Help: &help,
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, sample := range v.samples {
+		value := sample.value
+		m := &dto.Metric{
+			Gauge: &dto.Gauge{Value: &value},
+		}
+		for _, name := range sortedLabelNames(sample.labels) {
+			name, value := name, sample.labels[name]
+			m.Label = append(m.Label, &dto.LabelPair{
+				Name:  &name,
+				Value: &value,
+			})
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+	return mf, nil
+}
+
+type deriveSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// deriveValue is either a scalar or a vector of series.
+type deriveValue struct {
+	scalar  bool
+	value   float64
+	samples []deriveSample
+}
+
+type deriveNode interface {
+	eval(map[string]*dto.MetricFamily) (deriveValue, error)
+}
+
+type deriveNumber float64
+
+func (n deriveNumber) eval(map[string]*dto.MetricFamily) (deriveValue, error) {
+	return deriveValue{scalar: true, value: float64(n)}, nil
+}
+
+type deriveMatcher struct {
+	name, value string
+	equal       bool
+}
+
+type deriveSelector struct {
+	name     string
+	matchers []deriveMatcher
+}
+
+func (s *deriveSelector) eval(families map[string]*dto.MetricFamily) (deriveValue, error) {
+	mf, ok := families[s.name]
+	if !ok {
+		return deriveValue{}, nil // not collected in this scrape
+	}
+	v := deriveValue{}
+	for _, m := range mf.Metric {
+		var value float64
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			value = m.GetCounter().GetValue()
+		case dto.MetricType_GAUGE:
+			value = m.GetGauge().GetValue()
+		case dto.MetricType_UNTYPED:
+			value = m.GetUntyped().GetValue()
+		default:
+			return deriveValue{}, fmt.Errorf("%v is a %v, only counters, gauges, and untyped metrics can be used", s.name, familyType(mf))
+		}
+
+		labels := make(map[string]string, len(m.Label))
+		for _, pair := range m.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		matches := true
+		for _, matcher := range s.matchers {
+			if (labels[matcher.name] == matcher.value) != matcher.equal {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		for _, matcher := range s.matchers {
+			if matcher.equal {
+				delete(labels, matcher.name)
+			}
+		}
+		v.samples = append(v.samples, deriveSample{labels, value})
+	}
+	return v, nil
+}
+
+type deriveBinary struct {
+	op          byte
+	left, right deriveNode
+	on          bool     // match on the labels only, otherwise ignoring them
+	labels      []string // of on or ignoring
+}
+
+func (b *deriveBinary) eval(families map[string]*dto.MetricFamily) (deriveValue, error) {
+	left, err := b.left.eval(families)
+	if err != nil {
+		return deriveValue{}, err
+	}
+	right, err := b.right.eval(families)
+	if err != nil {
+		return deriveValue{}, err
+	}
+
+	if left.scalar && right.scalar {
+		return deriveValue{scalar: true, value: b.apply(left.value, right.value)}, nil
+	} else if left.scalar || right.scalar {
+		v := deriveValue{}
+		for _, sample := range append(left.samples, right.samples...) {
+			if left.scalar {
+				sample.value = b.apply(left.value, sample.value)
+			} else {
+				sample.value = b.apply(sample.value, right.value)
+			}
+			v.samples = append(v.samples, sample)
+		}
+		return v, nil
+	}
+
+	rights := make(map[string]deriveSample, len(right.samples))
+	for _, sample := range right.samples {
+		labels := b.matchLabels(sample.labels)
+		sig := labelSignature(labels)
+		if _, ok := rights[sig]; ok {
+			return deriveValue{}, fmt.Errorf("right operand of %c has multiple series with labels %v", b.op, labels)
+		}
+		rights[sig] = sample
+	}
+	v := deriveValue{}
+	lefts := make(map[string]bool, len(left.samples))
+	for _, sample := range left.samples {
+		labels := b.matchLabels(sample.labels)
+		sig := labelSignature(labels)
+		if lefts[sig] {
+			return deriveValue{}, fmt.Errorf("left operand of %c has multiple series with labels %v", b.op, labels)
+		}
+		lefts[sig] = true
+		if r, ok := rights[sig]; ok {
+			v.samples = append(v.samples, deriveSample{labels, b.apply(sample.value, r.value)})
+		}
+	}
+	return v, nil
+}
+
+// matchLabels returns the labels that series are matched on, which are also the labels of the result.
+func (b *deriveBinary) matchLabels(labels map[string]string) map[string]string {
+	if b.labels == nil {
+		return labels
+	}
+	match := map[string]string{}
+	for name, value := range labels {
+		if containsString(b.labels, name) == b.on {
+			match[name] = value
+		}
+	}
+	return match
+}
+
+func (b *deriveBinary) apply(x, y float64) float64 {
+	switch b.op {
+	case '+':
+		return x + y
+	case '-':
+		return x - y
+	case '*':
+		return x * y
+	case '/':
+		return x / y
+	}
+	return math.NaN()
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// labelSignature returns a key that is unique for the label set.
+func labelSignature(labels map[string]string) string {
+	sb := strings.Builder{}
+	for _, name := range sortedLabelNames(labels) {
+		sb.WriteString(name)
+		sb.WriteByte(0)
+		sb.WriteString(labels[name])
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+func isMetricName(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || r == ':' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || 0 < i && '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// deriveParser is a recursive descent parser of expressions:
+//
+//	expr     = term { ("+" | "-") [modifier] term }
+//	term     = unary { ("*" | "/") [modifier] unary }
+//	unary    = "-" unary | number | selector | "(" expr ")"
+//	selector = name [ "{" [ label ("=" | "!=") string { "," label ("=" | "!=") string } ] "}" ]
+//	modifier = ("on" | "ignoring") "(" [ label { "," label } ] ")"
+type deriveParser struct {
+	s   string
+	pos int
+}
+
+func parseDeriveExpr(s string) (deriveNode, error) {
+	p := &deriveParser{s: s}
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	} else if p.skipSpace(); p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return node, nil
+}
+
+func (p *deriveParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("position %d: %v", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *deriveParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// consume skips the token if it follows.
+func (p *deriveParser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *deriveParser) expect(token string) error {
+	if !p.consume(token) {
+		return p.errorf("expected %q", token)
+	}
+	return nil
+}
+
+func (p *deriveParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && isMetricName(p.s[start:p.pos+1]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *deriveParser) expr() (deriveNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		if p.consume("+") {
+			op = '+'
+		} else if p.consume("-") {
+			op = '-'
+		} else {
+			return left, nil
+		}
+		if left, err = p.binary(op, left, p.term); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *deriveParser) term() (deriveNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		if p.consume("*") {
+			op = '*'
+		} else if p.consume("/") {
+			op = '/'
+		} else {
+			return left, nil
+		}
+		if left, err = p.binary(op, left, p.unary); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// binary parses the optional matching modifier and the right operand of an operator.
+func (p *deriveParser) binary(op byte, left deriveNode, operand func() (deriveNode, error)) (deriveNode, error) {
+	b := &deriveBinary{op: op, left: left}
+	start := p.pos
+	if keyword := p.ident(); keyword == "on" || keyword == "ignoring" {
+		if p.consume("(") {
+			b.on = keyword == "on"
+			b.labels = []string{}
+			for !p.consume(")") {
+				if 0 < len(b.labels) {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				label := p.ident()
+				if label == "" {
+					return nil, p.errorf("expected label name")
+				}
+				b.labels = append(b.labels, label)
+			}
+		} else {
+			p.pos = start // metric named on or ignoring
+		}
+	} else {
+		p.pos = start
+	}
+
+	right, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	b.right = right
+	return b, nil
+}
+
+func (p *deriveParser) unary() (deriveNode, error) {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return nil, p.errorf("unexpected end of expression")
+	} else if p.consume("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &deriveBinary{op: '-', left: deriveNumber(0.0), right: operand}, nil
+	} else if p.consume("(") {
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		} else if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	} else if c := p.s[p.pos]; '0' <= c && c <= '9' || c == '.' {
+		return p.number()
+	}
+	return p.selector()
+}
+
+func (p *deriveParser) number() (deriveNode, error) {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if '0' <= c && c <= '9' || c == '.' || c == 'e' || c == 'E' || (c == '+' || c == '-') && (p.s[p.pos-1] == 'e' || p.s[p.pos-1] == 'E') {
+			p.pos++
+		} else {
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("bad number %q", p.s[start:])
+	}
+	return deriveNumber(f), nil
+}
+
+func (p *deriveParser) selector() (deriveNode, error) {
+	s := &deriveSelector{name: p.ident()}
+	if s.name == "" {
+		return nil, p.errorf("expected number, metric name, or %q", "(")
+	}
+	if !p.consume("{") {
+		return s, nil
+	}
+	for !p.consume("}") {
+		if 0 < len(s.matchers) {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		matcher := deriveMatcher{name: p.ident()}
+		if matcher.name == "" {
+			return nil, p.errorf("expected label name")
+		} else if p.consume("!=") {
+			matcher.equal = false
+		} else if p.consume("=") {
+			matcher.equal = true
+		} else {
+			return nil, p.errorf("expected %q or %q", "=", "!=")
+		}
+		p.skipSpace()
+		quoted, err := strconv.QuotedPrefix(p.s[p.pos:])
+		if err != nil || quoted[0] != '"' {
+			return nil, p.errorf("expected quoted label value")
+		}
+		p.pos += len(quoted)
+		matcher.value, _ = strconv.Unquote(quoted)
+		s.matchers = append(s.matchers, matcher)
+	}
+	return s, nil
+}
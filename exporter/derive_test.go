@@ -0,0 +1,278 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// deriveString returns the expression with all binary operations in parentheses.
+func deriveString(node deriveNode) string {
+	switch n := node.(type) {
+	case deriveNumber:
+		return strconv.FormatFloat(float64(n), 'g', -1, 64)
+	case *deriveSelector:
+		if n.matchers == nil {
+			return n.name
+		}
+		matchers := []string{}
+		for _, m := range n.matchers {
+			op := "!="
+			if m.equal {
+				op = "="
+			}
+			matchers = append(matchers, m.name+op+strconv.Quote(m.value))
+		}
+		return n.name + "{" + strings.Join(matchers, ",") + "}"
+	case *deriveBinary:
+		modifier := ""
+		if n.labels != nil {
+			modifier = "ignoring"
+			if n.on {
+				modifier = "on"
+			}
+			modifier = " " + modifier + "(" + strings.Join(n.labels, ",") + ")"
+		}
+		return fmt.Sprintf("(%v %c%v %v)", deriveString(n.left), n.op, modifier, deriveString(n.right))
+	}
+	return fmt.Sprintf("%T", node)
+}
+
+func TestParseDeriveExpr(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"1 * 2 + 3", "((1 * 2) + 3)"},
+		{"a - b - c", "((a - b) - c)"},
+		{"a / b * c", "((a / b) * c)"},
+		{"a - (b - c)", "(a - (b - c))"},
+		{"-a * 2", "((0 - a) * 2)"},
+		{"a--b", "(a - (0 - b))"},
+		{"1e3 + .5 - 1.5e-2", "((1000 + 0.5) - 0.015)"},
+		{"  a\t+b  ", "(a + b)"},
+		{`a{x="1"}`, `a{x="1"}`},
+		{`a{x="1", y!="2"}`, `a{x="1",y!="2"}`},
+		{`a{x="\"quoted\""}`, `a{x="\"quoted\""}`},
+		{`a{}`, `a`},
+		{"a / on(x, y) b", "(a / on(x,y) b)"},
+		{"a * ignoring(x) b + c", "((a * ignoring(x) b) + c)"},
+		{"a / on() b", "(a / on() b)"},
+		{"a + on(x) b * c", "(a + on(x) (b * c))"},
+		{"on + ignoring", "(on + ignoring)"},
+		{`a + ignoring{x="1"}`, `(a + ignoring{x="1"})`},
+		{"node:mem_bytes:ratio * 100", "(node:mem_bytes:ratio * 100)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			node, err := parseDeriveExpr(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			} else if s := deriveString(node); s != tt.expected {
+				t.Fatalf("parsed as %v, expected %v", s, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseDeriveExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", `position 1: unexpected end of expression`},
+		{"a +", `position 4: unexpected end of expression`},
+		{"(a + b", `position 7: expected ")"`},
+		{"a b", `position 3: unexpected "b"`},
+		{"a + )", `position 5: expected number, metric name, or "("`},
+		{"1.2.3", `position 1: bad number "1.2.3"`},
+		{`a{x="1"`, `position 8: expected ","`},
+		{`a{x="1" y="2"}`, `position 9: expected ","`},
+		{`a{="1"}`, `position 3: expected label name`},
+		{`a{x~"1"}`, `position 4: expected "=" or "!="`},
+		{`a{x=1}`, `position 5: expected quoted label value`},
+		{`a{x='1'}`, `position 5: expected quoted label value`},
+		{`a{x="1}`, `position 5: expected quoted label value`},
+		{"a / on(x b", `position 10: expected ","`},
+		{"a / on(,) b", `position 8: expected label name`},
+		{"a / ignoring(x)", `position 16: unexpected end of expression`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if _, err := parseDeriveExpr(tt.expr); err == nil {
+				t.Fatalf("expected error %q", tt.err)
+			} else if err.Error() != tt.err {
+				t.Fatalf("error is %q, expected %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func newDeriveFamilies(t *testing.T) []*dto.MetricFamily {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	gauge := func(name string, labels []string, values map[string]float64) {
+		vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: name}, labels)
+		for key, value := range values {
+			vec.WithLabelValues(strings.Split(key, ",")[:len(labels)]...).Set(value)
+		}
+		registry.MustRegister(vec)
+	}
+	gauge("mem_bytes", []string{"type"}, map[string]float64{"used": 25, "free": 75, "total": 100})
+	gauge("disk_used_bytes", []string{"device", "mount"}, map[string]float64{"sda,/": 30, "sdb,/data": 50})
+	gauge("disk_size_bytes", []string{"device"}, map[string]float64{"sda": 100, "sdb": 200, "sdc": 10})
+
+	cpu := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "cpu_seconds_total", Help: "cpu"}, []string{"cpu", "mode"})
+	cpu.WithLabelValues("0", "idle").Add(10)
+	cpu.WithLabelValues("0", "user").Add(5)
+	cpu.WithLabelValues("1", "idle").Add(20)
+	cpu.WithLabelValues("1", "user").Add(10)
+	registry.MustRegister(cpu)
+
+	up := prometheus.NewUntypedFunc(prometheus.UntypedOpts{Name: "up", Help: "up"}, func() float64 { return 1.0 })
+	registry.MustRegister(up)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "latency"})
+	histogram.Observe(0.1)
+	registry.MustRegister(histogram)
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+// deriveSamples returns the samples of the family as name{labels} value, or nil if the family doesn't exist.
+func deriveSamples(mfs []*dto.MetricFamily, name string) []string {
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		samples := []string{}
+		for _, m := range mf.Metric {
+			labels := []string{}
+			for _, pair := range m.Label {
+				labels = append(labels, pair.GetName()+"="+strconv.Quote(pair.GetValue()))
+			}
+			sample := name
+			if 0 < len(labels) {
+				sample += "{" + strings.Join(labels, ",") + "}"
+			}
+			samples = append(samples, sample+" "+strconv.FormatFloat(m.GetGauge().GetValue(), 'g', -1, 64))
+		}
+		return samples
+	}
+	return nil
+}
+
+func TestDeriverEval(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []string
+	}{
+		{"1 + 2 * 3", []string{"x 7"}},
+		{`mem_bytes{type="used"} * 100`, []string{"x 2500"}},
+		{`100 - mem_bytes{type="used"}`, []string{"x 75"}},
+		{`-mem_bytes{type="used"}`, []string{"x -25"}},
+		{`mem_bytes{type="used"} / mem_bytes{type="total"}`, []string{"x 0.25"}},
+		{`mem_bytes{type!="total"} / 100`, []string{`x{type="free"} 0.75`, `x{type="used"} 0.25`}},
+		{`mem_bytes{type!="total", type!="free"}`, []string{`x{type="used"} 25`}},
+		{`mem_bytes / 4`, []string{`x{type="free"} 18.75`, `x{type="total"} 25`, `x{type="used"} 6.25`}},
+		{`disk_used_bytes / on(device) disk_size_bytes`, []string{`x{device="sda"} 0.3`, `x{device="sdb"} 0.25`}},
+		{`disk_used_bytes / ignoring(mount) disk_size_bytes`, []string{`x{device="sda"} 0.3`, `x{device="sdb"} 0.25`}},
+		{`disk_used_bytes{mount="/"} / ignoring(device) disk_size_bytes{device="sda"}`, []string{"x 0.3"}},
+		{`cpu_seconds_total{mode="user"} / on(cpu) cpu_seconds_total{mode="idle"}`, []string{`x{cpu="0"} 0.5`, `x{cpu="1"} 0.5`}},
+		{`cpu_seconds_total{mode="user"} / cpu_seconds_total{mode="idle"} * 2`, []string{`x{cpu="0"} 1`, `x{cpu="1"} 1`}},
+		{"up * 2", []string{"x 2"}},
+		{"disk_used_bytes / disk_size_bytes", nil},                          // no series with identical labels
+		{`disk_used_bytes{mount="/"} / disk_size_bytes{device="sda"}`, nil}, // matched labels are dropped
+		{`mem_bytes{type="swap"} * 100`, nil},                               // no series match
+		{"missing_bytes + 1", nil},                                          // not collected
+		{`1 / mem_bytes{type="used"} * 0`, []string{"x 0"}},                 // left to right
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			warnings := &bytes.Buffer{}
+			d, err := NewDeriver([]string{"x=" + tt.expr}, collector.Log{Warning: log.New(warnings, "", 0)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mfs := d.Derive(newDeriveFamilies(t))
+			if warnings.Len() != 0 {
+				t.Fatalf("unexpected warning: %v", warnings)
+			} else if !sort.SliceIsSorted(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() }) {
+				t.Fatal("families are not sorted")
+			}
+			samples := deriveSamples(mfs, "x")
+			if fmt.Sprint(samples) != fmt.Sprint(tt.expected) {
+				t.Fatalf("samples are %v, expected %v", samples, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDeriverDisable(t *testing.T) {
+	tests := []struct {
+		rule    string
+		warning string
+	}{
+		{"x=disk_used_bytes / on() disk_size_bytes", "derived metric x disabled: right operand of / has multiple series with labels map[]"},
+		{"x=mem_bytes - on() up", "derived metric x disabled: left operand of - has multiple series with labels map[]"},
+		{"x=cpu_seconds_total / ignoring(mode) cpu_seconds_total", "derived metric x disabled: right operand of / has multiple series with labels map[cpu:0]"},
+		{"x=latency_seconds * 1000", "derived metric x disabled: latency_seconds is a histogram, only counters, gauges, and untyped metrics can be used"},
+		{"up=up * 2", "derived metric up disabled: metric up already exists"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			warnings := &bytes.Buffer{}
+			d, err := NewDeriver([]string{tt.rule, "y=up + 1"}, collector.Log{Warning: log.New(warnings, "", 0)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the rule is disabled with a single warning, and other rules are still evaluated
+			for i := 0; i < 2; i++ {
+				mfs := d.Derive(newDeriveFamilies(t))
+				if samples := deriveSamples(mfs, "x"); samples != nil {
+					t.Fatalf("samples of disabled rule are %v", samples)
+				} else if samples := deriveSamples(mfs, "y"); fmt.Sprint(samples) != "[y 2]" {
+					t.Fatalf("samples of y are %v", samples)
+				}
+			}
+			if s := strings.TrimSpace(warnings.String()); s != tt.warning {
+				t.Fatalf("warnings are %q, expected %q", s, tt.warning)
+			}
+		})
+	}
+}
+
+func TestNewDeriverErrors(t *testing.T) {
+	tests := []struct {
+		rules []string
+		err   string
+	}{
+		{[]string{"x"}, "derived metric x must be of the form name=expr"},
+		{[]string{"x="}, "derived metric x= must be of the form name=expr"},
+		{[]string{"=up"}, "derived metric =up must be of the form name=expr"},
+		{[]string{"1x=up"}, "derived metric 1x=up must be of the form name=expr"},
+		{[]string{"x=up", " x = up * 2"}, "derived metric x is given more than once"},
+		{[]string{"x=up +"}, "derived metric x: position 5: unexpected end of expression"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.rules, " "), func(t *testing.T) {
+			if _, err := NewDeriver(tt.rules, collector.Log{}); err == nil || err.Error() != tt.err {
+				t.Fatalf("error is %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
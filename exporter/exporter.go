@@ -0,0 +1,1463 @@
+// Package exporter gates collectors on the state of systemd services and collects them concurrently within the scrape timeout, with background collection, sanity checks and self-monitoring of the collectors.
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// ServiceRequirement is a list of alternative sets of services, the requirement is met if all services of any of the sets are active.
+type ServiceRequirement [][]string
+
+// AllOf requires all services to be active.
+func AllOf(services ...string) ServiceRequirement {
+	return ServiceRequirement{services}
+}
+
+// AnyOf requires at least one of the services to be active, such as for services that are named differently between distributions.
+func AnyOf(services ...string) ServiceRequirement {
+	req := ServiceRequirement{}
+	for _, service := range services {
+		req = append(req, []string{service})
+	}
+	return req
+}
+
+// ParseServiceMap parses the services that collectors require given as collector=service, where repeated collectors require any of their services.
+func ParseServiceMap(serviceMap []string) (map[string]ServiceRequirement, error) {
+	m := map[string]ServiceRequirement{}
+	for _, item := range serviceMap {
+		name, service, ok := strings.Cut(item, "=")
+		if !ok || name == "" || service == "" {
+			return nil, fmt.Errorf("service map %v must be of the form collector=service", item)
+		} else if _, err := path.Match(service, ""); err != nil {
+			return nil, fmt.Errorf("service map %v: %w", item, err)
+		}
+		m[name] = append(m[name], []string{service})
+	}
+	return m, nil
+}
+
+type ServiceCollector struct {
+	prometheus.Collector
+	name     string
+	services []uint64 // alternative bitmasks of services that must be active
+	poller   *poller  // nil when collected at scrape time
+	hung     *hungRuns
+}
+
+// hungRuns counts the runs of a collector that outlived their scrape and are still going, during which the collector isn't run again so that hung collectors don't pile up.
+type hungRuns struct {
+	n      atomic.Int32
+	warned atomic.Bool // skipping the collector was logged since it hung
+}
+
+// Active returns whether the required services of the collector are active.
+func (c ServiceCollector) Active(activeServices uint64) bool {
+	for _, bits := range c.services {
+		if bits&activeServices == bits {
+			return true
+		}
+	}
+	return false
+}
+
+// poller keeps the metrics of the last background collection of a collector.
+type poller struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	metrics []prometheus.Metric
+}
+
+func (p *poller) store(metrics []prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metrics = metrics
+}
+
+func (p *poller) replay(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	metrics := p.metrics
+	p.mu.Unlock()
+	for _, metric := range metrics {
+		ch <- metric
+	}
+}
+
+// frozenMetric is a snapshot of a metric, since the metrics of vectors keep changing with the next collection.
+type frozenMetric struct {
+	desc *prometheus.Desc
+	m    *dto.Metric
+}
+
+func freezeMetric(metric prometheus.Metric) (prometheus.Metric, error) {
+	m := &dto.Metric{}
+	if err := metric.Write(m); err != nil {
+		return nil, err
+	}
+	return frozenMetric{metric.Desc(), m}, nil
+}
+
+func (m frozenMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m frozenMetric) Write(out *dto.Metric) error {
+	out.Label = m.m.Label
+	out.Gauge = m.m.Gauge
+	out.Counter = m.m.Counter
+	out.Summary = m.m.Summary
+	out.Untyped = m.m.Untyped
+	out.Histogram = m.m.Histogram
+	out.TimestampMs = m.m.TimestampMs
+	return nil
+}
+
+const systemdRetryInterval = time.Minute
+
+// CloseTimeout is the maximum time to wait for scrapes in progress when closing.
+const CloseTimeout = 10 * time.Second
+
+// Options configures the exporter.
+type Options struct {
+	// MaxConcurrent is the maximum number of collectors that run concurrently per scrape, zero is unlimited
+	MaxConcurrent int
+
+	// Systemd gates the collectors on their services, otherwise all collectors are collected
+	Systemd bool
+
+	// HonorCollectionTime sets the time the backend was read as the timestamp of the samples
+	HonorCollectionTime bool
+
+	// MaxRate is the maximum increase per second of counters given as metric=rate, see SanityChecker.ParseMaxRates
+	MaxRate []string
+
+	// NativeHistogramBucketFactor is the growth factor of the buckets of native histograms, zero disables native histograms
+	NativeHistogramBucketFactor float64
+
+	// ServiceMap overrides the services that a collector requires given as collector=service, where repeated collectors are alternatives
+	ServiceMap []string
+
+	// DisableGating collects all collectors regardless of the services they require
+	DisableGating bool
+
+	// MaxSeriesPerFamily is the maximum number of series per metric family in a scrape, zero is unlimited; SeriesLimits overrides it per family
+	MaxSeriesPerFamily int
+	SeriesLimits       map[string]int
+
+	// Derive are gauges derived from the other metrics of a scrape given as name=expr, see Deriver
+	Derive []string
+}
+
+type Exporter struct {
+	log           collector.Log
+	mu            sync.RWMutex
+	services      []string
+	collectors    []ServiceCollector
+	maxConcurrent int
+
+	serviceMap    map[string]ServiceRequirement // by collector name
+	disableGating bool
+
+	honorCollectionTime bool
+
+	ctx     context.Context
+	systemd bool
+	connMu  sync.Mutex
+	conn    *dbus.Conn // nil when systemd is not available
+
+	// listing all units is expensive and cached
+	allUnitsInterval time.Duration
+	unitsMu          sync.Mutex
+	unitsTime        time.Time
+	unitStates       map[string]int
+
+	// resource usage of the active services, the CPU counter is diffed
+	serviceMu      sync.Mutex
+	serviceCounter *collector.CounterTracker
+	serviceMem     *prometheus.GaugeVec
+	serviceCPU     *prometheus.CounterVec
+	serviceTasks   *prometheus.GaugeVec
+	serviceSwap    *prometheus.GaugeVec
+	servicePSI     *prometheus.CounterVec
+
+	// boot phases are read once systemd finished booting, startup durations are read once per start of a service
+	bootPhases     map[string]float64
+	serviceStarts  map[string]serviceStart
+	bootPhase      *prometheus.GaugeVec
+	serviceStartup *prometheus.GaugeVec
+
+	service     *prometheus.GaugeVec
+	failedUnits prometheus.Gauge
+	units       *prometheus.GaugeVec
+	duration    *prometheus.GaugeVec
+	success     *prometheus.GaugeVec
+	lastSuccess *prometheus.GaugeVec
+	lastRun     *prometheus.GaugeVec
+	backoff     *prometheus.GaugeVec
+	resolvedIP  *prometheus.GaugeVec
+	runs        *prometheus.HistogramVec
+	panics      *prometheus.CounterVec
+
+	// skip state of the collectors, to log only changes
+	skippedMu    sync.Mutex
+	skippedState map[string]bool
+	skipped      *prometheus.GaugeVec
+
+	// collectors with an interval are collected in the background while their services were active at the last scrape
+	pollCancel     context.CancelFunc
+	pollWG         sync.WaitGroup
+	activeServices atomic.Uint64
+	lastPoll       *prometheus.GaugeVec
+
+	sanity     *SanityChecker
+	exposition *Exposition
+	limiter    *SeriesLimiter
+	deriver    *Deriver
+
+	// metadata of the last audit
+	metadataMu sync.Mutex
+	metadata   []MetricMeta
+
+	// scrapes in progress are waited for before closing the collectors, as are collections that outlive an aborted scrape
+	cancel     context.CancelFunc
+	scrapeMu   sync.Mutex
+	scrapes    sync.WaitGroup
+	collecting sync.WaitGroup
+	closed     bool
+
+	// background collection is slowed down by a factor when the exporter uses too much CPU
+	maxCPUPercent  float64
+	throttleMu     sync.Mutex
+	throttleFactor int
+	cpuSeconds     float64
+	cpuTime        time.Time
+	throttled      prometheus.Gauge
+}
+
+// New returns an exporter that gates collectors on the state of systemd services. Without systemd, or when it is not available over D-Bus, all collectors are collected.
+func New(ctx context.Context, opts Options, log collector.Log) (*Exporter, error) {
+	log = log.WithDefaults()
+	sanity := NewSanityChecker(log)
+	if err := sanity.ParseMaxRates(opts.MaxRate); err != nil {
+		return nil, err
+	}
+
+	serviceMap, err := ParseServiceMap(opts.ServiceMap)
+	if err != nil {
+		return nil, err
+	}
+	deriver, err := NewDeriver(opts.Derive, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *dbus.Conn
+	if opts.Systemd {
+		var err error
+		if conn, err = dbus.NewWithContext(ctx); err != nil {
+			log.Warning.Println("connecting to systemd over dbus:", err)
+			log.Warning.Println("collecting without service gating until systemd becomes available")
+			conn = nil
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	e := &Exporter{
+		log:           log,
+		maxConcurrent: opts.MaxConcurrent,
+		ctx:           ctx,
+		cancel:        cancel,
+		systemd:       opts.Systemd,
+		conn:          conn,
+		sanity:        sanity,
+		serviceMap:    serviceMap,
+		disableGating: opts.DisableGating,
+
+		honorCollectionTime: opts.HonorCollectionTime,
+
+		service: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_service_active",
+			Help: "Systemd service active.",
+		}, []string{"service"}),
+		serviceMem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_service_memory_bytes",
+			Help: "Memory usage of the systemd service in bytes, requires MemoryAccounting.",
+		}, []string{"service"}),
+		serviceCPU: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_service_cpu_seconds_total",
+			Help: "Total CPU time consumed by the systemd service in seconds, requires CPUAccounting.",
+		}, []string{"service"}),
+		serviceTasks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_service_tasks",
+			Help: "Number of tasks of the systemd service, requires TasksAccounting.",
+		}, []string{"service"}),
+		serviceSwap: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_service_swap_bytes",
+			Help: "Swap usage of the systemd service in bytes, from its cgroup.",
+		}, []string{"service"}),
+		servicePSI: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "node_service_memory_pressure_seconds_total",
+			Help: "Total time in seconds that some or all (full) tasks of the systemd service were stalled on memory, from its cgroup.",
+		}, []string{"service", "type"}),
+		serviceCounter: collector.NewCounterTracker(),
+		serviceStarts:  map[string]serviceStart{},
+		bootPhase: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_boot_phase_duration_seconds",
+			Help: "Duration of the boot phase in seconds as reported by systemd, phases that the system doesn't report are omitted.",
+		}, []string{"phase"}),
+		serviceStartup: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_service_startup_duration_seconds",
+			Help: "Duration in seconds from activating the systemd service until its main process started, for its last start.",
+		}, []string{"service"}),
+		failedUnits: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "node_systemd_failed_units",
+			Help: "Number of failed systemd units.",
+		}),
+		units: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_systemd_units",
+			Help: "Number of systemd units per active state.",
+		}, []string{"state"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_collector_duration_seconds",
+			Help: "Duration of the last collection in seconds, split in waiting for a free slot and running.",
+		}, []string{"collector", "phase"}),
+		success: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_collector_success",
+			Help: "Whether the last collection finished before the scrape timeout without errors or panicking.",
+		}, []string{"collector"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_collector_last_success_timestamp_seconds",
+			Help: "Time of the last successful collection as a Unix timestamp in seconds.",
+		}, []string{"collector"}),
+		lastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_collector_last_duration_seconds",
+			Help: "Duration of the last successful collection in seconds.",
+		}, []string{"collector"}),
+		backoff: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_collector_backoff_seconds",
+			Help: "Remaining cool-down in seconds during which the collector doesn't attempt its backend after consecutive failures, zero when it is attempted.",
+		}, []string{"collector"}),
+		resolvedIP: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_backend_resolved_ip",
+			Help: "IP address that the hostname of a backend of the collector resolved to when last connecting, always one.",
+		}, []string{"collector", "backend", "ip"}),
+		runs: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                        "dex_collector_run_duration_seconds",
+			Help:                        "Distribution of the durations of running the collector in seconds.",
+			Buckets:                     []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			NativeHistogramBucketFactor: opts.NativeHistogramBucketFactor,
+		}, []string{"collector"}),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dex_collector_panics_total",
+			Help: "Number of panics recovered from during collection.",
+		}, []string{"collector"}),
+		skippedState: map[string]bool{},
+		skipped: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_collector_skipped",
+			Help: "Whether the collector was skipped in the last scrape, such as when the services it depends on are inactive.",
+		}, []string{"collector", "reason"}),
+		lastPoll: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dex_collector_last_poll_timestamp_seconds",
+			Help: "Time of the last background collection of collectors with an interval as a Unix timestamp in seconds.",
+		}, []string{"collector"}),
+	}
+	e.activeServices.Store(^uint64(0))
+	e.exposition = NewExposition()
+	e.limiter = NewSeriesLimiter(opts.MaxSeriesPerFamily, opts.SeriesLimits, log)
+	e.deriver = deriver
+	e.throttleFactor = 1
+	e.throttled = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dex_throttled",
+		Help: "Whether background collection is slowed down since the CPU usage of the exporter exceeds --self.max-cpu-percent.",
+	})
+	if opts.Systemd && conn == nil {
+		go e.connect()
+	}
+	return e, nil
+}
+
+// Close aborts the scrapes in progress and waits for them and their collections to finish, up to CloseTimeout, before closing the collectors that implement io.Closer.
+func (e *Exporter) Close() error {
+	e.scrapeMu.Lock()
+	e.closed = true
+	e.scrapeMu.Unlock()
+
+	e.cancel()
+	if e.pollCancel != nil {
+		e.pollCancel()
+		e.pollWG.Wait()
+	}
+	done := make(chan struct{})
+	go func() {
+		e.scrapes.Wait()
+		e.collecting.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(CloseTimeout):
+		e.log.Warning.Println("closing collectors while a scrape or collection is still in progress")
+	}
+
+	e.mu.RLock()
+	for _, c := range e.collectors {
+		if closer, ok := c.Collector.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				e.log.Error.Printf("closing collector %v: %v", c.name, err)
+			}
+		}
+	}
+	e.mu.RUnlock()
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	if e.conn != nil {
+		e.conn.Close()
+	}
+	return nil
+}
+
+// connect retries connecting to systemd in the background, for when D-Bus wasn't available at startup.
+func (e *Exporter) connect() {
+	ticker := time.NewTicker(systemdRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		conn, err := dbus.NewWithContext(e.ctx)
+		if err != nil {
+			e.log.Debug.Println("connecting to systemd over dbus:", err)
+			continue
+		}
+		e.log.Info.Println("connected to systemd over dbus, collectors are gated on their services")
+		e.connMu.Lock()
+		e.conn = conn
+		e.connMu.Unlock()
+		return
+	}
+}
+
+// hasSystemd returns whether the collectors are gated on systemd services.
+func (e *Exporter) hasSystemd() bool {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	return e.conn != nil
+}
+
+var errNoSystemd = fmt.Errorf("systemd is not available")
+
+// Systemd returns the D-Bus connection to systemd, reconnecting if the connection was lost. Reconnecting is abandoned when ctx is done, but the new connection lives as long as the exporter.
+func (e *Exporter) Systemd(ctx context.Context) (*dbus.Conn, error) {
+	e.connMu.Lock()
+	conn := e.conn
+	e.connMu.Unlock()
+	if conn == nil {
+		return nil, errNoSystemd
+	} else if conn.Connected() {
+		return conn, nil
+	}
+
+	e.log.Warning.Println("reconnecting to D-Bus")
+	done := make(chan error, 1)
+	go func() {
+		newConn, err := dbus.NewWithContext(e.ctx)
+		if err == nil {
+			e.connMu.Lock()
+			if e.conn == conn {
+				e.conn.Close()
+				e.conn = newConn
+			} else {
+				newConn.Close() // reconnected concurrently
+			}
+			e.connMu.Unlock()
+		}
+		done <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	return e.conn, nil
+}
+
+// SetMaxCPUPercent sets the soft limit on the CPU usage of the exporter, which is measured between scrapes.
+func (e *Exporter) SetMaxCPUPercent(percent float64) {
+	e.throttleMu.Lock()
+	defer e.throttleMu.Unlock()
+	e.maxCPUPercent = percent
+}
+
+const maxThrottleFactor = 8
+
+// updateThrottle doubles the throttle factor when the CPU usage since the previous scrape exceeds the limit, and halves it when the usage is below half the limit.
+func (e *Exporter) updateThrottle() {
+	e.throttleMu.Lock()
+	defer e.throttleMu.Unlock()
+	if e.maxCPUPercent <= 0.0 {
+		return
+	}
+
+	cpuSeconds, err := collector.SelfCPUSeconds()
+	if err != nil {
+		e.log.Debug.Println("reading CPU usage of the exporter:", err)
+		return
+	}
+	t := time.Now()
+	prevSeconds, prevTime := e.cpuSeconds, e.cpuTime
+	e.cpuSeconds, e.cpuTime = cpuSeconds, t
+	if prevTime.IsZero() || t.Sub(prevTime) <= 0 {
+		return
+	}
+
+	percent := 100.0 * (cpuSeconds - prevSeconds) / t.Sub(prevTime).Seconds()
+	factor := e.throttleFactor
+	if e.maxCPUPercent < percent && factor < maxThrottleFactor {
+		factor *= 2
+	} else if percent < e.maxCPUPercent/2.0 && 1 < factor {
+		factor /= 2
+	}
+	if factor != e.throttleFactor {
+		e.log.Info.Printf("CPU usage of %.1f%%, background collection is slowed down by a factor of %d", percent, factor)
+		e.throttleFactor = factor
+	}
+	if 1 < e.throttleFactor {
+		e.throttled.Set(1.0)
+	} else {
+		e.throttled.Set(0.0)
+	}
+}
+
+// throttle returns the interval slowed down by the throttle factor.
+func (e *Exporter) throttle(interval time.Duration) time.Duration {
+	e.throttleMu.Lock()
+	defer e.throttleMu.Unlock()
+	return interval * time.Duration(e.throttleFactor)
+}
+
+// EnableAllUnits exports the number of units per state, listing all units at most once per interval.
+func (e *Exporter) EnableAllUnits(interval time.Duration) {
+	e.allUnitsInterval = interval
+}
+
+func (e *Exporter) collectUnits(ch chan<- prometheus.Metric) error {
+	e.unitsMu.Lock()
+	defer e.unitsMu.Unlock()
+
+	if e.unitStates == nil || e.throttle(e.allUnitsInterval) <= time.Since(e.unitsTime) {
+		conn, err := e.Systemd(context.Background())
+		if err != nil {
+			return err
+		}
+		units, err := conn.ListUnitsContext(context.Background())
+		if err != nil {
+			return err
+		}
+		e.unitStates = map[string]int{
+			"active":     0,
+			"inactive":   0,
+			"failed":     0,
+			"activating": 0,
+		}
+		for _, unit := range units {
+			state := unit.ActiveState
+			if state == "reloading" {
+				state = "active"
+			}
+			e.unitStates[state]++
+		}
+		e.unitsTime = time.Now()
+	}
+
+	e.failedUnits.Set(float64(e.unitStates["failed"]))
+	for state, n := range e.unitStates {
+		e.units.WithLabelValues(state).Set(float64(n))
+	}
+	e.failedUnits.Collect(ch)
+	e.units.Collect(ch)
+	return nil
+}
+
+// collectServiceAccounting exports the resource usage that systemd accounts for the active services. Properties for which accounting is disabled are omitted.
+func (e *Exporter) collectServiceAccounting(ctx context.Context, conn *dbus.Conn, units []dbus.UnitStatus, ch chan<- prometheus.Metric) {
+	e.serviceMu.Lock()
+	defer e.serviceMu.Unlock()
+
+	e.serviceMem.Reset()
+	e.serviceTasks.Reset()
+	e.serviceSwap.Reset()
+	e.serviceStartup.Reset()
+	for i, unit := range units {
+		service := e.services[i]
+		active := unit.ActiveState == "active" || unit.ActiveState == "reloading"
+		if !active || !strings.HasSuffix(unit.Name, ".service") {
+			e.serviceCounter.Forget(service)
+			e.serviceCPU.DeleteLabelValues(service)
+			e.servicePSI.DeletePartialMatch(prometheus.Labels{"service": service})
+			delete(e.serviceStarts, service)
+			continue
+		}
+		props, err := conn.GetUnitTypePropertiesContext(ctx, unit.Name, "Service")
+		if err != nil {
+			e.log.Warning.Printf("retrieving properties of %v over dbus: %v", unit.Name, err)
+			continue
+		}
+		if mem, ok := props["MemoryCurrent"].(uint64); ok && mem != math.MaxUint64 {
+			e.serviceMem.WithLabelValues(service).Set(float64(mem))
+		}
+		if cpu, ok := props["CPUUsageNSec"].(uint64); ok && cpu != math.MaxUint64 {
+			diff, _ := e.serviceCounter.Delta(cpu, service)
+			e.serviceCPU.WithLabelValues(service).Add(float64(diff) / 1e9)
+		}
+		if tasks, ok := props["TasksCurrent"].(uint64); ok && tasks != math.MaxUint64 {
+			e.serviceTasks.WithLabelValues(service).Set(float64(tasks))
+		}
+		if cgroup, ok := props["ControlGroup"].(string); ok && cgroup != "" {
+			e.collectServiceCgroup(service, path.Join("/sys/fs/cgroup", cgroup))
+		}
+		if start, ok := props["ExecMainStartTimestamp"].(uint64); ok && start != 0 {
+			e.collectServiceStartup(ctx, conn, service, unit.Name, start)
+		}
+	}
+	e.serviceMem.Collect(ch)
+	e.serviceCPU.Collect(ch)
+	e.serviceTasks.Collect(ch)
+	e.serviceSwap.Collect(ch)
+	e.servicePSI.Collect(ch)
+	e.serviceStartup.Collect(ch)
+}
+
+// serviceStart is the startup duration of a service for the start of its main process, in microseconds since the epoch.
+type serviceStart struct {
+	execMainStart uint64
+	duration      float64
+}
+
+// collectServiceStartup sets the time from leaving the inactive state until the main process started. It is only read from systemd when the service was (re)started since the last scrape.
+func (e *Exporter) collectServiceStartup(ctx context.Context, conn *dbus.Conn, service, unit string, execMainStart uint64) {
+	start, ok := e.serviceStarts[service]
+	if !ok || start.execMainStart != execMainStart {
+		prop, err := conn.GetUnitPropertyContext(ctx, unit, "InactiveExitTimestamp")
+		if err != nil {
+			e.log.Warning.Printf("retrieving properties of %v over dbus: %v", unit, err)
+			return
+		}
+		inactiveExit, _ := prop.Value.Value().(uint64)
+		if inactiveExit == 0 || execMainStart < inactiveExit {
+			return
+		}
+		start = serviceStart{
+			execMainStart: execMainStart,
+			duration:      float64(execMainStart-inactiveExit) / 1e6,
+		}
+		e.serviceStarts[service] = start
+	}
+	e.serviceStartup.WithLabelValues(service).Set(start.duration)
+}
+
+// collectBootPhases exports the durations of the boot phases like systemd-analyze does. They are read from systemd until it finished booting, and cached after.
+func (e *Exporter) collectBootPhases(conn *dbus.Conn, ch chan<- prometheus.Metric) {
+	e.serviceMu.Lock()
+	defer e.serviceMu.Unlock()
+
+	if e.bootPhases == nil {
+		timestamps := map[string]uint64{}
+		for _, name := range []string{"Firmware", "Loader", "InitRD", "Userspace", "Finish"} {
+			value, err := conn.GetManagerProperty(name + "TimestampMonotonic")
+			if err != nil {
+				e.log.Warning.Println("retrieving boot timestamps over dbus:", err)
+				return
+			}
+			// value is formatted as a GVariant, such as "@t 1234"
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				e.log.Warning.Printf("bad boot timestamp %v: %v", name, value)
+				return
+			}
+			if timestamps[name], err = strconv.ParseUint(fields[len(fields)-1], 10, 64); err != nil {
+				e.log.Warning.Printf("bad boot timestamp %v: %v", name, value)
+				return
+			}
+		}
+		if timestamps["Finish"] == 0 {
+			return // still booting
+		}
+
+		// firmware and loader timestamps are counted back from the start of the kernel
+		phases := map[string]float64{}
+		if timestamps["Firmware"] != 0 && timestamps["Loader"] != 0 {
+			phases["firmware"] = float64(timestamps["Firmware"]-timestamps["Loader"]) / 1e6
+		}
+		if timestamps["Loader"] != 0 {
+			phases["loader"] = float64(timestamps["Loader"]) / 1e6
+		}
+		if timestamps["InitRD"] != 0 {
+			phases["kernel"] = float64(timestamps["InitRD"]) / 1e6
+			phases["initrd"] = float64(timestamps["Userspace"]-timestamps["InitRD"]) / 1e6
+		} else {
+			phases["kernel"] = float64(timestamps["Userspace"]) / 1e6
+		}
+		phases["userspace"] = float64(timestamps["Finish"]-timestamps["Userspace"]) / 1e6
+		e.bootPhases = phases
+	}
+	for phase, duration := range e.bootPhases {
+		e.bootPhase.WithLabelValues(phase).Set(duration)
+	}
+	e.bootPhase.Collect(ch)
+}
+
+// collectServiceCgroup reads the swap usage and memory pressure from the cgroup v2 directory of a service. Files are missing when the swap controller or PSI is not enabled, and their series are omitted.
+func (e *Exporter) collectServiceCgroup(service, dir string) {
+	if b, err := os.ReadFile(path.Join(dir, "memory.swap.current")); err == nil {
+		if swap, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err == nil {
+			e.serviceSwap.WithLabelValues(service).Set(float64(swap))
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		e.log.Debug.Printf("service %v: %v", service, err)
+	}
+
+	pressure, err := readPressure(path.Join(dir, "memory.pressure"))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			e.log.Debug.Printf("service %v: %v", service, err)
+		}
+		return
+	}
+	for typ, total := range pressure {
+		diff, _ := e.serviceCounter.Delta(total, service, "pressure", typ)
+		e.servicePSI.WithLabelValues(service, typ).Add(float64(diff) / 1e6)
+	}
+}
+
+// readPressure returns the total stall time in microseconds of some and full lines of a PSI file, such as "some avg10=0.00 avg60=0.00 avg300=0.00 total=1234".
+func readPressure(filename string) (map[string]uint64, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pressure := map[string]uint64{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "some" && fields[0] != "full" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if val, ok := strings.CutPrefix(field, "total="); ok {
+				total, err := strconv.ParseUint(val, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%v: bad total %v", filename, val)
+				}
+				pressure[fields[0]] = total
+			}
+		}
+	}
+	return pressure, nil
+}
+
+// isServicePattern returns whether the service is a glob pattern, such as php*-fpm for the services of which the name includes the PHP version.
+func isServicePattern(service string) bool {
+	return strings.ContainsAny(service, "*?[")
+}
+
+// listServices returns the units of the services in the order of e.services. A pattern resolves to the first active unit that matches it, or else to an inactive unit named after the pattern.
+func (e *Exporter) listServices(ctx context.Context, conn *dbus.Conn) ([]dbus.UnitStatus, error) {
+	names, patterns := []string{}, []string{}
+	for _, service := range e.services {
+		if isServicePattern(service) {
+			patterns = append(patterns, servicePattern(service))
+		} else {
+			names = append(names, service)
+		}
+	}
+	units, err := conn.ListUnitsByNamesContext(ctx, names)
+	if err != nil {
+		return nil, err
+	} else if len(units) != len(names) {
+		return nil, fmt.Errorf("systemd listed %d units for %d services", len(units), len(names))
+	}
+	var matches []dbus.UnitStatus
+	if 0 < len(patterns) {
+		if matches, err = conn.ListUnitsByPatternsContext(ctx, nil, patterns); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]dbus.UnitStatus, 0, len(e.services))
+	for _, service := range e.services {
+		if isServicePattern(service) {
+			statuses = append(statuses, matchService(service, matches))
+		} else {
+			statuses = append(statuses, units[0])
+			units = units[1:]
+		}
+	}
+	return statuses, nil
+}
+
+// servicePattern returns the pattern of the unit names of a service pattern.
+func servicePattern(pattern string) string {
+	if !strings.HasSuffix(pattern, ".service") {
+		pattern += ".service"
+	}
+	return pattern
+}
+
+// matchService returns the first active unit that matches the service pattern, or else an inactive unit named after the pattern.
+func matchService(pattern string, units []dbus.UnitStatus) dbus.UnitStatus {
+	status := dbus.UnitStatus{Name: pattern, LoadState: "not-found", ActiveState: "inactive"}
+	for _, unit := range units {
+		if ok, _ := path.Match(servicePattern(pattern), unit.Name); !ok {
+			continue
+		} else if unit.ActiveState == "active" || unit.ActiveState == "reloading" {
+			return unit
+		} else if status.LoadState == "not-found" {
+			status = unit
+		}
+	}
+	return status
+}
+
+func (e *Exporter) addServices(services ...string) uint64 {
+	bits := uint64(0)
+	for _, service := range services {
+		has := false
+		for i := range e.services {
+			if e.services[i] == service {
+				bits |= 1 << i
+				has = true
+				break
+			}
+		}
+		if !has {
+			if len(e.services) == 64 {
+				panic("too many services added: maximum is up to 64 services")
+			}
+			bits |= 1 << len(e.services)
+			e.services = append(e.services, service)
+		}
+	}
+	return bits
+}
+
+func (e *Exporter) AddServices(services ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.addServices(services...)
+}
+
+// Services returns the services that collectors depend on.
+func (e *Exporter) Services() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]string{}, e.services...)
+}
+
+// AddCollector adds a collector that is only collected when all requirements on the services are met, or always if there are none.
+func (e *Exporter) AddCollector(name string, c prometheus.Collector, reqs ...ServiceRequirement) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.disableGating {
+		reqs = nil
+	} else if req, ok := e.serviceMap[name]; ok {
+		reqs = []ServiceRequirement{req}
+	}
+
+	// combine the alternatives of each requirement
+	alternatives := []uint64{0}
+	for _, req := range reqs {
+		if len(req) == 0 {
+			continue
+		}
+		combined := []uint64{}
+		for _, bits := range alternatives {
+			for _, services := range req {
+				combined = append(combined, bits|e.addServices(services...))
+			}
+		}
+		alternatives = combined
+	}
+	e.collectors = append(e.collectors, ServiceCollector{
+		Collector: c,
+		name:      name,
+		services:  alternatives,
+		hung:      &hungRuns{},
+	})
+	rules := []collector.SanityRule{}
+	if ruler, ok := c.(collector.SanityRuler); ok {
+		rules = ruler.SanityRules()
+	}
+	e.sanity.AddRules(name, c, rules)
+}
+
+// ServiceMap returns the alternatives of services of which all must be active per collector, which is empty for collectors that are always collected.
+func (e *Exporter) ServiceMap() map[string][][]string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	m := map[string][][]string{}
+	for _, c := range e.collectors {
+		alternatives := [][]string{}
+		for _, bits := range c.services {
+			services := []string{}
+			for i, service := range e.services {
+				if bits&(1<<i) != 0 {
+					services = append(services, service)
+				}
+			}
+			if 0 < len(services) {
+				alternatives = append(alternatives, services)
+			}
+		}
+		m[c.name] = alternatives
+	}
+	return m
+}
+
+// SetInterval collects the collectors with the given name in the background every interval, instead of at scrape time. Scrapes return the metrics of the last collection. It must be called before Start.
+func (e *Exporter) SetInterval(name string, interval time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if interval <= 0 {
+		return
+	}
+	for i := range e.collectors {
+		if e.collectors[i].name == name {
+			e.collectors[i].poller = &poller{interval: interval}
+		}
+	}
+}
+
+// Start starts collecting the collectors with an interval in the background, until the context of the exporter is done or it is closed.
+func (e *Exporter) Start() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(e.ctx)
+	e.pollCancel = cancel
+	for _, collector := range e.collectors {
+		if collector.poller != nil {
+			e.pollWG.Add(1)
+			go e.poll(ctx, collector)
+		}
+	}
+}
+
+// poll collects a collector every interval, where each collection may take up to the interval. The interval is slowed down when the exporter is throttled.
+func (e *Exporter) poll(ctx context.Context, collector ServiceCollector) {
+	defer e.pollWG.Done()
+	for {
+		next := time.Now().Add(e.throttle(collector.poller.interval))
+		if collector.Active(e.activeServices.Load()) {
+			e.pollOnce(ctx, collector)
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (e *Exporter) pollOnce(ctx context.Context, collector ServiceCollector) {
+	ctx, cancel := context.WithTimeout(ctx, collector.poller.interval)
+	defer cancel()
+
+	metrics := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric, 1)
+	go func() {
+		buffer := []prometheus.Metric{}
+		for metric := range metrics {
+			frozen, err := freezeMetric(metric)
+			if err != nil {
+				e.log.Debug.Printf("collector %v: %v", collector.name, err)
+				continue
+			}
+			buffer = append(buffer, frozen)
+		}
+		done <- buffer
+	}()
+
+	t := time.Now()
+	success := 0.0
+	if e.collect(ctx, collector, metrics) {
+		success = 1.0
+		e.lastSuccess.WithLabelValues(collector.name).Set(float64(time.Now().UnixNano()) / 1e9)
+		e.lastRun.WithLabelValues(collector.name).Set(time.Since(t).Seconds())
+	}
+	close(metrics)
+	collector.poller.store(<-done)
+
+	e.duration.WithLabelValues(collector.name, "run").Set(time.Since(t).Seconds())
+	e.runs.WithLabelValues(collector.name).Observe(time.Since(t).Seconds())
+	e.success.WithLabelValues(collector.name).Set(success)
+	e.lastPoll.WithLabelValues(collector.name).Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+// CheckAll checks the connection to D-Bus and to the backends of all collectors, and writes a table with the results.
+func (e *Exporter) CheckAll(ctx context.Context, w io.Writer) bool {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Fprintf(tw, "%v\tFAIL\t%v\n", name, err)
+			ok = false
+		} else {
+			fmt.Fprintf(tw, "%v\tOK\t\n", name)
+		}
+	}
+
+	if e.systemd {
+		conn, err := e.Systemd(ctx)
+		if err == nil {
+			_, err = e.listServices(ctx, conn)
+		}
+		check("systemd", err)
+	}
+	for _, c := range e.collectors {
+		if checker, ok := c.Collector.(collector.Checker); ok {
+			check(c.name, checker.Check(ctx))
+		}
+	}
+	tw.Flush()
+	return ok
+}
+
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.service.Describe(ch)
+	e.serviceMem.Describe(ch)
+	e.serviceCPU.Describe(ch)
+	e.serviceTasks.Describe(ch)
+	e.serviceSwap.Describe(ch)
+	e.servicePSI.Describe(ch)
+	e.bootPhase.Describe(ch)
+	e.serviceStartup.Describe(ch)
+	if 0 < e.allUnitsInterval {
+		e.failedUnits.Describe(ch)
+		e.units.Describe(ch)
+	}
+	e.duration.Describe(ch)
+	e.success.Describe(ch)
+	e.lastSuccess.Describe(ch)
+	e.lastRun.Describe(ch)
+	e.backoff.Describe(ch)
+	e.resolvedIP.Describe(ch)
+	e.runs.Describe(ch)
+	e.skipped.Describe(ch)
+	e.lastPoll.Describe(ch)
+	e.sanity.invalid.Describe(ch)
+	e.throttled.Describe(ch)
+	e.exposition.Describe(ch)
+	e.limiter.Describe(ch)
+	e.panics.Describe(ch)
+	for _, collector := range e.collectors {
+		collector.Describe(ch)
+	}
+}
+
+// WarmUp collects all collectors once and discards their metrics, so that counters exported as increases have their baseline and the first scrape doesn't expose artifacts. It should be called before serving scrapes.
+func (e *Exporter) WarmUp(ctx context.Context) {
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(done)
+	}()
+	e.CollectContext(ctx, ch)
+	close(ch)
+	<-done
+}
+
+// ScrapeHandler returns a handler that gathers the registry and the exporter. The exporter returns the metrics gathered so far when the scrape timeout sent by Prometheus minus the offset has passed.
+func (e *Exporter) ScrapeHandler(registry *prometheus.Registry, offset time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gatherer, cancel := e.scrapeGatherer(r, registry, offset)
+		defer cancel()
+		e.exposition.Handler(gatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}).ServeHTTP(w, r)
+	})
+}
+
+// JSONHandler returns a handler that gathers the same metrics as ScrapeHandler, but renders them as JSON.
+func (e *Exporter) JSONHandler(registry *prometheus.Registry, offset time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gatherer, cancel := e.scrapeGatherer(r, registry, offset)
+		defer cancel()
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			if len(mfs) == 0 {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			e.log.Error.Println("gathering metrics:", err)
+		}
+		b, err := json.Marshal(MetricFamiliesToJSON(mfs))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// scrapeGatherer returns a gatherer of the registry and the exporter for a scrape request, which must be cancelled afterwards. Derived gauges are added, after which metric families with too many series are limited.
+func (e *Exporter) scrapeGatherer(r *http.Request, registry *prometheus.Registry, offset time.Duration) (prometheus.Gatherer, context.CancelFunc) {
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil && 0.0 < seconds {
+			timeout := time.Duration(seconds * float64(time.Second))
+			if offset < timeout {
+				timeout -= offset
+			}
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+	}
+
+	scrape := prometheus.NewRegistry()
+	scrape.MustRegister(scrapeCollector{e, ctx})
+	return e.limiter.Gatherer(e.deriver.Gatherer(prometheus.Gatherers{registry, scrape})), cancel
+}
+
+type scrapeCollector struct {
+	*Exporter
+	ctx context.Context
+}
+
+func (c scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Exporter.CollectContext(c.ctx, ch)
+}
+
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Exporter) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	t0 := time.Now()
+	defer func() {
+		e.log.Info.Println("collect duration total:", time.Since(t0))
+	}()
+
+	defer e.panics.Collect(ch)
+
+	e.scrapeMu.Lock()
+	if e.closed {
+		e.scrapeMu.Unlock()
+		return
+	}
+	e.scrapes.Add(1)
+	e.scrapeMu.Unlock()
+	defer e.scrapes.Done()
+
+	// abort the scrape when the exporter is closed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(e.ctx, cancel)()
+
+	e.updateThrottle()
+
+	t := time.Now()
+	ok := false
+	activeServices := uint64(0)
+	e.recoverCollect("node_service", func() {
+		if !e.hasSystemd() {
+			// without systemd all collectors are collected
+			activeServices = ^uint64(0)
+			ok = true
+			return
+		}
+		conn, err := e.Systemd(ctx)
+		if err != nil {
+			e.log.Error.Println("connecting to systemd over dbus:", err)
+			return
+		}
+		services, err := e.listServices(ctx, conn)
+		if err != nil {
+			e.log.Error.Println("retrieving systemd services over dbus:", err)
+			return
+		}
+		for i, service := range services {
+			active := 0.0
+			if service.ActiveState == "active" || service.ActiveState == "reloading" {
+				active = 1.0
+				activeServices |= 1 << i
+			}
+			e.service.WithLabelValues(e.services[i]).Set(active)
+		}
+		e.service.Collect(ch)
+		e.collectServiceAccounting(ctx, conn, services, ch)
+		e.collectBootPhases(conn, ch)
+		ok = true
+	})
+	e.log.Info.Println("collect duration for node_service:", time.Since(t))
+	if ok {
+		e.activeServices.Store(activeServices)
+		e.collectAll(ctx, activeServices, ch)
+	} else {
+		// the collectors can't be gated without the state of the services
+		for _, collector := range e.collectors {
+			e.success.WithLabelValues(collector.name).Set(0.0)
+		}
+	}
+	e.duration.Collect(ch)
+	e.success.Collect(ch)
+	e.lastSuccess.Collect(ch)
+	e.lastRun.Collect(ch)
+	e.backoff.Collect(ch)
+	e.resolvedIP.Collect(ch)
+	e.runs.Collect(ch)
+	e.skipped.Collect(ch)
+	e.lastPoll.Collect(ch)
+	e.sanity.invalid.Collect(ch)
+	e.throttled.Collect(ch)
+	e.exposition.Collect(ch)
+	e.limiter.Collect(ch)
+}
+
+// collectAll runs the collectors of which the services are active concurrently, and replays the last collection of the collectors that are polled in the background.
+func (e *Exporter) collectAll(ctx context.Context, activeServices uint64, ch chan<- prometheus.Metric) {
+	if 0 < e.allUnitsInterval && e.hasSystemd() {
+		e.recoverCollect("node_systemd_units", func() {
+			if err := e.collectUnits(ch); err != nil {
+				e.log.Error.Println("listing systemd units over dbus:", err)
+			}
+		})
+	}
+
+	// limit the number of collectors that run concurrently
+	var sem chan struct{}
+	if 0 < e.maxConcurrent {
+		sem = make(chan struct{}, e.maxConcurrent)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, collector := range e.collectors {
+		active := collector.Active(activeServices)
+		e.setSkipped(collector.name, !active)
+		if active && collector.poller != nil {
+			collector.poller.replay(ch)
+		} else if active {
+			wg.Add(1)
+			go func(collector ServiceCollector) {
+				defer wg.Done()
+				t := time.Now()
+				if sem != nil {
+					select {
+					case sem <- struct{}{}:
+						defer func() { <-sem }()
+					case <-ctx.Done():
+						e.log.Warning.Printf("collector %v did not start before the scrape timeout", collector.name)
+						e.success.WithLabelValues(collector.name).Set(0.0)
+						return
+					}
+				}
+				wait := time.Since(t)
+
+				t = time.Now()
+				success := 0.0
+				if e.collect(ctx, collector, ch) {
+					success = 1.0
+					e.lastSuccess.WithLabelValues(collector.name).Set(float64(time.Now().UnixNano()) / 1e9)
+					e.lastRun.WithLabelValues(collector.name).Set(time.Since(t).Seconds())
+				}
+				e.duration.WithLabelValues(collector.name, "wait").Set(wait.Seconds())
+				e.duration.WithLabelValues(collector.name, "run").Set(time.Since(t).Seconds())
+				e.runs.WithLabelValues(collector.name).Observe(time.Since(t).Seconds())
+				e.success.WithLabelValues(collector.name).Set(success)
+			}(collector)
+		}
+	}
+	wg.Wait()
+}
+
+// setSkipped sets whether a collector is skipped because its services are inactive, and logs when that changes.
+func (e *Exporter) setSkipped(name string, skipped bool) {
+	e.skippedMu.Lock()
+	defer e.skippedMu.Unlock()
+
+	if prev, ok := e.skippedState[name]; ok && prev != skipped || !ok && skipped {
+		if skipped {
+			e.log.Info.Printf("collector %v is skipped since its services are inactive", name)
+		} else {
+			e.log.Info.Printf("collector %v is no longer skipped since its services are active", name)
+		}
+	}
+	e.skippedState[name] = skipped
+
+	value := 0.0
+	if skipped {
+		value = 1.0
+	}
+	e.skipped.WithLabelValues(name, "service_inactive").Set(value)
+}
+
+// collect runs a collector and forwards its metrics until the context is done, after which the remaining metrics are discarded. Metrics with sanity rules are held until the collector finishes and are only forwarded if valid. It returns whether the collector finished in time without errors or panicking. Concurrent scrapes run the collector concurrently, but a collector that didn't finish in time keeps running in the background and isn't run again until it finished.
+func (e *Exporter) collect(ctx context.Context, c ServiceCollector, ch chan<- prometheus.Metric) bool {
+	if 0 < c.hung.n.Load() {
+		if c.hung.warned.CompareAndSwap(false, true) {
+			e.log.Warning.Printf("collector %v is skipped until its run that outlived the scrape finishes", c.name)
+		} else {
+			e.log.Debug.Printf("collector %v is skipped until its run that outlived the scrape finishes", c.name)
+		}
+		return false
+	}
+
+	collect := func(ch chan<- prometheus.Metric) error {
+		c.Collect(ch)
+		return nil
+	}
+	if contextCollector, ok := c.Collector.(collector.ContextCollector); ok {
+		collect = func(ch chan<- prometheus.Metric) error {
+			return contextCollector.CollectContext(ctx, ch)
+		}
+	}
+
+	// the run is abandoned when the scrape ends before it finishes
+	var runMu sync.Mutex
+	finished, abandoned := false, false
+
+	metrics := make(chan prometheus.Metric)
+	done := make(chan bool, 1)
+	e.collecting.Add(1)
+	go func() {
+		ok := false
+		defer func() {
+			close(metrics)
+			done <- ok
+			runMu.Lock()
+			finished = true
+			if abandoned && c.hung.n.Add(-1) == 0 {
+				c.hung.warned.Store(false)
+			}
+			runMu.Unlock()
+			e.collecting.Done()
+		}()
+		e.recoverCollect(c.name, func() {
+			var err error
+			if e.honorCollectionTime {
+				err = collectWithTimestamp(c.Collector, collect, metrics)
+			} else {
+				err = collect(metrics)
+			}
+			ok = err == nil
+		})
+		if backoffer, hasBackoff := c.Collector.(collector.Backoffer); hasBackoff {
+			e.backoff.WithLabelValues(c.name).Set(backoffer.Backoff().Seconds())
+		}
+		if resolver, ok := c.Collector.(collector.ResolvedIPer); ok {
+			e.resolvedIP.DeletePartialMatch(prometheus.Labels{"collector": c.name})
+			for backend, ip := range resolver.ResolvedIPs() {
+				e.resolvedIP.WithLabelValues(c.name, backend, ip).Set(1.0)
+			}
+		}
+	}()
+
+	held := []prometheus.Metric{}
+	for {
+		select {
+		case metric, open := <-metrics:
+			if !open {
+				if 0 < len(held) {
+					for _, metric := range e.sanity.Filter(c.name, held) {
+						ch <- metric
+					}
+				}
+				return <-done
+			} else if e.sanity.Checks(c.name, metric) {
+				held = append(held, metric)
+			} else {
+				ch <- metric
+			}
+		case <-ctx.Done():
+			e.log.Warning.Printf("collector %v did not finish before the scrape timeout", c.name)
+			runMu.Lock()
+			if !finished {
+				abandoned = true
+				c.hung.n.Add(1)
+			}
+			runMu.Unlock()
+			go func() {
+				for range metrics {
+				}
+			}()
+			return false
+		}
+	}
+}
+
+// collectWithTimestamp collects the metrics and adds the time the backend was read as their timestamp, which is the start of collection unless the collector implements ReadTimer.
+func collectWithTimestamp(c prometheus.Collector, collect func(chan<- prometheus.Metric) error, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	metrics := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric, 1)
+	go func() {
+		buffer := []prometheus.Metric{}
+		for metric := range metrics {
+			buffer = append(buffer, metric)
+		}
+		done <- buffer
+	}()
+	var err error
+	func() {
+		defer close(metrics)
+		err = collect(metrics)
+	}()
+	buffer := <-done
+
+	if readTimer, ok := c.(collector.ReadTimer); ok {
+		if readTime := readTimer.ReadTime(); !readTime.IsZero() {
+			t = readTime
+		}
+	}
+	for _, metric := range buffer {
+		ch <- prometheus.NewMetricWithTimestamp(t, metric)
+	}
+	return err
+}
+
+// recoverCollect runs a collection and recovers from a panic so that other collectors can finish.
+func (e *Exporter) recoverCollect(name string, collect func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.log.Error.Printf("collector %v panicked: %v\n%s", name, r, debug.Stack())
+			e.panics.WithLabelValues(name).Inc()
+		}
+	}()
+	collect()
+}
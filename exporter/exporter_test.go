@@ -0,0 +1,295 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+func newTestExporter(t *testing.T, opts Options) *Exporter {
+	t.Helper()
+	e, err := New(context.Background(), opts, collector.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+// scrape collects the exporter and returns the metrics.
+func scrape(e *Exporter, ctx context.Context) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		e.CollectContext(ctx, ch)
+		close(ch)
+	}()
+	metrics := []prometheus.Metric{}
+	for metric := range ch {
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// slowCollector blocks in Collect until released, regardless of the scrape timeout.
+type slowCollector struct {
+	release chan struct{}
+	runs    atomic.Int32
+	gauge   prometheus.Gauge
+}
+
+func newSlowCollector() *slowCollector {
+	return &slowCollector{
+		release: make(chan struct{}),
+		gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "slow_value",
+			Help: "Value of the slow collector.",
+		}),
+	}
+}
+
+func (c *slowCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.gauge.Describe(ch)
+}
+
+func (c *slowCollector) Collect(ch chan<- prometheus.Metric) {
+	c.runs.Add(1)
+	<-c.release
+	c.gauge.Collect(ch)
+}
+
+func TestCollectInFlight(t *testing.T) {
+	warnings := &strings.Builder{}
+	e, err := New(context.Background(), Options{}, collector.Log{Warning: log.New(warnings, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	slow := newSlowCollector()
+	e.AddCollector("slow", slow)
+	success := func() float64 {
+		return testutil.ToFloat64(e.success.WithLabelValues("slow"))
+	}
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		scrape(e, ctx)
+		cancel()
+		if v := success(); v != 0.0 {
+			t.Errorf("scrape %d: success is %v while the collector is hung", i, v)
+		}
+	}
+	if runs := slow.runs.Load(); runs != 1 {
+		t.Errorf("hung collector was run %d times, expected once", runs)
+	}
+	if n := strings.Count(warnings.String(), "is skipped"); n != 1 {
+		t.Errorf("skipping the hung collector was warned %d times, expected once:\n%v", n, warnings)
+	}
+
+	close(slow.release)
+	for deadline := time.Now().Add(time.Second); 0 < e.collectors[0].hung.n.Load(); {
+		if time.Now().After(deadline) {
+			t.Fatal("collector still marked as hung after it finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	scrape(e, context.Background())
+	if v := success(); v != 1.0 {
+		t.Errorf("success is %v after the collector recovered", v)
+	}
+	if runs := slow.runs.Load(); runs != 2 {
+		t.Errorf("collector was run %d times, expected twice", runs)
+	}
+}
+
+func TestCollectConcurrentScrapes(t *testing.T) {
+	e := newTestExporter(t, Options{})
+	slow := newSlowCollector()
+	e.AddCollector("slow", slow)
+
+	// both scrapes run the collector while the other is still collecting
+	results := make(chan []prometheus.Metric, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- scrape(e, context.Background())
+		}()
+	}
+	for deadline := time.Now().Add(time.Second); slow.runs.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("collector was run %d times by concurrent scrapes, expected twice", slow.runs.Load())
+		}
+	}
+	close(slow.release)
+
+	for i := 0; i < 2; i++ {
+		found := false
+		for _, metric := range <-results {
+			if metric.Desc() == slow.gauge.Desc() {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("scrape %d: metrics of the collector missing", i)
+		}
+	}
+	if v := testutil.ToFloat64(e.success.WithLabelValues("slow")); v != 1.0 {
+		t.Errorf("success is %v after concurrent scrapes, expected 1", v)
+	}
+}
+
+// closingCollector blocks in CollectContext until the scrape is aborted, and records whether it was closed before CollectContext returned.
+type closingCollector struct {
+	*slowCollector
+	started   chan struct{}
+	cancelled atomic.Bool
+	closes    atomic.Int32
+	early     atomic.Bool // closed before its collection returned
+}
+
+func (c *closingCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	c.runs.Add(1)
+	close(c.started)
+	<-ctx.Done()
+	time.Sleep(10 * time.Millisecond) // cleaning up after the scrape was aborted
+	c.cancelled.Store(true)
+	return ctx.Err()
+}
+
+func (c *closingCollector) Close() error {
+	if !c.cancelled.Load() {
+		c.early.Store(true)
+	}
+	c.closes.Add(1)
+	return nil
+}
+
+func TestCloseDuringScrape(t *testing.T) {
+	e, err := New(context.Background(), Options{}, collector.Log{}.WithDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := &closingCollector{slowCollector: newSlowCollector(), started: make(chan struct{})}
+	e.AddCollector("slow", slow)
+
+	done := make(chan struct{})
+	go func() {
+		scrape(e, context.Background())
+		close(done)
+	}()
+	<-slow.started
+
+	t0 := time.Now()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	} else if CloseTimeout/2 < time.Since(t0) {
+		t.Errorf("closing took %v while aborting the scrape", time.Since(t0))
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("scrape in progress not aborted by closing")
+	}
+	if n := slow.closes.Load(); n != 1 {
+		t.Errorf("collector closed %d times, expected once", n)
+	} else if slow.early.Load() {
+		t.Errorf("collector closed while it was still collecting")
+	}
+
+	if metrics := scrape(e, context.Background()); len(metrics) != 0 {
+		t.Errorf("scrape after closing returned %d metrics", len(metrics))
+	} else if runs := slow.runs.Load(); runs != 1 {
+		t.Errorf("collector was run %d times, expected once before closing", runs)
+	}
+}
+
+func TestServiceRequirements(t *testing.T) {
+	e := newTestExporter(t, Options{})
+	e.AddCollector("mysql", newSlowCollector(), AnyOf("mariadb", "mysql"))
+	e.AddCollector("web", newSlowCollector(), AllOf("nginx", "php-fpm"))
+	e.AddCollector("app", newSlowCollector(), AllOf("nginx"), AnyOf("redis", "memcache"))
+	e.AddCollector("always", newSlowCollector())
+
+	tests := []struct {
+		active   []string
+		expected []string
+	}{
+		{nil, []string{"always"}},
+		{[]string{"mariadb"}, []string{"mysql", "always"}},
+		{[]string{"mysql"}, []string{"mysql", "always"}},
+		{[]string{"mariadb", "mysql"}, []string{"mysql", "always"}},
+		{[]string{"nginx"}, []string{"always"}},
+		{[]string{"php-fpm"}, []string{"always"}},
+		{[]string{"nginx", "php-fpm"}, []string{"web", "always"}},
+		{[]string{"redis"}, []string{"always"}},
+		{[]string{"nginx", "memcache"}, []string{"app", "always"}},
+		{[]string{"nginx", "redis", "php-fpm", "mysql"}, []string{"mysql", "web", "app", "always"}},
+	}
+	for _, tt := range tests {
+		activeServices := uint64(0)
+		for i, service := range e.services {
+			for _, active := range tt.active {
+				if service == active {
+					activeServices |= 1 << i
+				}
+			}
+		}
+		collected := []string{}
+		for _, c := range e.collectors {
+			if c.Active(activeServices) {
+				collected = append(collected, c.name)
+			}
+		}
+		if fmt.Sprint(collected) != fmt.Sprint(tt.expected) {
+			t.Errorf("active %v: got collectors %v, expected %v", tt.active, collected, tt.expected)
+		}
+	}
+}
+
+func TestMatchService(t *testing.T) {
+	units := []dbus.UnitStatus{
+		{Name: "php7.4-fpm.service", LoadState: "loaded", ActiveState: "inactive"},
+		{Name: "php8.2-fpm.service", LoadState: "loaded", ActiveState: "active"},
+		{Name: "redis-server.service", LoadState: "loaded", ActiveState: "active"},
+	}
+	tests := []struct {
+		pattern string
+		units   []dbus.UnitStatus
+		name    string
+		active  string
+	}{
+		{"php*-fpm", units, "php8.2-fpm.service", "active"},
+		{"php*-fpm", units[:1], "php7.4-fpm.service", "inactive"},
+		{"php7*-fpm.service", units, "php7.4-fpm.service", "inactive"},
+		{"redis*", units, "redis-server.service", "active"},
+		{"memcache*", units, "memcache*", "inactive"},
+	}
+	for _, tt := range tests {
+		unit := matchService(tt.pattern, tt.units)
+		if unit.Name != tt.name || unit.ActiveState != tt.active {
+			t.Errorf("%v: got %v %v, expected %v %v", tt.pattern, unit.Name, unit.ActiveState, tt.name, tt.active)
+		}
+	}
+}
+
+func TestParseServiceMap(t *testing.T) {
+	m, err := ParseServiceMap([]string{"nginx=openresty", "redis=redis-server", "redis=valkey", "phpfpm=php*-fpm"})
+	if err != nil {
+		t.Fatal(err)
+	} else if s := fmt.Sprint(m); s != "map[nginx:[[openresty]] phpfpm:[[php*-fpm]] redis:[[redis-server] [valkey]]]" {
+		t.Errorf("got %v", s)
+	}
+
+	for _, item := range []string{"nginx", "=openresty", "nginx=", "phpfpm=php[-fpm"} {
+		if _, err := ParseServiceMap([]string{item}); err == nil {
+			t.Errorf("%v: expected error", item)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package exporter
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Exposition exports the number of metric families and series and the size of the last served exposition, to notice cardinality regressions. The numbers are those of the previous scrape, since they are only known after it has been gathered and written.
+type Exposition struct {
+	families prometheus.Gauge
+	series   prometheus.Gauge
+	bytes    prometheus.Gauge
+}
+
+func NewExposition() *Exposition {
+	return &Exposition{
+		families: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dex_exposition_families",
+			Help: "Number of metric families of the last served exposition.",
+		}),
+		series: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dex_exposition_series",
+			Help: "Number of series of the last served exposition, where histograms and summaries count as one.",
+		}),
+		bytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dex_exposition_bytes",
+			Help: "Size of the last served exposition in bytes, after compression if accepted by the scraper.",
+		}),
+	}
+}
+
+func (e *Exposition) Describe(ch chan<- *prometheus.Desc) {
+	e.families.Describe(ch)
+	e.series.Describe(ch)
+	e.bytes.Describe(ch)
+}
+
+func (e *Exposition) Collect(ch chan<- prometheus.Metric) {
+	e.families.Collect(ch)
+	e.series.Collect(ch)
+	e.bytes.Collect(ch)
+}
+
+// Handler serves the gatherer like promhttp, and counts the metric families, series and bytes that were served.
+func (e *Exposition) Handler(gatherer prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counted := &countingGatherer{Gatherer: gatherer}
+		cw := &countingResponseWriter{ResponseWriter: w}
+		promhttp.HandlerFor(counted, opts).ServeHTTP(cw, r)
+		if counted.gathered {
+			e.families.Set(float64(counted.families))
+			e.series.Set(float64(counted.series))
+			e.bytes.Set(float64(cw.n))
+		}
+	})
+}
+
+type countingGatherer struct {
+	prometheus.Gatherer
+	gathered bool
+	families int
+	series   int
+}
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	g.gathered = true
+	g.families = len(mfs)
+	g.series = 0
+	for _, mf := range mfs {
+		g.series += len(mf.Metric)
+	}
+	return mfs, err
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += n
+	return n, err
+}
@@ -0,0 +1,295 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const protobufAccept = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+
+// newTestRegistry returns a registry with a counter, a gauge and a histogram, whose metric names start with test_.
+func newTestRegistry(opts prometheus.HistogramOpts) *prometheus.Registry {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_requests_total",
+		Help: "Number of requests.",
+	}, []string{"code"})
+	counter.WithLabelValues("200").Add(42.0)
+	counter.WithLabelValues("500").Add(3.0)
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_temperature_celsius",
+		Help: "Temperature in degrees Celsius.",
+	})
+	gauge.Set(-12.5)
+
+	opts.Name, opts.Help = "test_duration_seconds", "Duration in seconds."
+	histogram := prometheus.NewHistogram(opts)
+	for _, v := range []float64{0.002, 0.04, 0.04, 0.3, 7.0} {
+		histogram.Observe(v)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(counter, gauge, histogram)
+	return registry
+}
+
+// testSamples returns the values of the test_ metric families, where histograms are given by their count, sum and cumulative classic buckets other than +Inf.
+func testSamples(mfs []*dto.MetricFamily) []string {
+	samples := []string{}
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "test_") {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := []string{}
+			for _, pair := range m.Label {
+				labels = append(labels, pair.GetName()+"="+pair.GetValue())
+			}
+			name := fmt.Sprintf("%v%v", mf.GetName(), labels)
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, fmt.Sprintf("%v %v", name, m.GetCounter().GetValue()))
+			case dto.MetricType_GAUGE:
+				samples = append(samples, fmt.Sprintf("%v %v", name, m.GetGauge().GetValue()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				samples = append(samples, fmt.Sprintf("%v count %v sum %v", name, h.GetSampleCount(), h.GetSampleSum()))
+				for _, bucket := range h.Bucket {
+					if math.IsInf(bucket.GetUpperBound(), 1) {
+						continue // only explicit in the text format
+					}
+					samples = append(samples, fmt.Sprintf("%v le %v %v", name, bucket.GetUpperBound(), bucket.GetCumulativeCount()))
+				}
+			}
+		}
+	}
+	sort.Strings(samples)
+	return samples
+}
+
+// scrapeFormat requests the handler with the given Accept header and decodes the response.
+func scrapeFormat(t *testing.T, handler http.Handler, accept string) ([]*dto.MetricFamily, expfmt.Format) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%v: got status %d", accept, rec.Code)
+	}
+
+	format := expfmt.ResponseFormat(rec.Result().Header)
+	mfs := []*dto.MetricFamily{}
+	dec := expfmt.NewDecoder(rec.Body, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%v: %v", accept, err)
+		}
+		mfs = append(mfs, mf)
+	}
+	return mfs, format
+}
+
+func TestScrapeFormats(t *testing.T) {
+	e := newTestExporter(t, Options{})
+	registry := newTestRegistry(prometheus.HistogramOpts{Buckets: []float64{0.01, 0.1, 1.0}})
+	handler := e.ScrapeHandler(registry, 0)
+
+	mfs, format := scrapeFormat(t, handler, "")
+	if format != expfmt.FmtText {
+		t.Fatalf("default: got format %v, expected %v", format, expfmt.FmtText)
+	}
+	expected := testSamples(mfs)
+	if len(expected) != 7 {
+		t.Fatalf("text: got samples %v", expected)
+	}
+
+	if mfs, format = scrapeFormat(t, handler, protobufAccept); format != expfmt.FmtProtoDelim {
+		t.Errorf("protobuf: got format %v", format)
+	} else if samples := testSamples(mfs); fmt.Sprint(samples) != fmt.Sprint(expected) {
+		t.Errorf("protobuf: got samples\n%v\nexpected\n%v", samples, expected)
+	}
+
+	// OpenMetrics cannot be decoded by expfmt, so compare its sample lines to the text format
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/openmetrics-text") {
+		t.Errorf("openmetrics: got content type %v", contentType)
+	}
+	for _, line := range []string{
+		`test_requests_total{code="200"} 42.0`,
+		`test_requests_total{code="500"} 3.0`,
+		`test_temperature_celsius -12.5`,
+		`test_duration_seconds_bucket{le="0.1"} 3`,
+		`test_duration_seconds_count 5`,
+		"# EOF",
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("openmetrics: missing %v in\n%v", line, rec.Body.String())
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	e.JSONHandler(registry, 0).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics.json", nil))
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("json: got content type %v", contentType)
+	}
+	metrics := map[string][]JSONSample{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &metrics); err != nil {
+		t.Fatal("json:", err)
+	}
+	samples := []string{}
+	for name, jsonSamples := range metrics {
+		if !strings.HasPrefix(name, "test_") {
+			continue
+		}
+		for _, sample := range jsonSamples {
+			labels := []string{}
+			for key, val := range sample.Labels {
+				labels = append(labels, key+"="+val)
+			}
+			name := fmt.Sprintf("%v%v", name, labels)
+			if sample.Type == "histogram" {
+				samples = append(samples, fmt.Sprintf("%v count %v sum %v", name, *sample.Count, float64(*sample.Sum)))
+				for _, bucket := range sample.Buckets[:len(sample.Buckets)-1] { // without +Inf
+					samples = append(samples, fmt.Sprintf("%v le %v %v", name, float64(bucket.UpperBound), bucket.Count))
+				}
+			} else {
+				samples = append(samples, fmt.Sprintf("%v %v", name, float64(*sample.Value)))
+			}
+		}
+	}
+	sort.Strings(samples)
+	if fmt.Sprint(samples) != fmt.Sprint(expected) {
+		t.Errorf("json: got samples\n%v\nexpected\n%v", samples, expected)
+	}
+}
+
+func TestScrapeNativeHistograms(t *testing.T) {
+	for _, factor := range []float64{0.0, 1.1} {
+		t.Run(fmt.Sprint(factor), func(t *testing.T) {
+			e := newTestExporter(t, Options{NativeHistogramBucketFactor: factor})
+			fast := newSlowCollector()
+			close(fast.release)
+			e.AddCollector("fast", fast)
+			registry := newTestRegistry(prometheus.HistogramOpts{
+				Buckets:                     []float64{0.01, 0.1, 1.0},
+				NativeHistogramBucketFactor: factor,
+			})
+			srv := httptest.NewServer(e.ScrapeHandler(registry, 0))
+			defer srv.Close()
+
+			for i, accept := range []string{protobufAccept, ""} {
+				req, err := http.NewRequest("GET", srv.URL, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Accept", accept)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				mfs, native := []*dto.MetricFamily{}, accept != "" && factor != 0.0
+				dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+				for {
+					mf := &dto.MetricFamily{}
+					if err := dec.Decode(mf); err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					mfs = append(mfs, mf)
+				}
+				resp.Body.Close()
+
+				histograms := map[string]*dto.Histogram{}
+				for _, mf := range mfs {
+					for _, m := range mf.Metric {
+						if mf.GetName() == "test_duration_seconds" || mf.GetName() == "dex_collector_run_duration_seconds" && len(m.Label) == 1 && m.Label[0].GetValue() == "fast" {
+							histograms[mf.GetName()] = m.GetHistogram()
+						}
+					}
+				}
+				for name, count := range map[string]uint64{"test_duration_seconds": 5, "dex_collector_run_duration_seconds": uint64(i + 1)} {
+					h, ok := histograms[name]
+					if !ok {
+						t.Errorf("%q: %v missing", accept, name)
+						continue
+					} else if h.GetSampleCount() != count || len(h.Bucket) == 0 {
+						t.Errorf("%q: %v has count %d and %d classic buckets, expected count %d", accept, name, h.GetSampleCount(), len(h.Bucket), count)
+					}
+					if (h.Schema != nil) != native {
+						t.Errorf("%q: %v has native schema %v, expected native %v", accept, name, h.Schema, native)
+					}
+				}
+				if h := histograms["test_duration_seconds"]; native && h != nil {
+					// bucket counts are encoded as deltas to the previous bucket
+					n, count := h.GetZeroCount(), int64(0)
+					for _, delta := range h.PositiveDelta {
+						count += delta
+						n += uint64(count)
+					}
+					if n != h.GetSampleCount() {
+						t.Errorf("%q: native buckets %v %v hold %d observations, expected %d", accept, h.PositiveSpan, h.PositiveDelta, n, h.GetSampleCount())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExpositionCounts(t *testing.T) {
+	e := NewExposition()
+	registry := newTestRegistry(prometheus.HistogramOpts{Buckets: []float64{0.01, 0.1, 1.0}})
+	handler := e.Handler(registry, promhttp.HandlerOpts{})
+	for _, encoding := range []string{"", "gzip"} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Encoding") != encoding {
+			t.Fatalf("%q: got content encoding %q", encoding, rec.Header().Get("Content-Encoding"))
+		}
+
+		// histograms count as one series
+		if v := testutil.ToFloat64(e.families); v != 3.0 {
+			t.Errorf("%q: got %v families, expected 3", encoding, v)
+		}
+		if v := testutil.ToFloat64(e.series); v != 4.0 {
+			t.Errorf("%q: got %v series, expected 4", encoding, v)
+		}
+		if v := testutil.ToFloat64(e.bytes); v != float64(rec.Body.Len()) {
+			t.Errorf("%q: got %v bytes, expected %d", encoding, v, rec.Body.Len())
+		}
+	}
+
+	// the counts of the last scrape are exposed by the next
+	registry.MustRegister(e)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "dex_exposition_families 3\n") || !strings.Contains(rec.Body.String(), "dex_exposition_series 4\n") {
+		t.Errorf("counts of the previous scrape not exposed:\n%v", rec.Body.String())
+	} else if v := testutil.ToFloat64(e.families); v != 6.0 {
+		t.Errorf("got %v families including the exposition's own, expected 6", v)
+	}
+}
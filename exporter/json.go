@@ -0,0 +1,116 @@
+package exporter
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// JSONFloat is a float that is encoded as a string when it is NaN or infinite, which JSON doesn't support.
+type JSONFloat float64
+
+func (f JSONFloat) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(f)) {
+		return []byte(`"NaN"`), nil
+	} else if math.IsInf(float64(f), 1) {
+		return []byte(`"+Inf"`), nil
+	} else if math.IsInf(float64(f), -1) {
+		return []byte(`"-Inf"`), nil
+	}
+	return strconv.AppendFloat(nil, float64(f), 'g', -1, 64), nil
+}
+
+func (f *JSONFloat) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseFloat(strings.Trim(string(b), `"`), 64)
+	if err != nil {
+		return err
+	}
+	*f = JSONFloat(v)
+	return nil
+}
+
+type JSONBucket struct {
+	UpperBound JSONFloat `json:"le"`
+	Count      uint64    `json:"count"`
+}
+
+type JSONQuantile struct {
+	Quantile JSONFloat `json:"quantile"`
+	Value    JSONFloat `json:"value"`
+}
+
+// JSONSample is a sample of a metric. Counters, gauges and untyped metrics have a value, histograms have cumulative buckets and summaries have quantiles, both with a count and sum.
+type JSONSample struct {
+	Labels    map[string]string `json:"labels"`
+	Type      string            `json:"type"`
+	Value     *JSONFloat        `json:"value,omitempty"`
+	Count     *uint64           `json:"count,omitempty"`
+	Sum       *JSONFloat        `json:"sum,omitempty"`
+	Buckets   []JSONBucket      `json:"buckets,omitempty"`
+	Quantiles []JSONQuantile    `json:"quantiles,omitempty"`
+	Timestamp *int64            `json:"timestamp_ms,omitempty"`
+}
+
+// MetricFamiliesToJSON converts gathered metric families to samples by metric name.
+func MetricFamiliesToJSON(mfs []*dto.MetricFamily) map[string][]JSONSample {
+	jsonFloat := func(f float64) *JSONFloat {
+		v := JSONFloat(f)
+		return &v
+	}
+
+	metrics := make(map[string][]JSONSample, len(mfs))
+	for _, mf := range mfs {
+		samples := make([]JSONSample, 0, len(mf.Metric))
+		for _, m := range mf.Metric {
+			sample := JSONSample{
+				Labels: make(map[string]string, len(m.Label)),
+				Type:   "untyped",
+			}
+			for _, pair := range m.Label {
+				sample.Labels[pair.GetName()] = pair.GetValue()
+			}
+			if m.TimestampMs != nil {
+				sample.Timestamp = m.TimestampMs
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				sample.Type = "counter"
+				sample.Value = jsonFloat(m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				sample.Type = "gauge"
+				sample.Value = jsonFloat(m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				sample.Type = "histogram"
+				h := m.GetHistogram()
+				count := h.GetSampleCount()
+				sample.Count = &count
+				sample.Sum = jsonFloat(h.GetSampleSum())
+				sample.Buckets = make([]JSONBucket, 0, len(h.Bucket)+1)
+				for _, bucket := range h.Bucket {
+					sample.Buckets = append(sample.Buckets, JSONBucket{JSONFloat(bucket.GetUpperBound()), bucket.GetCumulativeCount()})
+				}
+				if len(h.Bucket) == 0 || !math.IsInf(h.Bucket[len(h.Bucket)-1].GetUpperBound(), 1) {
+					sample.Buckets = append(sample.Buckets, JSONBucket{JSONFloat(math.Inf(1)), count})
+				}
+			case dto.MetricType_SUMMARY:
+				sample.Type = "summary"
+				s := m.GetSummary()
+				count := s.GetSampleCount()
+				sample.Count = &count
+				sample.Sum = jsonFloat(s.GetSampleSum())
+				sample.Quantiles = make([]JSONQuantile, 0, len(s.Quantile))
+				for _, quantile := range s.Quantile {
+					sample.Quantiles = append(sample.Quantiles, JSONQuantile{JSONFloat(quantile.GetQuantile()), JSONFloat(quantile.GetValue())})
+				}
+			default:
+				sample.Value = jsonFloat(m.GetUntyped().GetValue())
+			}
+			samples = append(samples, sample)
+		}
+		metrics[mf.GetName()] = samples
+	}
+	return metrics
+}
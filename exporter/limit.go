@@ -0,0 +1,102 @@
+package exporter
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// seriesLimitExceeded is the metric of the limiter itself, which is never limited so that it reports all families.
+const seriesLimitExceeded = "dex_series_limit_exceeded"
+
+// SeriesLimiter drops the series of a metric family above a maximum, so that a collector with runaway label values can't explode the number of series in Prometheus. The limit is checked per scrape, and a warning is logged the first time a family exceeds it.
+type SeriesLimiter struct {
+	log    collector.Log
+	max    int            // zero is unlimited
+	limits map[string]int // by family, overrides max
+
+	mu       sync.Mutex
+	warned   map[string]bool
+	exceeded *prometheus.GaugeVec
+	registry *prometheus.Registry // of exceeded
+}
+
+// NewSeriesLimiter returns a limiter of max series per family, where limits overrides the maximum for specific families. Zero is unlimited.
+func NewSeriesLimiter(max int, limits map[string]int, log collector.Log) *SeriesLimiter {
+	l := &SeriesLimiter{
+		log:    log.WithDefaults(),
+		max:    max,
+		limits: limits,
+		warned: map[string]bool{},
+		exceeded: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: seriesLimitExceeded,
+			Help: "Whether the metric family exceeded its maximum number of series in the scrape, of which the excess series were dropped.",
+		}, []string{"family"}),
+		registry: prometheus.NewRegistry(),
+	}
+	l.registry.MustRegister(l.exceeded)
+	return l
+}
+
+func (l *SeriesLimiter) Describe(ch chan<- *prometheus.Desc) {
+	l.exceeded.Describe(ch)
+}
+
+func (l *SeriesLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.exceeded.Collect(ch)
+}
+
+// Limit drops the series of each family above its limit. The series are sorted by label values by the registry, so the same series are kept for every scrape. Histograms and summaries count as one series.
+func (l *SeriesLimiter) Limit(mfs []*dto.MetricFamily) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, mf := range mfs {
+		name := mf.GetName()
+		if name == seriesLimitExceeded {
+			continue
+		}
+		limit, ok := l.limits[name]
+		if !ok {
+			limit = l.max
+		}
+		if limit <= 0 || len(mf.Metric) <= limit {
+			if l.warned[name] {
+				l.exceeded.WithLabelValues(name).Set(0.0)
+			}
+			continue
+		}
+		if !l.warned[name] {
+			l.log.Warning.Printf("metric %v has %d series, dropping those above the limit of %d", name, len(mf.Metric), limit)
+			l.warned[name] = true
+		}
+		l.exceeded.WithLabelValues(name).Set(1.0)
+		mf.Metric = mf.Metric[:limit]
+	}
+}
+
+// Gatherer returns a gatherer that limits the series of the gathered families. The family of the limiter is replaced by the state after limiting, so that it describes the same scrape.
+func (l *SeriesLimiter) Gatherer(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := gatherer.Gather()
+		l.Limit(mfs)
+
+		exceeded, errExceeded := l.registry.Gather()
+		if errExceeded != nil {
+			return mfs, errExceeded
+		}
+		for i := 0; i < len(mfs); i++ {
+			if mfs[i].GetName() == seriesLimitExceeded {
+				mfs = append(mfs[:i], mfs[i+1:]...)
+				break
+			}
+		}
+		mfs = append(mfs, exceeded...)
+		sort.Slice(mfs, func(i, j int) bool {
+			return mfs[i].GetName() < mfs[j].GetName()
+		})
+		return mfs, err
+	})
+}
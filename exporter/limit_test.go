@@ -0,0 +1,78 @@
+package exporter
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+func TestSeriesLimiter(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	add := func(name string, n int) *prometheus.GaugeVec {
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: name}, []string{"id"})
+		for i := 0; i < n; i++ {
+			gauge.WithLabelValues(strconv.Itoa(i)).Set(1.0)
+		}
+		registry.MustRegister(gauge)
+		return gauge
+	}
+	add("big", 5)
+	add("small", 3)
+	add("override", 8)
+	fits := add("fits", 2)
+
+	l := NewSeriesLimiter(4, map[string]int{"small": 2, "override": 10}, collector.Log{})
+	registry.MustRegister(l) // as the exporter does, which collects before limiting
+	gatherer := l.Gatherer(registry)
+
+	tests := []struct {
+		fitsSeries int
+		series     map[string]int
+		exceeded   map[string]float64
+	}{
+		{2, map[string]int{"big": 4, "small": 2, "override": 8, "fits": 2}, map[string]float64{"big": 1.0, "small": 1.0}},
+		{6, map[string]int{"big": 4, "small": 2, "override": 8, "fits": 4}, map[string]float64{"big": 1.0, "small": 1.0, "fits": 1.0}},
+		{1, map[string]int{"big": 4, "small": 2, "override": 8, "fits": 1}, map[string]float64{"big": 1.0, "small": 1.0, "fits": 0.0}},
+	}
+	for i, tt := range tests {
+		fits.Reset()
+		for j := 0; j < tt.fitsSeries; j++ {
+			fits.WithLabelValues(strconv.Itoa(j)).Set(1.0)
+		}
+
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		families := map[string]*dto.MetricFamily{}
+		for j, mf := range mfs {
+			if _, ok := families[mf.GetName()]; ok {
+				t.Errorf("scrape %d: family %v is duplicated", i, mf.GetName())
+			} else if 0 < j && mf.GetName() < mfs[j-1].GetName() {
+				t.Errorf("scrape %d: family %v is not sorted", i, mf.GetName())
+			}
+			families[mf.GetName()] = mf
+		}
+		for name, n := range tt.series {
+			if series := len(families[name].GetMetric()); series != n {
+				t.Errorf("scrape %d: %v has %d series, expected %d", i, name, series, n)
+			}
+		}
+
+		exceeded := map[string]float64{}
+		for _, m := range families[seriesLimitExceeded].GetMetric() {
+			exceeded[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+		if len(exceeded) != len(tt.exceeded) {
+			t.Errorf("scrape %d: got exceeded %v, expected %v", i, exceeded, tt.exceeded)
+		}
+		for name, v := range tt.exceeded {
+			if exceeded[name] != v {
+				t.Errorf("scrape %d: %v exceeded is %v, expected %v in the same scrape", i, name, exceeded[name], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricMeta is the metadata of a metric family, and the naming conventions it violates.
+type MetricMeta struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Help       string   `json:"help"`
+	Labels     []string `json:"labels"`
+	Violations []string `json:"violations,omitempty"`
+}
+
+// Deprecated returns whether the metric is only kept for compatibility, which is marked by its help text. Its violations are not fatal.
+func (m MetricMeta) Deprecated() bool {
+	return strings.HasPrefix(m.Help, "Deprecated")
+}
+
+// baseUnits are the units that metric names may end in, which the help text must mention.
+var baseUnits = []string{"seconds", "bytes", "celsius", "volts", "watts", "amperes", "joules", "hertz", "meters"}
+
+// nonBaseUnits are the units by metric name suffix that should be converted to a base unit.
+var nonBaseUnits = map[string]string{
+	"kilobytes":    "bytes",
+	"megabytes":    "bytes",
+	"milliseconds": "seconds",
+	"microseconds": "seconds",
+	"minutes":      "seconds",
+	"percent":      "ratio",
+}
+
+// Audit collects all collectors once and returns the metadata of the metrics of the exporter and of the registry, sorted by name. Metrics that are described but weren't collected, such as those of collectors whose services are inactive, have the unknown type. Metrics that are collected but not described, such as those proxied from other exporters, are listed but not checked against the conventions. The result is served by MetadataHandler.
+func (e *Exporter) Audit(ctx context.Context, registry prometheus.Gatherer) []MetricMeta {
+	metas := map[string]*MetricMeta{}
+	checked := map[string]bool{}
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		e.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		if meta, ok := descMeta(desc); ok {
+			metas[meta.Name] = &meta
+			checked[meta.Name] = true
+		}
+	}
+
+	scrape := prometheus.NewRegistry()
+	scrape.MustRegister(scrapeCollector{e, ctx})
+	mfs, err := scrape.Gather()
+	if err != nil {
+		e.log.Debug.Println("audit:", err)
+	}
+	if registry != nil {
+		// the metrics of the registry are not described, but are all our own
+		registryMFs, err := registry.Gather()
+		if err != nil {
+			e.log.Debug.Println("audit:", err)
+		}
+		for _, mf := range registryMFs {
+			checked[mf.GetName()] = true
+		}
+		mfs = append(mfs, registryMFs...)
+	}
+	for _, mf := range mfs {
+		if meta, ok := metas[mf.GetName()]; ok {
+			meta.Type = familyType(mf)
+			continue
+		}
+		metas[mf.GetName()] = &MetricMeta{
+			Name:   mf.GetName(),
+			Type:   familyType(mf),
+			Help:   mf.GetHelp(),
+			Labels: familyLabels(mf),
+		}
+	}
+
+	list := make([]MetricMeta, 0, len(metas))
+	for name, meta := range metas {
+		if checked[name] {
+			meta.Violations = auditMeta(*meta)
+		}
+		list = append(list, *meta)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	e.metadataMu.Lock()
+	e.metadata = list
+	e.metadataMu.Unlock()
+	return list
+}
+
+// MetadataHandler returns a handler that serves the metadata of the last audit as JSON.
+func (e *Exporter) MetadataHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.metadataMu.Lock()
+		metadata := e.metadata
+		e.metadataMu.Unlock()
+		if metadata == nil {
+			http.Error(w, "metadata not audited", http.StatusServiceUnavailable)
+			return
+		}
+		b, err := json.Marshal(metadata)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// auditMeta returns the naming conventions that the metric violates: the unit suffix must match the help text and be a base unit, counters must end in _total and other types must not.
+func auditMeta(meta MetricMeta) []string {
+	violations := []string{}
+	if meta.Type == "counter" && !strings.HasSuffix(meta.Name, "_total") {
+		violations = append(violations, "counter doesn't end in _total")
+	} else if meta.Type != "counter" && meta.Type != "unknown" && strings.HasSuffix(meta.Name, "_total") {
+		violations = append(violations, fmt.Sprintf("%v ends in _total", meta.Type))
+	}
+
+	name := strings.TrimSuffix(meta.Name, "_total")
+	suffix := name[strings.LastIndexByte(name, '_')+1:]
+	words := strings.FieldsFunc(strings.ToLower(meta.Help), func(r rune) bool {
+		return !('a' <= r && r <= 'z')
+	})
+	if unit, ok := nonBaseUnits[suffix]; ok {
+		violations = append(violations, fmt.Sprintf("%v is not a base unit, use %v", suffix, unit))
+	} else if containsString(baseUnits, suffix) && !containsString(words, suffix) {
+		violations = append(violations, fmt.Sprintf("help text doesn't mention the unit %v", suffix))
+	}
+	for i := 0; i+1 < len(words); i++ {
+		if words[i] == "in" && words[i+1] != suffix && containsString(baseUnits, words[i+1]) {
+			violations = append(violations, fmt.Sprintf("help text is in %v but the name doesn't end in _%v", words[i+1], words[i+1]))
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return violations
+}
+
+func containsString(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// descMeta returns the metadata of a descriptor, of which the fields are not otherwise exposed. Its format is Desc{fqName: "name", help: "help", constLabels: {key="value"}, variableLabels: {label}}.
+func descMeta(desc *prometheus.Desc) (MetricMeta, bool) {
+	s := desc.String()
+	unquote := func(key string) (string, bool) {
+		_, s, ok := strings.Cut(s, key+": ")
+		if !ok {
+			return "", false
+		}
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", false
+		}
+		value, err := strconv.Unquote(quoted)
+		return value, err == nil
+	}
+	name, ok := unquote("fqName")
+	if !ok || name == "" {
+		return MetricMeta{}, false
+	}
+	help, _ := unquote("help")
+
+	labels := []string{}
+	if _, s, ok := strings.Cut(s, "constLabels: {"); ok {
+		for !strings.HasPrefix(s, "}") {
+			label, rest, ok := strings.Cut(s, "=")
+			if !ok {
+				break
+			}
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				break
+			}
+			labels = append(labels, label)
+			s = strings.TrimPrefix(rest[len(quoted):], ",")
+		}
+	}
+	if _, s, ok := strings.Cut(s, "variableLabels: {"); ok {
+		s, _, _ = strings.Cut(s, "}")
+		for _, label := range strings.Split(s, ",") {
+			if label = strings.TrimSuffix(strings.TrimPrefix(label, "c("), ")"); label != "" {
+				labels = append(labels, label)
+			}
+		}
+	}
+	sort.Strings(labels)
+	return MetricMeta{Name: name, Type: "unknown", Help: help, Labels: labels}, true
+}
+
+func familyType(mf *dto.MetricFamily) string {
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		return "counter"
+	case dto.MetricType_GAUGE:
+		return "gauge"
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		return "histogram"
+	case dto.MetricType_SUMMARY:
+		return "summary"
+	}
+	return "untyped"
+}
+
+// familyLabels returns the label names of all samples of the family.
+func familyLabels(mf *dto.MetricFamily) []string {
+	labels := []string{}
+	seen := map[string]bool{}
+	for _, m := range mf.Metric {
+		for _, pair := range m.Label {
+			if !seen[pair.GetName()] {
+				seen[pair.GetName()] = true
+				labels = append(labels, pair.GetName())
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
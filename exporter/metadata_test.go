@@ -0,0 +1,48 @@
+package exporter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAuditMeta(t *testing.T) {
+	tests := []struct {
+		meta       MetricMeta
+		violations string
+	}{
+		{MetricMeta{Name: "node_disk_bytes", Type: "gauge", Help: "Hard disk size in bytes."}, "[]"},
+		{MetricMeta{Name: "node_diskio_seconds_total", Type: "counter", Help: "Hard disk time in seconds."}, "[]"},
+		{MetricMeta{Name: "node_up", Type: "gauge", Help: "Whether the node is up."}, "[]"},
+		{MetricMeta{Name: "nginx_requests", Type: "counter", Help: "Number of requests."}, "[counter doesn't end in _total]"},
+		{MetricMeta{Name: "nginx_connections_total", Type: "gauge", Help: "Number of connections."}, "[gauge ends in _total]"},
+		{MetricMeta{Name: "node_disk_kilobytes", Type: "gauge", Help: "Hard disk size in kilobytes."}, "[kilobytes is not a base unit, use bytes]"},
+		{MetricMeta{Name: "node_memory_bytes", Type: "gauge", Help: "Memory usage."}, "[help text doesn't mention the unit bytes]"},
+		{MetricMeta{Name: "node_uptime", Type: "gauge", Help: "Time since boot in seconds."}, "[help text is in seconds but the name doesn't end in _seconds]"},
+		{MetricMeta{Name: "proxied_total", Type: "unknown", Help: "Described but not collected."}, "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.meta.Name, func(t *testing.T) {
+			violations := auditMeta(tt.meta)
+			if violations == nil {
+				violations = []string{}
+			}
+			if s := fmt.Sprint(violations); s != tt.violations {
+				t.Errorf("got %v, expected %v", s, tt.violations)
+			}
+		})
+	}
+}
+
+func TestDescMeta(t *testing.T) {
+	desc := prometheus.NewDesc("test_disk_bytes", "Disk size in \"bytes\", {per mount}.", []string{"mount", "device"}, prometheus.Labels{"host": "a"})
+	meta, ok := descMeta(desc)
+	if !ok {
+		t.Fatal("descriptor not parsed")
+	} else if meta.Name != "test_disk_bytes" || meta.Help != "Disk size in \"bytes\", {per mount}." || meta.Type != "unknown" {
+		t.Errorf("got %+v", meta)
+	} else if fmt.Sprint(meta.Labels) != "[device host mount]" {
+		t.Errorf("got labels %v, expected [device host mount]", meta.Labels)
+	}
+}
@@ -0,0 +1,235 @@
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type sanityObservation struct {
+	value float64
+	time  time.Time
+}
+
+// SanityChecker validates the samples of collectors against their rules. Only samples of metrics with rules are inspected, so that the checks are cheap enough to run at every scrape.
+type SanityChecker struct {
+	log      collector.Log
+	mu       sync.Mutex
+	rules    map[string]map[string][]collector.SanityRule // by collector and metric name
+	names    map[*prometheus.Desc]string
+	maxRates map[string]float64
+	prev     map[string]map[string]sanityObservation // counters by collector and series
+	logged   map[string]bool
+
+	invalid *prometheus.CounterVec
+}
+
+func NewSanityChecker(log collector.Log) *SanityChecker {
+	return &SanityChecker{
+		log:      log.WithDefaults(),
+		rules:    map[string]map[string][]collector.SanityRule{},
+		names:    map[*prometheus.Desc]string{},
+		maxRates: map[string]float64{},
+		prev:     map[string]map[string]sanityObservation{},
+		logged:   map[string]bool{},
+
+		invalid: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dex_invalid_samples_total",
+			Help: "Total number of samples that were dropped since they violated an invariant, such as used memory exceeding the total.",
+		}, []string{"collector", "metric"}),
+	}
+}
+
+// ParseMaxRates parses the maximum increase per second of counters given as metric=rate, which override those of the rules. It must be called before adding rules.
+func (c *SanityChecker) ParseMaxRates(maxRates []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, maxRate := range maxRates {
+		metric, rate, ok := strings.Cut(maxRate, "=")
+		if !ok || metric == "" {
+			return fmt.Errorf("max rate %v must be of the form metric=rate", maxRate)
+		}
+		f, err := strconv.ParseFloat(rate, 64)
+		if err != nil || f < 0.0 {
+			return fmt.Errorf("max rate %v must be of the form metric=rate", maxRate)
+		}
+		c.maxRates[metric] = f
+	}
+	return nil
+}
+
+// AddRules adds the rules of a collector, and rules for its counters with a maximum rate given by ParseMaxRates. The collector is described to find the metrics the rules apply to, so metrics that are not described are not validated.
+func (c *SanityChecker) AddRules(name string, describer prometheus.Collector, rules []collector.SanityRule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.rules[name] == nil {
+		c.rules[name] = map[string][]collector.SanityRule{}
+	}
+	for _, rule := range rules {
+		c.rules[name][rule.Metric] = append(c.rules[name][rule.Metric], rule)
+	}
+
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		describer.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		metric := descName(desc)
+		if _, ok := c.maxRates[metric]; ok && c.rules[name][metric] == nil {
+			c.rules[name][metric] = []collector.SanityRule{{Metric: metric}}
+		}
+		if c.rules[name][metric] != nil {
+			c.names[desc] = metric
+		}
+	}
+}
+
+// descName returns the metric name of a descriptor, which is not otherwise exposed.
+func descName(desc *prometheus.Desc) string {
+	_, s, ok := strings.Cut(desc.String(), "fqName: ")
+	if !ok {
+		return ""
+	}
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return ""
+	}
+	name, _ := strconv.Unquote(quoted)
+	return name
+}
+
+// Checks returns whether the metric needs to be validated.
+func (c *SanityChecker) Checks(name string, metric prometheus.Metric) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.names[metric.Desc()]; ok {
+		return c.rules[name][c.names[metric.Desc()]] != nil
+	}
+	return false
+}
+
+type sanitySample struct {
+	metric prometheus.Metric
+	name   string
+	m      *dto.Metric
+	value  float64
+	valid  bool
+}
+
+// Filter returns the metrics of a collection that don't violate the rules of the collector. Counters that exceed their maximum rate update the baseline, so that a legitimate jump is only dropped once.
+func (c *SanityChecker) Filter(name string, metrics []prometheus.Metric) []prometheus.Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := time.Now()
+	samples := []*sanitySample{}
+	for _, metric := range metrics {
+		sample := &sanitySample{metric: metric, name: c.names[metric.Desc()], m: &dto.Metric{}, valid: true}
+		if err := metric.Write(sample.m); err != nil {
+			continue
+		}
+		switch {
+		case sample.m.Gauge != nil:
+			sample.value = sample.m.GetGauge().GetValue()
+		case sample.m.Counter != nil:
+			sample.value = sample.m.GetCounter().GetValue()
+		case sample.m.Untyped != nil:
+			sample.value = sample.m.GetUntyped().GetValue()
+		}
+		samples = append(samples, sample)
+	}
+
+	// index the samples by metric and labels, except for the compared label
+	index := map[string]*sanitySample{}
+	for _, sample := range samples {
+		for _, rule := range c.rules[name][sample.name] {
+			if rule.Label != "" {
+				index[sanitySeries(sample.name, sample.m, rule.Label, true)] = sample
+			}
+		}
+	}
+
+	prev := c.prev[name]
+	cur := map[string]sanityObservation{}
+	for _, sample := range samples {
+		for _, rule := range c.rules[name][sample.name] {
+			if rule.Label != "" && sanityLabel(sample.m, rule.Label) == rule.Lesser {
+				key := sanitySeries(sample.name, sample.m, rule.Label, false) + rule.Greater
+				if greater, ok := index[key]; ok && greater.value < sample.value {
+					c.drop(name, sample, fmt.Sprintf("%v=%v exceeds %v=%v", rule.Label, rule.Lesser, rule.Label, rule.Greater))
+				}
+			}
+
+			maxRate := rule.MaxRate
+			if f, ok := c.maxRates[sample.name]; ok {
+				maxRate = f
+			}
+			if 0.0 < maxRate && sample.m.Counter != nil {
+				key := sanitySeries(sample.name, sample.m, "", false)
+				cur[key] = sanityObservation{sample.value, t}
+				if p, ok := prev[key]; ok && 0.0 < t.Sub(p.time).Seconds() {
+					if rate := (sample.value - p.value) / t.Sub(p.time).Seconds(); maxRate < rate {
+						c.drop(name, sample, fmt.Sprintf("increase of %g/s exceeds %g/s", rate, maxRate))
+					}
+				}
+			}
+		}
+	}
+	c.prev[name] = cur
+
+	valid := metrics[:0:0]
+	for _, sample := range samples {
+		if sample.valid {
+			valid = append(valid, sample.metric)
+		}
+	}
+	return valid
+}
+
+func (c *SanityChecker) drop(name string, sample *sanitySample, reason string) {
+	if !sample.valid {
+		return
+	}
+	sample.valid = false
+	c.invalid.WithLabelValues(name, sample.name).Inc()
+	if key := name + "\x00" + sample.name; !c.logged[key] {
+		c.log.Warning.Printf("collector %v: dropped sample of %v since %v, further invalid samples are only counted", name, sample.name, reason)
+		c.logged[key] = true
+	}
+}
+
+// sanitySeries returns a key of the metric name and its labels. The value of the given label is left out and the label is put last, so that samples that differ only by that label can be found by appending its value.
+func sanitySeries(name string, m *dto.Metric, label string, withValue bool) string {
+	sb := strings.Builder{}
+	sb.WriteString(name)
+	for _, pair := range m.Label {
+		if pair.GetName() != label {
+			sb.WriteString("\x00" + pair.GetName() + "=" + pair.GetValue())
+		}
+	}
+	if label != "" {
+		sb.WriteString("\x00" + label + "=")
+		if withValue {
+			sb.WriteString(sanityLabel(m, label))
+		}
+	}
+	return sb.String()
+}
+
+func sanityLabel(m *dto.Metric, label string) string {
+	for _, pair := range m.Label {
+		if pair.GetName() == label {
+			return pair.GetValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package exporter
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// memCollector exports a memory gauge by type and a counter.
+type memCollector struct {
+	mem   *prometheus.GaugeVec
+	bytes prometheus.Counter
+}
+
+func newMemCollector() *memCollector {
+	return &memCollector{
+		mem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "test_mem_bytes",
+			Help: "Memory size in bytes.",
+		}, []string{"type"}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "test_bytes_total",
+			Help: "Number of bytes.",
+		}),
+	}
+}
+
+func (c *memCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.mem.Describe(ch)
+	c.bytes.Describe(ch)
+}
+
+func (c *memCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mem.Collect(ch)
+	c.bytes.Collect(ch)
+}
+
+// filter returns the sorted series of the collector that pass the checker, such as test_mem_bytes{type=used}.
+func (c *memCollector) filter(checker *SanityChecker) []string {
+	metrics := []prometheus.Metric{}
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	for metric := range ch {
+		if checker.Checks("mem", metric) {
+			metrics = append(metrics, metric)
+		}
+	}
+
+	series := []string{}
+	for _, metric := range checker.Filter("mem", metrics) {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			continue
+		}
+		labels := ""
+		if 0 < len(m.Label) {
+			labels = fmt.Sprintf("{%v=%v}", m.Label[0].GetName(), m.Label[0].GetValue())
+		}
+		series = append(series, descName(metric.Desc())+labels)
+	}
+	sort.Strings(series)
+	return series
+}
+
+func TestSanityChecker(t *testing.T) {
+	c := newMemCollector()
+	checker := NewSanityChecker(collector.Log{}.WithDefaults())
+	if err := checker.ParseMaxRates([]string{"test_bytes_total=1000"}); err != nil {
+		t.Fatal(err)
+	}
+	checker.AddRules("mem", c, []collector.SanityRule{{Metric: "test_mem_bytes", Label: "type", Lesser: "used", Greater: "total"}})
+
+	c.mem.WithLabelValues("used").Set(1024.0)
+	c.mem.WithLabelValues("total").Set(4096.0)
+	if names := c.filter(checker); fmt.Sprint(names) != "[test_bytes_total test_mem_bytes{type=total} test_mem_bytes{type=used}]" {
+		t.Errorf("valid samples: got %v", names)
+	}
+
+	// used exceeds total and the counter jumps
+	c.mem.WithLabelValues("used").Set(8192.0)
+	c.bytes.Add(1e9)
+	time.Sleep(10 * time.Millisecond)
+	if names := c.filter(checker); fmt.Sprint(names) != "[test_mem_bytes{type=total}]" {
+		t.Errorf("invalid samples: got %v", names)
+	}
+	if n := testutil.ToFloat64(checker.invalid.WithLabelValues("mem", "test_mem_bytes")); n != 1.0 {
+		t.Errorf("dex_invalid_samples_total of test_mem_bytes is %v", n)
+	} else if n := testutil.ToFloat64(checker.invalid.WithLabelValues("mem", "test_bytes_total")); n != 1.0 {
+		t.Errorf("dex_invalid_samples_total of test_bytes_total is %v", n)
+	}
+
+	// the counter jump updated the baseline
+	c.mem.WithLabelValues("used").Set(1024.0)
+	if names := c.filter(checker); len(names) != 3 {
+		t.Errorf("valid samples after the jump: got %v", names)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type FirewallOptions struct {
+	NFTables bool `name:"nftables" desc:"Export the named counters of nftables."`
+	IPTables bool `name:"iptables" desc:"Export the counters of iptables rules with a comment."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+const firewallTimeout = 5 * time.Second
+
+type firewallCounter struct {
+	Labels  []string
+	Packets uint64
+	Bytes   uint64
+}
+
+type Firewall struct {
+	nftables bool
+	iptables bool
+	nftStats map[string]firewallCounter
+	iptStats map[string]firewallCounter
+
+	nftPackets *prometheus.CounterVec
+	nftBytes   *prometheus.CounterVec
+	iptPackets *prometheus.CounterVec
+	iptBytes   *prometheus.CounterVec
+}
+
+func NewFirewall(opts FirewallOptions) (*Firewall, error) {
+	e := &Firewall{
+		nftables: opts.NFTables,
+		iptables: opts.IPTables,
+		nftStats: map[string]firewallCounter{},
+		iptStats: map[string]firewallCounter{},
+
+		nftPackets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nftables_counter_packets_total",
+			Help: "Total number of packets of a named nftables counter.",
+		}, []string{"table", "name"}),
+		nftBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nftables_counter_bytes_total",
+			Help: "Total number of bytes of a named nftables counter.",
+		}, []string{"table", "name"}),
+		iptPackets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "iptables_rule_packets_total",
+			Help: "Total number of packets matched by an iptables rule with a comment.",
+		}, []string{"table", "chain", "comment"}),
+		iptBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "iptables_rule_bytes_total",
+			Help: "Total number of bytes matched by an iptables rule with a comment.",
+		}, []string{"table", "chain", "comment"}),
+	}
+	if e.nftables {
+		if _, err := exec.LookPath("nft"); err != nil {
+			return nil, fmt.Errorf("firewall: %w", err)
+		}
+	}
+	if e.iptables {
+		if _, err := exec.LookPath("iptables-save"); err != nil {
+			return nil, fmt.Errorf("firewall: %w", err)
+		}
+	}
+	e.updateStats(context.Background())
+	return e, nil
+}
+
+func (e *Firewall) Close() error {
+	return nil
+}
+
+// Check lists the firewall counters.
+func (e *Firewall) Check(ctx context.Context) error {
+	if e.nftables {
+		if _, err := getNFTables(ctx); err != nil {
+			return err
+		}
+	}
+	if e.iptables {
+		if _, err := getIPTables(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Firewall) Describe(ch chan<- *prometheus.Desc) {
+	if e.nftables {
+		e.nftPackets.Describe(ch)
+		e.nftBytes.Describe(ch)
+	}
+	if e.iptables {
+		e.iptPackets.Describe(ch)
+		e.iptBytes.Describe(ch)
+	}
+}
+
+func (e *Firewall) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Firewall) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	err := e.updateStats(ctx)
+	if e.nftables {
+		e.nftPackets.Collect(ch)
+		e.nftBytes.Collect(ch)
+	}
+	if e.iptables {
+		e.iptPackets.Collect(ch)
+		e.iptBytes.Collect(ch)
+	}
+	Debug.Println("collect duration for firewall:", time.Since(t))
+	return err
+}
+
+// updateStats logs errors of nftables and iptables separately and returns the last error.
+func (e *Firewall) updateStats(ctx context.Context) error {
+	var lastErr error
+	if e.nftables {
+		if counters, err := getNFTables(ctx); err != nil {
+			Error.Println("firewall nftables:", err)
+			lastErr = err
+		} else {
+			firewallUpdate(e.nftStats, counters, e.nftPackets, e.nftBytes)
+		}
+	}
+	if e.iptables {
+		if counters, err := getIPTables(ctx); err != nil {
+			Error.Println("firewall iptables:", err)
+			lastErr = err
+		} else {
+			firewallUpdate(e.iptStats, counters, e.iptPackets, e.iptBytes)
+		}
+	}
+	return lastErr
+}
+
+// firewallUpdate adds the increases since the last update to the metrics, where counters are reset when the firewall is reloaded. The first observation of a counter is used as baseline and removed counters are deleted.
+func firewallUpdate(stats, counters map[string]firewallCounter, packets, bytes *prometheus.CounterVec) {
+	for key, counter := range stats {
+		if _, ok := counters[key]; !ok {
+			packets.DeleteLabelValues(counter.Labels...)
+			bytes.DeleteLabelValues(counter.Labels...)
+			delete(stats, key)
+		}
+	}
+	for key, counter := range counters {
+		if prev, ok := stats[key]; ok {
+			packets.WithLabelValues(counter.Labels...).Add(float64(collector.CounterDelta(prev.Packets, counter.Packets)))
+			bytes.WithLabelValues(counter.Labels...).Add(float64(collector.CounterDelta(prev.Bytes, counter.Bytes)))
+		}
+		stats[key] = counter
+	}
+}
+
+func firewallRun(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, firewallTimeout)
+	defer cancel()
+	b, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return b, nil
+}
+
+// getNFTables returns the named counters, anonymous rule counters are not included.
+func getNFTables(ctx context.Context) (map[string]firewallCounter, error) {
+	b, err := firewallRun(ctx, "nft", "-j", "list", "counters")
+	if err != nil {
+		return nil, err
+	}
+	doc := struct {
+		NFTables []struct {
+			Counter *struct {
+				Family  string `json:"family"`
+				Table   string `json:"table"`
+				Name    string `json:"name"`
+				Packets uint64 `json:"packets"`
+				Bytes   uint64 `json:"bytes"`
+			} `json:"counter"`
+		} `json:"nftables"`
+	}{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %w", err)
+	}
+
+	counters := map[string]firewallCounter{}
+	for _, item := range doc.NFTables {
+		if item.Counter == nil {
+			continue
+		}
+		table := item.Counter.Family + " " + item.Counter.Table
+		counters[table+"\x00"+item.Counter.Name] = firewallCounter{
+			Labels:  []string{table, item.Counter.Name},
+			Packets: item.Counter.Packets,
+			Bytes:   item.Counter.Bytes,
+		}
+	}
+	return counters, nil
+}
+
+// getIPTables returns the counters of rules with a comment, such as: [12:3456] -A INPUT -p tcp -m comment --comment "ssh" -j ACCEPT
+func getIPTables(ctx context.Context) (map[string]firewallCounter, error) {
+	b, err := firewallRun(ctx, "iptables-save", "-c")
+	if err != nil {
+		return nil, err
+	}
+
+	table := ""
+	counters := map[string]firewallCounter{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "*") {
+			table = line[1:]
+			continue
+		} else if !strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		end := strings.IndexByte(line, ']')
+		if end == -1 {
+			continue
+		}
+		packetsStr, bytesStr, _ := strings.Cut(line[1:end], ":")
+		fields := strings.Fields(line[end+1:])
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		chain, comment := fields[1], iptablesComment(line[end+1:])
+		if comment == "" {
+			continue
+		}
+		packetCount, _ := strconv.ParseUint(packetsStr, 10, 64)
+		byteCount, _ := strconv.ParseUint(bytesStr, 10, 64)
+
+		// rules with the same comment are summed
+		key := table + "\x00" + chain + "\x00" + comment
+		counter := counters[key]
+		counter.Labels = []string{table, chain, comment}
+		counter.Packets += packetCount
+		counter.Bytes += byteCount
+		counters[key] = counter
+	}
+	return counters, nil
+}
+
+func iptablesComment(rule string) string {
+	i := strings.Index(rule, "--comment ")
+	if i == -1 {
+		return ""
+	}
+	rule = rule[i+len("--comment "):]
+	if strings.HasPrefix(rule, "\"") {
+		if end := strings.IndexByte(rule[1:], '"'); end != -1 {
+			return rule[1 : end+1]
+		}
+		return ""
+	}
+	if end := strings.IndexByte(rule, ' '); end != -1 {
+		return rule[:end]
+	}
+	return rule
+}
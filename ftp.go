@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type FTPOptions struct {
+	Enable  bool   `desc:"Count the sessions of the FTP server (vsftpd or ProFTPD)."`
+	Port    int    `desc:"Port of the FTP server."`
+	Xferlog string `desc:"Path to the transfer log in xferlog format to count transfers from (e.g. /var/log/xferlog or /var/log/vsftpd.log with xferlog_std_format)."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+// FTP counts the established connections to the FTP port and the transfers in the xferlog.
+type FTP struct {
+	port uint64
+	log  *LogTail // nil if not counting transfers
+
+	sessions  prometheus.Gauge
+	transfers *prometheus.CounterVec
+	bytes     *prometheus.CounterVec
+}
+
+func NewFTP(opts FTPOptions) (*FTP, error) {
+	if opts.Port <= 0 || 65535 < opts.Port {
+		return nil, fmt.Errorf("ftp: invalid port %v", opts.Port)
+	}
+
+	e := &FTP{
+		port: uint64(opts.Port),
+
+		sessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ftp_sessions",
+			Help: "Number of established connections to the FTP port.",
+		}),
+		transfers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ftp_transfers_total",
+			Help: "Total number of file transfers.",
+		}, []string{"direction"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ftp_transfer_bytes_total",
+			Help: "Total number of bytes transferred.",
+		}, []string{"direction"}),
+	}
+	if opts.Xferlog != "" {
+		log, err := NewLogTail(opts.Xferlog)
+		if err != nil {
+			return nil, fmt.Errorf("ftp: %w", err)
+		}
+		e.log = log
+		for _, direction := range []string{"in", "out"} {
+			e.transfers.WithLabelValues(direction)
+			e.bytes.WithLabelValues(direction)
+		}
+	}
+	return e, nil
+}
+
+func (e *FTP) Close() error {
+	if e.log != nil {
+		return e.log.Close()
+	}
+	return nil
+}
+
+// Check counts the sessions and reads the transfer log.
+func (e *FTP) Check(ctx context.Context) error {
+	if _, err := countTCPSessions(e.port); err != nil {
+		return err
+	} else if e.log != nil {
+		_, err := e.log.Lines()
+		return err
+	}
+	return nil
+}
+
+func (e *FTP) Describe(ch chan<- *prometheus.Desc) {
+	e.sessions.Describe(ch)
+	if e.log != nil {
+		e.transfers.Describe(ch)
+		e.bytes.Describe(ch)
+	}
+}
+
+func (e *FTP) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *FTP) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	errs := []error{}
+	if n, err := countTCPSessions(e.port); err != nil {
+		Error.Println("ftp:", err)
+		errs = append(errs, err)
+	} else {
+		e.sessions.Set(float64(n))
+		e.sessions.Collect(ch)
+	}
+
+	if e.log != nil {
+		if err := e.updateTransfers(); err != nil {
+			Error.Println("ftp:", err)
+			errs = append(errs, err)
+		}
+		e.transfers.Collect(ch)
+		e.bytes.Collect(ch)
+	}
+	Debug.Println("collect duration for ftp:", time.Since(t))
+	return errors.Join(errs...)
+}
+
+// updateTransfers parses xferlog lines: date (5 fields), transfer-time, remote-host, file-size, filename, transfer-type, special-action-flag, direction, access-mode, username, service-name, authentication-method, authenticated-user-id and completion-status. The filename may contain spaces, so the fields after it are counted from the end.
+func (e *FTP) updateTransfers() error {
+	lines, err := e.log.Lines()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 18 {
+			continue
+		}
+		size, err := strconv.ParseUint(fields[7], 10, 64)
+		if err != nil {
+			Debug.Println("ftp: bad xferlog line:", line)
+			continue
+		}
+
+		direction := ""
+		switch fields[len(fields)-7] {
+		case "i":
+			direction = "in"
+		case "o":
+			direction = "out"
+		default:
+			continue // deleted
+		}
+		e.transfers.WithLabelValues(direction).Inc()
+		e.bytes.WithLabelValues(direction).Add(float64(size))
+	}
+	return nil
+}
+
+// countTCPSessions returns the number of established TCP connections to a local port, from /proc/net/tcp and /proc/net/tcp6.
+func countTCPSessions(port uint64) (int, error) {
+	n := 0
+	for _, filename := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(filename)
+		if errors.Is(err, os.ErrNotExist) && filename == "/proc/net/tcp6" {
+			continue // IPv6 disabled
+		} else if err != nil {
+			return 0, err
+		}
+
+		// sl local_address rem_address st ...
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != "01" { // TCP_ESTABLISHED
+				continue
+			}
+			colon := strings.LastIndexByte(fields[1], ':')
+			if colon == -1 {
+				continue
+			}
+			if localPort, err := strconv.ParseUint(fields[1][colon+1:], 16, 16); err == nil && localPort == port {
+				n++
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return 0, fmt.Errorf("%v: %w", filename, err)
+		}
+	}
+	return n, nil
+}
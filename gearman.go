@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type GearmanOptions struct {
+	URI string `desc:"A URI or unix socket path for connecting to the Gearman admin port (e.g. localhost:4730)."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+type Gearman struct {
+	scheme, host string
+
+	jobs    *prometheus.GaugeVec
+	workers *prometheus.GaugeVec
+}
+
+func NewGearman(opts GearmanOptions) (*Gearman, error) {
+	scheme, host, err := collector.ParseURI(opts.URI)
+	if err != nil {
+		return nil, err
+	}
+	return &Gearman{
+		scheme: scheme,
+		host:   host,
+
+		jobs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gearman_jobs",
+			Help: "Number of queued or running jobs.",
+		}, []string{"function", "state"}),
+		workers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gearman_workers",
+			Help: "Number of workers registered for a function.",
+		}, []string{"function"}),
+	}, nil
+}
+
+func (e *Gearman) Close() error {
+	return nil
+}
+
+// Check requests the status of the job server.
+func (e *Gearman) Check(ctx context.Context) error {
+	_, err := e.getStats()
+	return err
+}
+
+func (e *Gearman) Describe(ch chan<- *prometheus.Desc) {
+	e.jobs.Describe(ch)
+	e.workers.Describe(ch)
+}
+
+func (e *Gearman) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Gearman) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	stats, err := e.getStats()
+	if err != nil {
+		Error.Println("gearman:", err)
+		return err
+	}
+	e.jobs.Reset()
+	e.workers.Reset()
+	for function, stat := range stats {
+		e.jobs.WithLabelValues(function, "queued").Set(float64(stat.Queued))
+		e.jobs.WithLabelValues(function, "running").Set(float64(stat.Running))
+		e.workers.WithLabelValues(function).Set(float64(stat.Workers))
+	}
+	e.jobs.Collect(ch)
+	e.workers.Collect(ch)
+	Debug.Println("collect duration for gearman:", time.Since(t))
+	return nil
+}
+
+type gearmanStats struct {
+	Queued  uint64
+	Running uint64
+	Workers uint64
+}
+
+func (e *Gearman) getStats() (map[string]gearmanStats, error) {
+	conn, err := net.DialTimeout(e.scheme, e.host, 1*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	stats := map[string]gearmanStats{}
+	lines, err := gearmanCommand(conn, r, "status")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		// function total running available
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected status line: %v", line)
+		}
+		total, _ := strconv.ParseUint(fields[1], 10, 64)
+		running, _ := strconv.ParseUint(fields[2], 10, 64)
+		stat := gearmanStats{Running: running}
+		if running < total {
+			stat.Queued = total - running
+		}
+		stats[fields[0]] = stat
+	}
+
+	lines, err = gearmanCommand(conn, r, "workers")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		// fd ip client-id : function...
+		_, functions, ok := strings.Cut(line, " : ")
+		if !ok {
+			continue
+		}
+		for _, function := range strings.Fields(functions) {
+			stat := stats[function]
+			stat.Workers++
+			stats[function] = stat
+		}
+	}
+	return stats, nil
+}
+
+// gearmanCommand sends an admin command and returns the response lines up to the terminating dot.
+func gearmanCommand(conn net.Conn, r *bufio.Reader, cmd string) ([]string, error) {
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", cmd, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "." {
+			return lines, nil
+		} else if strings.HasPrefix(line, "ERR ") {
+			return nil, fmt.Errorf("%v: %v", cmd, line[4:])
+		}
+		lines = append(lines, line)
+	}
+}
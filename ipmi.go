@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type IPMIOptions struct {
+	Enable   bool `desc:"Export IPMI sensors and power readings using ipmitool."`
+	Interval int  `desc:"Seconds between reading the IPMI sensors in the background."`
+}
+
+const ipmiTimeout = 20 * time.Second
+
+type ipmiSensor struct {
+	Name  string
+	Unit  string
+	Value float64
+	State string
+}
+
+type ipmiStats struct {
+	Sensors  []ipmiSensor
+	Power    float64
+	HasPower bool
+}
+
+// IPMI reads the sensors in the background since IPMI is slow, and exports the last read values.
+type IPMI struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats ipmiStats
+	read  time.Time
+	quit  chan struct{}
+	done  chan struct{}
+
+	value *prometheus.GaugeVec
+	state *prometheus.GaugeVec
+	power prometheus.Gauge
+}
+
+func NewIPMI(opts IPMIOptions) (*IPMI, error) {
+	if _, err := exec.LookPath("ipmitool"); err != nil {
+		return nil, fmt.Errorf("ipmi: %w", err)
+	} else if opts.Interval <= 0 {
+		return nil, fmt.Errorf("ipmi: interval must be positive")
+	}
+	e := &IPMI{
+		interval: time.Duration(opts.Interval) * time.Second,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+
+		value: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipmi_sensor_value",
+			Help: "Value of the IPMI sensor.",
+		}, []string{"name", "unit"}),
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipmi_sensor_state",
+			Help: "State of the IPMI sensor, being 0 for ok, 1 for warning and 2 for critical.",
+		}, []string{"name"}),
+		power: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ipmi_power_watts",
+			Help: "Instantaneous power reading of the chassis in watts.",
+		}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Close stops reading the sensors.
+func (e *IPMI) Close() error {
+	close(e.quit)
+	<-e.done
+	return nil
+}
+
+// Check reads the sensors.
+func (e *IPMI) Check(ctx context.Context) error {
+	_, err := ipmiSensors(ctx)
+	return err
+}
+
+// ReadTime returns the time the sensors were last read.
+func (e *IPMI) ReadTime() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.read
+}
+
+func (e *IPMI) Describe(ch chan<- *prometheus.Desc) {
+	e.value.Describe(ch)
+	e.state.Describe(ch)
+	e.power.Describe(ch)
+}
+
+func (e *IPMI) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	stats := e.stats
+	e.mu.Unlock()
+
+	e.value.Reset()
+	e.state.Reset()
+	for _, sensor := range stats.Sensors {
+		if sensor.Unit != "discrete" {
+			e.value.WithLabelValues(sensor.Name, sensor.Unit).Set(sensor.Value)
+		}
+		switch sensor.State {
+		case "ok":
+			e.state.WithLabelValues(sensor.Name).Set(0.0)
+		case "nc":
+			e.state.WithLabelValues(sensor.Name).Set(1.0)
+		case "cr", "nr":
+			e.state.WithLabelValues(sensor.Name).Set(2.0)
+		}
+	}
+	e.value.Collect(ch)
+	e.state.Collect(ch)
+	if stats.HasPower {
+		e.power.Set(stats.Power)
+		e.power.Collect(ch)
+	}
+}
+
+func (e *IPMI) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.update()
+		select {
+		case <-e.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *IPMI) update() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-e.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	t := time.Now()
+	sensors, err := ipmiSensors(ctx)
+	if err != nil {
+		Error.Println("ipmi:", err)
+		return
+	}
+	stats := ipmiStats{
+		Sensors: sensors,
+	}
+	if power, err := ipmiPower(ctx); err != nil {
+		Debug.Println("ipmi: power reading:", err)
+	} else {
+		stats.Power = power
+		stats.HasPower = true
+	}
+
+	e.mu.Lock()
+	e.stats = stats
+	e.read = t
+	e.mu.Unlock()
+	Debug.Println("read duration for ipmi:", time.Since(t))
+}
+
+func ipmiRun(ctx context.Context, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ipmiTimeout)
+	defer cancel()
+	b, err := exec.CommandContext(ctx, "ipmitool", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipmitool %v: %w", strings.Join(args, " "), err)
+	}
+	return b, nil
+}
+
+// ipmiSensors parses lines such as: CPU Temp | 45.000 | degrees C | ok | ...
+func ipmiSensors(ctx context.Context) ([]ipmiSensor, error) {
+	b, err := ipmiRun(ctx, "sensor")
+	if err != nil {
+		return nil, err
+	}
+
+	sensors := []ipmiSensor{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < 4 {
+			continue
+		}
+		sensor := ipmiSensor{
+			Name:  strings.TrimSpace(fields[0]),
+			Unit:  strings.ReplaceAll(strings.ToLower(strings.TrimSpace(fields[2])), " ", "_"),
+			State: strings.TrimSpace(fields[3]),
+		}
+		if sensor.State == "na" {
+			continue
+		}
+		if sensor.Unit != "discrete" {
+			value, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+			if err != nil {
+				continue
+			}
+			sensor.Value = value
+		}
+		sensors = append(sensors, sensor)
+	}
+	return sensors, nil
+}
+
+// ipmiPower parses the line: Instantaneous power reading: 220 Watts
+func ipmiPower(ctx context.Context) (float64, error) {
+	b, err := ipmiRun(ctx, "dcmi", "power", "reading")
+	if err != nil {
+		return 0.0, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(key) == "Instantaneous power reading" {
+			fields := strings.Fields(val)
+			if len(fields) == 0 {
+				break
+			}
+			return strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	return 0.0, fmt.Errorf("no instantaneous power reading")
+}
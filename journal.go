@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type JournalOptions struct {
+	Enable    bool     `desc:"Count the systemd journal entries per unit and priority."`
+	Unit      []string `desc:"Systemd unit whose journal entries are counted, can be repeated. Defaults to the watched services."`
+	StateFile string   `desc:"File to persist the journal cursor to, so that restarts don't count entries twice."`
+}
+
+var journalPriorities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Journal follows the journal entries of units using journalctl, like SSH does. Only counters are kept, so memory is bounded when the journal floods.
+type Journal struct {
+	units    []string
+	follower *journalFollower
+
+	errors   *prometheus.CounterVec
+	messages *prometheus.CounterVec
+}
+
+func NewJournal(opts JournalOptions) (*Journal, error) {
+	if len(opts.Unit) == 0 {
+		return nil, fmt.Errorf("journal: no units to follow")
+	}
+
+	// journalctl matches fields literally, so glob patterns such as php*-fpm are passed with --unit, which also matches the entries that systemd and coredumps log about the unit and are filtered out by count
+	units := []string{}
+	args := []string{"--output-fields=PRIORITY,_SYSTEMD_UNIT"}
+	for _, unit := range opts.Unit {
+		if !strings.Contains(unit, ".") {
+			unit += ".service"
+		}
+		if _, err := path.Match(unit, ""); err != nil {
+			return nil, fmt.Errorf("journal: bad unit %v: %w", unit, err)
+		} else if strings.ContainsAny(unit, "*?[") {
+			args = append(args, "--unit="+unit)
+		} else {
+			args = append(args, "_SYSTEMD_UNIT="+unit)
+		}
+		units = append(units, unit)
+	}
+
+	e := &Journal{
+		units: units,
+
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "journal_errors_total",
+			Help: "Total number of journal entries with priority err or higher.",
+		}, []string{"unit"}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "journal_messages_total",
+			Help: "Total number of journal entries per priority.",
+		}, []string{"unit", "priority"}),
+	}
+	for _, unit := range units {
+		if !strings.ContainsAny(unit, "*?[") {
+			e.errors.WithLabelValues(unit)
+		}
+	}
+
+	var err error
+	if e.follower, err = newJournalFollower("journal", opts.StateFile, args, e.count); err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	return e, nil
+}
+
+// Close stops following the journal and saves the cursor.
+func (e *Journal) Close() error {
+	return e.follower.Close()
+}
+
+// Check reads the journal.
+func (e *Journal) Check(ctx context.Context) error {
+	return exec.CommandContext(ctx, "journalctl", "--lines=0", "--no-pager", "--quiet").Run()
+}
+
+func (e *Journal) Describe(ch chan<- *prometheus.Desc) {
+	e.errors.Describe(ch)
+	e.messages.Describe(ch)
+}
+
+func (e *Journal) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+// CollectContext returns an error when journalctl isn't running or can't read the journal files, the counters are still exported.
+func (e *Journal) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	err := e.follower.SaveCursor()
+	if err != nil {
+		Error.Println("journal:", err)
+	}
+	e.errors.Collect(ch)
+	e.messages.Collect(ch)
+	return errors.Join(err, e.follower.Err())
+}
+
+// count counts a journal entry of one of the units.
+func (e *Journal) count(b []byte) {
+	entry := struct {
+		Priority string `json:"PRIORITY"`
+		Unit     string `json:"_SYSTEMD_UNIT"`
+	}{}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		Debug.Println("journal: bad journal entry:", err)
+		return
+	} else if !e.matchUnit(entry.Unit) {
+		return
+	}
+
+	if priority, err := strconv.Atoi(entry.Priority); err == nil && 0 <= priority && priority < len(journalPriorities) {
+		e.messages.WithLabelValues(entry.Unit, journalPriorities[priority]).Inc()
+		if priority <= 3 {
+			e.errors.WithLabelValues(entry.Unit).Inc()
+		}
+	}
+}
+
+// matchUnit returns whether the unit is one of the units or matches one of the unit patterns.
+func (e *Journal) matchUnit(unit string) bool {
+	for _, pattern := range e.units {
+		if ok, _ := path.Match(pattern, unit); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalFollower follows the systemd journal using journalctl, which handles journal rotation. This avoids cgo, which is required to use libsystemd directly. The cursor is persisted to the state file so that restarts don't handle entries twice, and journalctl is restarted when it exits.
+type journalFollower struct {
+	name      string
+	args      []string
+	stateFile string
+	entry     func([]byte)
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	cursor string
+	saved  string
+	err    error
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// newJournalFollower starts following the journal entries selected by the journalctl arguments, such as matches and --unit, and calls entry with each entry in JSON. The name prefixes log messages.
+func newJournalFollower(name, stateFile string, args []string, entry func([]byte)) (*journalFollower, error) {
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		return nil, err
+	}
+
+	cursor := ""
+	if stateFile != "" {
+		b, err := os.ReadFile(stateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		cursor = strings.TrimSpace(string(b))
+	}
+
+	f := &journalFollower{
+		name:      name,
+		args:      args,
+		stateFile: stateFile,
+		entry:     entry,
+		cursor:    cursor,
+		saved:     cursor,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go f.run()
+	return f, nil
+}
+
+// Close stops following the journal and saves the cursor.
+func (f *journalFollower) Close() error {
+	close(f.quit)
+	f.mu.Lock()
+	if f.cmd != nil {
+		f.cmd.Process.Kill()
+	}
+	f.mu.Unlock()
+	<-f.done
+	return f.SaveCursor()
+}
+
+// Err returns an error when journalctl isn't running or can't read the journal files.
+func (f *journalFollower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// SaveCursor writes the cursor of the last entry to the state file if it changed.
+func (f *journalFollower) SaveCursor() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stateFile == "" || f.cursor == f.saved {
+		return nil
+	}
+
+	if err := WriteStateFile(f.stateFile, []byte(f.cursor+"\n")); err != nil {
+		return err
+	}
+	f.saved = f.cursor
+	return nil
+}
+
+// run follows the journal, restarting journalctl when it exits.
+func (f *journalFollower) run() {
+	defer close(f.done)
+	for {
+		err := f.follow()
+		select {
+		case <-f.quit:
+			return
+		default:
+		}
+		Warning.Printf("%v: journalctl stopped: %v", f.name, err)
+		f.mu.Lock()
+		f.err = fmt.Errorf("journalctl stopped: %v", err)
+		f.mu.Unlock()
+		select {
+		case <-f.quit:
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func (f *journalFollower) follow() error {
+	args := append([]string{"--follow", "--output=json", "--no-pager"}, f.args...)
+	f.mu.Lock()
+	if f.cursor != "" {
+		args = append(args, "--after-cursor="+f.cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+	f.mu.Unlock()
+
+	cmd := exec.Command("journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	} else if err := cmd.Start(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	select {
+	case <-f.quit:
+		cmd.Process.Kill()
+	default:
+	}
+	f.cmd = cmd
+	f.err = nil
+	f.mu.Unlock()
+
+	// journalctl keeps running when it can't open (all) journal files, such as without the systemd-journal group
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			Warning.Printf("%v: %v", f.name, scanner.Text())
+			if strings.Contains(scanner.Text(), "insufficient permissions") {
+				f.mu.Lock()
+				f.err = fmt.Errorf("journal files not readable: %v", scanner.Text())
+				f.mu.Unlock()
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := struct {
+			Cursor string `json:"__CURSOR"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			Debug.Printf("%v: bad journal entry: %v", f.name, err)
+			continue
+		}
+
+		f.entry(scanner.Bytes())
+		f.mu.Lock()
+		f.cursor = entry.Cursor
+		f.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		<-stderrDone
+		cmd.Wait()
+		return err
+	}
+	<-stderrDone
+	return cmd.Wait()
+}
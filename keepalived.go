@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type KeepalivedOptions struct {
+	File    string   `desc:"Path of the state dump of keepalived, either the JSON dump (e.g. /tmp/keepalived.json, requires keepalived built with --enable-json) or the data dump (e.g. /tmp/keepalived.data). Empty disables reading the VRRP state."`
+	Signal  bool     `desc:"Signal keepalived to write the dump before reading it, otherwise the dump must be written by other means."`
+	PidFile string   `name:"pid-file" desc:"Path of the PID file of the keepalived parent process, used for signaling."`
+	VIP     []string `desc:"Virtual IP address that is checked for on the interfaces of the host, can be repeated. This doesn't require keepalived."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+const keepalivedTimeout = 2 * time.Second
+
+// keepalivedStates maps the VRRP states of keepalived to exported values, the INIT state is not exported.
+var keepalivedStates = map[string]float64{
+	"BACKUP": 0.0,
+	"MASTER": 1.0,
+	"FAULT":  2.0,
+}
+
+// keepalivedJSONStates are the state numbers of the JSON dump.
+var keepalivedJSONStates = map[int]string{
+	0: "INIT",
+	1: "BACKUP",
+	2: "MASTER",
+	3: "FAULT",
+}
+
+// Keepalived exports the VRRP state of keepalived instances from its state dump, and whether virtual IP addresses are assigned to this host.
+type Keepalived struct {
+	file    string
+	pidFile string
+	signal  syscall.Signal
+	vips    []net.IP
+	states  map[string]float64
+
+	state       *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+	ipPresent   *prometheus.GaugeVec
+}
+
+func NewKeepalived(opts KeepalivedOptions) (*Keepalived, error) {
+	vips := []net.IP{}
+	for _, vip := range opts.VIP {
+		addr, _, _ := strings.Cut(vip, "/")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("keepalived: bad VIP %v", vip)
+		}
+		vips = append(vips, ip)
+	}
+
+	e := &Keepalived{
+		file:    opts.File,
+		pidFile: opts.PidFile,
+		vips:    vips,
+		states:  map[string]float64{},
+
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "keepalived_vrrp_state",
+			Help: "VRRP state of the instance, being 0 for BACKUP, 1 for MASTER and 2 for FAULT.",
+		}, []string{"instance"}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keepalived_vrrp_transitions_total",
+			Help: "Total number of observed VRRP state changes of the instance.",
+		}, []string{"instance"}),
+		ipPresent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_ip_present",
+			Help: "Virtual IP address is assigned to an interface of this host.",
+		}, []string{"address"}),
+	}
+	if opts.File != "" && opts.Signal {
+		// the signal numbers depend on the version of keepalived
+		name := "DATA"
+		if filepath.Ext(opts.File) == ".json" {
+			name = "JSON"
+		}
+		b, err := exec.Command("keepalived", "--signum="+name).Output()
+		if err != nil {
+			return nil, fmt.Errorf("keepalived: signal number of %v: %w", name, err)
+		}
+		signum, err := strconv.Atoi(string(bytes.TrimSpace(b)))
+		if err != nil || signum <= 0 {
+			return nil, fmt.Errorf("keepalived: signal number of %v not supported", name)
+		}
+		e.signal = syscall.Signal(signum)
+	}
+	return e, nil
+}
+
+func (e *Keepalived) Close() error {
+	return nil
+}
+
+// Check reads the state dump and the interface addresses.
+func (e *Keepalived) Check(ctx context.Context) error {
+	if e.file != "" {
+		if _, err := e.readStates(ctx); err != nil {
+			return err
+		}
+	}
+	_, err := net.InterfaceAddrs()
+	return err
+}
+
+func (e *Keepalived) Describe(ch chan<- *prometheus.Desc) {
+	e.state.Describe(ch)
+	e.transitions.Describe(ch)
+	e.ipPresent.Describe(ch)
+}
+
+func (e *Keepalived) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Keepalived) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	errs := []error{}
+	if e.file != "" {
+		states, err := e.readStates(ctx)
+		if err != nil {
+			Error.Println("keepalived:", err)
+			errs = append(errs, fmt.Errorf("keepalived: %w", err))
+		} else {
+			e.state.Reset()
+			for instance, state := range states {
+				value, ok := keepalivedStates[state]
+				if !ok {
+					continue
+				}
+				if prev, ok := e.states[instance]; ok && prev != value {
+					Info.Printf("keepalived: instance %v changed to %v", instance, state)
+					e.transitions.WithLabelValues(instance).Inc()
+				} else if !ok {
+					e.transitions.WithLabelValues(instance)
+				}
+				e.states[instance] = value
+				e.state.WithLabelValues(instance).Set(value)
+			}
+			e.state.Collect(ch)
+			e.transitions.Collect(ch)
+		}
+	}
+
+	if 0 < len(e.vips) {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			Error.Println("keepalived:", err)
+			errs = append(errs, fmt.Errorf("keepalived: %w", err))
+		} else {
+			for _, vip := range e.vips {
+				present := 0.0
+				for _, addr := range addrs {
+					if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(vip) {
+						present = 1.0
+						break
+					}
+				}
+				e.ipPresent.WithLabelValues(vip.String()).Set(present)
+			}
+			e.ipPresent.Collect(ch)
+		}
+	}
+	Debug.Println("collect duration for keepalived:", time.Since(t))
+	return errors.Join(errs...)
+}
+
+// readStates returns the VRRP state per instance, after signaling keepalived to write its state dump and waiting for it to be written.
+func (e *Keepalived) readStates(ctx context.Context) (map[string]string, error) {
+	if e.signal != 0 {
+		var mtime time.Time
+		if info, err := os.Stat(e.file); err == nil {
+			mtime = info.ModTime()
+		}
+		if err := e.signalKeepalived(); err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, keepalivedTimeout)
+		defer cancel()
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			if info, err := os.Stat(e.file); err == nil && info.ModTime().After(mtime) && 0 < info.Size() {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%v not written after signaling keepalived", e.file)
+			case <-ticker.C:
+			}
+		}
+	}
+
+	b, err := os.ReadFile(e.file)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(e.file) == ".json" {
+		return parseKeepalivedJSON(b)
+	}
+	return parseKeepalivedData(b), nil
+}
+
+func (e *Keepalived) signalKeepalived() error {
+	b, err := os.ReadFile(e.pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return fmt.Errorf("%v: bad PID", e.pidFile)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Signal(e.signal)
+}
+
+// parseKeepalivedJSON parses the instances of the JSON dump.
+func parseKeepalivedJSON(b []byte) (map[string]string, error) {
+	instances := []struct {
+		Data struct {
+			Name  string `json:"iname"`
+			State int    `json:"state"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(b, &instances); err != nil {
+		return nil, err
+	}
+	states := map[string]string{}
+	for _, instance := range instances {
+		if state, ok := keepalivedJSONStates[instance.Data.State]; ok {
+			states[instance.Data.Name] = state
+		}
+	}
+	return states, nil
+}
+
+// parseKeepalivedData parses lines such as " VRRP Instance = VI_1" followed by "   State = MASTER" of the data dump.
+func parseKeepalivedData(b []byte) map[string]string {
+	states := map[string]string{}
+	instance := ""
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "VRRP Instance" {
+			instance = value
+		} else if key == "State" && instance != "" {
+			states[instance] = value
+			instance = ""
+		}
+	}
+	return states
+}
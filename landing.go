@@ -0,0 +1,57 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Dex Exporter</title></head>
+<body>
+<h1>Dex Exporter</h1>
+<p><a href="{{.TelemetryPath}}">Metrics</a> · <a href="{{.JSONPath}}">Metrics as JSON</a> · <a href="/-/metrics-meta">Metric metadata</a> · <a href="/version">Version</a></p>
+<h2>Collectors</h2>
+<table>
+<tr><th>Collector</th><th>Required services</th></tr>
+{{range .Collectors}}<tr><td>{{.Name}}</td><td>{{if .Services}}{{.Services}}{{else}}<i>always collected</i>{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type landingCollector struct {
+	Name     string
+	Services string
+}
+
+// LandingHandler serves a page that links to the endpoints and lists the systemd services that each collector requires, as set by --service.map.
+func LandingHandler(telemetryPath string, serviceMap map[string][][]string) http.Handler {
+	collectors := []landingCollector{}
+	for name, alternatives := range serviceMap {
+		services := []string{}
+		for _, alternative := range alternatives {
+			services = append(services, strings.Join(alternative, " and "))
+		}
+		collectors = append(collectors, landingCollector{name, strings.Join(services, " or ")})
+	}
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].Name < collectors[j].Name
+	})
+	data := struct {
+		TelemetryPath string
+		JSONPath      string
+		Collectors    []landingCollector
+	}{telemetryPath, strings.TrimSuffix(telemetryPath, "/") + ".json", collectors}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		landingTemplate.Execute(w, data)
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type LighttpdOptions struct {
+	URI string `desc:"A URI or unix socket path for scraping lighttpd metrics. The mod_status page must be available through the URI (e.g. http://localhost/server-status?auto or unix:///run/lighttpd.sock:/server-status?auto)."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+type Lighttpd struct {
+	client *collector.Client
+	stats  lighttpdStats
+
+	req     prometheus.Counter
+	bytes   prometheus.Counter
+	workers *prometheus.GaugeVec
+}
+
+func NewLighttpd(opts LighttpdOptions) (*Lighttpd, error) {
+	client, err := collector.NewClient(opts.URI)
+	if err != nil {
+		return nil, err
+	}
+	e := &Lighttpd{
+		client: client,
+
+		req: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lighttpd_requests_total",
+			Help: "Total number of requests.",
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lighttpd_bytes_total",
+			Help: "Total number of bytes sent.",
+		}),
+		workers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "lighttpd_workers",
+			Help: "Number of busy or idle workers.",
+		}, []string{"state"}),
+	}
+	e.updateStats(context.Background())
+	return e, nil
+}
+
+func (e *Lighttpd) Close() error {
+	return nil
+}
+
+// Check fetches the mod_status page.
+func (e *Lighttpd) Check(ctx context.Context) error {
+	_, err := e.client.Get(ctx)
+	return err
+}
+
+func (e *Lighttpd) Describe(ch chan<- *prometheus.Desc) {
+	e.req.Describe(ch)
+	e.bytes.Describe(ch)
+	e.workers.Describe(ch)
+}
+
+func (e *Lighttpd) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Lighttpd) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	stats, err := e.updateStats(ctx)
+	if err != nil {
+		Error.Println(err)
+	} else {
+		e.req.Add(float64(stats.Requests))
+		e.req.Collect(ch)
+
+		e.bytes.Add(float64(stats.KBytes * 1024))
+		e.bytes.Collect(ch)
+
+		e.workers.WithLabelValues("busy").Set(float64(stats.BusyServers))
+		e.workers.WithLabelValues("idle").Set(float64(stats.IdleServers))
+		e.workers.Collect(ch)
+	}
+	Debug.Println("collect duration for lighttpd:", time.Since(t))
+	return err
+}
+
+type lighttpdStats struct {
+	Requests    uint64
+	KBytes      uint64
+	BusyServers uint64
+	IdleServers uint64
+}
+
+func (e *Lighttpd) updateStats(ctx context.Context) (lighttpdStats, error) {
+	b, err := e.client.Get(ctx)
+	if err != nil {
+		return lighttpdStats{}, fmt.Errorf("lighttpd: %w", err)
+	}
+
+	status := ParseStatusAuto(b)
+	if _, ok := status["Total Accesses"]; !ok {
+		Debug.Printf("data from mod_status:\n%v", string(b))
+		return lighttpdStats{}, fmt.Errorf("lighttpd: Total Accesses not found in mod_status page")
+	}
+
+	cur := lighttpdStats{
+		Requests:    lighttpdGetUint64(status, "Total Accesses"),
+		KBytes:      lighttpdGetUint64(status, "Total kBytes"),
+		BusyServers: lighttpdGetUint64(status, "BusyServers"),
+		IdleServers: lighttpdGetUint64(status, "IdleServers"),
+	}
+
+	diff := cur
+	diff.Requests -= e.stats.Requests
+	diff.KBytes -= e.stats.KBytes
+	e.stats = cur
+	return diff, nil
+}
+
+func lighttpdGetUint64(status map[string]string, key string) uint64 {
+	val := status[key]
+	n, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		Warning.Printf("lighttpd: key %v: %v is not an integer", key, val)
+	}
+	return n
+}
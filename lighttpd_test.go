@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLighttpdFirstScrape(t *testing.T) {
+	accesses := atomic.Int64{}
+	accesses.Store(1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Total Accesses: %d\nTotal kBytes: %d\nBusyServers: 2\nIdleServers: 8\n", accesses.Load(), accesses.Load()/10)
+	}))
+	defer srv.Close()
+
+	e, err := NewLighttpd(LighttpdOptions{URI: srv.URL + "/server-status?auto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := newWarmExporter(t, "lighttpd", e)
+
+	// totals since the server started are not exposed as increments
+	expected := `
+# HELP lighttpd_requests_total Total number of requests.
+# TYPE lighttpd_requests_total counter
+lighttpd_requests_total 0
+# HELP lighttpd_bytes_total Total number of bytes sent.
+# TYPE lighttpd_bytes_total counter
+lighttpd_bytes_total 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "lighttpd_requests_total", "lighttpd_bytes_total"); err != nil {
+		t.Error("first scrape:", err)
+	}
+
+	accesses.Store(1020)
+	expected = strings.NewReplacer("requests_total 0", "requests_total 20", "bytes_total 0", "bytes_total 2048").Replace(expected)
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "lighttpd_requests_total", "lighttpd_bytes_total"); err != nil {
+		t.Error("second scrape:", err)
+	}
+}
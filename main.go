@@ -2,37 +2,92 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/coreos/go-systemd/v22/dbus"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tdewolff/argp"
+	"github.com/tdewolff/dex_exporter/collector"
+	"github.com/tdewolff/dex_exporter/collector/nginx"
+	"github.com/tdewolff/dex_exporter/collector/node"
+	"github.com/tdewolff/dex_exporter/collector/redis"
+	"github.com/tdewolff/dex_exporter/exporter"
 	"gopkg.in/yaml.v2"
 )
 
 var Version = "built from source"
 
 type WebOptions struct {
-	ListenAddress string `desc:"Address to listen to (e.g. :9900 or 123.45.67.89:9900), can be Unix socket (e.g. unix:///var/run/dex_exporter/dex_exporter.sock)."`
+	ListenAddress string `desc:"Address to listen to (e.g. :9900, 123.45.67.89:9900 or [::1]:9900), prefix with tcp4:// or tcp6:// to listen on IPv4 or IPv6 only, can be Unix socket (e.g. unix:///var/run/dex_exporter/dex_exporter.sock), abstract Unix socket (e.g. unix:@dex_exporter) or inherited file descriptor (e.g. fd://3)."`
 	TelemetryPath string `desc:"Path under which to expose metrics."`
 	TLSCert       string `desc:"Path to TLS certificate."`
 	TLSKey        string `desc:"Path to TLS key."`
 	BasicAuth     string `desc:"Basic authentication as username:password."`
-	Config        struct {
+
+	IdleTimeout float64 `desc:"Seconds that an idle connection is kept open for the next scrape, which should exceed the scrape interval so that Prometheus reuses its connection and TLS session."`
+	ReadTimeout float64 `desc:"Seconds within which a client must send its request."`
+
+	SocketAllowedUID []uint32 `name:"socket-allowed-uid" desc:"User ID allowed to connect to the Unix socket, can be repeated. Connections from other users and groups are rejected."`
+	SocketAllowedGID []uint32 `name:"socket-allowed-gid" desc:"Group ID allowed to connect to the Unix socket, can be repeated. Connections from other users and groups are rejected."`
+	SocketMode       string   `name:"socket-mode" desc:"Octal permissions of the Unix socket file, set regardless of the umask."`
+	SocketGroup      string   `name:"socket-group" desc:"Group name or ID that owns the Unix socket file, so that its members such as the web server can connect. Empty keeps the group of the process."`
+
+	ProxyProtocol        bool     `desc:"Require a PROXY protocol v1 or v2 header from trusted upstreams, so that the original client address is used."`
+	ProxyProtocolTrusted []string `desc:"CIDR of upstreams that send the PROXY protocol header, can be repeated. Other clients connect without header. By default all upstreams must send the header."`
+
+	MaxConcurrentCollectors int     `desc:"Maximum number of collectors that run concurrently during a scrape, zero is unlimited."`
+	ScrapeTimeoutOffset     float64 `desc:"Seconds subtracted from the scrape timeout sent by Prometheus, after which the gathered metrics are returned."`
+
+	Config struct {
 		File string `desc:"Path to configuration file that can enable TLS or authentication. See: https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md"`
 	}
 }
 
+type ServiceOptions struct {
+	AllUnits         bool `desc:"Export the number of systemd units per state, which requires listing all units."`
+	AllUnitsInterval int  `desc:"Minimum number of seconds between listing all units."`
+
+	Map           []string `desc:"Systemd service that a collector requires as collector=service (e.g. nginx=openresty), overriding its default services, can be repeated where any of the services must be active."`
+	DisableGating bool     `desc:"Collect all collectors regardless of whether their services are active."`
+}
+
+type MetricsOptions struct {
+	HonorCollectionTime bool `desc:"Add the time the backend was read as a timestamp to the metrics, which Prometheus discourages but may be more accurate for slow backends."`
+	NativeHistograms    bool `desc:"Also expose duration histograms as native histograms, which are only scraped using the protobuf format (Prometheus --enable-feature=native-histograms)."`
+
+	MaxSeriesPerFamily int `desc:"Maximum number of series of a metric family in a scrape, above which the excess series are dropped. Can be overridden per family in the series_limits section of --web.config.file. Zero is unlimited."`
+
+	MaxRate []string `desc:"Maximum increase per second of a counter as metric=rate (e.g. node_net_bytes_total=1.25e9), above which its sample is dropped as invalid, can be repeated. Overrides the defaults of the collectors and applies to any described counter."`
+
+	Derive []string `desc:"Gauge derived from the metrics of the same scrape as name=expr (e.g. node_mem_used_ratio=node_mem_bytes{type=\"used\"} / node_mem_bytes{type=\"total\"}), can be repeated. Expressions combine numbers and selectors with + - * / where series must have the same labels, or the same labels of on(label, ...) or ignoring(label, ...) after the operator."`
+}
+
+// nativeHistogramBucketFactor is the growth factor of the buckets of native histograms, zero disables native histograms.
+var nativeHistogramBucketFactor = 0.0
+
+type SelfOptions struct {
+	MaxCPUPercent float64 `name:"max-cpu-percent" desc:"Soft limit on the CPU usage of the exporter in percent of one core, above which background collection intervals (see --<collector>.interval) and the listing of all units are slowed down. Zero disables."`
+	GoMemLimit    string  `name:"gomemlimit" desc:"Soft memory limit of the Go runtime like GOMEMLIMIT (e.g. 64MiB), or auto for 90% of the cgroup memory limit."`
+	GoMaxProcs    string  `name:"gomaxprocs" desc:"Maximum number of CPUs executing simultaneously like GOMAXPROCS, or auto for the cgroup CPU quota rounded up."`
+}
+
+type StateOptions struct {
+	FileMode string `name:"file-mode" desc:"Octal permissions of the state files (see --journal.state-file and --ssh.state-file), set regardless of the umask."`
+}
+
 type LogOptions struct {
-	Level string `desc:"Only log messages with the given severity or above. One of: [debug, info, warn, error]"`
+	Level       string  `desc:"Only log messages with the given severity or above. One of: [debug, info, warn, error]"`
+	DedupWindow float64 `desc:"Seconds during which identical error and warning messages are logged once, the number of repetitions is logged when another message is logged or after the window. Zero disables."`
 }
 
 type WebConfig struct {
@@ -41,6 +96,9 @@ type WebConfig struct {
 		KeyFile  string `yaml:"key_file"`
 	} `yaml:"tls_server_config"`
 	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+
+	// SeriesLimits overrides --metrics.max-series-per-family per metric family
+	SeriesLimits map[string]int `yaml:"series_limits"`
 }
 
 var (
@@ -52,30 +110,182 @@ var (
 
 func main() {
 	version := false
+	checkBackends := false
+	noSystemd := false
+	strictMetadata := false
 	webOptions := WebOptions{
-		ListenAddress: ":9900",
-		TelemetryPath: "/metrics",
+		ListenAddress:       ":9900",
+		TelemetryPath:       "/metrics",
+		ScrapeTimeoutOffset: 0.5,
+		IdleTimeout:         120.0,
+		ReadTimeout:         10.0,
+		SocketMode:          "0770",
+	}
+	stateOptions := StateOptions{
+		FileMode: "0600",
 	}
 	logOptions := LogOptions{
-		Level: "info",
+		Level:       "info",
+		DedupWindow: 300.0,
+	}
+	serviceOptions := ServiceOptions{
+		AllUnitsInterval: 60,
+	}
+	metricsOptions := MetricsOptions{
+		MaxSeriesPerFamily: 1000,
+	}
+	selfOptions := SelfOptions{}
+	nodeOptions := node.Options{
+		TimeStepThreshold: 0.5,
+		LegacyDiskMetric:  true,
+	}
+	oomOptions := node.OOMOptions{}
+	nginxOptions := nginx.Options{
+		FastCGIPath: "/stub_status",
+		ConfigPath:  "/etc/nginx/nginx.conf",
+	}
+	redisOptions := redis.Options{
+		Timeout:         5.0,
+		ResolveInterval: 60.0,
+		CountInterval:   300.0,
+		CountBudget:     1.0,
 	}
-	nginxOptions := NginxOptions{}
-	redisOptions := RedisOptions{}
 	memcacheOptions := MemcacheOptions{}
 	phpfpmOptions := PHPFPMOptions{}
+	uwsgiOptions := UWSGIOptions{}
+	squidOptions := SquidOptions{}
+	lighttpdOptions := LighttpdOptions{}
+	minioOptions := MinioOptions{}
+	etcdOptions := EtcdOptions{}
+	traefikOptions := TraefikOptions{}
+	powerdnsOptions := PowerDNSOptions{
+		Service: "pdns",
+	}
+	beanstalkdOptions := BeanstalkdOptions{}
+	keepalivedOptions := KeepalivedOptions{
+		PidFile: "/run/keepalived.pid",
+	}
+	gearmanOptions := GearmanOptions{}
+	mqttOptions := MQTTOptions{}
+	ftpOptions := FTPOptions{
+		Port: 21,
+	}
+	sshOptions := SSHOptions{}
+	journalOptions := JournalOptions{}
+	timerOptions := TimerOptions{}
+	firewallOptions := FirewallOptions{}
+	ipmiOptions := IPMIOptions{
+		Interval: 30,
+	}
+	proxyOptions := ProxyOptions{}
+	scriptOptions := ScriptOptions{
+		Timeout: 10.0,
+	}
+	probeOptions := ProbeOptions{
+		Timeout: 5.0,
+	}
+	snmpOptions := SNMPOptions{
+		Community:     "public",
+		Timeout:       10.0,
+		MaxInterfaces: 256,
+	}
+	statsdOptions := StatsdOptions{
+		Prefix: "statsd_",
+	}
+	eximOptions := EximOptions{
+		Binary:  "exim",
+		Service: "exim",
+	}
 
 	cmd := argp.New("Exporter for Prometheus by Taco de Wolff")
 	cmd.AddOpt(&version, "", "version", "Show version")
+	cmd.AddOpt(&checkBackends, "", "check-backends", "Check connectivity to all enabled backends and exit")
+	cmd.AddOpt(&noSystemd, "", "no-systemd", "Don't connect to systemd over D-Bus, all collectors are collected regardless of their services")
+	cmd.AddOpt(&strictMetadata, "", "strict-metadata", "Fail at startup when metric names violate the naming conventions, such as counters not ending in _total")
 	cmd.AddOpt(&webOptions, "", "web", "")
 	cmd.AddOpt(&logOptions, "", "log", "")
+	cmd.AddOpt(&stateOptions, "", "state", "")
+	cmd.AddOpt(&serviceOptions, "", "service", "")
+	cmd.AddOpt(&metricsOptions, "", "metrics", "")
+	cmd.AddOpt(&selfOptions, "", "self", "")
+	cmd.AddOpt(&nodeOptions, "", "node", "")
+	cmd.AddOpt(&oomOptions, "", "oom", "")
 	cmd.AddOpt(&nginxOptions, "", "nginx", "")
 	cmd.AddOpt(&redisOptions, "", "redis", "")
 	cmd.AddOpt(&memcacheOptions, "", "memcache", "")
 	cmd.AddOpt(&phpfpmOptions, "", "phpfpm", "")
+	cmd.AddOpt(&uwsgiOptions, "", "uwsgi", "")
+	cmd.AddOpt(&squidOptions, "", "squid", "")
+	cmd.AddOpt(&lighttpdOptions, "", "lighttpd", "")
+	cmd.AddOpt(&minioOptions, "", "minio", "")
+	cmd.AddOpt(&etcdOptions, "", "etcd", "")
+	cmd.AddOpt(&traefikOptions, "", "traefik", "")
+	cmd.AddOpt(&eximOptions, "", "exim", "")
+	cmd.AddOpt(&powerdnsOptions, "", "powerdns", "")
+	cmd.AddOpt(&beanstalkdOptions, "", "beanstalkd", "")
+	cmd.AddOpt(&keepalivedOptions, "", "keepalived", "")
+	cmd.AddOpt(&gearmanOptions, "", "gearman", "")
+	cmd.AddOpt(&mqttOptions, "", "mqtt", "")
+	cmd.AddOpt(&ftpOptions, "", "ftp", "")
+	cmd.AddOpt(&sshOptions, "", "ssh", "")
+	cmd.AddOpt(&journalOptions, "", "journal", "")
+	cmd.AddOpt(&timerOptions, "", "timer", "")
+	cmd.AddOpt(&firewallOptions, "", "firewall", "")
+	cmd.AddOpt(&ipmiOptions, "", "ipmi", "")
+	cmd.AddOpt(&proxyOptions, "", "proxy", "")
+	cmd.AddOpt(&scriptOptions, "", "script", "")
+	cmd.AddOpt(&probeOptions, "", "probe", "")
+	cmd.AddOpt(&snmpOptions, "", "snmp", "")
+	cmd.AddOpt(&statsdOptions, "", "statsd", "")
+
+	// option groups by flag prefix, of which a hash is exported to detect stale configurations
+	configOptions := ConfigOptions{
+		"no_systemd":      &noSystemd,
+		"strict_metadata": &strictMetadata,
+		"web":             &webOptions,
+		"log":             &logOptions,
+		"state":           &stateOptions,
+		"service":         &serviceOptions,
+		"metrics":         &metricsOptions,
+		"self":            &selfOptions,
+		"node":            &nodeOptions,
+		"oom":             &oomOptions,
+		"nginx":           &nginxOptions,
+		"redis":           &redisOptions,
+		"memcache":        &memcacheOptions,
+		"phpfpm":          &phpfpmOptions,
+		"uwsgi":           &uwsgiOptions,
+		"squid":           &squidOptions,
+		"lighttpd":        &lighttpdOptions,
+		"minio":           &minioOptions,
+		"etcd":            &etcdOptions,
+		"traefik":         &traefikOptions,
+		"exim":            &eximOptions,
+		"powerdns":        &powerdnsOptions,
+		"beanstalkd":      &beanstalkdOptions,
+		"keepalived":      &keepalivedOptions,
+		"gearman":         &gearmanOptions,
+		"mqtt":            &mqttOptions,
+		"ftp":             &ftpOptions,
+		"ssh":             &sshOptions,
+		"journal":         &journalOptions,
+		"timer":           &timerOptions,
+		"firewall":        &firewallOptions,
+		"ipmi":            &ipmiOptions,
+		"proxy":           &proxyOptions,
+		"script":          &scriptOptions,
+		"probe":           &probeOptions,
+		"snmp":            &snmpOptions,
+		"statsd":          &statsdOptions,
+	}
+	configDefaults, err := configOptions.Encode()
+	if err != nil {
+		panic(err)
+	}
 	cmd.Parse()
 
 	if version {
-		fmt.Println("dex_exporter", Version)
+		fmt.Println("dex_exporter", GetBuildInfo())
 		return
 	}
 
@@ -90,13 +300,22 @@ func main() {
 	case "debug":
 		verbose = 4
 	}
+	var errorWriter, warningWriter io.Writer = os.Stderr, os.Stderr
+	if 0.0 < logOptions.DedupWindow {
+		window := time.Duration(logOptions.DedupWindow * float64(time.Second))
+		errorDedup := NewDedupWriter(os.Stderr, window)
+		defer errorDedup.Close()
+		warningDedup := NewDedupWriter(os.Stderr, window)
+		defer warningDedup.Close()
+		errorWriter, warningWriter = errorDedup, warningDedup
+	}
 	if 1 <= verbose {
-		Error = log.New(os.Stderr, "ERROR: ", 0)
+		Error = log.New(errorWriter, "ERROR: ", 0)
 	} else {
 		Error = log.New(ioutil.Discard, "", 0)
 	}
 	if 2 <= verbose {
-		Warning = log.New(os.Stderr, "WARNING: ", 0)
+		Warning = log.New(warningWriter, "WARNING: ", 0)
 	} else {
 		Warning = log.New(ioutil.Discard, "", 0)
 	}
@@ -111,44 +330,124 @@ func main() {
 		Debug = log.New(ioutil.Discard, "", 0)
 	}
 
-	// register all exporters
-	ctx, cancel := context.WithCancel(context.Background())
-	exporter, err := NewExporter(ctx)
+	if err := ApplySelfOptions(selfOptions); err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+	if stateFileMode, err = ParseFileMode(stateOptions.FileMode); err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+
+	if metricsOptions.NativeHistograms {
+		nativeHistogramBucketFactor = 1.1
+	}
+
+	// the web configuration is read before creating the exporter, which takes its series limits
+	config := WebConfig{}
+	tlsCert, tlsKey := "", ""
+	basicAuthUsers := map[string]string{}
+	if webOptions.Config.File != "" {
+		b, err := os.ReadFile(webOptions.Config.File)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		} else if err := yaml.Unmarshal(b, &config); err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		tlsCert = config.TLSServerConfig.CertFile
+		tlsKey = config.TLSServerConfig.KeyFile
+		basicAuthUsers = config.BasicAuthUsers
+	} else {
+		tlsCert = webOptions.TLSCert
+		tlsKey = webOptions.TLSKey
+		if webOptions.BasicAuth != "" {
+			colon := strings.IndexByte(webOptions.BasicAuth, ':')
+			if colon == -1 || colon == 0 || colon == len(webOptions.BasicAuth)-1 {
+				Error.Println("invalid format for web.basic-auth")
+				os.Exit(1)
+			}
+			username := webOptions.BasicAuth[:colon]
+			password := webOptions.BasicAuth[colon+1:]
+			basicAuthUsers[username] = password
+		}
+	}
+
+	// register all exporters, shutting down gracefully on SIGINT or SIGTERM
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	dex, err := exporter.New(ctx, exporter.Options{
+		MaxConcurrent:               webOptions.MaxConcurrentCollectors,
+		Systemd:                     !noSystemd,
+		HonorCollectionTime:         metricsOptions.HonorCollectionTime,
+		MaxRate:                     metricsOptions.MaxRate,
+		ServiceMap:                  serviceOptions.Map,
+		DisableGating:               serviceOptions.DisableGating,
+		NativeHistogramBucketFactor: nativeHistogramBucketFactor,
+		MaxSeriesPerFamily:          metricsOptions.MaxSeriesPerFamily,
+		SeriesLimits:                config.SeriesLimits,
+		Derive:                      metricsOptions.Derive,
+	}, logs())
 	if err != nil {
 		Error.Println(err)
 		os.Exit(1)
 	}
-	defer exporter.Close()
+	defer dex.Close() // closes the collectors
+	if serviceOptions.AllUnits {
+		dex.EnableAllUnits(time.Duration(serviceOptions.AllUnitsInterval) * time.Second)
+	}
+	if 0.0 < selfOptions.MaxCPUPercent {
+		if _, err := collector.SelfCPUSeconds(); err != nil {
+			Warning.Println("self: CPU usage limit disabled:", err)
+		} else {
+			dex.SetMaxCPUPercent(selfOptions.MaxCPUPercent)
+		}
+	}
 
 	// node exporter
-	node, err := NewNode()
-	if err != nil {
+	if nodeCollector, err := node.New(nodeOptions, logs()); errors.Is(err, collector.ErrNotSupported) {
+		Warning.Println(err)
+	} else if err != nil {
 		Error.Println(err)
 		os.Exit(1)
+	} else {
+		if nodeOptions.LegacyDiskMetric {
+			Warning.Println("node: node_disk_kilobytes is deprecated and will be removed in the next release, migrate dashboards and alerts to node_disk_bytes and disable it with --node.legacy-disk-metric=false")
+		}
+		dex.AddCollector("node", nodeCollector)
+	}
+
+	// oom exporter
+	if oomOptions.Enable {
+		if oom, err := node.NewOOM(oomOptions, logs()); errors.Is(err, collector.ErrNotSupported) {
+			Warning.Println(err)
+		} else if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		} else {
+			dex.AddCollector("oom", oom)
+		}
 	}
-	defer node.Close()
-	exporter.AddCollector(node)
 
 	// nginx exporter
-	if nginxOptions.URI != "" {
-		nginx, err := NewNginx(nginxOptions)
+	for service, opts := range nginxOptions.ServiceOptions() {
+		nginxCollector, err := nginx.New(service, opts, logs())
 		if err != nil {
 			Error.Println(err)
 			os.Exit(1)
 		}
-		defer nginx.Close()
-		exporter.AddCollector(nginx, "nginx")
+		dex.AddCollector(service, nginxCollector, exporter.AllOf(service))
+		dex.SetInterval(service, time.Duration(nginxOptions.Interval*float64(time.Second)))
 	}
 
 	// redis exporter
-	if redisOptions.URI != "" {
-		redis, err := NewRedis(redisOptions)
+	if redisOptions.URI != "" || redisOptions.SentinelURI != "" {
+		redisCollector, err := redis.New(redisOptions, logs())
 		if err != nil {
 			Error.Println(err)
 			os.Exit(1)
 		}
-		defer redis.Close()
-		exporter.AddCollector(redis, "redis")
+		dex.AddCollector("redis", redisCollector, exporter.AllOf("redis"))
 	}
 
 	// memcache exporter
@@ -158,183 +457,405 @@ func main() {
 			Error.Println(err)
 			os.Exit(1)
 		}
-		defer memcache.Close()
-		exporter.AddCollector(memcache, "memcache")
+		dex.AddCollector("memcache", memcache, exporter.AllOf("memcache"))
 	}
 
 	// phpfpm exporter
-	if 0 < len(phpfpmOptions.StatusURI) || phpfpmOptions.OPcacheURI != "" {
+	if 0 < len(phpfpmOptions.StatusURI) || phpfpmOptions.OPcacheURI != "" || phpfpmOptions.ConfigGlob != "" {
 		phpfpm, err := NewPHPFPM(phpfpmOptions)
 		if err != nil {
 			Error.Println(err)
 			os.Exit(1)
 		}
-		defer phpfpm.Close()
-		exporter.AddCollector(phpfpm, "php-fpm")
+		dex.AddCollector("phpfpm", phpfpm, exporter.AllOf("php*-fpm"))
 	}
 
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(exporter)
+	// uwsgi exporter
+	if 0 < len(uwsgiOptions.StatsURI) {
+		uwsgi, err := NewUWSGI(uwsgiOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		services := []string{}
+		if uwsgiOptions.Service != "" {
+			services = append(services, uwsgiOptions.Service)
+		}
+		dex.AddCollector("uwsgi", uwsgi, exporter.AllOf(services...))
+	}
 
-	config := WebConfig{}
-	tlsCert, tlsKey := "", ""
-	basicAuthUsers := map[string]string{}
-	if webOptions.Config.File != "" {
-		b, err := os.ReadFile(webOptions.Config.File)
+	// squid exporter
+	if squidOptions.URI != "" {
+		squid, err := NewSquid(squidOptions)
 		if err != nil {
 			Error.Println(err)
 			os.Exit(1)
-		} else if err := yaml.Unmarshal(b, &config); err != nil {
+		}
+		dex.AddCollector("squid", squid, exporter.AllOf("squid"))
+	}
+
+	// lighttpd exporter
+	if lighttpdOptions.URI != "" {
+		lighttpd, err := NewLighttpd(lighttpdOptions)
+		if err != nil {
 			Error.Println(err)
 			os.Exit(1)
 		}
-		tlsCert = config.TLSServerConfig.CertFile
-		tlsKey = config.TLSServerConfig.KeyFile
-		basicAuthUsers = config.BasicAuthUsers
-	} else {
-		tlsCert = webOptions.TLSCert
-		tlsKey = webOptions.TLSKey
-		if webOptions.BasicAuth != "" {
-			colon := strings.IndexByte(webOptions.BasicAuth, ':')
-			if colon == -1 || colon == 0 || colon == len(webOptions.BasicAuth)-1 {
-				Error.Println("invalid format for web.basic-auth")
-				os.Exit(1)
-			}
-			username := webOptions.BasicAuth[:colon]
-			password := webOptions.BasicAuth[colon+1:]
-			basicAuthUsers[username] = password
+		dex.AddCollector("lighttpd", lighttpd, exporter.AllOf("lighttpd"))
+	}
+
+	// minio exporter
+	if minioOptions.URI != "" {
+		minio, err := NewMinio(minioOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
 		}
+		dex.AddCollector("minio", minio, exporter.AllOf("minio"))
 	}
 
-	telemetryHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-	if 0 < len(basicAuthUsers) {
-		if tlsCert == "" || tlsKey == "" {
-			Warning.Println("using basic authorization without TLS")
+	// etcd exporter
+	if etcdOptions.URI != "" {
+		etcd, err := NewEtcd(etcdOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
 		}
-		telemetryHandler = BasicAuth(telemetryHandler, basicAuthUsers)
+		dex.AddCollector("etcd", etcd, exporter.AllOf("etcd"))
 	}
-	http.Handle(webOptions.TelemetryPath, telemetryHandler)
 
-	if err := ListenAndServe(webOptions.ListenAddress, tlsCert, tlsKey); err != nil && err != http.ErrServerClosed {
-		Error.Println(err)
+	// traefik exporter
+	if traefikOptions.APIURI != "" {
+		traefik, err := NewTraefik(traefikOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("traefik", traefik, exporter.AllOf("traefik"))
 	}
-	cancel()
-}
 
-type ServiceCollector struct {
-	prometheus.Collector
-	services uint64
-}
+	// exim exporter
+	if eximOptions.Mainlog != "" {
+		exim, err := NewExim(eximOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("exim", exim, exporter.AllOf(eximOptions.Service))
+	}
 
-type Exporter struct {
-	mu         sync.RWMutex
-	services   []string
-	collectors []ServiceCollector
+	// powerdns exporter
+	if powerdnsOptions.APIURI != "" {
+		powerdns, err := NewPowerDNS(powerdnsOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("powerdns", powerdns, exporter.AllOf(powerdnsOptions.Service))
+	}
 
-	conn    *dbus.Conn
-	service *prometheus.GaugeVec
-}
+	// beanstalkd exporter
+	if beanstalkdOptions.URI != "" {
+		beanstalkd, err := NewBeanstalkd(beanstalkdOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("beanstalkd", beanstalkd, exporter.AllOf("beanstalkd"))
+	}
 
-func NewExporter(ctx context.Context) (*Exporter, error) {
-	conn, err := dbus.NewWithContext(ctx)
-	if err != nil {
-		return nil, err
-	}
-	return &Exporter{
-		conn: conn,
-		service: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "node_service_active",
-			Help: "Systemd service active.",
-		}, []string{"service"}),
-	}, nil
-}
+	// keepalived exporter, the VIPs are checked regardless of whether keepalived is running
+	if keepalivedOptions.File != "" || 0 < len(keepalivedOptions.VIP) {
+		keepalived, err := NewKeepalived(keepalivedOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("keepalived", keepalived)
+	}
 
-func (e *Exporter) Close() error {
-	e.conn.Close()
-	return nil
-}
+	// gearman exporter
+	if gearmanOptions.URI != "" {
+		gearman, err := NewGearman(gearmanOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("gearman", gearman, exporter.AllOf("gearman-job-server"))
+	}
 
-func (e *Exporter) addServices(services ...string) uint64 {
-	bits := uint64(0)
-	for _, service := range services {
-		has := false
-		for i := range e.services {
-			if e.services[i] == service {
-				bits |= 1 << i
-				has = true
-				break
-			}
+	// mqtt exporter
+	if mqttOptions.URI != "" {
+		mqtt, err := NewMQTT(mqttOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
 		}
-		if !has {
-			if len(e.services) == 64 {
-				panic("too many services added: maximum is up to 64 services")
-			}
-			bits |= 1 << len(e.services)
-			e.services = append(e.services, service)
+		dex.AddCollector("mqtt", mqtt, exporter.AllOf("mosquitto"))
+	}
+
+	// ftp exporter
+	if ftpOptions.Enable || ftpOptions.Xferlog != "" {
+		ftp, err := NewFTP(ftpOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
 		}
+		dex.AddCollector("ftp", ftp, exporter.AnyOf("vsftpd", "proftpd"))
 	}
-	return bits
-}
 
-func (e *Exporter) AddServices(services ...string) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	// ssh exporter
+	if sshOptions.Journal {
+		ssh, err := NewSSH(sshOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("ssh", ssh)
+	}
 
-	e.addServices(services...)
-}
+	// systemd timer exporter
+	if 0 < len(timerOptions.Unit) {
+		timer, err := NewTimer(dex.Systemd, timerOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("timer", timer)
+	}
 
-func (e *Exporter) AddCollector(collector prometheus.Collector, services ...string) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	// firewall exporter
+	if firewallOptions.NFTables || firewallOptions.IPTables {
+		firewall, err := NewFirewall(firewallOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("firewall", firewall)
+	}
 
-	bits := e.addServices(services...)
-	e.collectors = append(e.collectors, ServiceCollector{
-		Collector: collector,
-		services:  bits,
-	})
-}
+	// ipmi exporter
+	if ipmiOptions.Enable {
+		ipmi, err := NewIPMI(ipmiOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("ipmi", ipmi)
+	}
 
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	e.service.Describe(ch)
-	for _, collector := range e.collectors {
-		collector.Describe(ch)
+	// proxy exporter
+	if 0 < len(proxyOptions.Target) {
+		proxy, err := NewProxy(proxyOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("proxy", proxy)
 	}
-}
 
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	t0 := time.Now()
-	defer func() {
-		Info.Println("collect duration total:", time.Since(t0))
-	}()
+	// script exporter
+	if 0 < len(scriptOptions.Command) {
+		script, err := NewScript(scriptOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("script", script)
+	}
 
-	t := time.Now()
-	activeServices := uint64(0)
-	services, err := e.conn.ListUnitsByNamesContext(context.Background(), e.services)
-	if err != nil {
-		Error.Println("retrieving systemd services over dbus:", err)
+	// probe exporter
+	if 0 < len(probeOptions.TCPTarget) {
+		probe, err := NewProbe(probeOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("probe", probe)
+	}
+
+	// snmp exporter
+	if 0 < len(snmpOptions.Target) {
+		snmp, err := NewSNMP(snmpOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("snmp", snmp)
+	}
+
+	// statsd exporter
+	if statsdOptions.ListenAddress != "" {
+		statsd, err := NewStatsd(statsdOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("statsd", statsd)
+	}
+
+	// journal exporter, added last so that it defaults to all watched services
+	if journalOptions.Enable {
+		if len(journalOptions.Unit) == 0 {
+			journalOptions.Unit = dex.Services()
+		}
+		journal, err := NewJournal(journalOptions)
+		if err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+		dex.AddCollector("journal", journal)
+	}
+
+	// collect slow or intrusive backends in the background
+	for name, interval := range map[string]float64{
+		"node":       nodeOptions.Interval,
+		"redis":      redisOptions.Interval,
+		"memcache":   memcacheOptions.Interval,
+		"phpfpm":     phpfpmOptions.Interval,
+		"uwsgi":      uwsgiOptions.Interval,
+		"squid":      squidOptions.Interval,
+		"lighttpd":   lighttpdOptions.Interval,
+		"minio":      minioOptions.Interval,
+		"etcd":       etcdOptions.Interval,
+		"traefik":    traefikOptions.Interval,
+		"exim":       eximOptions.Interval,
+		"powerdns":   powerdnsOptions.Interval,
+		"beanstalkd": beanstalkdOptions.Interval,
+		"keepalived": keepalivedOptions.Interval,
+		"gearman":    gearmanOptions.Interval,
+		"ftp":        ftpOptions.Interval,
+		"timer":      timerOptions.Interval,
+		"firewall":   firewallOptions.Interval,
+		"proxy":      proxyOptions.Interval,
+		"script":     scriptOptions.Interval,
+		"probe":      probeOptions.Interval,
+		"snmp":       snmpOptions.Interval,
+	} {
+		dex.SetInterval(name, time.Duration(interval*float64(time.Second)))
+	}
+
+	if checkBackends {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		ok := dex.CheckAll(ctx, os.Stdout)
+		cancel()
+		if !ok {
+			os.Exit(1)
+		}
 		return
+	}
+	dex.Start()
+
+	registry := prometheus.NewRegistry()
+
+	scrapeTimeoutOffset := time.Duration(webOptions.ScrapeTimeoutOffset * float64(time.Second))
+	telemetryHandler := dex.ScrapeHandler(registry, scrapeTimeoutOffset)
+	jsonHandler := dex.JSONHandler(registry, scrapeTimeoutOffset)
+	metadataHandler := dex.MetadataHandler()
+	serviceMap := dex.ServiceMap()
+	for _, item := range serviceOptions.Map {
+		if name, _, _ := strings.Cut(item, "="); serviceMap[name] == nil {
+			Warning.Printf("service map: collector %v is unknown or not enabled", name)
+		}
+	}
+	landingHandler := LandingHandler(webOptions.TelemetryPath, serviceMap)
+	if 0 < len(basicAuthUsers) {
+		if tlsCert == "" || tlsKey == "" {
+			Warning.Println("using basic authorization without TLS")
+		}
+		telemetryHandler = BasicAuth(telemetryHandler, basicAuthUsers)
+		jsonHandler = BasicAuth(jsonHandler, basicAuthUsers)
+		metadataHandler = BasicAuth(metadataHandler, basicAuthUsers)
+		landingHandler = BasicAuth(landingHandler, basicAuthUsers)
+	}
+
+	// instrument outside of authentication so that rejected scrapes are counted too
+	httpRequests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dex_http_requests_total",
+		Help: "Total number of HTTP requests to the telemetry endpoint.",
+	}, []string{"code"})
+	httpDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:                        "dex_http_request_duration_seconds",
+		Help:                        "Duration of HTTP requests to the telemetry endpoint in seconds.",
+		Buckets:                     []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		NativeHistogramBucketFactor: nativeHistogramBucketFactor,
+	}, []string{})
+	httpSize := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dex_http_response_size_bytes",
+		Help:    "Size of HTTP responses of the telemetry endpoint in bytes.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{})
+	registry.MustRegister(httpRequests, httpDuration, httpSize)
+	buildInfo := GetBuildInfo()
+	registry.MustRegister(NewBuildInfoGauge(buildInfo))
+	registry.MustRegister(NewSelf())
+	if configInfo, err := NewConfigInfo(configOptions, configDefaults); err != nil {
+		Error.Println(err)
 	} else {
-		for i, service := range services {
-			active := 0.0
-			if service.ActiveState == "active" || service.ActiveState == "reloading" {
-				active = 1.0
-				activeServices |= 1 << i
-			}
-			e.service.WithLabelValues(e.services[i]).Set(active)
+		registry.MustRegister(configInfo)
+	}
+	exemplar := promhttp.WithExemplarFromContext(RequestIDExemplar)
+	telemetryHandler = RequestID(promhttp.InstrumentHandlerCounter(httpRequests,
+		promhttp.InstrumentHandlerDuration(httpDuration,
+			promhttp.InstrumentHandlerResponseSize(httpSize, telemetryHandler), exemplar), exemplar))
+	http.Handle(webOptions.TelemetryPath, telemetryHandler)
+	http.Handle(strings.TrimSuffix(webOptions.TelemetryPath, "/")+".json", RequestID(jsonHandler))
+	http.Handle("/-/metrics-meta", RequestID(metadataHandler))
+	http.Handle("/version", VersionHandler(buildInfo))
+	if webOptions.TelemetryPath != "/" {
+		http.Handle("/", landingHandler)
+	}
+
+	server := NewServer(time.Duration(webOptions.IdleTimeout*float64(time.Second)), time.Duration(webOptions.ReadTimeout*float64(time.Second)))
+	registry.MustRegister(server.conns)
+	if socketMode, err := ParseFileMode(webOptions.SocketMode); err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	} else if err := server.SetSocketPermissions(socketMode, webOptions.SocketGroup); err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
+
+	var peerCreds *PeerCreds
+	if 0 < len(webOptions.SocketAllowedUID) || 0 < len(webOptions.SocketAllowedGID) {
+		peerCreds = NewPeerCreds(webOptions.SocketAllowedUID, webOptions.SocketAllowedGID)
+		registry.MustRegister(peerCreds.rejected)
+	}
+	var proxyProtocol *ProxyProtocol
+	if webOptions.ProxyProtocol {
+		if proxyProtocol, err = NewProxyProtocol(webOptions.ProxyProtocolTrusted); err != nil {
+			Error.Println(err)
+			os.Exit(1)
 		}
-		e.service.Collect(ch)
+		registry.MustRegister(proxyProtocol.errors)
 	}
-	Info.Println("collect duration for node_service:", time.Since(t))
 
-	wg := sync.WaitGroup{}
-	for _, collector := range e.collectors {
-		if collector.services&activeServices == activeServices {
-			wg.Add(1)
-			go func(collector prometheus.Collector) {
-				defer wg.Done()
-				collector.Collect(ch)
-			}(collector.Collector)
+	// set the baselines of all collectors before the first scrape
+	warmUpCtx, warmUpCancel := context.WithTimeout(ctx, 10*time.Second)
+	dex.WarmUp(warmUpCtx)
+	warmUpCancel()
+
+	// audit the metric names once all metrics are registered
+	auditCtx, auditCancel := context.WithTimeout(ctx, 10*time.Second)
+	violations := 0
+	for _, meta := range dex.Audit(auditCtx, registry) {
+		for _, violation := range meta.Violations {
+			if meta.Deprecated() {
+				Info.Printf("deprecated metric %v: %v", meta.Name, violation)
+			} else {
+				Warning.Printf("metric %v: %v", meta.Name, violation)
+				violations++
+			}
 		}
 	}
-	wg.Wait()
+	auditCancel()
+	if strictMetadata && 0 < violations {
+		Error.Printf("%d metric naming violations", violations)
+		os.Exit(1)
+	}
+
+	if err := ListenAndServe(ctx, webOptions.ListenAddress, tlsCert, tlsKey, server, peerCreds, proxyProtocol); err != nil && err != http.ErrServerClosed {
+		Error.Println(err)
+	}
+	cancel()
 }
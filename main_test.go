@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/exporter"
+)
+
+func TestMain(m *testing.M) {
+	Error = log.New(io.Discard, "", 0)
+	Warning = log.New(io.Discard, "", 0)
+	Info = log.New(io.Discard, "", 0)
+	Debug = log.New(io.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// newWarmExporter returns a registry with an exporter of the collector that has been warmed up, as main does before serving scrapes.
+func newWarmExporter(t *testing.T, name string, c prometheus.Collector) *prometheus.Registry {
+	t.Helper()
+	e, err := exporter.New(context.Background(), exporter.Options{}, logs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	e.AddCollector(name, c)
+	e.WarmUp(context.Background())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+	return registry
+}
@@ -1,34 +1,74 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/grobie/gomemcache/memcache"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
 )
 
 type MemcacheOptions struct {
-	URI []string `desc:"A URI or unix socket path for connecting to the Memcache server."`
+	URI         []string `desc:"A URI or unix socket path for connecting to the Memcache server."`
+	TLS         bool     `desc:"Connect to the Memcache servers over TLS."`
+	TLSCA       string   `desc:"Path to CA certificate to verify the server certificates."`
+	TLSInsecure bool     `desc:"Skip verification of the server certificates."`
+	Username    string   `desc:"Username for SASL authentication, which uses the binary protocol."`
+	Password    string   `desc:"Password for SASL authentication."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
 }
 
 type Memcache struct {
-	uris  URIGlobs
-	stats map[string]memcacheStats
+	uris      collector.URIGlobs
+	tlsConfig *tls.Config
+	username  string
+	password  string
+	authErrs  map[string]bool
+	counters  *collector.CounterTracker
+	breakers  *collector.Breakers
+	resolver  *collector.HostResolver
 
+	up  *prometheus.GaugeVec
 	mem *prometheus.GaugeVec
 	key *prometheus.CounterVec
 }
 
 func NewMemcache(opts MemcacheOptions) (*Memcache, error) {
-	uris, err := ParseURIGlobs(opts.URI)
+	uris, err := collector.ParseURIGlobs(opts.URI, logs())
 	if err != nil {
 		return nil, err
 	}
+	var tlsConfig *tls.Config
+	if opts.TLS {
+		if tlsConfig, err = collector.NewTLSConfig(opts.TLSCA, opts.TLSInsecure); err != nil {
+			return nil, fmt.Errorf("memcache: %w", err)
+		}
+	}
 	e := &Memcache{
-		uris:  uris,
-		stats: map[string]memcacheStats{},
+		uris:      uris,
+		tlsConfig: tlsConfig,
+		username:  opts.Username,
+		password:  opts.Password,
+		authErrs:  map[string]bool{},
+		counters:  collector.NewCounterTracker(),
+		breakers:  collector.NewBreakers("memcache", logs()),
+		resolver:  collector.NewHostResolver(0),
 
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "memcache_up",
+			Help: "Memcache server is reachable and authenticated.",
+		}, []string{"server"}),
 		mem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "memcache_mem_bytes",
 			Help: "Memory size in bytes.",
@@ -38,7 +78,9 @@ func NewMemcache(opts MemcacheOptions) (*Memcache, error) {
 			Help: "Key hits or misses.",
 		}, []string{"type", "server"}),
 	}
-	e.updateStats()
+	if _, err := e.updateStats(); err != nil && collector.IsTLSError(err) {
+		return nil, fmt.Errorf("memcache: %w", err)
+	}
 	return e, nil
 }
 
@@ -46,17 +88,48 @@ func (e *Memcache) Close() error {
 	return nil
 }
 
+// Check retrieves the stats of all Memcache servers.
+func (e *Memcache) Check(ctx context.Context) error {
+	for _, uri := range e.uris.Get() {
+		if _, err := e.getServerStats(uri); err != nil {
+			return fmt.Errorf("%v: %w", e.uris.Name(uri), err)
+		}
+	}
+	return nil
+}
+
+func (e *Memcache) SanityRules() []collector.SanityRule {
+	return []collector.SanityRule{
+		{Metric: "memcache_mem_bytes", Label: "type", Lesser: "used", Greater: "total"},
+	}
+}
+
+// Backoff returns the longest remaining cool-down of the servers after consecutive failures.
+func (e *Memcache) Backoff() time.Duration {
+	return e.breakers.Backoff()
+}
+
+// ResolvedIPs returns the IP address of each server that was connected to last.
+func (e *Memcache) ResolvedIPs() map[string]string {
+	return e.resolver.ResolvedIPs()
+}
+
 func (e *Memcache) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
 	e.mem.Describe(ch)
 	e.key.Describe(ch)
 }
 
 func (e *Memcache) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Memcache) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
 	t := time.Now()
 	stats, err := e.updateStats()
-	if err != nil {
-		Error.Println(err)
-	} else {
+	e.up.Collect(ch)
+	if stats != nil {
+		e.mem.Reset()
 		for server, stat := range stats {
 			e.mem.WithLabelValues("used", server).Set(float64(stat.MemoryUsed))
 			e.mem.WithLabelValues("total", server).Set(float64(stat.MemoryTotal))
@@ -67,6 +140,7 @@ func (e *Memcache) Collect(ch chan<- prometheus.Metric) {
 		e.key.Collect(ch)
 	}
 	Debug.Println("collect duration for memcache:", time.Since(t))
+	return err
 }
 
 type memcacheStats struct {
@@ -76,39 +150,129 @@ type memcacheStats struct {
 	KeyMisses   uint64
 }
 
-func (e *Memcache) updateStats() (map[string]memcacheStats, error) {
-	client, err := memcache.New(e.uris.Get()...)
+// memcacheServer selects a single TCP address or Unix socket path.
+type memcacheServer struct {
+	addr net.Addr
+}
+
+func (s memcacheServer) PickServer(key string) (net.Addr, error) {
+	return s.addr, nil
+}
+
+func (s memcacheServer) Each(f func(net.Addr) error) error {
+	return f(s.addr)
+}
+
+// newClient returns a client for a single server, so that servers are queried independently. The URI is resolved with ParseURI, since the client only recognizes Unix sockets by a slash and not by the unix: scheme. A new client connects for every scrape, so hostnames are resolved every time.
+func (e *Memcache) newClient(uri string) (*memcache.Client, net.Addr, error) {
+	network, host, err := collector.ParseURI(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	var addr net.Addr
+	if network == "unix" {
+		addr = &net.UnixAddr{Name: host, Net: "unix"}
+	} else if resolved, _, err := e.resolver.Resolve(context.Background(), e.uris.Name(uri), host); err != nil {
+		return nil, nil, err
+	} else if addr, err = net.ResolveTCPAddr(network, resolved); err != nil {
+		return nil, nil, err
+	}
+	client := memcache.NewFromSelector(memcacheServer{addr})
+	client.TlsConfig = e.tlsConfig
+	return client, addr, nil
+}
+
+// getServerStats returns the raw stats of a server, using the binary protocol when authenticating.
+func (e *Memcache) getServerStats(uri string) (map[string]string, error) {
+	if e.username != "" {
+		return e.getBinaryStats(uri)
+	}
+	client, addr, err := e.newClient(uri)
 	if err != nil {
 		return nil, err
 	}
 	stats, err := client.Stats()
 	if err != nil {
-		//client.Close() // TODO
 		return nil, err
-		//} else if err := client.Close(); err != nil {
-		//	return nil, err
+	} else if _, ok := stats[addr]; !ok {
+		return nil, fmt.Errorf("no stats returned")
 	}
+	return stats[addr].Stats, nil
+}
 
-	diffs := map[string]memcacheStats{}
-	for addr, stat := range stats {
-		name := addr.String()
+// getStats returns the raw stats per server. Servers are queried concurrently and independently, so that an unreachable server only sets its memcache_up to zero, and servers that failed consecutively are backed off. Failures are logged per server, and an error is only returned when no server could be queried.
+func (e *Memcache) getStats() (map[string]map[string]string, error) {
+	uris := e.uris.Get()
+	serverStats := make([]map[string]string, len(uris))
+	errs := make([]error, len(uris))
+	wg := sync.WaitGroup{}
+	for i, uri := range uris {
+		wg.Add(1)
+		go func(i int, uri string) {
+			defer wg.Done()
+			breaker := e.breakers.Get(e.uris.Name(uri))
+			if errs[i] = breaker.Allow(); errs[i] != nil {
+				return
+			}
+			serverStats[i], errs[i] = e.getServerStats(uri)
+			breaker.Done(errs[i])
+		}(i, uri)
+	}
+	wg.Wait()
 
-		cur := memcacheStats{}
-		cur.MemoryUsed = memcacheGetUint64(stat.Stats, "bytes")
-		cur.MemoryTotal = memcacheGetUint64(stat.Stats, "limit_maxbytes")
-		cur.KeyHits = memcacheSumUint64(stat.Stats, []string{"get_hits", "delete_hits", "incr_hits", "decr_hits", "cas_hits", "touch_hits"})
-		cur.KeyMisses = memcacheSumUint64(stat.Stats, []string{"get_misses", "delete_misses", "incr_misses", "decr_misses", "cas_misses", "touch_misses"})
-
-		prev, ok := e.stats[name]
-		e.stats[name] = cur
-		if !ok {
+	var lastErr error
+	stats := map[string]map[string]string{}
+	e.up.Reset()
+	for i, uri := range uris {
+		name := e.uris.Name(uri)
+		if errors.Is(errs[i], errMemcacheAuth) {
+			// report authentication failures only once
+			if !e.authErrs[name] {
+				Error.Printf("memcache %v: %v", name, errs[i])
+				e.authErrs[name] = true
+			}
+			e.up.WithLabelValues(name).Set(0.0)
+			continue
+		} else if errs[i] != nil {
+			if errors.Is(errs[i], collector.ErrBackoff) {
+				Debug.Printf("memcache %v: %v", name, errs[i])
+			} else {
+				Error.Printf("memcache %v: %v", name, errs[i])
+			}
+			lastErr = fmt.Errorf("memcache %v: %w", name, errs[i])
+			e.up.WithLabelValues(name).Set(0.0)
 			continue
 		}
+		delete(e.authErrs, name)
+		e.up.WithLabelValues(name).Set(1.0)
+		stats[name] = serverStats[i]
+	}
+	if len(stats) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return stats, nil
+}
+
+func (e *Memcache) updateStats() (map[string]memcacheStats, error) {
+	stats, err := e.getStats()
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := map[string]memcacheStats{}
+	for name, stat := range stats {
+		cur := memcacheStats{}
+		cur.MemoryUsed = memcacheGetUint64(stat, "bytes")
+		cur.MemoryTotal = memcacheGetUint64(stat, "limit_maxbytes")
+		cur.KeyHits = memcacheSumUint64(stat, []string{"get_hits", "delete_hits", "incr_hits", "decr_hits", "cas_hits", "touch_hits"})
+		cur.KeyMisses = memcacheSumUint64(stat, []string{"get_misses", "delete_misses", "incr_misses", "decr_misses", "cas_misses", "touch_misses"})
 
 		diff := cur
-		diff.KeyHits -= prev.KeyHits
-		diff.KeyMisses -= prev.KeyMisses
-		diffs[name] = diff
+		diff.KeyHits, _ = e.counters.Delta(cur.KeyHits, name, "hits")
+		if misses, ok := e.counters.Delta(cur.KeyMisses, name, "misses"); ok {
+			diff.KeyMisses = misses
+			diffs[name] = diff
+		}
 	}
 	return diffs, nil
 }
@@ -129,3 +293,100 @@ func memcacheSumUint64(stats map[string]string, keys []string) uint64 {
 	}
 	return sum
 }
+
+var errMemcacheAuth = errors.New("authentication failed")
+
+const (
+	memcacheOpStat     = 0x10
+	memcacheOpSASLAuth = 0x21
+)
+
+// getBinaryStats authenticates with SASL PLAIN and retrieves the stats over the binary protocol.
+func (e *Memcache) getBinaryStats(uri string) (map[string]string, error) {
+	scheme, host, err := collector.ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	resolved := host
+	if scheme != "unix" {
+		if resolved, _, err = e.resolver.Resolve(context.Background(), e.uris.Name(uri), host); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.DialTimeout(scheme, resolved, 1*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if e.tlsConfig != nil {
+		tlsConfig := e.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" && scheme != "unix" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(host)
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	auth := "\x00" + e.username + "\x00" + e.password
+	if err := memcacheWriteRequest(conn, memcacheOpSASLAuth, "PLAIN", auth); err != nil {
+		return nil, err
+	} else if status, _, _, err := memcacheReadResponse(r); err != nil {
+		return nil, err
+	} else if status == 0x20 {
+		return nil, errMemcacheAuth
+	} else if status != 0 {
+		return nil, fmt.Errorf("SASL authentication: status %#x", status)
+	}
+
+	if err := memcacheWriteRequest(conn, memcacheOpStat, "", ""); err != nil {
+		return nil, err
+	}
+	stats := map[string]string{}
+	for {
+		status, key, val, err := memcacheReadResponse(r)
+		if err != nil {
+			return nil, err
+		} else if status != 0 {
+			return nil, fmt.Errorf("stat: status %#x", status)
+		} else if key == "" {
+			return stats, nil
+		}
+		stats[key] = val
+	}
+}
+
+func memcacheWriteRequest(w io.Writer, opcode byte, key, val string) error {
+	b := make([]byte, 24, 24+len(key)+len(val))
+	b[0] = 0x80
+	b[1] = opcode
+	binary.BigEndian.PutUint16(b[2:], uint16(len(key)))
+	binary.BigEndian.PutUint32(b[8:], uint32(len(key)+len(val)))
+	b = append(b, key...)
+	b = append(b, val...)
+	_, err := w.Write(b)
+	return err
+}
+
+func memcacheReadResponse(r io.Reader) (uint16, string, string, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", "", err
+	} else if header[0] != 0x81 {
+		return 0, "", "", fmt.Errorf("bad response magic %#x", header[0])
+	}
+	keyLen := int(binary.BigEndian.Uint16(header[2:]))
+	extrasLen := int(header[4])
+	status := binary.BigEndian.Uint16(header[6:])
+	bodyLen := int(binary.BigEndian.Uint32(header[8:]))
+	if bodyLen < extrasLen+keyLen {
+		return 0, "", "", fmt.Errorf("bad response length")
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, "", "", err
+	}
+	key := string(body[extrasLen : extrasLen+keyLen])
+	val := string(body[extrasLen+keyLen:])
+	return status, key, val, nil
+}
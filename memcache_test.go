@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeMemcached replies to the stats command of the text protocol with the given stats, and with no stats to its subcommands such as stats slabs. Closing the listener stops the server.
+type fakeMemcached struct {
+	net.Listener
+
+	mu    sync.Mutex
+	stats map[string]string
+}
+
+func newFakeMemcached(t *testing.T, stats map[string]string) *fakeMemcached {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeMemcached{Listener: ln, stats: stats}
+	t.Cleanup(func() { s.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.TrimSpace(line); {
+		case cmd == "stats":
+			s.mu.Lock()
+			for key, val := range s.stats {
+				fmt.Fprintf(conn, "STAT %s %s\r\n", key, val)
+			}
+			s.mu.Unlock()
+		case !strings.HasPrefix(cmd, "stats "):
+			fmt.Fprint(conn, "ERROR\r\n")
+			continue
+		}
+		fmt.Fprint(conn, "END\r\n")
+	}
+}
+
+func (s *fakeMemcached) Set(key, val string) {
+	s.mu.Lock()
+	s.stats[key] = val
+	s.mu.Unlock()
+}
+
+func TestMemcacheVanishedServer(t *testing.T) {
+	a := newFakeMemcached(t, map[string]string{"bytes": "100", "limit_maxbytes": "1000"})
+	b := newFakeMemcached(t, map[string]string{"bytes": "200", "limit_maxbytes": "2000"})
+	e, err := NewMemcache(MemcacheOptions{URI: []string{a.Addr().String(), b.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameA, nameB := e.uris.Name(a.Addr().String()), e.uris.Name(b.Addr().String())
+
+	if n := testutil.CollectAndCount(e, "memcache_mem_bytes"); n != 4 {
+		t.Fatalf("got %d memory series, expected 4", n)
+	}
+
+	b.Close()
+	if n := testutil.CollectAndCount(e, "memcache_mem_bytes"); n != 2 {
+		t.Errorf("got %d memory series after a server stopped, expected 2", n)
+	}
+	if v := testutil.ToFloat64(e.mem.WithLabelValues("used", nameA)); v != 100.0 {
+		t.Errorf("memory of the remaining server is %v, expected 100", v)
+	}
+	if v := testutil.ToFloat64(e.up.WithLabelValues(nameB)); v != 0.0 {
+		t.Errorf("stopped server is up %v, expected 0", v)
+	}
+}
+
+func TestMemcacheRefusedServer(t *testing.T) {
+	up := newFakeMemcached(t, map[string]string{"bytes": "100", "limit_maxbytes": "1000"})
+	refused := refusedAddr(t)
+	e, err := NewMemcache(MemcacheOptions{URI: []string{refused, up.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			if err := e.CollectContext(context.Background(), ch); err != nil {
+				t.Errorf("scrape %d: %v", i, err)
+			}
+			close(ch)
+		}()
+		for range ch {
+		}
+		if v := testutil.ToFloat64(e.up.WithLabelValues(e.uris.Name(refused))); v != 0.0 {
+			t.Errorf("scrape %d: refusing server is up %v, expected 0", i, v)
+		}
+		if v := testutil.ToFloat64(e.up.WithLabelValues(e.uris.Name(up.Addr().String()))); v != 1.0 {
+			t.Errorf("scrape %d: reachable server is up %v, expected 1", i, v)
+		}
+		if n := testutil.CollectAndCount(e, "memcache_mem_bytes"); n != 2 {
+			t.Errorf("scrape %d: got %d memory series, expected those of the reachable server", i, n)
+		}
+	}
+
+	e, err = NewMemcache(MemcacheOptions{URI: []string{refused}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan prometheus.Metric, 10)
+	if err := e.CollectContext(context.Background(), ch); err == nil {
+		t.Errorf("all servers refusing: expected error")
+	}
+}
+
+func TestMemcacheFirstScrape(t *testing.T) {
+	s := newFakeMemcached(t, map[string]string{"bytes": "100", "limit_maxbytes": "1000", "get_hits": "5000", "get_misses": "700"})
+	e, err := NewMemcache(MemcacheOptions{URI: []string{s.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := newWarmExporter(t, "memcache", e)
+	server := e.uris.Name(s.Addr().String())
+
+	// totals since the server started are not exposed as increments
+	expected := fmt.Sprintf(`
+# HELP memcache_key_total Key hits or misses.
+# TYPE memcache_key_total counter
+memcache_key_total{server="%[1]v",type="hits"} 0
+memcache_key_total{server="%[1]v",type="misses"} 0
+`, server)
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "memcache_key_total"); err != nil {
+		t.Error("first scrape:", err)
+	}
+
+	s.Set("get_hits", "5012")
+	expected = strings.Replace(expected, `type="hits"} 0`, `type="hits"} 12`, 1)
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "memcache_key_total"); err != nil {
+		t.Error("second scrape:", err)
+	}
+}
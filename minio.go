@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type MinioOptions struct {
+	URI             string `desc:"A URI for connecting to MinIO (e.g. http://localhost:9000)."`
+	AccessKey       string `desc:"Access key for the admin API, preferably set MINIO_ACCESS_KEY instead."`
+	SecretKey       string `desc:"Secret key for the admin API, preferably set MINIO_SECRET_KEY instead."`
+	CredentialsFile string `desc:"File containing ACCESS_KEY:SECRET_KEY for the admin API."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+// credentials returns the access and secret key from the options, the environment or the credentials file, in that order.
+func (opts MinioOptions) credentials() (string, string, error) {
+	if opts.AccessKey != "" || opts.SecretKey != "" {
+		return opts.AccessKey, opts.SecretKey, nil
+	} else if accessKey, secretKey := os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY"); accessKey != "" || secretKey != "" {
+		return accessKey, secretKey, nil
+	} else if opts.CredentialsFile != "" {
+		b, err := os.ReadFile(opts.CredentialsFile)
+		if err != nil {
+			return "", "", err
+		}
+		accessKey, secretKey, ok := strings.Cut(strings.TrimSpace(string(b)), ":")
+		if !ok {
+			return "", "", fmt.Errorf("minio: credentials file must contain ACCESS_KEY:SECRET_KEY")
+		}
+		return accessKey, secretKey, nil
+	}
+	return "", "", nil
+}
+
+type Minio struct {
+	health    *collector.Client
+	info      *collector.Client
+	accessKey string
+	secretKey string
+
+	up      prometheus.Gauge
+	disks   *prometheus.GaugeVec
+	storage *prometheus.GaugeVec
+}
+
+func NewMinio(opts MinioOptions) (*Minio, error) {
+	accessKey, secretKey, err := opts.credentials()
+	if err != nil {
+		return nil, err
+	} else if (accessKey == "") != (secretKey == "") {
+		return nil, fmt.Errorf("minio: both access and secret key must be set")
+	}
+
+	uri := strings.TrimSuffix(opts.URI, "/")
+	health, err := collector.NewClient(uri + "/minio/health/cluster")
+	if err != nil {
+		return nil, err
+	}
+	info, err := collector.NewClient(uri + "/minio/admin/v3/info")
+	if err != nil {
+		return nil, err
+	}
+	return &Minio{
+		health:    health,
+		info:      info,
+		accessKey: accessKey,
+		secretKey: secretKey,
+
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "minio_up",
+			Help: "MinIO cluster is healthy.",
+		}),
+		disks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "minio_disks",
+			Help: "Number of disks.",
+		}, []string{"state"}),
+		storage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "minio_storage_bytes",
+			Help: "Storage size in bytes.",
+		}, []string{"type"}),
+	}, nil
+}
+
+func (e *Minio) Close() error {
+	return nil
+}
+
+// Check requests the cluster health and, if credentials are given, the admin info.
+func (e *Minio) Check(ctx context.Context) error {
+	if _, err := e.health.Get(ctx); err != nil {
+		return err
+	}
+	if e.accessKey != "" {
+		if _, err := e.getInfo(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Minio) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+	e.disks.Describe(ch)
+	e.storage.Describe(ch)
+}
+
+func (e *Minio) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Minio) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	_, err := e.health.Get(ctx)
+	if err != nil {
+		Error.Println("minio:", err)
+		e.up.Set(0.0)
+	} else {
+		e.up.Set(1.0)
+	}
+	e.up.Collect(ch)
+
+	if e.accessKey != "" {
+		if stats, infoErr := e.getInfo(ctx); infoErr != nil {
+			Error.Println("minio:", infoErr)
+			err = infoErr
+		} else {
+			e.disks.WithLabelValues("online").Set(float64(stats.Online))
+			e.disks.WithLabelValues("offline").Set(float64(stats.Offline))
+			e.storage.WithLabelValues("used").Set(float64(stats.Used))
+			e.storage.WithLabelValues("total").Set(float64(stats.Total))
+			e.disks.Collect(ch)
+			e.storage.Collect(ch)
+		}
+	}
+	Debug.Println("collect duration for minio:", time.Since(t))
+	return err
+}
+
+type minioStats struct {
+	Online  uint64
+	Offline uint64
+	Used    uint64
+	Total   uint64
+}
+
+func (e *Minio) getInfo(ctx context.Context) (minioStats, error) {
+	req, err := e.info.NewRequest(ctx)
+	if err != nil {
+		return minioStats{}, err
+	}
+	signV4(req, e.accessKey, e.secretKey, "us-east-1", "s3", time.Now())
+	b, err := e.info.Do(req)
+	if err != nil {
+		return minioStats{}, err
+	}
+
+	doc := struct {
+		Servers []struct {
+			Drives []struct {
+				State      string `json:"state"`
+				TotalSpace uint64 `json:"totalspace"`
+				UsedSpace  uint64 `json:"usedspace"`
+			} `json:"drives"`
+		} `json:"servers"`
+	}{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return minioStats{}, fmt.Errorf("failed to parse admin info: %w", err)
+	}
+
+	stats := minioStats{}
+	for _, server := range doc.Servers {
+		for _, drive := range server.Drives {
+			if drive.State == "ok" {
+				stats.Online++
+			} else {
+				stats.Offline++
+			}
+			stats.Used += drive.UsedSpace
+			stats.Total += drive.TotalSpace
+		}
+	}
+	return stats, nil
+}
+
+// signV4 signs a request without body using AWS Signature Version 4.
+func signV4(req *http.Request, accessKey, secretKey, region, service string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	amzDate := t.Format("20060102T150405Z")
+	payloadHash := hex.EncodeToString(sha256Sum(nil))
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		"host:" + host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sha256Sum([]byte(canonicalRequest)))
+
+	key := hmacSum([]byte("AWS4"+secretKey), date)
+	key = hmacSum(key, region)
+	key = hmacSum(key, service)
+	key = hmacSum(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSum(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func hmacSum(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
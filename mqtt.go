@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type MQTTOptions struct {
+	URI         string `desc:"A URI for connecting to the MQTT broker (e.g. mqtt://localhost:1883 or mqtts://localhost:8883)."`
+	Username    string `desc:"Username for connecting to the MQTT broker."`
+	Password    string `desc:"Password for connecting to the MQTT broker."`
+	TLSCA       string `desc:"Path to CA certificate to verify the server certificate of mqtts:// URIs."`
+	TLSInsecure bool   `desc:"Skip verification of the server certificate of mqtts:// URIs."`
+}
+
+const (
+	mqttKeepAlive  = 30 * time.Second
+	mqttMaxBackoff = time.Minute
+)
+
+var mqttCounters = map[string]string{
+	"$SYS/broker/messages/received": "received",
+	"$SYS/broker/messages/sent":     "sent",
+	"$SYS/broker/bytes/received":    "bytes_received",
+	"$SYS/broker/bytes/sent":        "bytes_sent",
+}
+
+var mqttGauges = map[string]string{
+	"$SYS/broker/clients/connected":       "clients",
+	"$SYS/broker/retained messages/count": "retained",
+	"$SYS/broker/store/messages/count":    "stored",
+	"$SYS/broker/messages/stored":         "stored",
+}
+
+// MQTT keeps a subscription to the $SYS topics of the broker and caches the latest values, which are exported when collecting.
+type MQTT struct {
+	scheme, host       string
+	tlsConfig          *tls.Config
+	username, password string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	up     bool
+	values map[string]float64
+	prev   map[string]float64
+	read   time.Time
+	quit   chan struct{}
+	done   chan struct{}
+
+	brokerUp prometheus.Gauge
+	clients  prometheus.Gauge
+	received prometheus.Counter
+	sent     prometheus.Counter
+	bytes    *prometheus.CounterVec
+	retained prometheus.Gauge
+	stored   prometheus.Gauge
+}
+
+// mqttParseURI parses MQTT URIs including the mqtt:// and mqtts:// schemes, the latter requiring TLS.
+func mqttParseURI(uri string) (string, string, bool, error) {
+	useTLS := false
+	if strings.HasPrefix(uri, "mqtts://") {
+		uri = "tcp://" + uri[8:]
+		useTLS = true
+	} else if strings.HasPrefix(uri, "mqtt://") {
+		uri = "tcp://" + uri[7:]
+	}
+	scheme, host, err := collector.ParseURI(uri)
+	if err == nil && strings.Contains(host, "://") {
+		return "", "", false, fmt.Errorf("unsupported scheme of %v", uri)
+	}
+	return scheme, host, useTLS, err
+}
+
+func NewMQTT(opts MQTTOptions) (*MQTT, error) {
+	scheme, host, useTLS, err := mqttParseURI(opts.URI)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if useTLS {
+		if tlsConfig, err = collector.NewTLSConfig(opts.TLSCA, opts.TLSInsecure); err != nil {
+			return nil, err
+		}
+		if tlsConfig.ServerName, _, err = net.SplitHostPort(host); err != nil {
+			return nil, err
+		}
+	}
+	e := &MQTT{
+		scheme:    scheme,
+		host:      host,
+		tlsConfig: tlsConfig,
+		username:  opts.Username,
+		password:  opts.Password,
+		values:    map[string]float64{},
+		prev:      map[string]float64{},
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+
+		brokerUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_broker_up",
+			Help: "Subscription to the MQTT broker is connected.",
+		}),
+		clients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_clients_connected",
+			Help: "Number of connected clients.",
+		}),
+		received: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt_messages_received_total",
+			Help: "Total number of received messages.",
+		}),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt_messages_sent_total",
+			Help: "Total number of sent messages.",
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_bytes_total",
+			Help: "Total number of received or sent bytes.",
+		}, []string{"direction"}),
+		retained: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_retained_messages",
+			Help: "Number of retained messages.",
+		}),
+		stored: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_stored_messages",
+			Help: "Number of messages in the store, including retained messages and messages queued for durable clients.",
+		}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Close disconnects from the broker and stops the subscription.
+func (e *MQTT) Close() error {
+	close(e.quit)
+	e.mu.Lock()
+	if e.conn != nil {
+		e.conn.Write([]byte{0xE0, 0x00}) // DISCONNECT
+		e.conn.Close()
+	}
+	e.mu.Unlock()
+	<-e.done
+	return nil
+}
+
+// Check connects and subscribes to the broker.
+func (e *MQTT) Check(ctx context.Context) error {
+	conn, _, err := e.connect()
+	if err != nil {
+		return err
+	}
+	conn.Write([]byte{0xE0, 0x00}) // DISCONNECT
+	return conn.Close()
+}
+
+// ReadTime returns the time the last $SYS value was received.
+func (e *MQTT) ReadTime() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.read
+}
+
+func (e *MQTT) Describe(ch chan<- *prometheus.Desc) {
+	e.brokerUp.Describe(ch)
+	e.clients.Describe(ch)
+	e.received.Describe(ch)
+	e.sent.Describe(ch)
+	e.bytes.Describe(ch)
+	e.retained.Describe(ch)
+	e.stored.Describe(ch)
+}
+
+func (e *MQTT) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.up {
+		e.brokerUp.Set(1.0)
+	} else {
+		e.brokerUp.Set(0.0)
+	}
+	e.brokerUp.Collect(ch)
+
+	// counters are reported as totals since the broker started
+	diff := map[string]float64{}
+	for key, val := range e.values {
+		if prev, ok := e.prev[key]; ok && prev <= val {
+			diff[key] = val - prev
+		}
+		e.prev[key] = val
+	}
+	e.received.Add(diff["received"])
+	e.sent.Add(diff["sent"])
+	e.bytes.WithLabelValues("received").Add(diff["bytes_received"])
+	e.bytes.WithLabelValues("sent").Add(diff["bytes_sent"])
+	e.received.Collect(ch)
+	e.sent.Collect(ch)
+	e.bytes.Collect(ch)
+
+	if val, ok := e.values["clients"]; ok {
+		e.clients.Set(val)
+		e.clients.Collect(ch)
+	}
+	if val, ok := e.values["retained"]; ok {
+		e.retained.Set(val)
+		e.retained.Collect(ch)
+	}
+	if val, ok := e.values["stored"]; ok {
+		e.stored.Set(val)
+		e.stored.Collect(ch)
+	}
+}
+
+// run keeps the subscription alive, reconnecting with exponential backoff.
+func (e *MQTT) run() {
+	defer close(e.done)
+	backoff := time.Second
+	for {
+		connected, err := e.subscribe()
+		e.mu.Lock()
+		e.up = false
+		e.conn = nil
+		e.mu.Unlock()
+
+		select {
+		case <-e.quit:
+			return
+		default:
+		}
+		if connected {
+			backoff = time.Second
+		}
+		Warning.Printf("mqtt: %v, reconnecting in %v", err, backoff)
+		select {
+		case <-e.quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; mqttMaxBackoff < backoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+// connect opens a connection to the broker and subscribes to the $SYS topics.
+func (e *MQTT) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout(e.scheme, e.host, 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	} else if e.tlsConfig != nil {
+		conn = tls.Client(conn, e.tlsConfig)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	hostname, _ := os.Hostname()
+	flags := byte(0x02) // clean session
+	payload := mqttString("dex_exporter-" + hostname + "-" + strconv.Itoa(os.Getpid()))
+	if e.username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(e.username)...)
+		if e.password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(e.password)...)
+		}
+	}
+	connect := append(mqttString("MQTT"), 0x04, flags, 0, 0)
+	binary.BigEndian.PutUint16(connect[len(connect)-2:], uint16(mqttKeepAlive/time.Second))
+	if _, err := conn.Write(mqttPacket(0x10, append(connect, payload...))); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	typ, body, err := mqttReadPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	} else if typ != 0x20 || len(body) != 2 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unexpected packet type %x", typ)
+	} else if body[1] != 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("connection refused with return code %d", body[1])
+	}
+
+	subscribe := append([]byte{0x00, 0x01}, mqttString("$SYS/#")...)
+	subscribe = append(subscribe, 0x00) // QoS 0
+	if _, err := conn.Write(mqttPacket(0x82, subscribe)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// subscribe connects to the broker and handles incoming messages until the connection fails.
+func (e *MQTT) subscribe() (bool, error) {
+	conn, r, err := e.connect()
+	if err != nil {
+		return false, err
+	}
+	e.mu.Lock()
+	select {
+	case <-e.quit:
+		e.mu.Unlock()
+		conn.Close()
+		return true, nil
+	default:
+	}
+	e.conn = conn
+	e.up = true
+	e.mu.Unlock()
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(mqttKeepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				e.mu.Lock()
+				conn.Write([]byte{0xC0, 0x00}) // PINGREQ
+				e.mu.Unlock()
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		typ, body, err := mqttReadPacket(r)
+		if err != nil {
+			return true, err
+		} else if typ&0xF0 != 0x30 {
+			continue // SUBACK, PINGRESP
+		}
+
+		// PUBLISH
+		if len(body) < 2 {
+			return true, errors.New("malformed publish packet")
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+n {
+			return true, errors.New("malformed publish packet")
+		}
+		topic, payload := string(body[2:2+n]), body[2+n:]
+		if typ&0x06 != 0 {
+			// QoS 1 or 2 has a packet identifier, but we subscribed with QoS 0
+			if len(payload) < 2 {
+				return true, errors.New("malformed publish packet")
+			}
+			payload = payload[2:]
+		}
+
+		key, ok := mqttCounters[topic]
+		if !ok {
+			if key, ok = mqttGauges[topic]; !ok {
+				continue
+			}
+		}
+		if val, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64); err == nil {
+			e.mu.Lock()
+			e.values[key] = val
+			e.read = time.Now()
+			e.mu.Unlock()
+		}
+	}
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func mqttPacket(typ byte, body []byte) []byte {
+	b := []byte{typ}
+	n := len(body)
+	for {
+		c := byte(n % 128)
+		if n /= 128; 0 < n {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(c&0x7F) << shift
+		if c&0x80 == 0 {
+			break
+		} else if shift += 7; 21 < shift {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
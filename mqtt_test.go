@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeMQTTBroker accepts connections with the CONNACK return code and acknowledges subscriptions, after which Publish sends messages to the subscribers. Closing the listener stops the broker.
+type fakeMQTTBroker struct {
+	net.Listener
+	returnCode byte
+
+	mu          sync.Mutex
+	subscribers []net.Conn
+	connects    int
+	disconnects int
+}
+
+func newFakeMQTTBroker(t *testing.T, returnCode byte, config *tls.Config) *fakeMQTTBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	} else if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	b := &fakeMQTTBroker{Listener: ln, returnCode: returnCode}
+	t.Cleanup(func() {
+		b.Close()
+		b.Drop()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeMQTTBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if typ, body, err := mqttReadPacket(r); err != nil || typ != 0x10 || !bytes.HasPrefix(body, mqttString("MQTT")) {
+		return
+	}
+	b.mu.Lock()
+	b.connects++
+	b.mu.Unlock()
+	if _, err := conn.Write([]byte{0x20, 0x02, 0x00, b.returnCode}); err != nil || b.returnCode != 0 {
+		return
+	}
+
+	typ, body, err := mqttReadPacket(r)
+	if err != nil || typ != 0x82 || len(body) < 2 {
+		return
+	} else if _, err := conn.Write([]byte{0x90, 0x03, body[0], body[1], 0x00}); err != nil {
+		return
+	}
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, conn)
+	b.mu.Unlock()
+
+	for {
+		typ, _, err := mqttReadPacket(r)
+		if err != nil {
+			return
+		} else if typ == 0xE0 {
+			b.mu.Lock()
+			b.disconnects++
+			b.mu.Unlock()
+		}
+	}
+}
+
+// Publish sends a message to the subscribers, with a packet identifier for QoS 1.
+func (b *fakeMQTTBroker) Publish(qos byte, topic, payload string) {
+	body := mqttString(topic)
+	if qos != 0 {
+		body = append(body, 0x00, 0x01)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.subscribers {
+		conn.Write(mqttPacket(0x30|qos<<1, append(body, payload...)))
+	}
+}
+
+// Drop closes the connections to the subscribers.
+func (b *fakeMQTTBroker) Drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.subscribers {
+		conn.Close()
+	}
+	b.subscribers = nil
+}
+
+func (b *fakeMQTTBroker) Counts() (int, int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connects, len(b.subscribers), b.disconnects
+}
+
+func waitForMQTT(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if deadline.Before(time.Now()) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (e *MQTT) value(key string) (float64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	val, ok := e.values[key]
+	return val, ok
+}
+
+// refusedAddr returns an address on which connections are refused.
+func refusedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	var tests = []struct {
+		length int
+		bytes  int
+	}{
+		{0, 1},
+		{127, 1},
+		{128, 2},
+		{16383, 2},
+		{16384, 3},
+		{2097151, 3},
+		{2097152, 4},
+	}
+	for _, tt := range tests {
+		packet := mqttPacket(0x30, make([]byte, tt.length))
+		if n := len(packet) - 1 - tt.length; n != tt.bytes {
+			t.Errorf("remaining length %v is encoded in %v bytes, expected %v", tt.length, n, tt.bytes)
+		}
+		typ, body, err := mqttReadPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil {
+			t.Errorf("remaining length %v: %v", tt.length, err)
+		} else if typ != 0x30 || len(body) != tt.length {
+			t.Errorf("remaining length %v is decoded as type %#x with %v bytes", tt.length, typ, len(body))
+		}
+	}
+
+	// the remaining length has at most four bytes
+	if _, _, err := mqttReadPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}))); err == nil || !strings.Contains(err.Error(), "malformed remaining length") {
+		t.Errorf("expected malformed remaining length error, got %v", err)
+	}
+	if _, _, err := mqttReadPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0x80}))); !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF for truncated remaining length, got %v", err)
+	}
+	if _, _, err := mqttReadPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0x05, 0x00}))); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF for truncated body, got %v", err)
+	}
+}
+
+func TestMQTTParseURI(t *testing.T) {
+	var tests = []struct {
+		uri    string
+		host   string
+		useTLS bool
+		err    bool
+	}{
+		{"mqtt://localhost:1883", "localhost:1883", false, false},
+		{"mqtts://localhost:8883", "localhost:8883", true, false},
+		{"localhost:1883", "localhost:1883", false, false},
+		{"tcp://127.0.0.1:1883", "127.0.0.1:1883", false, false},
+		{"ws://localhost:8080", "", false, true},
+		{"mqtts://localhost", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			_, host, useTLS, err := mqttParseURI(tt.uri)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if host != tt.host || useTLS != tt.useTLS {
+				t.Fatalf("parsed as %v with TLS %v", host, useTLS)
+			}
+		})
+	}
+}
+
+func TestMQTTConnackRefused(t *testing.T) {
+	broker := newFakeMQTTBroker(t, 5, nil) // not authorized
+	e, err := NewMQTT(MQTTOptions{URI: "mqtt://" + broker.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if err := e.Check(context.Background()); err == nil || !strings.Contains(err.Error(), "return code 5") {
+		t.Fatalf("expected refusal with return code 5, got %v", err)
+	}
+	if up := testutil.ToFloat64(e.brokerUp); up != 0.0 {
+		t.Fatalf("mqtt_broker_up is %v", up)
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	broker := newFakeMQTTBroker(t, 0, nil)
+	e, err := NewMQTT(MQTTOptions{URI: "mqtt://" + broker.Addr().String(), Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	waitForMQTT(t, "subscription", func() bool {
+		_, subscribers, _ := broker.Counts()
+		return subscribers == 1
+	})
+
+	broker.Publish(0, "$SYS/broker/clients/connected", "3")
+	broker.Publish(1, "$SYS/broker/messages/received", " 100\n")
+	broker.Publish(0, "$SYS/broker/messages/sent", "not a number")
+	broker.Publish(0, "$SYS/broker/uptime", "10 seconds")
+	broker.Publish(0, "$SYS/broker/bytes/sent", "2000")
+	waitForMQTT(t, "values", func() bool {
+		_, ok := e.value("bytes_sent")
+		return ok
+	})
+	if val, _ := e.value("clients"); val != 3.0 {
+		t.Errorf("clients is %v", val)
+	} else if val, _ := e.value("received"); val != 100.0 {
+		t.Errorf("received of QoS 1 message is %v", val)
+	} else if _, ok := e.value("sent"); ok {
+		t.Error("sent is set from a payload that isn't a number")
+	} else if e.ReadTime().IsZero() {
+		t.Error("read time is not set")
+	}
+
+	// counters start at zero and increase by the difference of the broker's totals
+	e.Collect(make(chan prometheus.Metric, 100))
+	broker.Publish(0, "$SYS/broker/messages/received", "150")
+	waitForMQTT(t, "received", func() bool {
+		val, _ := e.value("received")
+		return val == 150.0
+	})
+	e.Collect(make(chan prometheus.Metric, 100))
+	if up := testutil.ToFloat64(e.brokerUp); up != 1.0 {
+		t.Errorf("mqtt_broker_up is %v", up)
+	} else if received := testutil.ToFloat64(e.received); received != 50.0 {
+		t.Errorf("mqtt_messages_received_total is %v, expected 50", received)
+	} else if clients := testutil.ToFloat64(e.clients); clients != 3.0 {
+		t.Errorf("mqtt_clients_connected is %v", clients)
+	}
+}
+
+func TestMQTTReconnect(t *testing.T) {
+	broker := newFakeMQTTBroker(t, 0, nil)
+	e, err := NewMQTT(MQTTOptions{URI: "mqtt://" + broker.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	waitForMQTT(t, "subscription", func() bool {
+		_, subscribers, _ := broker.Counts()
+		return subscribers == 1
+	})
+
+	broker.Drop()
+	waitForMQTT(t, "disconnect", func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return !e.up
+	})
+	waitForMQTT(t, "resubscription", func() bool {
+		_, subscribers, _ := broker.Counts()
+		return subscribers == 1
+	})
+	if connects, _, _ := broker.Counts(); connects != 2 {
+		t.Fatalf("broker has %v connects, expected 2", connects)
+	}
+
+	broker.Publish(0, "$SYS/broker/clients/connected", "7")
+	waitForMQTT(t, "clients", func() bool {
+		val, _ := e.value("clients")
+		return val == 7.0
+	})
+	e.Collect(make(chan prometheus.Metric, 100))
+	if up := testutil.ToFloat64(e.brokerUp); up != 1.0 {
+		t.Fatalf("mqtt_broker_up is %v", up)
+	}
+}
+
+func TestMQTTClose(t *testing.T) {
+	broker := newFakeMQTTBroker(t, 0, nil)
+	e, err := NewMQTT(MQTTOptions{URI: "mqtt://" + broker.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForMQTT(t, "subscription", func() bool {
+		_, subscribers, _ := broker.Counts()
+		return subscribers == 1
+	})
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.done:
+	default:
+		t.Fatal("subscription is still running after closing")
+	}
+	waitForMQTT(t, "DISCONNECT", func() bool {
+		_, _, disconnects := broker.Counts()
+		return disconnects == 1
+	})
+
+	// closing while waiting to reconnect doesn't wait for the backoff
+	e, err = NewMQTT(MQTTOptions{URI: "mqtt://" + refusedAddr(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	} else if time.Second <= time.Since(start) {
+		t.Fatalf("closing took %v", time.Since(start))
+	}
+}
+
+func TestMQTTS(t *testing.T) {
+	// use the certificate of httptest for the broker
+	server := httptest.NewTLSServer(nil)
+	cert := server.TLS.Certificates[0]
+	server.Close()
+
+	broker := newFakeMQTTBroker(t, 0, &tls.Config{Certificates: []tls.Certificate{cert}})
+	e, err := NewMQTT(MQTTOptions{URI: "mqtts://" + broker.Addr().String(), TLSInsecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate of httptest isn't trusted
+	e, err = NewMQTT(MQTTOptions{URI: "mqtts://" + broker.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.Check(context.Background()); err == nil {
+		t.Fatal("expected certificate error")
+	}
+
+	// plain MQTT isn't accepted by a TLS broker
+	e, err = NewMQTT(MQTTOptions{URI: "mqtt://" + broker.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.Check(context.Background()); err == nil {
+		t.Fatal("expected error for plain MQTT")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build freebsd || darwin
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// getsockoptPeerCred returns the effective user and group IDs of the peer, the PID is not available.
+func getsockoptPeerCred(fd int) (peerCredentials, error) {
+	xucred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return peerCredentials{}, err
+	} else if xucred.Ngroups < 1 {
+		return peerCredentials{}, fmt.Errorf("peer credentials without groups")
+	}
+	return peerCredentials{UID: xucred.Uid, GID: xucred.Groups[0]}, nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func getsockoptPeerCred(fd int) (peerCredentials, error) {
+	ucred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	return peerCredentials{ucred.Uid, ucred.Gid, ucred.Pid}, nil
+}
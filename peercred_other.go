@@ -0,0 +1,9 @@
+//go:build !linux && !freebsd && !darwin
+
+package main
+
+import "github.com/tdewolff/dex_exporter/collector"
+
+func getsockoptPeerCred(fd int) (peerCredentials, error) {
+	return peerCredentials{}, collector.ErrNotSupported
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	fcgiclient "github.com/tomasen/fcgi_client"
+	"github.com/tdewolff/dex_exporter/collector"
 )
 
 type PHPFPMOptions struct {
@@ -19,38 +23,89 @@ type PHPFPMOptions struct {
 
 	OPcacheURI  string `name:"opcache-uri" desc:"A URI or unix socket path for connecting to the PHP-FPM server."`
 	OPcachePath string `name:"opcache-path" desc:"Path of the OPcache metrics page."`
+
+	ConfigGlob string `name:"config-glob" desc:"Glob of the PHP-FPM pool configuration files (e.g. /etc/php/*/fpm/pool.d/*.conf) from which pm.max_children is exported per pool. Files are re-read when modified."`
+
+	IdleTimeout float64 `name:"idle-timeout" desc:"Seconds that the connection to a pool is kept open after a scrape to be reused by the next scrape, which avoids dialing for every scrape of pools on TCP. An open connection occupies a process of the pool. Zero dials a new connection for every scrape."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
 }
 
 type PHPFPM struct {
-	statusURIs   URIGlobs
-	statusPath   string
-	opcacheURI   string
-	opcachePath  string
-	opcacheStats phpfpmOPcacheStats
+	statusURIs  collector.URIGlobs
+	statusPath  string
+	opcacheURI  string
+	opcachePath string
+	counters    *collector.CounterTracker
+	breakers    *collector.Breakers
+	idleTimeout time.Duration
 
+	clientsMu sync.Mutex
+	clients   map[string]*collector.FastCGIClient // by URI and path
+
+	configGlob string
+	configsMu  sync.Mutex
+	configs    map[string]phpfpmConfig // by filename
+
+	up                *prometheus.GaugeVec
 	proc              *prometheus.GaugeVec
+	probeDuration     *prometheus.GaugeVec
+	probeFailures     *prometheus.CounterVec
+	connections       *prometheus.CounterVec
+	maxChildren       *prometheus.GaugeVec
 	opcacheMem        *prometheus.GaugeVec
 	opcacheStringsMem *prometheus.GaugeVec
 	opcacheKey        *prometheus.CounterVec
 }
 
 func NewPHPFPM(opts PHPFPMOptions) (*PHPFPM, error) {
-	statusURIs, err := ParseURIGlobs(opts.StatusURI)
+	statusURIs, err := collector.ParseURIGlobs(opts.StatusURI, logs())
 	if err != nil {
 		return nil, err
-	} else if _, _, err := ParseURI(opts.OPcacheURI); err != nil {
-		return nil, err
+	} else if opts.OPcacheURI != "" {
+		if _, _, err := collector.ParseURI(opts.OPcacheURI); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := filepath.Glob(opts.ConfigGlob); err != nil {
+		return nil, fmt.Errorf("phpfpm: config glob: %w", err)
 	}
 	e := &PHPFPM{
 		statusURIs:  statusURIs,
 		statusPath:  opts.StatusPath,
 		opcacheURI:  opts.OPcacheURI,
 		opcachePath: opts.OPcachePath,
+		counters:    collector.NewCounterTracker(),
+		breakers:    collector.NewBreakers("phpfpm", logs()),
+		idleTimeout: time.Duration(opts.IdleTimeout * float64(time.Second)),
+		clients:     map[string]*collector.FastCGIClient{},
+		configGlob:  opts.ConfigGlob,
+		configs:     map[string]phpfpmConfig{},
 
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "phpfpm_up",
+			Help: "Status page of the pool could be fetched.",
+		}, []string{"pool_uri"}),
 		proc: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "phpfpm_proc_count",
 			Help: "Number of processes.",
 		}, []string{"type", "pool"}),
+		probeDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "phpfpm_status_probe_duration_seconds",
+			Help: "Duration of the last status page request in seconds.",
+		}, []string{"pool_uri"}),
+		probeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phpfpm_status_probe_failures_total",
+			Help: "Total number of failed status page requests.",
+		}, []string{"pool_uri"}),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phpfpm_scrape_connections_total",
+			Help: "Total number of requests to the pool by whether a kept connection was reused, a new connection was dialed, or the connection failed.",
+		}, []string{"pool_uri", "result"}),
+		maxChildren: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "phpfpm_max_children",
+			Help: "Maximum number of processes of the pool as configured by pm.max_children.",
+		}, []string{"pool"}),
 		opcacheMem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "phpfpm_opcache_mem_bytes",
 			Help: "Memory size in bytes.",
@@ -64,38 +119,106 @@ func NewPHPFPM(opts PHPFPMOptions) (*PHPFPM, error) {
 			Help: "Key hits or misses.",
 		}, []string{"type"}),
 	}
-	e.updateStats()
+	e.updateStats(context.Background())
+	if e.opcacheURI != "" {
+		e.updateOPcacheStats(context.Background())
+	}
 	return e, nil
 }
 
+// Close closes the connections that are kept open.
 func (e *PHPFPM) Close() error {
+	e.clientsMu.Lock()
+	defer e.clientsMu.Unlock()
+	for key, client := range e.clients {
+		client.Close()
+		delete(e.clients, key)
+	}
 	return nil
 }
 
+// Check fetches the status page of all pools and the OPcache metrics page.
+func (e *PHPFPM) Check(ctx context.Context) error {
+	for _, uri := range e.statusURIs.Get() {
+		if _, err := e.getURL(ctx, e.statusURIs.Name(uri), uri, e.statusPath); err != nil {
+			return fmt.Errorf("%v: %w", uri, err)
+		}
+	}
+	if e.opcacheURI != "" {
+		if _, err := e.getURL(ctx, collector.URIName(e.opcacheURI), e.opcacheURI, e.opcachePath); err != nil {
+			return fmt.Errorf("%v: %w", e.opcacheURI, err)
+		}
+	}
+	return nil
+}
+
+func (e *PHPFPM) SanityRules() []collector.SanityRule {
+	return []collector.SanityRule{
+		{Metric: "phpfpm_opcache_mem_bytes", Label: "type", Lesser: "used", Greater: "total"},
+		{Metric: "phpfpm_opcache_strings_mem_bytes", Label: "type", Lesser: "used", Greater: "total"},
+	}
+}
+
+// Backoff returns the longest remaining cool-down of the pools and OPcache page after consecutive failures.
+func (e *PHPFPM) Backoff() time.Duration {
+	return e.breakers.Backoff()
+}
+
 func (e *PHPFPM) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+	e.proc.Describe(ch)
+	e.probeDuration.Describe(ch)
+	e.probeFailures.Describe(ch)
+	e.connections.Describe(ch)
+	e.maxChildren.Describe(ch)
 	e.opcacheMem.Describe(ch)
 	e.opcacheStringsMem.Describe(ch)
 	e.opcacheKey.Describe(ch)
 }
 
 func (e *PHPFPM) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *PHPFPM) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
 	t0 := time.Now()
 	t := time.Now()
-	stats, err := e.updateStats()
-	if err != nil {
-		Error.Println(err)
-	} else {
-		for pool, stat := range stats {
-			e.proc.WithLabelValues("active", pool).Set(float64(stat.ActiveProcesses))
-			e.proc.WithLabelValues("total", pool).Set(float64(stat.TotalProcesses))
-			e.proc.Collect(ch)
+	e.up.Reset()
+	e.probeDuration.Reset()
+	stats, errStats := e.updateStats(ctx)
+	if errors.Is(errStats, collector.ErrBackoff) {
+		Debug.Println(errStats)
+	} else if errStats != nil {
+		Error.Println(errStats)
+	}
+	e.proc.Reset()
+	for pool, stat := range stats {
+		e.proc.WithLabelValues("active", pool).Set(float64(stat.ActiveProcesses))
+		e.proc.WithLabelValues("total", pool).Set(float64(stat.TotalProcesses))
+	}
+	e.up.Collect(ch)
+	e.proc.Collect(ch)
+	e.probeDuration.Collect(ch)
+	e.probeFailures.Collect(ch)
+	e.connections.Collect(ch)
+	if e.configGlob != "" {
+		e.maxChildren.Reset()
+		for pool, maxChildren := range e.readConfigs() {
+			e.maxChildren.WithLabelValues(pool).Set(float64(maxChildren))
 		}
+		e.maxChildren.Collect(ch)
 	}
 	Debug.Println("collect duration for phpfpm proc:", time.Since(t))
 
 	t = time.Now()
-	opcacheStats, err := e.updateOPcacheStats()
-	if err != nil {
+	if e.opcacheURI == "" {
+		Debug.Println("collect duration for phpfpm:", time.Since(t0))
+		return errStats
+	}
+	opcacheStats, err := e.updateOPcacheStats(ctx)
+	if errors.Is(err, collector.ErrBackoff) {
+		Debug.Println(err)
+	} else if err != nil {
 		Error.Println(err)
 	} else {
 		e.opcacheMem.WithLabelValues("used").Set(float64(opcacheStats.MemoryUsed))
@@ -112,6 +235,7 @@ func (e *PHPFPM) Collect(ch chan<- prometheus.Metric) {
 	}
 	Debug.Println("collect duration for phpfpm opcache:", time.Since(t))
 	Debug.Println("collect duration for phpfpm:", time.Since(t0))
+	return errors.Join(errStats, err)
 }
 
 type phpfpmStats struct {
@@ -119,41 +243,139 @@ type phpfpmStats struct {
 	TotalProcesses  uint64
 }
 
-func (e *PHPFPM) updateStats() (map[string]phpfpmStats, error) {
+// updateStats returns the stats per pool and records the duration of each status page request, the first error is returned after all pools have been tried. Pools that failed consecutively are backed off, which doesn't count as a failed request.
+func (e *PHPFPM) updateStats(ctx context.Context) (map[string]phpfpmStats, error) {
+	var firstErr error
 	stats := map[string]phpfpmStats{}
-	for _, uri := range e.statusURIs.Get() {
-		content, err := e.getURL(uri, e.statusPath)
-		if err != nil {
-			return nil, err
+	uris := e.statusURIs.Get()
+	e.closeClients(uris)
+	for _, uri := range uris {
+		name := e.statusURIs.Name(uri)
+		breaker := e.breakers.Get(name)
+		if err := breaker.Allow(); err != nil {
+			e.up.WithLabelValues(name).Set(0.0)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("phpfpm %v: %w", name, err)
+			}
+			continue
 		}
 
-		fmt.Println(string(content))
-
-		pool := ""
-		cur := phpfpmStats{}
-		scanner := bufio.NewScanner(bytes.NewReader(content))
-		for scanner.Scan() {
-			line := scanner.Text()
-			if colon := strings.IndexByte(line, ':'); colon != -1 {
-				key := line[:colon]
-				val := strings.TrimSpace(line[colon:])
-				switch key {
-				case "pool":
-					pool = val
-				case "active processes":
-					cur.ActiveProcesses = phpfpmGetUint64(key, val)
-				case "total processes":
-					cur.TotalProcesses = phpfpmGetUint64(key, val)
-				}
+		t := time.Now()
+		content, err := e.getURL(ctx, name, uri, e.statusPath)
+		breaker.Done(err)
+		if err != nil {
+			e.up.WithLabelValues(name).Set(0.0)
+			e.probeFailures.WithLabelValues(name).Inc()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("phpfpm %v: %w", name, err)
 			}
+			continue
 		}
+		e.up.WithLabelValues(name).Set(1.0)
+		e.probeDuration.WithLabelValues(name).Set(time.Since(t).Seconds())
+		e.probeFailures.WithLabelValues(name).Add(0.0)
+
+		pool, cur := parsePHPFPMStatus(content)
 		if pool == "" {
-			Warning.Println("PHP-FPM status page pool name not found for %v")
+			Warning.Printf("phpfpm: status page pool name not found for %v", name)
 		} else {
 			stats[pool] = cur
 		}
 	}
-	return stats, nil
+	return stats, firstErr
+}
+
+// parsePHPFPMStatus returns the pool name and stats of a status page in the plain text format, which has a line per key such as "active processes:  1".
+func parsePHPFPMStatus(content []byte) (string, phpfpmStats) {
+	pool := ""
+	stats := phpfpmStats{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		switch key {
+		case "pool":
+			pool = val
+		case "active processes":
+			stats.ActiveProcesses = phpfpmGetUint64(key, val)
+		case "total processes":
+			stats.TotalProcesses = phpfpmGetUint64(key, val)
+		}
+	}
+	return pool, stats
+}
+
+type phpfpmConfig struct {
+	mtime       time.Time
+	maxChildren map[string]uint64 // by pool
+}
+
+// readConfigs returns pm.max_children per pool of the configuration files matching the glob. Files are only parsed again when their modification time changed. If a pool is configured in several files, the last file in lexical order applies.
+func (e *PHPFPM) readConfigs() map[string]uint64 {
+	filenames, _ := filepath.Glob(e.configGlob) // pattern was checked in NewPHPFPM
+
+	e.configsMu.Lock()
+	defer e.configsMu.Unlock()
+	configs := map[string]phpfpmConfig{}
+	maxChildren := map[string]uint64{}
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			Warning.Println("phpfpm:", err)
+			continue
+		}
+		config, ok := e.configs[filename]
+		if !ok || !config.mtime.Equal(info.ModTime()) {
+			b, err := os.ReadFile(filename)
+			if err != nil {
+				Warning.Println("phpfpm:", err)
+				continue
+			}
+			Debug.Printf("phpfpm: read pool configuration %v", filename)
+			config = phpfpmConfig{
+				mtime:       info.ModTime(),
+				maxChildren: parsePHPFPMConfig(filename, b),
+			}
+		}
+		configs[filename] = config
+		for pool, n := range config.maxChildren {
+			maxChildren[pool] = n
+		}
+	}
+	e.configs = configs
+	return maxChildren
+}
+
+// parsePHPFPMConfig returns pm.max_children per pool of a pool configuration file, which is an INI file with a section per pool such as [www].
+func parsePHPFPMConfig(filename string, b []byte) map[string]uint64 {
+	pool := ""
+	maxChildren := map[string]uint64{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		} else if line[0] == '[' && line[len(line)-1] == ']' {
+			pool = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok || pool == "" || pool == "global" || strings.TrimSpace(key) != "pm.max_children" {
+			continue
+		}
+		val, _, _ = strings.Cut(val, ";")
+		val = strings.Trim(strings.TrimSpace(val), `"'`)
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			Warning.Printf("phpfpm: %v: pool %v: pm.max_children %v is not an integer", filename, pool, val)
+			continue
+		}
+		maxChildren[pool] = n
+	}
+	return maxChildren
 }
 
 type phpfpmOPcacheStats struct {
@@ -165,8 +387,13 @@ type phpfpmOPcacheStats struct {
 	KeyMisses                  uint64
 }
 
-func (e *PHPFPM) updateOPcacheStats() (phpfpmOPcacheStats, error) {
-	content, err := e.getURL(e.opcacheURI, e.opcachePath)
+func (e *PHPFPM) updateOPcacheStats(ctx context.Context) (phpfpmOPcacheStats, error) {
+	breaker := e.breakers.Get("opcache")
+	if err := breaker.Allow(); err != nil {
+		return phpfpmOPcacheStats{}, fmt.Errorf("phpfpm opcache: %w", err)
+	}
+	content, err := e.getURL(ctx, collector.URIName(e.opcacheURI), e.opcacheURI, e.opcachePath)
+	breaker.Done(err)
 	if err != nil {
 		return phpfpmOPcacheStats{}, err
 	}
@@ -198,32 +425,46 @@ func (e *PHPFPM) updateOPcacheStats() (phpfpmOPcacheStats, error) {
 	cur.InternedStringsMemoryTotal += cur.InternedStringsMemoryUsed
 
 	diff := cur
-	diff.KeyHits -= e.opcacheStats.KeyHits
-	diff.KeyMisses -= e.opcacheStats.KeyMisses
-	e.opcacheStats = cur
+	diff.KeyHits, _ = e.counters.Delta(cur.KeyHits, "hits")
+	diff.KeyMisses, _ = e.counters.Delta(cur.KeyMisses, "misses")
 	return diff, nil
 }
 
-func (e *PHPFPM) getURL(uri, path string) ([]byte, error) {
-	scheme, host, _ := ParseURI(uri)
-	client, err := fcgiclient.Dial(scheme, host)
-	if err != nil {
-		return nil, err
+// getURL fetches the page over the connection to the pool, which is kept open between scrapes if an idle timeout is set. The connection outcome is counted under the pool name.
+func (e *PHPFPM) getURL(ctx context.Context, name, uri, path string) ([]byte, error) {
+	key := uri + " " + path
+	e.clientsMu.Lock()
+	client, ok := e.clients[key]
+	if !ok {
+		var err error
+		if client, err = collector.NewFastCGIClient(uri, path); err != nil {
+			e.clientsMu.Unlock()
+			return nil, err
+		}
+		client.SetIdleTimeout(e.idleTimeout)
+		e.clients[key] = client
 	}
-	defer client.Close()
+	e.clientsMu.Unlock()
 
-	env := map[string]string{}
-	env["SCRIPT_FILENAME"] = path
-	env["SCRIPT_NAME"] = path
-	resp, err := client.Get(env)
-	if err != nil {
-		return nil, err
+	content, result, err := client.GetConn(ctx)
+	e.connections.WithLabelValues(name, result).Inc()
+	return content, err
+}
+
+// closeClients closes the connections to status URIs that are no longer present, such as removed sockets.
+func (e *PHPFPM) closeClients(uris []string) {
+	present := map[string]bool{e.opcacheURI + " " + e.opcachePath: true}
+	for _, uri := range uris {
+		present[uri+" "+e.statusPath] = true
 	}
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	e.clientsMu.Lock()
+	defer e.clientsMu.Unlock()
+	for key, client := range e.clients {
+		if !present[key] {
+			client.Close()
+			delete(e.clients, key)
+		}
 	}
-	return content, nil
 }
 
 func phpfpmGetUint64(key, val string) uint64 {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const phpfpmStatusPage = `pool:                 www
+process manager:      dynamic
+start time:           16/Oct/2026:09:12:44 +0000
+start since:          3721
+accepted conn:        18262
+listen queue:         0
+max listen queue:     2
+listen queue len:     511
+idle processes:       3
+active processes:     2
+total processes:      5
+max active processes: 7
+max children reached: 0
+slow requests:        0
+`
+
+const phpfpmPoolConfig = `; Start a new pool named 'www'.
+[www]
+user = www-data
+group = www-data
+listen = /run/php/php8.2-fpm.sock
+pm = dynamic
+pm.max_children = 12 ; raised for the spring sale
+pm.start_servers = 2
+
+[global]
+pm.max_children = 99
+`
+
+func TestParsePHPFPMStatus(t *testing.T) {
+	pool, stats := parsePHPFPMStatus([]byte(phpfpmStatusPage))
+	if pool != "www" {
+		t.Errorf("pool: got %q, expected %q", pool, "www")
+	}
+	if stats.ActiveProcesses != 2 || stats.TotalProcesses != 5 {
+		t.Errorf("stats: got %+v, expected 2 active and 5 total processes", stats)
+	}
+}
+
+func TestPHPFPMPoolLabels(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "www.conf"), []byte(phpfpmPoolConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewPHPFPM(PHPFPMOptions{ConfigGlob: filepath.Join(dir, "*.conf")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, _ := parsePHPFPMStatus([]byte(phpfpmStatusPage))
+	maxChildren := e.readConfigs()
+	if len(maxChildren) != 1 {
+		t.Fatalf("got pools %v, expected only %v", maxChildren, pool)
+	} else if n, ok := maxChildren[pool]; !ok {
+		t.Errorf("pool %q of the status page not in the pool configuration %v", pool, maxChildren)
+	} else if n != 12 {
+		t.Errorf("pm.max_children: got %d, expected 12", n)
+	}
+}
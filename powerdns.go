@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type PowerDNSOptions struct {
+	APIURI  string `name:"api-uri" desc:"A URI for connecting to the PowerDNS webserver API (e.g. http://localhost:8081)."`
+	APIKey  string `name:"api-key" desc:"API key sent as the X-API-Key header."`
+	Service string `desc:"Systemd service name the PowerDNS collector depends on (e.g. pdns or pdns-recursor)."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+type PowerDNS struct {
+	stats    *collector.Client
+	zones    *collector.Client
+	counters *collector.CounterTracker
+
+	queries *prometheus.CounterVec
+	answers *prometheus.CounterVec
+	cache   *prometheus.CounterVec
+	latency prometheus.Gauge
+	zoneNum prometheus.Gauge
+}
+
+func NewPowerDNS(opts PowerDNSOptions) (*PowerDNS, error) {
+	uri := strings.TrimSuffix(opts.APIURI, "/") + "/api/v1/servers/localhost"
+	stats, err := collector.NewClient(uri + "/statistics")
+	if err != nil {
+		return nil, err
+	}
+	zones, err := collector.NewClient(uri + "/zones")
+	if err != nil {
+		return nil, err
+	}
+	if opts.APIKey != "" {
+		stats.Header.Set("X-API-Key", opts.APIKey)
+		zones.Header.Set("X-API-Key", opts.APIKey)
+	}
+
+	e := &PowerDNS{
+		stats:    stats,
+		zones:    zones,
+		counters: collector.NewCounterTracker(),
+
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "powerdns_queries_total",
+			Help: "Total number of queries.",
+		}, []string{"protocol"}),
+		answers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "powerdns_answers_total",
+			Help: "Total number of answers by response code.",
+		}, []string{"rcode"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "powerdns_cache_lookups_total",
+			Help: "Total number of cache hits or misses.",
+		}, []string{"result"}),
+		latency: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "powerdns_latency_seconds",
+			Help: "Average query latency in seconds.",
+		}),
+		zoneNum: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "powerdns_zones",
+			Help: "Number of zones served by the authoritative server.",
+		}),
+	}
+	e.updateStats(context.Background())
+	return e, nil
+}
+
+func (e *PowerDNS) Close() error {
+	return nil
+}
+
+// Check fetches the statistics.
+func (e *PowerDNS) Check(ctx context.Context) error {
+	_, err := e.getStats(ctx)
+	return err
+}
+
+func (e *PowerDNS) Describe(ch chan<- *prometheus.Desc) {
+	e.queries.Describe(ch)
+	e.answers.Describe(ch)
+	e.cache.Describe(ch)
+	e.latency.Describe(ch)
+	e.zoneNum.Describe(ch)
+}
+
+func (e *PowerDNS) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *PowerDNS) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	stats, err := e.updateStats(ctx)
+	if err != nil {
+		Error.Println("powerdns:", err)
+		return err
+	}
+	for protocol, n := range stats.Queries {
+		e.queries.WithLabelValues(protocol).Add(float64(n))
+	}
+	for rcode, n := range stats.Answers {
+		e.answers.WithLabelValues(rcode).Add(float64(n))
+	}
+	e.cache.WithLabelValues("hit").Add(float64(stats.CacheHits))
+	e.cache.WithLabelValues("miss").Add(float64(stats.CacheMisses))
+	e.latency.Set(stats.Latency)
+	e.queries.Collect(ch)
+	e.answers.Collect(ch)
+	e.cache.Collect(ch)
+	e.latency.Collect(ch)
+	if stats.Authoritative {
+		e.zoneNum.Set(float64(stats.Zones))
+		e.zoneNum.Collect(ch)
+	}
+	Debug.Println("collect duration for powerdns:", time.Since(t))
+	return nil
+}
+
+// powerdnsStatistic is an item of the statistics endpoint, which is either a StatisticItem with a single value, or a MapStatisticItem or RingStatisticItem with a list of named values.
+type powerdnsStatistic struct {
+	Name   string
+	Type   string
+	Value  string
+	Values map[string]string
+}
+
+func (s *powerdnsStatistic) UnmarshalJSON(b []byte) error {
+	item := struct {
+		Name  string          `json:"name"`
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	}{}
+	if err := json.Unmarshal(b, &item); err != nil {
+		return err
+	}
+	s.Name, s.Type = item.Name, item.Type
+	if item.Type == "StatisticItem" {
+		return json.Unmarshal(item.Value, &s.Value)
+	}
+
+	values := []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}{}
+	if err := json.Unmarshal(item.Value, &values); err != nil {
+		return fmt.Errorf("%v: %w", item.Name, err)
+	}
+	s.Values = make(map[string]string, len(values))
+	for _, value := range values {
+		s.Values[value.Name] = value.Value
+	}
+	return nil
+}
+
+type powerdnsStats struct {
+	Authoritative bool
+	Queries       map[string]uint64
+	Answers       map[string]uint64
+	CacheHits     uint64
+	CacheMisses   uint64
+	Latency       float64
+	Zones         uint64
+}
+
+func (e *PowerDNS) getStats(ctx context.Context) (powerdnsStats, error) {
+	b, err := e.stats.Get(ctx)
+	if err != nil {
+		return powerdnsStats{}, err
+	}
+	items := []powerdnsStatistic{}
+	if err := json.Unmarshal(b, &items); err != nil {
+		return powerdnsStats{}, fmt.Errorf("failed to parse statistics: %w", err)
+	}
+	return powerdnsParseStats(items), nil
+}
+
+func powerdnsParseStats(items []powerdnsStatistic) powerdnsStats {
+	values := map[string]uint64{}
+	rcodes := map[string]string{}
+	for _, item := range items {
+		if item.Type == "StatisticItem" {
+			if n, err := strconv.ParseUint(item.Value, 10, 64); err == nil {
+				values[item.Name] = n
+			}
+		} else if item.Name == "response-by-rcode" {
+			rcodes = item.Values
+		}
+	}
+
+	// the recursor reports questions, the authoritative server reports queries per protocol
+	stats := powerdnsStats{
+		Queries: map[string]uint64{},
+		Answers: map[string]uint64{},
+	}
+	if questions, ok := values["questions"]; ok {
+		stats.Queries["all"] = questions
+		stats.Answers["noerror"] = values["noerror-answers"]
+		stats.Answers["nxdomain"] = values["nxdomain-answers"]
+		stats.Answers["servfail"] = values["servfail-answers"]
+		stats.CacheHits = values["cache-hits"]
+		stats.CacheMisses = values["cache-misses"]
+		stats.Latency = float64(values["qa-latency"]) / 1e6 // in microseconds
+	} else {
+		stats.Authoritative = true
+		stats.Queries["udp"] = values["udp-queries"]
+		stats.Queries["tcp"] = values["tcp-queries"]
+		for rcode, value := range rcodes {
+			if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+				stats.Answers[strings.ToLower(rcode)] = n
+			}
+		}
+		stats.CacheHits = values["packetcache-hit"]
+		stats.CacheMisses = values["packetcache-miss"]
+		stats.Latency = float64(values["latency"]) / 1e6 // in microseconds
+	}
+	return stats
+}
+
+func (e *PowerDNS) updateStats(ctx context.Context) (powerdnsStats, error) {
+	cur, err := e.getStats(ctx)
+	if err != nil {
+		return powerdnsStats{}, err
+	}
+	if cur.Authoritative {
+		b, err := e.zones.Get(ctx)
+		if err != nil {
+			return powerdnsStats{}, err
+		}
+		zones := []json.RawMessage{}
+		if err := json.Unmarshal(b, &zones); err != nil {
+			return powerdnsStats{}, fmt.Errorf("failed to parse zones: %w", err)
+		}
+		cur.Zones = uint64(len(zones))
+	}
+
+	diff := cur
+	diff.Queries = map[string]uint64{}
+	diff.Answers = map[string]uint64{}
+	for key, n := range cur.Queries {
+		if delta, ok := e.counters.Delta(n, "queries", key); ok {
+			diff.Queries[key] = delta
+		}
+	}
+	for key, n := range cur.Answers {
+		if delta, ok := e.counters.Delta(n, "answers", key); ok {
+			diff.Answers[key] = delta
+		}
+	}
+	diff.CacheHits, _ = e.counters.Delta(cur.CacheHits, "cache", "hits")
+	diff.CacheMisses, _ = e.counters.Delta(cur.CacheMisses, "cache", "misses")
+	return diff, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const powerdnsRecursorStatistics = `[
+	{"name": "questions", "type": "StatisticItem", "value": "1500"},
+	{"name": "noerror-answers", "type": "StatisticItem", "value": "1200"},
+	{"name": "nxdomain-answers", "type": "StatisticItem", "value": "250"},
+	{"name": "servfail-answers", "type": "StatisticItem", "value": "50"},
+	{"name": "cache-hits", "type": "StatisticItem", "value": "900"},
+	{"name": "cache-misses", "type": "StatisticItem", "value": "600"},
+	{"name": "qa-latency", "type": "StatisticItem", "value": "2500"},
+	{"name": "security-status", "type": "StatisticItem", "value": "1"},
+	{"name": "response-sizes", "type": "MapStatisticItem", "value": [{"name": "60", "value": "12"}, {"name": "100", "value": "30"}]},
+	{"name": "remotes", "type": "RingStatisticItem", "size": 10000, "value": [{"name": "192.0.2.1", "value": "7"}]}
+]`
+
+const powerdnsAuthoritativeStatistics = `[
+	{"name": "udp-queries", "type": "StatisticItem", "value": "4000"},
+	{"name": "tcp-queries", "type": "StatisticItem", "value": "25"},
+	{"name": "packetcache-hit", "type": "StatisticItem", "value": "3000"},
+	{"name": "packetcache-miss", "type": "StatisticItem", "value": "1025"},
+	{"name": "latency", "type": "StatisticItem", "value": "150"},
+	{"name": "response-by-rcode", "type": "MapStatisticItem", "value": [{"name": "NOERROR", "value": "3900"}, {"name": "NXDOMAIN", "value": "100"}, {"name": "REFUSED", "value": "25"}]},
+	{"name": "queries", "type": "RingStatisticItem", "size": 10000, "value": [{"name": "example.com/A", "value": "42"}]}
+]`
+
+func TestPowerDNSStatistic(t *testing.T) {
+	items := []powerdnsStatistic{}
+	if err := json.Unmarshal([]byte(powerdnsAuthoritativeStatistics), &items); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 7 {
+		t.Fatalf("got %d items, expected 7", len(items))
+	}
+	if item := items[0]; item.Name != "udp-queries" || item.Type != "StatisticItem" || item.Value != "4000" || item.Values != nil {
+		t.Errorf("statistic item: got %+v", item)
+	}
+	if item := items[5]; item.Name != "response-by-rcode" || item.Value != "" || len(item.Values) != 3 || item.Values["REFUSED"] != "25" {
+		t.Errorf("map statistic item: got %+v", item)
+	}
+	if item := items[6]; item.Type != "RingStatisticItem" || item.Values["example.com/A"] != "42" {
+		t.Errorf("ring statistic item: got %+v", item)
+	}
+
+	for _, b := range []string{
+		`[{"name": "questions", "type": "StatisticItem", "value": 1500}]`,
+		`[{"name": "response-by-rcode", "type": "MapStatisticItem", "value": "3900"}]`,
+		`[{"name": "questions", "type": "StatisticItem", "value": "1500"`,
+	} {
+		if err := json.Unmarshal([]byte(b), &items); err == nil {
+			t.Errorf("%v: expected error", b)
+		}
+	}
+}
+
+func TestPowerDNSParseStats(t *testing.T) {
+	tests := []struct {
+		name       string
+		statistics string
+		expected   powerdnsStats
+	}{
+		{"recursor", powerdnsRecursorStatistics, powerdnsStats{
+			Queries:     map[string]uint64{"all": 1500},
+			Answers:     map[string]uint64{"noerror": 1200, "nxdomain": 250, "servfail": 50},
+			CacheHits:   900,
+			CacheMisses: 600,
+			Latency:     0.0025,
+		}},
+		{"authoritative", powerdnsAuthoritativeStatistics, powerdnsStats{
+			Authoritative: true,
+			Queries:       map[string]uint64{"udp": 4000, "tcp": 25},
+			Answers:       map[string]uint64{"noerror": 3900, "nxdomain": 100, "refused": 25},
+			CacheHits:     3000,
+			CacheMisses:   1025,
+			Latency:       0.00015,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := []powerdnsStatistic{}
+			if err := json.Unmarshal([]byte(tt.statistics), &items); err != nil {
+				t.Fatal(err)
+			}
+			stats := powerdnsParseStats(items)
+			if stats.Authoritative != tt.expected.Authoritative || stats.CacheHits != tt.expected.CacheHits || stats.CacheMisses != tt.expected.CacheMisses || stats.Latency != tt.expected.Latency {
+				t.Errorf("got %+v, expected %+v", stats, tt.expected)
+			}
+			for _, m := range [][2]map[string]uint64{{stats.Queries, tt.expected.Queries}, {stats.Answers, tt.expected.Answers}} {
+				if len(m[0]) != len(m[1]) {
+					t.Errorf("got %v, expected %v", m[0], m[1])
+				}
+				for key, n := range m[1] {
+					if m[0][key] != n {
+						t.Errorf("%v: got %d, expected %d", key, m[0][key], n)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type ProbeOptions struct {
+	TCPTarget   []string `name:"tcp-target" desc:"Address to probe for accepting connections at scrape time (e.g. localhost:5432 or unix:///run/app.sock), can be repeated. Prefix with tls:// to also complete a TLS handshake."`
+	Timeout     float64  `desc:"Seconds all probes together may take."`
+	TLSCA       string   `desc:"Path to CA certificate to verify the server certificates of tls:// targets."`
+	TLSInsecure bool     `desc:"Skip verification of the server certificates of tls:// targets."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+type probeTarget struct {
+	name    string
+	network string
+	addr    string
+	tls     bool
+}
+
+// Probe dials TCP addresses and Unix sockets at scrape time to check whether they accept connections.
+type Probe struct {
+	targets   []probeTarget
+	timeout   time.Duration
+	tlsConfig *tls.Config
+
+	success    *prometheus.GaugeVec
+	duration   *prometheus.GaugeVec
+	tlsSuccess *prometheus.GaugeVec
+	certExpiry *prometheus.GaugeVec
+}
+
+func NewProbe(opts ProbeOptions) (*Probe, error) {
+	if opts.Timeout <= 0.0 {
+		return nil, fmt.Errorf("probe: timeout must be positive")
+	}
+	tlsConfig, err := collector.NewTLSConfig(opts.TLSCA, opts.TLSInsecure)
+	if err != nil {
+		return nil, fmt.Errorf("probe: %w", err)
+	}
+
+	targets := []probeTarget{}
+	for _, uri := range opts.TCPTarget {
+		target := probeTarget{name: uri}
+		if strings.HasPrefix(uri, "tls://") {
+			uri = uri[6:]
+			target.tls = true
+		}
+		if target.network, target.addr, err = collector.ParseURI(uri); err != nil {
+			return nil, fmt.Errorf("probe: %w", err)
+		} else if strings.Contains(target.addr, "://") {
+			return nil, fmt.Errorf("probe: unsupported scheme in %v", target.name)
+		}
+		targets = append(targets, target)
+	}
+	return &Probe{
+		targets:   targets,
+		timeout:   time.Duration(opts.Timeout * float64(time.Second)),
+		tlsConfig: tlsConfig,
+
+		success: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_tcp_success",
+			Help: "Whether the target accepted a connection.",
+		}, []string{"target"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_tcp_duration_seconds",
+			Help: "Duration of connecting to the target in seconds, including the TLS handshake.",
+		}, []string{"target"}),
+		tlsSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_tcp_tls_success",
+			Help: "Whether the TLS handshake with the target succeeded.",
+		}, []string{"target"}),
+		certExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_tcp_tls_cert_expiry_timestamp_seconds",
+			Help: "Expiry of the first certificate of the target to expire as a Unix timestamp in seconds.",
+		}, []string{"target"}),
+	}, nil
+}
+
+func (e *Probe) Close() error {
+	return nil
+}
+
+func (e *Probe) Describe(ch chan<- *prometheus.Desc) {
+	e.success.Describe(ch)
+	e.duration.Describe(ch)
+	e.tlsSuccess.Describe(ch)
+	e.certExpiry.Describe(ch)
+}
+
+func (e *Probe) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+// CollectContext probes all targets concurrently. Unreachable targets are what is being measured, so they are not reported as an error.
+func (e *Probe) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	e.success.Reset()
+	e.duration.Reset()
+	e.tlsSuccess.Reset()
+	e.certExpiry.Reset()
+	wg := sync.WaitGroup{}
+	for _, target := range e.targets {
+		wg.Add(1)
+		go func(target probeTarget) {
+			defer wg.Done()
+			e.probe(ctx, target)
+		}(target)
+	}
+	wg.Wait()
+
+	e.success.Collect(ch)
+	e.duration.Collect(ch)
+	e.tlsSuccess.Collect(ch)
+	e.certExpiry.Collect(ch)
+	Debug.Println("collect duration for probe:", time.Since(t))
+	return nil
+}
+
+func (e *Probe) probe(ctx context.Context, target probeTarget) {
+	t := time.Now()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, target.network, target.addr)
+	if err != nil {
+		Debug.Printf("probe: %v: %v", target.name, err)
+		e.success.WithLabelValues(target.name).Set(0.0)
+		e.duration.WithLabelValues(target.name).Set(time.Since(t).Seconds())
+		if target.tls {
+			e.tlsSuccess.WithLabelValues(target.name).Set(0.0)
+		}
+		return
+	}
+	defer conn.Close()
+	e.success.WithLabelValues(target.name).Set(1.0)
+
+	if target.tls {
+		config := e.tlsConfig.Clone()
+		if host, _, err := net.SplitHostPort(target.addr); err == nil {
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			Debug.Printf("probe: %v: %v", target.name, err)
+			e.tlsSuccess.WithLabelValues(target.name).Set(0.0)
+		} else {
+			e.tlsSuccess.WithLabelValues(target.name).Set(1.0)
+			expiry := time.Time{}
+			for _, cert := range tlsConn.ConnectionState().PeerCertificates {
+				if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+					expiry = cert.NotAfter
+				}
+			}
+			if !expiry.IsZero() {
+				e.certExpiry.WithLabelValues(target.name).Set(float64(expiry.Unix()))
+			}
+		}
+	}
+	e.duration.WithLabelValues(target.name).Set(time.Since(t).Seconds())
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type ProxyOptions struct {
+	Target []string `desc:"Prometheus endpoint to re-export as name=uri (e.g. grafana=http://localhost:3000/metrics), can be repeated. Samples get a job label set to the name."`
+	Prefix bool     `desc:"Prefix the metric names of each target with its name, which avoids conflicts between targets and with this exporter."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+const proxyTimeout = 10 * time.Second
+
+type proxyTarget struct {
+	name   string
+	client *collector.Client
+}
+
+// Proxy fetches the exposition of other Prometheus endpoints at scrape time and re-exports their samples.
+type Proxy struct {
+	targets []proxyTarget
+	prefix  bool
+
+	up *prometheus.GaugeVec
+}
+
+func NewProxy(opts ProxyOptions) (*Proxy, error) {
+	targets := []proxyTarget{}
+	for _, target := range opts.Target {
+		name, uri, ok := strings.Cut(target, "=")
+		if !ok || name == "" || uri == "" {
+			return nil, fmt.Errorf("proxy: target %v must be of the form name=uri", target)
+		}
+		client, err := collector.NewClient(uri)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %v: %w", name, err)
+		}
+		client.Header.Set("Accept", string(expfmt.FmtText))
+		targets = append(targets, proxyTarget{name, client})
+	}
+	return &Proxy{
+		targets: targets,
+		prefix:  opts.Prefix,
+
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_up",
+			Help: "Proxy target could be scraped.",
+		}, []string{"name"}),
+	}, nil
+}
+
+func (e *Proxy) Close() error {
+	return nil
+}
+
+// Check fetches the exposition of all targets.
+func (e *Proxy) Check(ctx context.Context) error {
+	for _, target := range e.targets {
+		if _, err := e.fetch(ctx, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe only describes proxy_up, since the proxied metrics are not known in advance.
+func (e *Proxy) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+}
+
+func (e *Proxy) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Proxy) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	families := make([]map[string]*dto.MetricFamily, len(e.targets))
+	errs := make([]error, len(e.targets))
+	wg := sync.WaitGroup{}
+	for i, target := range e.targets {
+		wg.Add(1)
+		go func(i int, target proxyTarget) {
+			defer wg.Done()
+			mfs, err := e.fetch(ctx, target)
+			if err != nil {
+				Error.Printf("proxy: %v: %v", target.name, err)
+				errs[i] = fmt.Errorf("proxy %v: %w", target.name, err)
+				return
+			}
+			families[i] = mfs
+		}(i, target)
+	}
+	wg.Wait()
+
+	// metric families must have the same help text and type across targets
+	descs := map[string]*dto.MetricFamily{}
+	e.up.Reset()
+	for i, target := range e.targets {
+		if families[i] == nil {
+			e.up.WithLabelValues(target.name).Set(0.0)
+			continue
+		}
+		e.up.WithLabelValues(target.name).Set(1.0)
+		for _, mf := range families[i] {
+			name := mf.GetName()
+			if e.prefix {
+				name = target.name + "_" + name
+			}
+			if desc, ok := descs[name]; !ok {
+				descs[name] = mf
+			} else if desc.GetType() != mf.GetType() {
+				Debug.Printf("proxy: %v: metric %v has conflicting type", target.name, name)
+				continue
+			} else {
+				mf.Help = desc.Help
+			}
+			for _, m := range mf.Metric {
+				metric, err := proxyMetric(name, target.name, mf, m)
+				if err != nil {
+					Debug.Printf("proxy: %v: %v", target.name, err)
+					continue
+				}
+				ch <- metric
+			}
+		}
+	}
+	e.up.Collect(ch)
+	Debug.Println("collect duration for proxy:", time.Since(t))
+	return errors.Join(errs...)
+}
+
+func (e *Proxy) fetch(ctx context.Context, target proxyTarget) (map[string]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxyTimeout)
+	defer cancel()
+	b, err := target.client.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parser := expfmt.TextParser{}
+	return parser.TextToMetricFamilies(bytes.NewReader(b))
+}
+
+// proxyMetric converts a sample to a const metric, adding the job label unless it is empty. An existing job label is renamed to exported_job like Prometheus does.
+func proxyMetric(name, job string, mf *dto.MetricFamily, m *dto.Metric) (prometheus.Metric, error) {
+	labelNames := []string{}
+	labelValues := []string{}
+	if job != "" {
+		labelNames = append(labelNames, "job")
+		labelValues = append(labelValues, job)
+	}
+	for _, label := range m.Label {
+		if job != "" && label.GetName() == "job" {
+			labelNames = append(labelNames, "exported_job")
+		} else {
+			labelNames = append(labelNames, label.GetName())
+		}
+		labelValues = append(labelValues, label.GetValue())
+	}
+	desc := prometheus.NewDesc(name, mf.GetHelp(), labelNames, nil)
+
+	var metric prometheus.Metric
+	var err error
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		metric, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue(), labelValues...)
+	case dto.MetricType_GAUGE:
+		metric, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue(), labelValues...)
+	case dto.MetricType_UNTYPED:
+		metric, err = prometheus.NewConstMetric(desc, prometheus.UntypedValue, m.GetUntyped().GetValue(), labelValues...)
+	case dto.MetricType_SUMMARY:
+		quantiles := map[float64]float64{}
+		for _, q := range m.GetSummary().Quantile {
+			quantiles[q.GetQuantile()] = q.GetValue()
+		}
+		metric, err = prometheus.NewConstSummary(desc, m.GetSummary().GetSampleCount(), m.GetSummary().GetSampleSum(), quantiles, labelValues...)
+	case dto.MetricType_HISTOGRAM:
+		// the +Inf bucket is implied by the sample count
+		buckets := map[float64]uint64{}
+		for _, b := range m.GetHistogram().Bucket {
+			if !math.IsInf(b.GetUpperBound(), 1) {
+				buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+			}
+		}
+		metric, err = prometheus.NewConstHistogram(desc, m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum(), buckets, labelValues...)
+	default:
+		return nil, fmt.Errorf("metric %v has unsupported type %v", name, mf.GetType())
+	}
+	if err != nil {
+		return nil, err
+	} else if m.TimestampMs != nil {
+		metric = prometheus.NewMetricWithTimestamp(time.UnixMilli(m.GetTimestampMs()), metric)
+	}
+	return metric, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const proxyProtocolTimeout = 5 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol decodes the PROXY protocol v1 and v2 header sent by load balancers such as HAProxy, so that the remote address is that of the original client. The header is required from trusted upstreams, and connections from other addresses are used as is.
+type ProxyProtocol struct {
+	trusted []*net.IPNet
+	errors  prometheus.Counter
+}
+
+// NewProxyProtocol returns a PROXY protocol decoder that trusts the given CIDRs, or all addresses if none are given. Unix socket peers are always trusted.
+func NewProxyProtocol(cidrs []string) (*ProxyProtocol, error) {
+	trusted := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol: %w", err)
+		}
+		trusted = append(trusted, ipnet)
+	}
+	return &ProxyProtocol{
+		trusted: trusted,
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dex_proxy_protocol_errors_total",
+			Help: "Total number of connections dropped for a missing or malformed PROXY protocol header.",
+		}),
+	}, nil
+}
+
+func (p *ProxyProtocol) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || len(p.trusted) == 0 {
+		return true
+	}
+	for _, ipnet := range p.trusted {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener wraps a listener so that connections from trusted upstreams decode the PROXY protocol header. The header is read on first use of the connection, so that a slow client doesn't block accepting other connections.
+func (p *ProxyProtocol) Listener(listener net.Listener) net.Listener {
+	return &proxyProtocolListener{listener, p}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	*ProxyProtocol
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	} else if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		errors: l.errors,
+	}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	r      *bufio.Reader
+	errors prometheus.Counter
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remote, c.err = readProxyProtocolHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			Warning.Printf("proxy protocol from %v: %v", c.Conn.RemoteAddr(), c.err)
+			c.errors.Inc()
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader returns the source address of the header, or nil if the proxy didn't send one (e.g. for health checks).
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(b, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	} else if b, err = r.Peek(6); err != nil {
+		return nil, fmt.Errorf("missing header: %w", err)
+	} else if string(b) == "PROXY " {
+		return readProxyProtocolV1(r)
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+// readProxyProtocolV1 parses the header "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", which is at most 107 bytes.
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("bad v1 header: %w", err)
+		} else if 107 <= len(line) {
+			return nil, fmt.Errorf("bad v1 header: too long")
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if 2 <= len(fields) && fields[1] == "UNKNOWN" {
+		return nil, nil
+	} else if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("bad v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("bad v1 header: bad source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 parses the binary header, only TCP over IPv4 and IPv6 addresses are used.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("bad v2 header: %w", err)
+	}
+	verCmd, fam := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("bad v2 header: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("bad v2 header: unsupported version")
+	} else if verCmd&0x0F == 0x00 {
+		return nil, nil // LOCAL command
+	} else if verCmd&0x0F != 0x01 {
+		return nil, fmt.Errorf("bad v2 header: unsupported command")
+	}
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("bad v2 header: short address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("bad v2 header: short address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func proxyProtocolV2(verCmd, fam byte, body []byte) string {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, verCmd, fam)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return string(append(header, body...))
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4 := []byte{192, 168, 0, 1, 192, 168, 0, 11, 0xDC, 0x04, 0x01, 0xBB}
+	ipv6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	ipv6 = append(ipv6, 0xDC, 0x04, 0x01, 0xBB)
+
+	var tests = []struct {
+		name   string
+		header string
+		remote string // empty for no address
+		err    string // empty for no error
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "192.168.0.1:56324", ""},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", ""},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", ""},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "", ""},
+		{"v1 longest", "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n", "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", ""},
+		{"v1 too long", "PROXY UNKNOWN " + strings.Repeat("f", 100) + "\r\n", "", "too long"},
+		{"v1 without CRLF", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", "", "bad v1 header"},
+		{"v1 missing fields", "PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n", "", "bad v1 header"},
+		{"v1 unknown protocol", "PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n", "", "bad v1 header"},
+		{"v1 bad address", "PROXY TCP4 192.168.0 192.168.0.11 56324 443\r\n", "", "bad source address"},
+		{"v1 IPv6 address for TCP4", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", "bad source address"},
+		{"v1 bad port", "PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n", "", "bad source address"},
+		{"v2 TCP4", proxyProtocolV2(0x21, 0x11, ipv4), "192.168.0.1:56324", ""},
+		{"v2 TCP6", proxyProtocolV2(0x21, 0x21, ipv6), "[2001:db8::1]:56324", ""},
+		{"v2 TCP4 with TLVs", proxyProtocolV2(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), "192.168.0.1:56324", ""},
+		{"v2 LOCAL", proxyProtocolV2(0x20, 0x00, nil), "", ""},
+		{"v2 LOCAL with address", proxyProtocolV2(0x20, 0x11, ipv4), "", ""},
+		{"v2 UDP4", proxyProtocolV2(0x21, 0x12, ipv4), "", ""},
+		{"v2 short TCP4 address", proxyProtocolV2(0x21, 0x11, ipv4[:8]), "", "short address"},
+		{"v2 short TCP6 address", proxyProtocolV2(0x21, 0x21, ipv6[:32]), "", "short address"},
+		{"v2 truncated", proxyProtocolV2(0x21, 0x11, ipv4)[:20], "", "unexpected EOF"},
+		{"v2 bad version", proxyProtocolV2(0x11, 0x11, ipv4), "", "unsupported version"},
+		{"v2 bad command", proxyProtocolV2(0x22, 0x11, ipv4), "", "unsupported command"},
+		{"missing", "GET /metrics HTTP/1.1\r\n", "", "missing header"},
+		{"missing and short", "GET", "", "missing header"},
+		{"empty", "", "", "missing header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.header
+			if tt.err == "" {
+				data += "GET / HTTP/1.1\r\n"
+			}
+			r := bufio.NewReader(strings.NewReader(data))
+			remote, err := readProxyProtocolHeader(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if tt.remote == "" && remote != nil {
+				t.Fatalf("remote address is %v, expected none", remote)
+			} else if tt.remote != "" && (remote == nil || remote.String() != tt.remote) {
+				t.Fatalf("remote address is %v, expected %v", remote, tt.remote)
+			}
+
+			// the header is consumed
+			if line, _ := r.ReadString('\n'); line != "GET / HTTP/1.1\r\n" {
+				t.Fatalf("header is followed by %q", line)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	var tests = []struct {
+		name    string
+		trusted string
+		send    string
+		remote  string // empty for the address of the client
+		read    string
+		errors  float64
+	}{
+		{"trusted", "127.0.0.0/8", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nping", "192.168.0.1:56324", "ping", 0},
+		{"trusted health check", "127.0.0.0/8", "PROXY UNKNOWN\r\nping", "", "ping", 0},
+		{"trusted missing header", "127.0.0.0/8", "ping\r\n", "", "", 1},
+		{"untrusted", "10.0.0.0/8", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nping", "", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nping", 0},
+		{"untrusted without header", "10.0.0.0/8", "ping", "", "ping", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProxyProtocol([]string{tt.trusted})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln = p.Listener(ln)
+			defer ln.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := io.WriteString(client, tt.send); err != nil {
+				t.Fatal(err)
+			}
+			client.(*net.TCPConn).CloseWrite()
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			remote := tt.remote
+			if remote == "" {
+				remote = client.LocalAddr().String()
+			}
+			if addr := conn.RemoteAddr().String(); addr != remote {
+				t.Errorf("remote address is %v, expected %v", addr, remote)
+			}
+			b, err := io.ReadAll(conn)
+			if tt.errors == 0 && err != nil {
+				t.Fatal(err)
+			} else if tt.errors != 0 && err == nil {
+				t.Fatal("expected error")
+			} else if string(b) != tt.read {
+				t.Errorf("read %q, expected %q", b, tt.read)
+			}
+			if errors := testutil.ToFloat64(p.errors); errors != tt.errors {
+				t.Errorf("dex_proxy_protocol_errors_total is %v, expected %v", errors, tt.errors)
+			}
+		})
+	}
+
+	if _, err := NewProxyProtocol([]string{"10.0.0.0"}); err == nil {
+		t.Error("expected error for address without prefix length")
+	}
+}
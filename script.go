@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+type ScriptOptions struct {
+	Command []string `desc:"Command to run as name=command (e.g. backups=/usr/local/bin/check-backups --days 1), can be repeated. The command is split on spaces and runs without a shell and with a clean environment. Its output is either a single number exported as script_result, or metrics in the Prometheus text format."`
+	Shell   bool     `desc:"Run the commands through /bin/sh -c, which allows quoting, pipes and redirections."`
+	Timeout float64  `desc:"Seconds after which a command is killed."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+// scriptEnv is the clean environment of the commands, only PATH is set so that interpreters can be found.
+var scriptEnv = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+
+type scriptResult struct {
+	value    float64
+	families map[string]*dto.MetricFamily
+	duration time.Duration
+	err      error
+}
+
+// scriptCall is a running execution of a script, whose result is shared by all scrapes that wait for it.
+type scriptCall struct {
+	done   chan struct{}
+	result scriptResult
+}
+
+type script struct {
+	name string
+	args []string
+
+	mu   sync.Mutex
+	call *scriptCall
+}
+
+// Script runs user-defined commands and exports their numeric result or the metrics they print. A script never runs concurrently with itself, overlapping scrapes wait for and share the result of the running execution.
+type Script struct {
+	scripts []*script
+	timeout time.Duration
+
+	success  *prometheus.GaugeVec
+	duration *prometheus.GaugeVec
+	result   *prometheus.GaugeVec
+}
+
+func NewScript(opts ScriptOptions) (*Script, error) {
+	if opts.Timeout <= 0.0 {
+		return nil, fmt.Errorf("script: timeout must be positive")
+	}
+	scripts := []*script{}
+	names := map[string]bool{}
+	for _, option := range opts.Command {
+		name, command, ok := strings.Cut(option, "=")
+		command = strings.TrimSpace(command)
+		if !ok || name == "" || command == "" {
+			return nil, fmt.Errorf("script: command %v must be of the form name=command", option)
+		} else if names[name] {
+			return nil, fmt.Errorf("script: duplicate name %v", name)
+		}
+		names[name] = true
+
+		var args []string
+		if opts.Shell {
+			args = []string{"/bin/sh", "-c", command}
+		} else {
+			args = strings.Fields(command)
+			binary, err := exec.LookPath(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("script: %v: %w", name, err)
+			}
+			args[0] = binary
+		}
+		scripts = append(scripts, &script{name: name, args: args})
+	}
+	return &Script{
+		scripts: scripts,
+		timeout: time.Duration(opts.Timeout * float64(time.Second)),
+
+		success: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "script_success",
+			Help: "Script exited successfully and its output could be parsed.",
+		}, []string{"name"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "script_duration_seconds",
+			Help: "Duration of the last run of the script in seconds.",
+		}, []string{"name"}),
+		result: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "script_result",
+			Help: "Number printed by the script.",
+		}, []string{"name"}),
+	}, nil
+}
+
+func (e *Script) Close() error {
+	return nil
+}
+
+// Check runs all scripts.
+func (e *Script) Check(ctx context.Context) error {
+	for _, s := range e.scripts {
+		if result := e.run(ctx, s); result.err != nil {
+			return fmt.Errorf("%v: %w", s.name, result.err)
+		}
+	}
+	return nil
+}
+
+// Describe doesn't describe the metrics printed by the scripts, since they are not known in advance.
+func (e *Script) Describe(ch chan<- *prometheus.Desc) {
+	e.success.Describe(ch)
+	e.duration.Describe(ch)
+	e.result.Describe(ch)
+}
+
+func (e *Script) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Script) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	results := make([]scriptResult, len(e.scripts))
+	wg := sync.WaitGroup{}
+	for i, s := range e.scripts {
+		wg.Add(1)
+		go func(i int, s *script) {
+			defer wg.Done()
+			results[i] = e.run(ctx, s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	// metric families must have the same help text and type across scripts, the families are not modified since they may be shared with concurrent scrapes
+	errs := []error{}
+	descs := map[string]*dto.MetricFamily{}
+	e.success.Reset()
+	e.duration.Reset()
+	e.result.Reset()
+	for i, s := range e.scripts {
+		result := results[i]
+		if result.duration != 0 {
+			e.duration.WithLabelValues(s.name).Set(result.duration.Seconds())
+		}
+		if result.err != nil {
+			Error.Printf("script: %v: %v", s.name, result.err)
+			errs = append(errs, fmt.Errorf("script %v: %w", s.name, result.err))
+			e.success.WithLabelValues(s.name).Set(0.0)
+			continue
+		}
+		e.success.WithLabelValues(s.name).Set(1.0)
+		if result.families == nil {
+			e.result.WithLabelValues(s.name).Set(result.value)
+			continue
+		}
+		for name, mf := range result.families {
+			if desc, ok := descs[name]; !ok {
+				descs[name] = mf
+			} else if desc.GetType() != mf.GetType() || desc.GetHelp() != mf.GetHelp() {
+				Debug.Printf("script: %v: metric %v has conflicting type or help text", s.name, name)
+				continue
+			}
+			for _, m := range mf.Metric {
+				metric, err := proxyMetric(name, "", mf, m)
+				if err != nil {
+					Debug.Printf("script: %v: %v", s.name, err)
+					continue
+				}
+				ch <- metric
+			}
+		}
+	}
+	e.success.Collect(ch)
+	e.duration.Collect(ch)
+	e.result.Collect(ch)
+	Debug.Println("collect duration for script:", time.Since(t))
+	return errors.Join(errs...)
+}
+
+// run starts the script, or waits for its running execution. The execution is not canceled by the scrape but only by the timeout, so that other waiting scrapes get its result.
+func (e *Script) run(ctx context.Context, s *script) scriptResult {
+	s.mu.Lock()
+	call := s.call
+	if call == nil {
+		call = &scriptCall{done: make(chan struct{})}
+		s.call = call
+		go func() {
+			call.result = e.exec(s)
+			s.mu.Lock()
+			s.call = nil
+			s.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result
+	case <-ctx.Done():
+		return scriptResult{err: ctx.Err()}
+	}
+}
+
+func (e *Script) exec(s *script) scriptResult {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	t := time.Now()
+	cmd := exec.CommandContext(ctx, s.args[0], s.args[1:]...)
+	cmd.Env = scriptEnv
+	cmd.WaitDelay = time.Second // don't wait for children that keep the output open
+	b, err := cmd.Output()
+	result := scriptResult{duration: time.Since(t)}
+	if ctx.Err() != nil {
+		result.err = fmt.Errorf("timed out after %v", e.timeout)
+		return result
+	} else if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) && 0 < len(exitErr.Stderr) {
+		stderr, _, _ := strings.Cut(strings.TrimSpace(string(exitErr.Stderr)), "\n")
+		result.err = fmt.Errorf("%w: %v", err, stderr)
+		return result
+	} else if err != nil {
+		result.err = err
+		return result
+	}
+
+	if value, err := strconv.ParseFloat(string(bytes.TrimSpace(b)), 64); err == nil {
+		result.value = value
+		return result
+	}
+	parser := expfmt.TextParser{}
+	if result.families, err = parser.TextToMetricFamilies(bytes.NewReader(b)); err != nil {
+		Debug.Printf("output of script %v:\n%v", s.name, string(b))
+		result.err = fmt.Errorf("output is neither a number nor metrics: %w", err)
+	}
+	return result
+}
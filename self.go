@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+// autoMemoryLimitFraction is the fraction of the cgroup memory limit used as soft memory limit with --self.gomemlimit=auto, leaving headroom for memory that the Go runtime doesn't manage.
+const autoMemoryLimitFraction = 0.9
+
+// ApplySelfOptions sets the soft memory limit and GOMAXPROCS of the Go runtime. With auto they are derived from the cgroup limits of the exporter, and are left unchanged when there are none.
+func ApplySelfOptions(opts SelfOptions) error {
+	var cgroupMemory uint64
+	var cgroupCPUs float64
+	var cgroupErr error
+	if opts.GoMemLimit == "auto" || opts.GoMaxProcs == "auto" {
+		cgroupMemory, cgroupCPUs, cgroupErr = collector.CgroupLimits()
+		if cgroupErr != nil {
+			Warning.Println("self: reading cgroup limits:", cgroupErr)
+		}
+	}
+
+	switch opts.GoMemLimit {
+	case "":
+	case "auto":
+		if cgroupErr == nil && cgroupMemory == 0 {
+			Info.Println("self: no cgroup memory limit, the memory limit is unchanged")
+		} else if cgroupErr == nil {
+			limit := int64(autoMemoryLimitFraction * float64(cgroupMemory))
+			debug.SetMemoryLimit(limit)
+			Info.Printf("self: memory limit set to %d bytes for a cgroup memory limit of %d bytes", limit, cgroupMemory)
+		}
+	default:
+		limit, err := parseByteSize(opts.GoMemLimit)
+		if err != nil {
+			return fmt.Errorf("self: gomemlimit: %w", err)
+		}
+		debug.SetMemoryLimit(limit)
+	}
+
+	switch opts.GoMaxProcs {
+	case "":
+	case "auto":
+		if cgroupErr == nil && cgroupCPUs == 0.0 {
+			Info.Println("self: no cgroup CPU quota, GOMAXPROCS is unchanged")
+		} else if cgroupErr == nil {
+			procs := int(math.Max(1.0, math.Ceil(cgroupCPUs)))
+			if procs < runtime.NumCPU() {
+				runtime.GOMAXPROCS(procs)
+			}
+			Info.Printf("self: GOMAXPROCS set to %d for a cgroup CPU quota of %g", runtime.GOMAXPROCS(0), cgroupCPUs)
+		}
+	default:
+		procs, err := strconv.Atoi(opts.GoMaxProcs)
+		if err != nil || procs < 1 {
+			return fmt.Errorf("self: gomaxprocs: must be a positive integer or auto")
+		}
+		runtime.GOMAXPROCS(procs)
+	}
+	return nil
+}
+
+// parseByteSize parses sizes like GOMEMLIMIT, such as 64MiB, with an optional B, KiB, MiB, GiB or TiB suffix.
+func parseByteSize(size string) (int64, error) {
+	s := strings.TrimSpace(size)
+	mult := int64(1)
+	for i, suffix := range []string{"TiB", "GiB", "MiB", "KiB", "B"} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, suffix))
+			mult = 1 << (10 * (4 - i))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q, expected bytes with an optional B, KiB, MiB, GiB or TiB suffix", size)
+	} else if math.MaxInt64/mult < n {
+		return 0, fmt.Errorf("size %q overflows", size)
+	}
+	return n * mult, nil
+}
+
+// Self exports the resource limits and peak memory usage of the exporter, to verify that the limits took effect.
+type Self struct {
+	memoryLimit prometheus.Gauge
+	gomaxprocs  prometheus.Gauge
+	maxRSS      prometheus.Gauge
+}
+
+func NewSelf() *Self {
+	return &Self{
+		memoryLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dex_self_memory_limit_bytes",
+			Help: "Soft memory limit of the Go runtime in bytes, omitted when there is none.",
+		}),
+		gomaxprocs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dex_self_gomaxprocs",
+			Help: "Maximum number of CPUs executing Go code simultaneously.",
+		}),
+		maxRSS: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dex_self_max_rss_bytes",
+			Help: "Peak resident memory of the exporter since the previous scrape in bytes.",
+		}),
+	}
+}
+
+func (e *Self) Describe(ch chan<- *prometheus.Desc) {
+	e.memoryLimit.Describe(ch)
+	e.gomaxprocs.Describe(ch)
+	e.maxRSS.Describe(ch)
+}
+
+func (e *Self) Collect(ch chan<- prometheus.Metric) {
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		e.memoryLimit.Set(float64(limit))
+		e.memoryLimit.Collect(ch)
+	}
+	e.gomaxprocs.Set(float64(runtime.GOMAXPROCS(0)))
+	e.gomaxprocs.Collect(ch)
+	if rss, err := collector.SelfPeakRSS(); err != nil {
+		Debug.Println("reading peak memory of the exporter:", err)
+	} else {
+		e.maxRSS.Set(float64(rss))
+		e.maxRSS.Collect(ch)
+	}
+}
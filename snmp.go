@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type SNMPOptions struct {
+	Target        []string `desc:"SNMP agent to walk the interface table of as host or host:port (e.g. switch.local), can be repeated."`
+	Community     string   `desc:"SNMP v2c community."`
+	Timeout       float64  `desc:"Seconds walking a target may take."`
+	MaxInterfaces int      `desc:"Maximum number of interfaces per target."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+const snmpMaxRepetitions = 25
+
+// interface table columns of IF-MIB
+var (
+	snmpIfDescr       = []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 2}
+	snmpIfOperStatus  = []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 8}
+	snmpIfInOctets    = []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 10}
+	snmpIfInErrors    = []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 14}
+	snmpIfOutOctets   = []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 16}
+	snmpIfOutErrors   = []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 20}
+	snmpIfName        = []uint32{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 1}
+	snmpIfHCInOctets  = []uint32{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 6}
+	snmpIfHCOutOctets = []uint32{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 10}
+)
+
+type snmpTarget struct {
+	name string
+	addr string
+
+	mu   sync.Mutex
+	prev map[string]uint64
+}
+
+// SNMP walks the interface table of SNMP v2c agents such as managed switches. It implements only the requests needed for that.
+type SNMP struct {
+	targets       []*snmpTarget
+	community     string
+	timeout       time.Duration
+	maxInterfaces int
+
+	up         *prometheus.GaugeVec
+	octets     *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	operStatus *prometheus.GaugeVec
+}
+
+func NewSNMP(opts SNMPOptions) (*SNMP, error) {
+	if opts.Timeout <= 0.0 {
+		return nil, fmt.Errorf("snmp: timeout must be positive")
+	} else if opts.MaxInterfaces <= 0 {
+		return nil, fmt.Errorf("snmp: maximum number of interfaces must be positive")
+	}
+
+	targets := []*snmpTarget{}
+	for _, target := range opts.Target {
+		addr := target
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			addr = net.JoinHostPort(target, "161")
+		}
+		targets = append(targets, &snmpTarget{
+			name: target,
+			addr: addr,
+			prev: map[string]uint64{},
+		})
+	}
+	e := &SNMP{
+		targets:       targets,
+		community:     opts.Community,
+		timeout:       time.Duration(opts.Timeout * float64(time.Second)),
+		maxInterfaces: opts.MaxInterfaces,
+
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "snmp_up",
+			Help: "SNMP agent could be walked.",
+		}, []string{"target"}),
+		octets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snmp_if_octets_total",
+			Help: "Total number of octets received or transmitted by the interface.",
+		}, []string{"target", "ifName", "direction"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snmp_if_errors_total",
+			Help: "Total number of packets with errors received or not transmitted by the interface.",
+		}, []string{"target", "ifName", "direction"}),
+		operStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "snmp_if_oper_status",
+			Help: "Operational status of the interface, being 1 for up, 2 for down, 3 for testing, 4 for unknown, 5 for dormant, 6 for not present and 7 for lower layer down.",
+		}, []string{"target", "ifName"}),
+	}
+
+	// set the baselines of the counters, errors are reported by the first scrape
+	wg := sync.WaitGroup{}
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *snmpTarget) {
+			defer wg.Done()
+			e.update(context.Background(), target)
+		}(target)
+	}
+	wg.Wait()
+	return e, nil
+}
+
+func (e *SNMP) Close() error {
+	return nil
+}
+
+// Check requests the operational status of the interfaces of all targets.
+func (e *SNMP) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	for _, target := range e.targets {
+		if _, err := e.walk(ctx, target.addr, snmpIfOperStatus); err != nil {
+			return fmt.Errorf("%v: %w", target.name, err)
+		}
+	}
+	return nil
+}
+
+func (e *SNMP) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+	e.octets.Describe(ch)
+	e.errors.Describe(ch)
+	e.operStatus.Describe(ch)
+}
+
+func (e *SNMP) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *SNMP) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	errs := make([]error, len(e.targets))
+	e.operStatus.Reset()
+	wg := sync.WaitGroup{}
+	for i, target := range e.targets {
+		wg.Add(1)
+		go func(i int, target *snmpTarget) {
+			defer wg.Done()
+			if err := e.update(ctx, target); err != nil {
+				Error.Printf("snmp: %v: %v", target.name, err)
+				errs[i] = fmt.Errorf("snmp %v: %w", target.name, err)
+				e.up.WithLabelValues(target.name).Set(0.0)
+			} else {
+				e.up.WithLabelValues(target.name).Set(1.0)
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	e.up.Collect(ch)
+	e.octets.Collect(ch)
+	e.errors.Collect(ch)
+	e.operStatus.Collect(ch)
+	Debug.Println("collect duration for snmp:", time.Since(t))
+	return errors.Join(errs...)
+}
+
+type snmpColumn map[string]snmpValue // by row index
+
+func (e *SNMP) update(ctx context.Context, target *snmpTarget) error {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	columns := map[string]snmpColumn{}
+	for name, oid := range map[string][]uint32{
+		"descr":       snmpIfDescr,
+		"operStatus":  snmpIfOperStatus,
+		"inOctets":    snmpIfInOctets,
+		"outOctets":   snmpIfOutOctets,
+		"inErrors":    snmpIfInErrors,
+		"outErrors":   snmpIfOutErrors,
+		"name":        snmpIfName,
+		"inHCOctets":  snmpIfHCInOctets,
+		"outHCOctets": snmpIfHCOutOctets,
+	} {
+		column, err := e.walk(ctx, target.addr, oid)
+		if err != nil {
+			return err
+		}
+		columns[name] = column
+	}
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	for index, status := range columns["operStatus"] {
+		ifName := columns["name"][index].String()
+		if ifName == "" {
+			ifName = columns["descr"][index].String()
+		}
+		if ifName == "" {
+			ifName = index
+		}
+		e.operStatus.WithLabelValues(target.name, ifName).Set(float64(status.Uint()))
+
+		// prefer the 64-bit counters, 32-bit counters wrap around within minutes on fast links
+		for _, direction := range []string{"in", "out"} {
+			if value, ok := columns[direction+"HCOctets"][index]; ok {
+				diff := target.delta(index+"/hcOctets/"+direction, value)
+				e.octets.WithLabelValues(target.name, ifName, direction).Add(float64(diff))
+			} else if value, ok := columns[direction+"Octets"][index]; ok {
+				diff := target.delta(index+"/octets/"+direction, value)
+				e.octets.WithLabelValues(target.name, ifName, direction).Add(float64(diff))
+			}
+			if value, ok := columns[direction+"Errors"][index]; ok {
+				diff := target.delta(index+"/errors/"+direction, value)
+				e.errors.WithLabelValues(target.name, ifName, direction).Add(float64(diff))
+			}
+		}
+	}
+	return nil
+}
+
+// delta returns the increase of a counter since the previous walk. Counter32 values wrap around at 2^32, while a decrease of a Counter64 is a reset.
+func (t *snmpTarget) delta(key string, value snmpValue) uint64 {
+	cur := value.Uint()
+	prev, ok := t.prev[key]
+	t.prev[key] = cur
+	if !ok {
+		return 0
+	} else if value.tag == snmpCounter32 {
+		return uint64(uint32(cur) - uint32(prev))
+	}
+	return collector.CounterDelta(prev, cur)
+}
+
+// walk returns the values of a table column by row index, using GetBulk requests. At most maxInterfaces rows are returned.
+func (e *SNMP) walk(ctx context.Context, addr string, column []uint32) (snmpColumn, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	values := snmpColumn{}
+	oid := column
+	buf := make([]byte, 65535)
+	for len(values) < e.maxInterfaces {
+		requestID := rand.Int31()
+		if _, err := conn.Write(snmpGetBulkRequest(e.community, requestID, oid)); err != nil {
+			return nil, err
+		}
+
+		var varbinds []snmpVarbind
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			var responseID int32
+			if responseID, varbinds, err = snmpParseResponse(buf[:n]); err != nil {
+				return nil, err
+			} else if responseID == requestID {
+				break
+			}
+		}
+
+		for _, varbind := range varbinds {
+			if !snmpHasPrefix(varbind.oid, column) || varbind.value.tag == snmpEndOfMibView || len(values) == e.maxInterfaces {
+				return values, nil
+			} else if varbind.value.tag == snmpNoSuchObject || varbind.value.tag == snmpNoSuchInstance {
+				continue
+			}
+			index := make([]string, len(varbind.oid)-len(column))
+			for i, arc := range varbind.oid[len(column):] {
+				index[i] = strconv.FormatUint(uint64(arc), 10)
+			}
+			values[strings.Join(index, ".")] = varbind.value
+			oid = varbind.oid
+		}
+		if len(varbinds) == 0 {
+			break
+		}
+	}
+	return values, nil
+}
+
+func snmpHasPrefix(oid, prefix []uint32) bool {
+	if len(oid) <= len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if oid[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// BER tags used by SNMP
+const (
+	snmpInteger        byte = 0x02
+	snmpOctetString    byte = 0x04
+	snmpNull           byte = 0x05
+	snmpObjectID       byte = 0x06
+	snmpSequence       byte = 0x30
+	snmpCounter32      byte = 0x41
+	snmpGauge32        byte = 0x42
+	snmpTimeTicks      byte = 0x43
+	snmpCounter64      byte = 0x46
+	snmpNoSuchObject   byte = 0x80
+	snmpNoSuchInstance byte = 0x81
+	snmpEndOfMibView   byte = 0x82
+	snmpGetResponse    byte = 0xA2
+	snmpGetBulk        byte = 0xA5
+)
+
+type snmpValue struct {
+	tag  byte
+	data []byte
+}
+
+// Uint returns the value of integer types.
+func (v snmpValue) Uint() uint64 {
+	n := uint64(0)
+	for _, c := range v.data {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// String returns the value of an octet string.
+func (v snmpValue) String() string {
+	if v.tag != snmpOctetString {
+		return ""
+	}
+	return string(v.data)
+}
+
+type snmpVarbind struct {
+	oid   []uint32
+	value snmpValue
+}
+
+func berEncode(tag byte, content ...[]byte) []byte {
+	length := 0
+	for _, b := range content {
+		length += len(b)
+	}
+	b := []byte{tag}
+	if length < 0x80 {
+		b = append(b, byte(length))
+	} else {
+		n := binary.BigEndian.AppendUint32(nil, uint32(length))
+		for len(n) > 1 && n[0] == 0 {
+			n = n[1:]
+		}
+		b = append(b, 0x80|byte(len(n)))
+		b = append(b, n...)
+	}
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berInteger(n int64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(n))
+	for 1 < len(b) && (b[0] == 0x00 && b[1]&0x80 == 0 || b[0] == 0xFF && b[1]&0x80 != 0) {
+		b = b[1:]
+	}
+	return berEncode(snmpInteger, b)
+}
+
+func berObjectID(oid []uint32) []byte {
+	b := []byte{byte(40*oid[0] + oid[1])}
+	for _, arc := range oid[2:] {
+		n := []byte{byte(arc & 0x7F)}
+		for arc >>= 7; arc != 0; arc >>= 7 {
+			n = append([]byte{0x80 | byte(arc&0x7F)}, n...)
+		}
+		b = append(b, n...)
+	}
+	return berEncode(snmpObjectID, b)
+}
+
+// berDecode returns the tag and content of the first element and the remaining bytes.
+func berDecode(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("short BER element")
+	}
+	tag, length, b := b[0], int(b[1]), b[2:]
+	if 0x80 <= length {
+		n := length & 0x7F
+		if n == 0 || 4 < n || len(b) < n {
+			return 0, nil, nil, fmt.Errorf("bad BER length")
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if len(b) < length {
+		return 0, nil, nil, fmt.Errorf("short BER element")
+	}
+	return tag, b[:length], b[length:], nil
+}
+
+func berParseObjectID(b []byte) ([]uint32, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty object identifier")
+	}
+	oid := []uint32{uint32(b[0]) / 40, uint32(b[0]) % 40}
+	arc := uint32(0)
+	for _, c := range b[1:] {
+		arc = arc<<7 | uint32(c&0x7F)
+		if c&0x80 == 0 {
+			oid = append(oid, arc)
+			arc = 0
+		}
+	}
+	return oid, nil
+}
+
+func snmpGetBulkRequest(community string, requestID int32, oid []uint32) []byte {
+	varbind := berEncode(snmpSequence, berObjectID(oid), berEncode(snmpNull))
+	pdu := berEncode(snmpGetBulk,
+		berInteger(int64(requestID)),
+		berInteger(0), // non-repeaters
+		berInteger(snmpMaxRepetitions),
+		berEncode(snmpSequence, varbind))
+	return berEncode(snmpSequence, berInteger(1), berEncode(snmpOctetString, []byte(community)), pdu)
+}
+
+// snmpParseResponse returns the request ID and variable bindings of a v2c response.
+func snmpParseResponse(b []byte) (int32, []snmpVarbind, error) {
+	tag, message, _, err := berDecode(b)
+	if err != nil {
+		return 0, nil, err
+	} else if tag != snmpSequence {
+		return 0, nil, fmt.Errorf("bad SNMP message")
+	}
+	if _, _, message, err = berDecode(message); err != nil { // version
+		return 0, nil, err
+	} else if _, _, message, err = berDecode(message); err != nil { // community
+		return 0, nil, err
+	}
+	tag, pdu, _, err := berDecode(message)
+	if err != nil {
+		return 0, nil, err
+	} else if tag != snmpGetResponse {
+		return 0, nil, fmt.Errorf("unexpected SNMP PDU type %#x", tag)
+	}
+
+	fields := [3]snmpValue{}
+	for i := range fields {
+		if fields[i].tag, fields[i].data, pdu, err = berDecode(pdu); err != nil {
+			return 0, nil, err
+		}
+	}
+	requestID := int32(fields[0].Uint())
+	if errorStatus := fields[1].Uint(); errorStatus != 0 {
+		return requestID, nil, fmt.Errorf("SNMP error status %v", errorStatus)
+	}
+
+	_, list, _, err := berDecode(pdu)
+	if err != nil {
+		return 0, nil, err
+	}
+	varbinds := []snmpVarbind{}
+	for 0 < len(list) {
+		var item []byte
+		if _, item, list, err = berDecode(list); err != nil {
+			return 0, nil, err
+		}
+		_, oidBytes, item, err := berDecode(item)
+		if err != nil {
+			return 0, nil, err
+		}
+		oid, err := berParseObjectID(oidBytes)
+		if err != nil {
+			return 0, nil, err
+		}
+		varbind := snmpVarbind{oid: oid}
+		if varbind.value.tag, varbind.value.data, _, err = berDecode(item); err != nil {
+			return 0, nil, err
+		}
+		varbinds = append(varbinds, varbind)
+	}
+	return requestID, varbinds, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func snmpUint(tag byte, n uint64) snmpValue {
+	_, data, _, _ := berDecode(berInteger(int64(n)))
+	return snmpValue{tag: tag, data: data}
+}
+
+func snmpOID(column []uint32, index ...uint32) []uint32 {
+	return append(append([]uint32{}, column...), index...)
+}
+
+func snmpResponse(community string, requestID int32, errorStatus int64, varbinds []snmpVarbind) []byte {
+	list := [][]byte{}
+	for _, varbind := range varbinds {
+		list = append(list, berEncode(snmpSequence, berObjectID(varbind.oid), berEncode(varbind.value.tag, varbind.value.data)))
+	}
+	pdu := berEncode(snmpGetResponse,
+		berInteger(int64(requestID)),
+		berInteger(errorStatus),
+		berInteger(0), // error index
+		berEncode(snmpSequence, list...))
+	return berEncode(snmpSequence, berInteger(1), berEncode(snmpOctetString, []byte(community)), pdu)
+}
+
+// snmpParseGetBulk returns the request ID, max-repetitions and first object identifier of a GetBulk request.
+func snmpParseGetBulk(b []byte) (string, int32, int, []uint32, error) {
+	_, message, _, err := berDecode(b)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	_, version, message, err := berDecode(message)
+	if err != nil {
+		return "", 0, 0, nil, err
+	} else if !bytes.Equal(version, []byte{1}) {
+		return "", 0, 0, nil, fmt.Errorf("bad version %v", version)
+	}
+	_, community, message, err := berDecode(message)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	tag, pdu, _, err := berDecode(message)
+	if err != nil {
+		return "", 0, 0, nil, err
+	} else if tag != snmpGetBulk {
+		return "", 0, 0, nil, fmt.Errorf("bad PDU type %#x", tag)
+	}
+	fields := [3]snmpValue{}
+	for i := range fields {
+		if fields[i].tag, fields[i].data, pdu, err = berDecode(pdu); err != nil {
+			return "", 0, 0, nil, err
+		}
+	}
+	_, list, _, err := berDecode(pdu)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	_, varbind, _, err := berDecode(list)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	_, oid, varbind, err := berDecode(varbind)
+	if err != nil {
+		return "", 0, 0, nil, err
+	} else if tag, _, _, err := berDecode(varbind); err != nil || tag != snmpNull {
+		return "", 0, 0, nil, fmt.Errorf("bad varbind value")
+	}
+	arcs, err := berParseObjectID(oid)
+	return string(community), int32(fields[0].Uint()), int(fields[2].Uint()), arcs, err
+}
+
+func snmpCompareOID(a, b []uint32) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// fakeSNMPAgent answers GetBulk requests of the community with the variables that follow the requested object identifier.
+type fakeSNMPAgent struct {
+	net.PacketConn
+	community string
+
+	mu       sync.Mutex
+	vars     []snmpVarbind
+	requests int
+}
+
+func newFakeSNMPAgent(t *testing.T, community string, vars []snmpVarbind) *fakeSNMPAgent {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &fakeSNMPAgent{PacketConn: conn, community: community}
+	a.Set(vars)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			community, requestID, maxRepetitions, oid, err := snmpParseGetBulk(buf[:n])
+			if err != nil {
+				t.Errorf("bad request: %v", err)
+				continue
+			} else if community != a.community {
+				continue // agents don't respond to wrong communities
+			}
+
+			a.mu.Lock()
+			a.requests++
+			varbinds := []snmpVarbind{}
+			for _, v := range a.vars {
+				if 0 < snmpCompareOID(v.oid, oid) && len(varbinds) < maxRepetitions {
+					varbinds = append(varbinds, v)
+				}
+			}
+			a.mu.Unlock()
+			if len(varbinds) == 0 {
+				varbinds = append(varbinds, snmpVarbind{oid: oid, value: snmpValue{tag: snmpEndOfMibView}})
+			}
+			conn.WriteTo(snmpResponse(community, requestID, 0, varbinds), addr)
+		}
+	}()
+	return a
+}
+
+func (a *fakeSNMPAgent) Set(vars []snmpVarbind) {
+	vars = append([]snmpVarbind{}, vars...)
+	sort.Slice(vars, func(i, j int) bool { return snmpCompareOID(vars[i].oid, vars[j].oid) < 0 })
+	a.mu.Lock()
+	a.vars = vars
+	a.mu.Unlock()
+}
+
+func (a *fakeSNMPAgent) Requests() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests
+}
+
+func TestSNMPGetBulkRoundTrip(t *testing.T) {
+	community, requestID, maxRepetitions, oid, err := snmpParseGetBulk(snmpGetBulkRequest("public", 123456789, snmpIfHCInOctets))
+	if err != nil {
+		t.Fatal(err)
+	} else if community != "public" || requestID != 123456789 || maxRepetitions != snmpMaxRepetitions || !reflect.DeepEqual(oid, snmpIfHCInOctets) {
+		t.Fatalf("request is %v %v %v %v", community, requestID, maxRepetitions, oid)
+	}
+
+	varbinds := []snmpVarbind{
+		{snmpOID(snmpIfDescr, 1), snmpValue{tag: snmpOctetString, data: []byte("eth0")}},
+		{snmpOID(snmpIfInOctets, 1), snmpUint(snmpCounter32, 4294967295)},
+		{snmpOID(snmpIfHCInOctets, 1), snmpUint(snmpCounter64, 1<<40)},
+		{snmpOID(snmpIfOperStatus, 100000), snmpUint(snmpInteger, 2)},
+		{snmpOID(snmpIfName, 2), snmpValue{tag: snmpNoSuchInstance, data: []byte{}}},
+	}
+	responseID, parsed, err := snmpParseResponse(snmpResponse("public", requestID, 0, varbinds))
+	if err != nil {
+		t.Fatal(err)
+	} else if responseID != requestID {
+		t.Fatalf("response ID is %v, expected %v", responseID, requestID)
+	} else if !reflect.DeepEqual(parsed, varbinds) {
+		t.Fatalf("varbinds are %v, expected %v", parsed, varbinds)
+	}
+	if s := parsed[0].value.String(); s != "eth0" {
+		t.Errorf("ifDescr is %q", s)
+	} else if n := parsed[1].value.Uint(); n != 4294967295 {
+		t.Errorf("ifInOctets is %v", n)
+	} else if n := parsed[2].value.Uint(); n != 1<<40 {
+		t.Errorf("ifHCInOctets is %v", n)
+	}
+
+	if _, _, err := snmpParseResponse(snmpResponse("public", requestID, 2, nil)); err == nil {
+		t.Error("expected error for error status noSuchName")
+	}
+}
+
+func TestSNMPParseMalformed(t *testing.T) {
+	var tests = []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", []byte{}},
+		{"no length", []byte{snmpSequence}},
+		{"short content", []byte{snmpSequence, 0x03, 0x02, 0x01}},
+		{"indefinite length", []byte{snmpSequence, 0x80, 0x00, 0x00}},
+		{"length of five bytes", []byte{snmpSequence, 0x85, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00}},
+		{"short long length", []byte{snmpSequence, 0x82, 0x01}},
+		{"long length exceeds content", []byte{snmpSequence, 0x81, 0x80, 0x00}},
+		{"huge length", []byte{snmpSequence, 0x84, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"not a sequence", berInteger(1)},
+		{"not a response", snmpGetBulkRequest("public", 1, snmpIfDescr)},
+		{"empty object identifier", berEncode(snmpSequence, berInteger(1), berEncode(snmpOctetString, []byte("public")),
+			berEncode(snmpGetResponse, berInteger(1), berInteger(0), berInteger(0),
+				berEncode(snmpSequence, berEncode(snmpSequence, berEncode(snmpObjectID), berEncode(snmpNull)))))},
+		{"varbind without value", berEncode(snmpSequence, berInteger(1), berEncode(snmpOctetString, []byte("public")),
+			berEncode(snmpGetResponse, berInteger(1), berInteger(0), berInteger(0),
+				berEncode(snmpSequence, berEncode(snmpSequence, berObjectID(snmpIfDescr)))))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := snmpParseResponse(tt.b); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	// every truncation of a response is an error
+	response := snmpResponse("public", 1, 0, []snmpVarbind{
+		{snmpOID(snmpIfDescr, 1), snmpValue{tag: snmpOctetString, data: bytes.Repeat([]byte("x"), 200)}},
+	})
+	for n := 0; n < len(response); n++ {
+		if _, _, err := snmpParseResponse(response[:n]); err == nil {
+			t.Fatalf("expected error for response truncated to %v of %v bytes", n, len(response))
+		}
+	}
+}
+
+func TestSNMPTargetDelta(t *testing.T) {
+	var tests = []struct {
+		name      string
+		prev, cur snmpValue
+		delta     uint64
+	}{
+		{"counter32", snmpUint(snmpCounter32, 1000), snmpUint(snmpCounter32, 1500), 500},
+		{"counter32 wrap", snmpUint(snmpCounter32, 4294967000), snmpUint(snmpCounter32, 100), 396},
+		{"counter32 wrap to zero", snmpUint(snmpCounter32, 4294967295), snmpUint(snmpCounter32, 0), 1},
+		{"counter64", snmpUint(snmpCounter64, 1<<40), snmpUint(snmpCounter64, 1<<40+10), 10},
+		{"counter64 reset", snmpUint(snmpCounter64, 1<<40), snmpUint(snmpCounter64, 10), 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &snmpTarget{prev: map[string]uint64{}}
+			if delta := target.delta("1/octets/in", tt.prev); delta != 0 {
+				t.Fatalf("first delta is %v, expected 0", delta)
+			} else if delta := target.delta("1/octets/in", tt.cur); delta != tt.delta {
+				t.Fatalf("delta is %v, expected %v", delta, tt.delta)
+			}
+		})
+	}
+}
+
+func TestSNMPWalk(t *testing.T) {
+	vars := []snmpVarbind{}
+	for i := uint32(1); i <= 30; i++ {
+		vars = append(vars, snmpVarbind{snmpOID(snmpIfDescr, i), snmpValue{tag: snmpOctetString, data: []byte(fmt.Sprintf("eth%d", i))}})
+		vars = append(vars, snmpVarbind{snmpOID(snmpIfOperStatus, i), snmpUint(snmpInteger, 1)})
+	}
+	agent := newFakeSNMPAgent(t, "public", vars)
+
+	e := &SNMP{community: "public", maxInterfaces: 100}
+	column, err := e.walk(context.Background(), agent.LocalAddr().String(), snmpIfDescr)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(column) != 30 {
+		t.Fatalf("walked %v rows, expected 30", len(column))
+	} else if s := column["30"].String(); s != "eth30" {
+		t.Fatalf("row 30 is %q", s)
+	} else if requests := agent.Requests(); requests != 2 {
+		t.Fatalf("walk took %v requests, expected 2", requests)
+	}
+
+	e.maxInterfaces = 5
+	if column, err := e.walk(context.Background(), agent.LocalAddr().String(), snmpIfDescr); err != nil {
+		t.Fatal(err)
+	} else if len(column) != 5 {
+		t.Fatalf("walked %v rows, expected at most 5", len(column))
+	}
+
+	// the last column of the table is followed by the end of the MIB view
+	e.maxInterfaces = 100
+	if column, err := e.walk(context.Background(), agent.LocalAddr().String(), snmpIfOperStatus); err != nil {
+		t.Fatal(err)
+	} else if len(column) != 30 {
+		t.Fatalf("walked %v rows, expected 30", len(column))
+	}
+}
+
+func TestSNMPCounter32Wrap(t *testing.T) {
+	interfaces := func(inOctets uint64) []snmpVarbind {
+		return []snmpVarbind{
+			{snmpOID(snmpIfDescr, 1), snmpValue{tag: snmpOctetString, data: []byte("eth0")}},
+			{snmpOID(snmpIfOperStatus, 1), snmpUint(snmpInteger, 1)},
+			{snmpOID(snmpIfInOctets, 1), snmpUint(snmpCounter32, inOctets)},
+		}
+	}
+	agent := newFakeSNMPAgent(t, "public", interfaces(4294967000))
+
+	e, err := NewSNMP(SNMPOptions{
+		Target:        []string{agent.LocalAddr().String()},
+		Community:     "public",
+		Timeout:       5.0,
+		MaxInterfaces: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.Set(interfaces(100))
+	if err := e.CollectContext(context.Background(), make(chan prometheus.Metric, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	target := agent.LocalAddr().String()
+	if up := testutil.ToFloat64(e.up.WithLabelValues(target)); up != 1.0 {
+		t.Errorf("snmp_up is %v", up)
+	} else if octets := testutil.ToFloat64(e.octets.WithLabelValues(target, "eth0", "in")); octets != 396.0 {
+		t.Errorf("snmp_if_octets_total is %v, expected 396", octets)
+	} else if status := testutil.ToFloat64(e.operStatus.WithLabelValues(target, "eth0")); status != 1.0 {
+		t.Errorf("snmp_if_oper_status is %v", status)
+	}
+}
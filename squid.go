@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type SquidOptions struct {
+	URI string `desc:"A URI for connecting to the Squid cache manager (e.g. http://localhost:3128)."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+type Squid struct {
+	counters *collector.Client
+	info     *collector.Client
+	stats    squidStats
+
+	up          prometheus.Gauge
+	req         *prometheus.CounterVec
+	mem         *prometheus.GaugeVec
+	disk        *prometheus.GaugeVec
+	serviceTime *prometheus.GaugeVec
+}
+
+func NewSquid(opts SquidOptions) (*Squid, error) {
+	uri := strings.TrimSuffix(opts.URI, "/")
+	counters, err := collector.NewClient(uri + "/squid-internal-mgr/counters")
+	if err != nil {
+		return nil, err
+	}
+	info, err := collector.NewClient(uri + "/squid-internal-mgr/info")
+	if err != nil {
+		return nil, err
+	}
+	e := &Squid{
+		counters: counters,
+		info:     info,
+
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "squid_up",
+			Help: "Squid cache manager is reachable.",
+		}),
+		req: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "squid_client_http_requests_total",
+			Help: "Total number of client HTTP requests, hits or errors.",
+		}, []string{"type"}),
+		mem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "squid_cache_mem_bytes",
+			Help: "Memory cache size in bytes.",
+		}, []string{"type"}),
+		disk: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "squid_cache_disk_bytes",
+			Help: "Disk cache size in bytes.",
+		}, []string{"type"}),
+		serviceTime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "squid_median_service_time_seconds",
+			Help: "Median service time over the last 5 minutes in seconds.",
+		}, []string{"type"}),
+	}
+	e.updateStats(context.Background())
+	return e, nil
+}
+
+func (e *Squid) Close() error {
+	return nil
+}
+
+// Check fetches the counters page of the cache manager.
+func (e *Squid) Check(ctx context.Context) error {
+	_, err := e.get(ctx, e.counters)
+	return err
+}
+
+func (e *Squid) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+	e.req.Describe(ch)
+	e.mem.Describe(ch)
+	e.disk.Describe(ch)
+	e.serviceTime.Describe(ch)
+}
+
+func (e *Squid) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Squid) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	stats, err := e.updateStats(ctx)
+	if err != nil {
+		Error.Println(err)
+		e.up.Set(0.0)
+	} else {
+		e.up.Set(1.0)
+		e.req.WithLabelValues("all").Add(float64(stats.Requests))
+		e.req.WithLabelValues("hit").Add(float64(stats.Hits))
+		e.req.WithLabelValues("error").Add(float64(stats.Errors))
+		e.req.Collect(ch)
+
+		e.mem.WithLabelValues("used").Set(float64(stats.MemoryUsed))
+		e.disk.WithLabelValues("used").Set(float64(stats.DiskUsed))
+		if stats.MemoryTotal != 0 {
+			e.mem.WithLabelValues("total").Set(float64(stats.MemoryTotal))
+		}
+		if stats.DiskTotal != 0 {
+			e.disk.WithLabelValues("total").Set(float64(stats.DiskTotal))
+		}
+		e.mem.Collect(ch)
+		e.disk.Collect(ch)
+
+		e.serviceTime.Reset()
+		for typ, seconds := range stats.ServiceTimes {
+			e.serviceTime.WithLabelValues(typ).Set(seconds)
+		}
+		e.serviceTime.Collect(ch)
+	}
+	e.up.Collect(ch)
+	Debug.Println("collect duration for squid:", time.Since(t))
+	return err
+}
+
+type squidStats struct {
+	Requests     uint64
+	Hits         uint64
+	Errors       uint64
+	MemoryUsed   uint64
+	MemoryTotal  uint64
+	DiskUsed     uint64
+	DiskTotal    uint64
+	ServiceTimes map[string]float64
+}
+
+var squidServiceTimes = map[string]string{
+	"HTTP Requests (All)": "all",
+	"Cache Misses":        "miss",
+	"Cache Hits":          "hit",
+	"Near Hits":           "near_hit",
+	"DNS Lookups":         "dns",
+}
+
+func (e *Squid) get(ctx context.Context, client *collector.Client) ([]byte, error) {
+	b, err := client.Get(ctx)
+	var statusErr collector.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("squid: access to cache manager denied, allow it with http_access allow localhost manager")
+	} else if err != nil {
+		return nil, fmt.Errorf("squid: %w", err)
+	}
+	return b, nil
+}
+
+func (e *Squid) updateStats(ctx context.Context) (squidStats, error) {
+	counters, err := e.get(ctx, e.counters)
+	if err != nil {
+		return squidStats{}, err
+	}
+	info, err := e.get(ctx, e.info)
+	if err != nil {
+		return squidStats{}, err
+	}
+
+	cur := squidStats{
+		ServiceTimes: map[string]float64{},
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(counters))
+	for scanner.Scan() {
+		split := strings.SplitN(scanner.Text(), "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+		switch key {
+		case "client_http.requests":
+			cur.Requests = squidGetUint64(key, val)
+		case "client_http.hits":
+			cur.Hits = squidGetUint64(key, val)
+		case "client_http.errors":
+			cur.Errors = squidGetUint64(key, val)
+		}
+	}
+
+	var memUsedPercent, diskUsedPercent float64
+	scanner = bufio.NewScanner(bytes.NewReader(info))
+	for scanner.Scan() {
+		split := strings.SplitN(scanner.Text(), ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+		switch key {
+		case "Storage Mem size":
+			cur.MemoryUsed = squidGetUint64(key, strings.TrimSuffix(val, " KB")) * 1024
+		case "Storage Swap size":
+			cur.DiskUsed = squidGetUint64(key, strings.TrimSuffix(val, " KB")) * 1024
+		case "Storage Mem capacity":
+			fmt.Sscanf(val, "%f%% used", &memUsedPercent)
+		case "Storage Swap capacity":
+			fmt.Sscanf(val, "%f%% used", &diskUsedPercent)
+		default:
+			if typ, ok := squidServiceTimes[key]; ok {
+				if fields := strings.Fields(val); 0 < len(fields) {
+					if seconds, err := strconv.ParseFloat(fields[0], 64); err == nil {
+						cur.ServiceTimes[typ] = seconds
+					}
+				}
+			}
+		}
+	}
+	if 0.0 < memUsedPercent {
+		cur.MemoryTotal = uint64(float64(cur.MemoryUsed) / memUsedPercent * 100.0)
+	}
+	if 0.0 < diskUsedPercent {
+		cur.DiskTotal = uint64(float64(cur.DiskUsed) / diskUsedPercent * 100.0)
+	}
+
+	diff := cur
+	diff.Requests -= e.stats.Requests
+	diff.Hits -= e.stats.Hits
+	diff.Errors -= e.stats.Errors
+	e.stats = cur
+	return diff, nil
+}
+
+func squidGetUint64(key, val string) uint64 {
+	n, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		Warning.Printf("squid: key %v: %v is not an integer", key, val)
+	}
+	return n
+}
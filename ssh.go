@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type SSHOptions struct {
+	Journal   bool   `desc:"Count SSH authentication attempts from the systemd journal."`
+	StateFile string `desc:"File to persist the journal cursor to, so that restarts don't count entries twice."`
+}
+
+// SSH follows the sshd entries of the systemd journal using journalctl.
+type SSH struct {
+	follower *journalFollower
+
+	auth    *prometheus.CounterVec
+	invalid prometheus.Counter
+}
+
+func NewSSH(opts SSHOptions) (*SSH, error) {
+	e := &SSH{
+		auth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssh_auth_total",
+			Help: "Total number of accepted or failed authentications.",
+		}, []string{"result", "method"}),
+		invalid: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ssh_invalid_users_total",
+			Help: "Total number of login attempts for invalid users.",
+		}),
+	}
+
+	var err error
+	args := []string{"SYSLOG_IDENTIFIER=sshd", "SYSLOG_IDENTIFIER=sshd-session"}
+	if e.follower, err = newJournalFollower("ssh", opts.StateFile, args, e.entry); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Close stops following the journal and saves the cursor.
+func (e *SSH) Close() error {
+	return e.follower.Close()
+}
+
+// Check reads the journal.
+func (e *SSH) Check(ctx context.Context) error {
+	return exec.CommandContext(ctx, "journalctl", "--lines=0", "--no-pager", "SYSLOG_IDENTIFIER=sshd").Run()
+}
+
+func (e *SSH) Describe(ch chan<- *prometheus.Desc) {
+	e.auth.Describe(ch)
+	e.invalid.Describe(ch)
+}
+
+func (e *SSH) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *SSH) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	err := e.follower.SaveCursor()
+	if err != nil {
+		Error.Println("ssh:", err)
+	}
+	e.auth.Collect(ch)
+	e.invalid.Collect(ch)
+	return err
+}
+
+func (e *SSH) entry(b []byte) {
+	entry := struct {
+		Message json.RawMessage `json:"MESSAGE"`
+	}{}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		Debug.Println("ssh: bad journal entry:", err)
+		return
+	}
+
+	// binary messages are encoded as arrays and ignored
+	var message string
+	if err := json.Unmarshal(entry.Message, &message); err == nil {
+		e.count(message)
+	}
+}
+
+// count parses messages such as "Accepted publickey for user from 1.2.3.4 port 22 ssh2", "Failed password for invalid user admin from ..." and "Invalid user admin from ...".
+func (e *SSH) count(message string) {
+	if strings.HasPrefix(message, "Invalid user ") {
+		e.invalid.Inc()
+		return
+	}
+
+	fields := strings.SplitN(message, " ", 4)
+	if len(fields) < 4 || fields[2] != "for" {
+		return
+	}
+	result := ""
+	switch fields[0] {
+	case "Accepted":
+		result = "accepted"
+	case "Failed":
+		result = "failed"
+	default:
+		return
+	}
+	method := fields[1]
+	if method != "password" && method != "publickey" {
+		method = "other"
+	}
+	e.auth.WithLabelValues(result, method).Inc()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+type StatsdOptions struct {
+	ListenAddress string    `desc:"UDP address to listen on for statsd metrics (e.g. :8125)."`
+	Prefix        string    `desc:"Prefix for the metric names."`
+	Buckets       []float64 `desc:"Histogram buckets in seconds for timers, see also --metrics.native-histograms."`
+	MappingFile   string    `desc:"YAML file mapping statsd names to metric names and labels, see README."`
+}
+
+const (
+	statsdQueueSize  = 1024
+	statsdPacketSize = 65535
+
+	// statsdMinSampleRate bounds the number of observations a sampled timer adds, which is the inverse of its sample rate
+	statsdMinSampleRate = 0.001
+)
+
+// statsdMapping maps statsd names matching a glob, where * matches a single dot-separated component, to a metric name and labels. Captured components are available as $1, $2, etc.
+type statsdMapping struct {
+	Match  string            `yaml:"match"`
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+
+	re *regexp.Regexp
+}
+
+type statsdMetric struct {
+	kind       byte // c, g, or t
+	labelNames []string
+	counter    *prometheus.CounterVec
+	gauge      *prometheus.GaugeVec
+	histogram  *prometheus.HistogramVec
+}
+
+// Statsd listens for the statsd line protocol over UDP and aggregates the samples into metrics.
+type Statsd struct {
+	conn     net.PacketConn
+	prefix   string
+	buckets  []float64
+	mappings []statsdMapping
+	queue    chan []byte
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	metrics map[string]*statsdMetric
+
+	packets *prometheus.CounterVec
+	lines   *prometheus.CounterVec
+}
+
+func NewStatsd(opts StatsdOptions) (*Statsd, error) {
+	mappings := []statsdMapping{}
+	if opts.MappingFile != "" {
+		var err error
+		if mappings, err = readStatsdMappings(opts.MappingFile); err != nil {
+			return nil, fmt.Errorf("statsd: %w", err)
+		}
+	}
+	if len(opts.Buckets) == 0 {
+		opts.Buckets = prometheus.DefBuckets
+	}
+
+	conn, err := net.ListenPacket("udp", opts.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	e := &Statsd{
+		conn:     conn,
+		prefix:   opts.Prefix,
+		buckets:  opts.Buckets,
+		mappings: mappings,
+		queue:    make(chan []byte, statsdQueueSize),
+		metrics:  map[string]*statsdMetric{},
+
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dex_statsd_packets_total",
+			Help: "Total number of received statsd packets, dropped when the exporter is overwhelmed.",
+		}, []string{"result"}),
+		lines: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dex_statsd_lines_total",
+			Help: "Total number of statsd lines, being invalid or conflicting with an existing metric.",
+		}, []string{"result"}),
+	}
+	e.wg.Add(2)
+	go e.read()
+	go e.process()
+	return e, nil
+}
+
+// Close stops listening and processes the queued packets.
+func (e *Statsd) Close() error {
+	err := e.conn.Close()
+	e.wg.Wait()
+	return err
+}
+
+func (e *Statsd) Describe(ch chan<- *prometheus.Desc) {
+	e.packets.Describe(ch)
+	e.lines.Describe(ch)
+}
+
+func (e *Statsd) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	for _, metric := range e.metrics {
+		switch metric.kind {
+		case 'c':
+			metric.counter.Collect(ch)
+		case 'g':
+			metric.gauge.Collect(ch)
+		case 't':
+			metric.histogram.Collect(ch)
+		}
+	}
+	e.mu.Unlock()
+	e.packets.Collect(ch)
+	e.lines.Collect(ch)
+}
+
+// read never blocks on processing, packets are dropped when the queue is full.
+func (e *Statsd) read() {
+	defer e.wg.Done()
+	defer close(e.queue)
+	buf := make([]byte, statsdPacketSize)
+	for {
+		n, _, err := e.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			Error.Println("statsd:", err)
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		select {
+		case e.queue <- packet:
+			e.packets.WithLabelValues("received").Inc()
+		default:
+			e.packets.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+func (e *Statsd) process() {
+	defer e.wg.Done()
+	for packet := range e.queue {
+		for _, line := range strings.Split(string(packet), "\n") {
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			if err := e.processLine(line); err != nil {
+				Debug.Printf("statsd: %v: %v", line, err)
+			}
+		}
+	}
+}
+
+var errStatsdConflict = fmt.Errorf("conflicts with existing metric")
+
+// processLine parses lines of the form name:value|type|@rate, where type is c, g, ms or h.
+func (e *Statsd) processLine(line string) error {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		e.lines.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("missing value")
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		e.lines.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("missing type")
+	}
+
+	relative := fields[0] != "" && (fields[0][0] == '+' || fields[0][0] == '-')
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		e.lines.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("bad value")
+	}
+	rate := 1.0
+	for _, field := range fields[2:] {
+		if strings.HasPrefix(field, "@") {
+			if rate, err = strconv.ParseFloat(field[1:], 64); err != nil || rate < statsdMinSampleRate || 1.0 < rate {
+				e.lines.WithLabelValues("invalid").Inc()
+				return fmt.Errorf("bad sample rate")
+			}
+		}
+	}
+
+	var kind byte
+	switch fields[1] {
+	case "c":
+		kind = 'c'
+	case "g":
+		kind = 'g'
+	case "ms", "h":
+		kind = 't'
+	default:
+		e.lines.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("unsupported type %v", fields[1])
+	}
+
+	name, labels := e.mapName(name)
+	if !statsdMetricName.MatchString(name) {
+		e.lines.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("bad metric name %v", name)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	metric, err := e.metric(kind, name, labels)
+	if err != nil {
+		e.lines.WithLabelValues("conflict").Inc()
+		return err
+	}
+	labelValues := make([]string, len(metric.labelNames))
+	for i, labelName := range metric.labelNames {
+		labelValues[i] = labels[labelName]
+	}
+
+	switch kind {
+	case 'c':
+		if value < 0.0 {
+			e.lines.WithLabelValues("invalid").Inc()
+			return fmt.Errorf("negative counter")
+		}
+		metric.counter.WithLabelValues(labelValues...).Add(value / rate)
+	case 'g':
+		if relative {
+			metric.gauge.WithLabelValues(labelValues...).Add(value)
+		} else {
+			metric.gauge.WithLabelValues(labelValues...).Set(value)
+		}
+	case 't':
+		histogram := metric.histogram.WithLabelValues(labelValues...)
+		for i := 0; i < int(math.Round(1.0/rate)); i++ {
+			histogram.Observe(value / 1000.0)
+		}
+	}
+	e.lines.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// metric returns the metric for the name, creating it if it doesn't exist yet. The metric type and label names must match those of the first sample.
+func (e *Statsd) metric(kind byte, name string, labels map[string]string) (*statsdMetric, error) {
+	switch kind {
+	case 'c':
+		if !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+	case 't':
+		if !strings.HasSuffix(name, "_seconds") {
+			name += "_seconds"
+		}
+	}
+
+	labelNames := make([]string, 0, len(labels))
+	for labelName := range labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+	if metric, ok := e.metrics[name]; ok {
+		if metric.kind != kind || strings.Join(metric.labelNames, ",") != strings.Join(labelNames, ",") {
+			return nil, errStatsdConflict
+		}
+		return metric, nil
+	}
+
+	help := "Metric received over statsd."
+	metric := &statsdMetric{
+		kind:       kind,
+		labelNames: labelNames,
+	}
+	switch kind {
+	case 'c':
+		metric.counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: name,
+			Help: help,
+		}, labelNames)
+	case 'g':
+		metric.gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: help,
+		}, labelNames)
+	case 't':
+		metric.histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                        name,
+			Help:                        help,
+			Buckets:                     e.buckets,
+			NativeHistogramBucketFactor: nativeHistogramBucketFactor,
+		}, labelNames)
+	}
+	e.metrics[name] = metric
+	return metric, nil
+}
+
+var statsdInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+var statsdMetricName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// mapName returns the metric name and labels for a statsd name, using the first matching mapping.
+func (e *Statsd) mapName(name string) (string, map[string]string) {
+	labels := map[string]string{}
+	for _, mapping := range e.mappings {
+		if match := mapping.re.FindStringSubmatchIndex(name); match != nil {
+			for label, tmpl := range mapping.Labels {
+				labels[label] = string(mapping.re.ExpandString(nil, tmpl, name, match))
+			}
+			name = string(mapping.re.ExpandString(nil, mapping.Name, name, match))
+			break
+		}
+	}
+	return e.prefix + statsdInvalidChars.ReplaceAllString(name, "_"), labels
+}
+
+func readStatsdMappings(filename string) ([]statsdMapping, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := struct {
+		Mappings []statsdMapping `yaml:"mappings"`
+	}{}
+	if err := yaml.UnmarshalStrict(b, &config); err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+
+	labelName := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	for i, mapping := range config.Mappings {
+		if mapping.Match == "" || mapping.Name == "" {
+			return nil, fmt.Errorf("%v: mapping %v must have match and name", filename, i+1)
+		}
+		for label := range mapping.Labels {
+			if !labelName.MatchString(label) {
+				return nil, fmt.Errorf("%v: mapping %v: bad label name %v", filename, i+1, label)
+			}
+		}
+		parts := strings.Split(mapping.Match, "*")
+		for j, part := range parts {
+			parts[j] = regexp.QuoteMeta(part)
+		}
+		config.Mappings[i].re = regexp.MustCompile("^" + strings.Join(parts, "([^.]+)") + "$")
+	}
+	return config.Mappings, nil
+}
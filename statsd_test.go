@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestStatsdSampleRate(t *testing.T) {
+	e, err := NewStatsd(StatsdOptions{ListenAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	tests := []struct {
+		line         string
+		err          bool
+		observations uint64 // total of the timer so far
+		counter      float64
+	}{
+		{"app.latency:20|ms", false, 1, 0},
+		{"app.latency:20|ms|@0.5", false, 3, 0},
+		{"app.latency:20|ms|@0.001", false, 1003, 0},
+		{"app.latency:20|ms|@0.000000000001", true, 1003, 0},
+		{"app.latency:20|ms|@0", true, 1003, 0},
+		{"app.latency:20|ms|@1.5", true, 1003, 0},
+		{"app.requests:2|c|@0.1", false, 1003, 20},
+		{"app.requests:1|c|@0.0001", true, 1003, 20},
+	}
+	for _, tt := range tests {
+		t0 := time.Now()
+		if err := e.processLine(tt.line); (err != nil) != tt.err {
+			t.Errorf("%v: got error %v, expected error %v", tt.line, err, tt.err)
+		} else if time.Second < time.Since(t0) {
+			t.Errorf("%v: processing took %v", tt.line, time.Since(t0))
+		}
+
+		e.mu.Lock()
+		m := &dto.Metric{}
+		if err := e.metrics["app_latency_seconds"].histogram.WithLabelValues().(prometheus.Metric).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		counter := 0.0
+		if metric, ok := e.metrics["app_requests_total"]; ok {
+			counter = testutil.ToFloat64(metric.counter)
+		}
+		e.mu.Unlock()
+		if n := m.GetHistogram().GetSampleCount(); n != tt.observations {
+			t.Errorf("%v: timer has %d observations, expected %d", tt.line, n, tt.observations)
+		}
+		if counter != tt.counter {
+			t.Errorf("%v: counter is %v, expected %v", tt.line, counter, tt.counter)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type TimerOptions struct {
+	Unit []string `desc:"Systemd timer or service unit name to monitor, can be repeated and can contain globs (e.g. backup-*.timer). Timers also export the service they trigger."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+type Timer struct {
+	systemd  func(context.Context) (*dbus.Conn, error)
+	literals []string
+	patterns []string
+
+	lastTrigger *prometheus.GaugeVec
+	exitCode    *prometheus.GaugeVec
+	lastRun     *prometheus.GaugeVec
+}
+
+func NewTimer(systemd func(context.Context) (*dbus.Conn, error), opts TimerOptions) (*Timer, error) {
+	var literals, patterns []string
+	for _, unit := range opts.Unit {
+		if !strings.HasSuffix(unit, ".timer") && !strings.HasSuffix(unit, ".service") {
+			return nil, fmt.Errorf("timer: unit %v must be a .timer or .service unit", unit)
+		} else if strings.ContainsAny(unit, "*?[") {
+			patterns = append(patterns, unit)
+		} else {
+			literals = append(literals, unit)
+		}
+	}
+	return &Timer{
+		systemd:  systemd,
+		literals: literals,
+		patterns: patterns,
+
+		lastTrigger: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "systemd_timer_last_trigger_seconds",
+			Help: "Time the timer last triggered as a Unix timestamp in seconds, zero if it never triggered.",
+		}, []string{"unit"}),
+		exitCode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "systemd_service_last_exit_code",
+			Help: "Exit code of the last run of the service.",
+		}, []string{"unit"}),
+		lastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "systemd_service_last_run_seconds",
+			Help: "Time the service last exited as a Unix timestamp in seconds, zero if it never ran.",
+		}, []string{"unit"}),
+	}, nil
+}
+
+func (e *Timer) Close() error {
+	return nil
+}
+
+func (e *Timer) Describe(ch chan<- *prometheus.Desc) {
+	e.lastTrigger.Describe(ch)
+	e.exitCode.Describe(ch)
+	e.lastRun.Describe(ch)
+}
+
+func (e *Timer) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Timer) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	err := e.updateStats(ctx)
+	if err != nil {
+		Error.Println("timer:", err)
+	}
+	e.lastTrigger.Collect(ch)
+	e.exitCode.Collect(ch)
+	e.lastRun.Collect(ch)
+	Debug.Println("collect duration for timer:", time.Since(t))
+	return err
+}
+
+func (e *Timer) units(ctx context.Context, conn *dbus.Conn) ([]string, error) {
+	units := append([]string{}, e.literals...)
+	if 0 < len(e.patterns) {
+		statuses, err := conn.ListUnitsByPatternsContext(ctx, nil, e.patterns)
+		if err != nil {
+			return nil, err
+		}
+		for _, status := range statuses {
+			units = append(units, status.Name)
+		}
+	}
+	return units, nil
+}
+
+func (e *Timer) updateStats(ctx context.Context) error {
+	conn, err := e.systemd(ctx)
+	if err != nil {
+		return err
+	}
+	units, err := e.units(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	e.lastTrigger.Reset()
+	e.exitCode.Reset()
+	e.lastRun.Reset()
+	services := map[string]bool{}
+	for _, unit := range units {
+		if strings.HasSuffix(unit, ".timer") {
+			props, err := conn.GetUnitTypePropertiesContext(ctx, unit, "Timer")
+			if err != nil {
+				return fmt.Errorf("%v: %w", unit, err)
+			}
+			lastTrigger, _ := props["LastTriggerUSec"].(uint64)
+			e.lastTrigger.WithLabelValues(unit).Set(float64(lastTrigger) / 1e6)
+			if service, _ := props["Unit"].(string); service != "" {
+				services[service] = true
+			}
+		} else {
+			services[unit] = true
+		}
+	}
+	for service := range services {
+		props, err := conn.GetUnitTypePropertiesContext(ctx, service, "Service")
+		if err != nil {
+			return fmt.Errorf("%v: %w", service, err)
+		}
+		exitTimestamp, _ := props["ExecMainExitTimestamp"].(uint64)
+		exitCode, _ := props["ExecMainStatus"].(int32)
+		e.exitCode.WithLabelValues(service).Set(float64(exitCode))
+		e.lastRun.WithLabelValues(service).Set(float64(exitTimestamp) / 1e6)
+	}
+	return nil
+}
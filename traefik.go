@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type TraefikOptions struct {
+	APIURI     string `name:"api-uri" desc:"A URI for connecting to the Traefik API (e.g. http://localhost:8080), which also serves /ping."`
+	BasicAuth  string `desc:"Basic authentication for the Traefik API as username:password."`
+	MetricsURI string `name:"metrics-uri" desc:"A URI of the Traefik Prometheus metrics to re-export a subset of (e.g. http://localhost:8080/metrics)."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+// traefikMetrics are re-exported from the exposition of Traefik, for both v2 and v3.
+var traefikMetrics = map[string]bool{
+	"traefik_config_reloads_total":         true,
+	"traefik_config_reloads_failure_total": true,
+	"traefik_config_last_reload_success":   true,
+	"traefik_entrypoint_requests_total":    true,
+	"traefik_entrypoint_open_connections":  true,
+	"traefik_open_connections":             true,
+	"traefik_service_server_up":            true,
+	"traefik_tls_certs_not_after":          true,
+}
+
+// Traefik exports the state of the routers and services from the Traefik API, and re-exports a subset of its metrics.
+type Traefik struct {
+	ping     *collector.Client
+	routers  *collector.Client
+	services *collector.Client
+	overview *collector.Client
+	metrics  *collector.Client // nil if not re-exported
+
+	up            prometheus.Gauge
+	routerStatus  *prometheus.GaugeVec
+	serviceStatus *prometheus.GaugeVec
+	errors        *prometheus.GaugeVec
+	warnings      *prometheus.GaugeVec
+}
+
+func NewTraefik(opts TraefikOptions) (*Traefik, error) {
+	authorization := ""
+	if opts.BasicAuth != "" {
+		if username, _, ok := strings.Cut(opts.BasicAuth, ":"); !ok || username == "" {
+			return nil, fmt.Errorf("traefik: basic authentication must be of the form username:password")
+		}
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(opts.BasicAuth))
+	}
+
+	uri := strings.TrimSuffix(opts.APIURI, "/")
+	client := func(uri string) (*collector.Client, error) {
+		client, err := collector.NewClient(uri)
+		if err != nil {
+			return nil, fmt.Errorf("traefik: %w", err)
+		}
+		if authorization != "" {
+			client.Header.Set("Authorization", authorization)
+		}
+		return client, nil
+	}
+
+	// the API is paginated with 100 items per page by default
+	e := &Traefik{}
+	var err error
+	if e.ping, err = client(uri + "/ping"); err != nil {
+		return nil, err
+	} else if e.routers, err = client(uri + "/api/http/routers?per_page=10000"); err != nil {
+		return nil, err
+	} else if e.services, err = client(uri + "/api/http/services?per_page=10000"); err != nil {
+		return nil, err
+	} else if e.overview, err = client(uri + "/api/overview"); err != nil {
+		return nil, err
+	}
+	if opts.MetricsURI != "" {
+		if e.metrics, err = client(opts.MetricsURI); err != nil {
+			return nil, err
+		}
+		e.metrics.Header.Set("Accept", string(expfmt.FmtText))
+	}
+
+	e.up = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "traefik_up",
+		Help: "Traefik responds to ping.",
+	})
+	e.routerStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "traefik_routers",
+		Help: "Number of HTTP routers per status.",
+	}, []string{"status"})
+	e.serviceStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "traefik_services",
+		Help: "Number of HTTP services per status.",
+	}, []string{"status"})
+	e.errors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "traefik_overview_errors",
+		Help: "Number of routers, services and middlewares with errors in their configuration.",
+	}, []string{"protocol", "type"})
+	e.warnings = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "traefik_overview_warnings",
+		Help: "Number of routers, services and middlewares with warnings in their configuration.",
+	}, []string{"protocol", "type"})
+	return e, nil
+}
+
+func (e *Traefik) Close() error {
+	return nil
+}
+
+// Check requests the overview of the API, which fails on bad credentials unlike ping.
+func (e *Traefik) Check(ctx context.Context) error {
+	_, err := e.overview.Get(ctx)
+	return err
+}
+
+// Describe doesn't describe the re-exported metrics, since they depend on the Traefik version.
+func (e *Traefik) Describe(ch chan<- *prometheus.Desc) {
+	e.up.Describe(ch)
+	e.routerStatus.Describe(ch)
+	e.serviceStatus.Describe(ch)
+	e.errors.Describe(ch)
+	e.warnings.Describe(ch)
+}
+
+func (e *Traefik) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *Traefik) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	errs := []error{}
+	if _, err := e.ping.Get(ctx); err != nil {
+		Error.Println("traefik:", err)
+		e.up.Set(0.0)
+		e.up.Collect(ch)
+		return err
+	}
+	e.up.Set(1.0)
+	e.up.Collect(ch)
+
+	for _, item := range []struct {
+		client *collector.Client
+		vec    *prometheus.GaugeVec
+	}{
+		{e.routers, e.routerStatus},
+		{e.services, e.serviceStatus},
+	} {
+		counts, err := e.getStatusCounts(ctx, item.client)
+		if err != nil {
+			Error.Println("traefik:", err)
+			errs = append(errs, err)
+			continue
+		}
+		item.vec.Reset()
+		for status, n := range counts {
+			item.vec.WithLabelValues(status).Set(float64(n))
+		}
+		item.vec.Collect(ch)
+	}
+
+	if err := e.collectOverview(ctx, ch); err != nil {
+		Error.Println("traefik:", err)
+		errs = append(errs, err)
+	}
+	if e.metrics != nil {
+		if err := e.collectMetrics(ctx, ch); err != nil {
+			Error.Println("traefik:", err)
+			errs = append(errs, err)
+		}
+	}
+	Debug.Println("collect duration for traefik:", time.Since(t))
+	return errors.Join(errs...)
+}
+
+// getStatusCounts returns the number of routers or services per status (enabled, disabled or warning).
+func (e *Traefik) getStatusCounts(ctx context.Context, client *collector.Client) (map[string]int, error) {
+	b, err := client.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items := []struct {
+		Status string `json:"status"`
+	}{}
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, err
+	}
+	counts := map[string]int{
+		"enabled":  0,
+		"disabled": 0,
+		"warning":  0,
+	}
+	for _, item := range items {
+		counts[item.Status]++
+	}
+	return counts, nil
+}
+
+func (e *Traefik) collectOverview(ctx context.Context, ch chan<- prometheus.Metric) error {
+	b, err := e.overview.Get(ctx)
+	if err != nil {
+		return err
+	}
+	type section struct {
+		Total    int `json:"total"`
+		Warnings int `json:"warnings"`
+		Errors   int `json:"errors"`
+	}
+	overview := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &overview); err != nil {
+		return err
+	}
+
+	e.errors.Reset()
+	e.warnings.Reset()
+	for _, protocol := range []string{"http", "tcp", "udp"} {
+		sections := map[string]section{}
+		if raw, ok := overview[protocol]; !ok {
+			continue
+		} else if err := json.Unmarshal(raw, &sections); err != nil {
+			return fmt.Errorf("overview %v: %w", protocol, err)
+		}
+		for typ, section := range sections {
+			e.errors.WithLabelValues(protocol, typ).Set(float64(section.Errors))
+			e.warnings.WithLabelValues(protocol, typ).Set(float64(section.Warnings))
+		}
+	}
+	e.errors.Collect(ch)
+	e.warnings.Collect(ch)
+	return nil
+}
+
+func (e *Traefik) collectMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	b, err := e.metrics.Get(ctx)
+	if err != nil {
+		return err
+	}
+	parser := expfmt.TextParser{}
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for name, mf := range mfs {
+		if !traefikMetrics[name] {
+			continue
+		}
+		for _, m := range mf.Metric {
+			metric, err := proxyMetric(name, "", mf, m)
+			if err != nil {
+				Debug.Println("traefik:", err)
+				continue
+			}
+			ch <- metric
+		}
+	}
+	return nil
+}
@@ -1,94 +1,213 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"crypto/subtle"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"path"
-	"path/filepath"
+	"os/user"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+	"github.com/tdewolff/dex_exporter/exporter"
 )
 
-func ParseURI(uri string) (string, string, error) {
-	if strings.HasPrefix(uri, "unix:") {
-		uri = uri[5:]
-		if strings.HasPrefix(uri, "//") {
-			uri = uri[2:]
-		}
-		if !path.IsAbs(uri) {
-			return "", "", fmt.Errorf("Unix socket path is not an absolute path")
+// logs returns the loggers of the exporter for the collectors.
+func logs() collector.Log {
+	return collector.Log{Error: Error, Warning: Warning, Info: Info, Debug: Debug}
+}
+
+// ParseStatusAuto parses the machine-readable server status page of Apache's and lighttpd's mod_status (?auto), consisting of "Key: value" lines.
+func ParseStatusAuto(b []byte) map[string]string {
+	status := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if colon := strings.IndexByte(line, ':'); colon != -1 {
+			status[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon+1:])
 		}
-		return "unix", uri, nil
 	}
+	return status
+}
 
-	if strings.HasPrefix(uri, "tcp://") {
-		uri = uri[6:]
+// PeerCreds allows connections to a Unix socket only from the given user or group IDs, using the credentials of the peer process.
+type PeerCreds struct {
+	uids     map[uint32]bool
+	gids     map[uint32]bool
+	rejected prometheus.Counter
+}
+
+func NewPeerCreds(uids, gids []uint32) *PeerCreds {
+	c := &PeerCreds{
+		uids: map[uint32]bool{},
+		gids: map[uint32]bool{},
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dex_socket_rejected_connections_total",
+			Help: "Total number of Unix socket connections rejected by peer credentials.",
+		}),
+	}
+	for _, uid := range uids {
+		c.uids[uid] = true
+	}
+	for _, gid := range gids {
+		c.gids[gid] = true
 	}
-	return "tcp", uri, nil
+	return c
 }
 
-type URIGlobs struct {
-	literals []string
-	globs    []string
+// Listener wraps a Unix socket listener so that connections from other users and groups are closed on accept.
+func (c *PeerCreds) Listener(listener net.Listener) net.Listener {
+	return &peerCredsListener{listener, c}
 }
 
-func ParseURIGlobs(uris []string) (URIGlobs, error) {
-	var literals, globs []string
-	for i := range uris {
-		uri := uris[i]
-		scheme, _, err := ParseURI(uri)
+type peerCredsListener struct {
+	net.Listener
+	*PeerCreds
+}
+
+func (l *peerCredsListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
 		if err != nil {
-			return URIGlobs{}, err
-		}
-		if scheme == "unix" {
-			if strings.ContainsRune(uri, '*') {
-				globs = append(globs, uri)
-			} else if info, err := os.Stat(uri); err != nil {
-				return URIGlobs{}, err
-			} else if info.IsDir() {
-				globs = append(globs, path.Join(uri, "*"))
-			} else {
-				literals = append(literals, uri)
-			}
+			return nil, err
+		}
+		cred, err := peerCred(conn)
+		if err != nil {
+			Warning.Println("rejected connection:", err)
+		} else if !l.uids[cred.UID] && !l.gids[cred.GID] {
+			Warning.Printf("rejected connection from uid %v gid %v pid %v", cred.UID, cred.GID, cred.PID)
 		} else {
-			literals = append(literals, uris[i])
+			return conn, nil
 		}
+		l.rejected.Inc()
+		conn.Close()
+	}
+}
+
+// peerCredentials are the credentials of the process on the other side of a Unix socket, the PID is zero if unknown.
+type peerCredentials struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+func peerCred(conn net.Conn) (peerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return peerCredentials{}, fmt.Errorf("not a Unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	var cred peerCredentials
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = getsockoptPeerCred(int(fd))
+	}); err != nil {
+		return peerCredentials{}, err
+	}
+	return cred, credErr
+}
+
+// Server configures the HTTP server of the exporter. Idle connections are kept open so that Prometheus reuses them between scrapes instead of connecting and handshaking TLS for every scrape.
+type Server struct {
+	idleTimeout time.Duration
+	readTimeout time.Duration
+	conns       prometheus.Gauge
+
+	socketMode os.FileMode
+	socketGID  int // -1 keeps the group of the process
+}
+
+func NewServer(idleTimeout, readTimeout time.Duration) *Server {
+	return &Server{
+		idleTimeout: idleTimeout,
+		readTimeout: readTimeout,
+		socketMode:  0770,
+		socketGID:   -1,
+		conns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dex_http_open_connections",
+			Help: "Number of currently open HTTP connections.",
+		}),
 	}
-	for _, uriGlob := range globs {
-		if _, err := filepath.Glob(uriGlob); err != nil {
-			return URIGlobs{}, err
+}
+
+// SetSocketPermissions sets the mode and the owning group, given by name or ID, of the Unix socket file. An empty group keeps the group of the process.
+func (s *Server) SetSocketPermissions(mode os.FileMode, group string) error {
+	s.socketMode = mode
+	if group == "" {
+		return nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		if g, err = user.LookupGroupId(group); err != nil {
+			return fmt.Errorf("socket group %v: %w", group, err)
 		}
 	}
-	fmt.Println(literals, globs)
-	return URIGlobs{literals, globs}, nil
+	if s.socketGID, err = strconv.Atoi(g.Gid); err != nil {
+		return fmt.Errorf("socket group %v: bad group ID %v", group, g.Gid)
+	}
+	return nil
 }
 
-func (z URIGlobs) Get() []string {
-	uris := z.literals
-	for _, uriGlob := range z.globs {
-		matches, _ := filepath.Glob(uriGlob)
-		fmt.Println(uriGlob, "=>", matches)
-		uris = append(uris, matches...)
+// httpServer returns a server for the default handlers that tracks its open connections.
+func (s *Server) httpServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: s.readTimeout,
+		ReadTimeout:       s.readTimeout,
+		IdleTimeout:       s.idleTimeout,
+		TLSConfig: &tls.Config{
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				s.conns.Inc()
+			case http.StateHijacked, http.StateClosed:
+				s.conns.Dec()
+			}
+		},
 	}
-	return uris
 }
 
-func ListenAndServe(uri, tlsCert, tlsKey string) error {
-	scheme, host, err := ParseURI(uri)
+// ListenAndServe serves on a TCP address, a Unix socket given as unix:///path/to/socket or unix:@name for an abstract socket, or an inherited file descriptor given as fd://3.
+func ListenAndServe(ctx context.Context, uri, tlsCert, tlsKey string, server *Server, peerCreds *PeerCreds, proxyProtocol *ProxyProtocol) error {
+	if strings.HasPrefix(uri, "fd://") {
+		listener, err := fdListener(uri)
+		if err != nil {
+			return err
+		}
+		if peerCreds != nil {
+			listener = peerCreds.Listener(listener)
+		}
+		if proxyProtocol != nil {
+			listener = proxyProtocol.Listener(listener)
+		}
+		Info.Println("listening on inherited file descriptor", listener.Addr())
+		return serve(ctx, server.httpServer(""), listener, tlsCert, tlsKey)
+	}
+
+	scheme, host, err := collector.ParseURI(uri)
 	if err != nil {
 		return err
 	}
 
 	var listener net.Listener
 	if scheme == "unix" {
-		if _, err := os.Stat(host); err == nil {
+		// abstract sockets have no file to replace or to set permissions on
+		abstract := strings.HasPrefix(host, "@")
+		if _, err := os.Stat(host); err == nil && !abstract {
 			Info.Println("removing existing file", host)
 			if err := os.Remove(host); err != nil {
 				return err
@@ -98,20 +217,113 @@ func ListenAndServe(uri, tlsCert, tlsKey string) error {
 		if err != nil {
 			return err
 		}
-		Info.Println("setting file permissions to 0770 on", host)
-		if os.Chmod(host, 0770); err != nil {
-			return err
+		if !abstract {
+			// the socket is created with the umask applied
+			Info.Printf("setting file permissions to %#o on %v", server.socketMode, host)
+			if err := os.Chmod(host, server.socketMode); err != nil {
+				listener.Close()
+				return err
+			} else if server.socketGID != -1 {
+				if err := os.Chown(host, -1, server.socketGID); err != nil {
+					listener.Close()
+					return err
+				}
+			}
+		}
+		if peerCreds != nil {
+			listener = peerCreds.Listener(listener)
+		}
+		if proxyProtocol != nil {
+			listener = proxyProtocol.Listener(listener)
 		}
 		Info.Println("listening on Unix socket", host)
-		return (&http.Server{Addr: host, Handler: nil}).Serve(listener)
+		return serve(ctx, server.httpServer(host), listener, "", "")
 	}
 
+	listener, err = net.Listen(scheme, host)
+	if err != nil {
+		return err
+	}
+	if proxyProtocol != nil {
+		listener = proxyProtocol.Listener(listener)
+	}
 	if tlsCert != "" && tlsKey != "" {
-		Info.Println("listening on", host, "with TLS")
-		return http.ListenAndServeTLS(host, tlsCert, tlsKey, nil)
+		Info.Println("listening on", host, "over", scheme, "with TLS")
+		return serve(ctx, server.httpServer(host), listener, tlsCert, tlsKey)
+	}
+	Info.Println("listening on", host, "over", scheme)
+	return serve(ctx, server.httpServer(host), listener, "", "")
+}
+
+// stateFileMode is the mode of state files such as journal cursors, which may reveal service names and are only readable by the owner by default.
+var stateFileMode os.FileMode = 0600
+
+// ParseFileMode parses an octal file mode such as 0600.
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid file mode %v: expected octal permissions such as 0600", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// WriteFile replaces a file atomically by writing to a temporary file and renaming it. The mode is set explicitly, so that it doesn't depend on the umask or on the mode of an existing file.
+func WriteFile(filename string, b []byte, mode os.FileMode) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	} else if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
 	}
-	Info.Println("listening on", host)
-	return http.ListenAndServe(host, nil)
+	return os.Rename(tmp, filename)
+}
+
+// WriteStateFile writes a state file with the mode of --state.file-mode.
+func WriteStateFile(filename string, b []byte) error {
+	return WriteFile(filename, b, stateFileMode)
+}
+
+// fdListener returns a listener on an inherited file descriptor given as fd://3, such as a socket passed by the service manager.
+func fdListener(uri string) (net.Listener, error) {
+	fd, err := strconv.Atoi(strings.TrimPrefix(uri, "fd://"))
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("invalid file descriptor %v: expected a number of at least 3, e.g. fd://3", uri)
+	}
+	f := os.NewFile(uintptr(fd), uri)
+	defer f.Close() // the listener has its own duplicate
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %v: %w", uri, err)
+	}
+	return listener, nil
+}
+
+// serve serves until the context is done, after which the server stops accepting connections and waits up to closeTimeout for the requests in progress.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, tlsCert, tlsKey string) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			Info.Println("shutting down")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), exporter.CloseTimeout)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}
+	}()
+	if tlsCert != "" && tlsKey != "" {
+		return server.ServeTLS(listener, tlsCert, tlsKey)
+	}
+	return server.Serve(listener)
 }
 
 func BasicAuth(next http.Handler, users map[string]string) http.Handler {
@@ -137,65 +349,228 @@ func BasicAuth(next http.Handler, users map[string]string) http.Handler {
 	})
 }
 
-type Client struct {
-	client *http.Client
-	uri    string
+type requestIDKey struct{}
+
+// RequestID adds the X-Request-Id header of the request, or a random ID if absent, to the request's context so that it can be attached as an exemplar.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || 64 < len(id) {
+			id = fmt.Sprintf("%016x", rand.Uint64())
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
 }
 
-func newClient(uri string) (*Client, error) {
-	u, err := url.Parse(uri)
-	if err != nil {
-		return nil, err
+// RequestIDExemplar returns the exemplar labels for the request ID in the context.
+func RequestIDExemplar(ctx context.Context) prometheus.Labels {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return prometheus.Labels{"request_id": id}
 	}
-	if u.Port() == "" {
-		if u.Scheme == "http" {
-			u.Host += ":80"
-		} else if u.Scheme == "https" {
-			u.Host += ":443"
-		} else if u.Scheme == "unix" {
-			uri = "http://localhost" + u.Path
-		} else {
-			return nil, fmt.Errorf("unsupported protocol: %v", u.Scheme)
+	return nil
+}
+
+const logTailMaxBytes = 1024 * 1024
+
+// DedupWriter writes log lines, but suppresses lines that are identical to one written within the window, such as errors of an unreachable backend at every scrape. The number of consecutive repetitions is written when another line is written, and the number of remaining suppressed lines after the window.
+type DedupWriter struct {
+	w      io.Writer
+	window time.Duration
+
+	mu     sync.Mutex
+	lines  map[string]*dedupLine
+	last   string // last line written or suppressed
+	streak int    // number of consecutive repetitions of last that were suppressed
+	quit   chan struct{}
+}
+
+type dedupLine struct {
+	first    time.Time
+	repeated int
+}
+
+// dedupMinTick is the minimum interval of checking for windows that passed, so that tiny windows don't busy-loop.
+const dedupMinTick = 10 * time.Millisecond
+
+func NewDedupWriter(w io.Writer, window time.Duration) *DedupWriter {
+	d := &DedupWriter{
+		w:      w,
+		window: window,
+		lines:  map[string]*dedupLine{},
+		quit:   make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Close writes the number of suppressed lines that are still pending.
+func (d *DedupWriter) Close() error {
+	close(d.quit)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flush(time.Time{})
+	return nil
+}
+
+func (d *DedupWriter) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.flush(now)
+	prev := d.last
+	if string(b) != prev && 0 < d.streak {
+		d.lines[prev].repeated -= d.streak
+		d.summarize(prev, d.streak)
+		d.streak = 0
+	}
+	d.last = string(b)
+	if line, ok := d.lines[string(b)]; ok {
+		line.repeated++
+		if string(b) == prev {
+			d.streak++
 		}
+		return len(b), nil
 	}
+	d.lines[string(b)] = &dedupLine{first: now}
+	return d.w.Write(b)
+}
 
-	d := net.Dialer{
-		Timeout:   1 * time.Second,  // timeout in establishing connection only
-		KeepAlive: 30 * time.Second, // time between keep-alive probes
+// run writes the number of suppressed lines of windows that passed while nothing was logged.
+func (d *DedupWriter) run() {
+	tick := d.window / 10
+	if tick < dedupMinTick {
+		tick = dedupMinTick
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case now := <-ticker.C:
+			d.mu.Lock()
+			d.flush(now)
+			d.mu.Unlock()
+		}
 	}
-	tr := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			if u.Scheme == "unix" {
-				return d.DialContext(ctx, "unix", u.Path)
+}
+
+// flush forgets the lines whose window has passed at now, or all lines if now is zero.
+func (d *DedupWriter) flush(now time.Time) {
+	for b, line := range d.lines {
+		if now.IsZero() || d.window <= now.Sub(line.first) {
+			d.summarize(b, line.repeated)
+			delete(d.lines, b)
+			if b == d.last {
+				d.streak = 0
 			}
-			return d.DialContext(ctx, "tcp", u.Host)
-		},
+		}
+	}
+}
+
+// summarize writes the number of times a line was suppressed, if any.
+func (d *DedupWriter) summarize(b string, repeated int) {
+	if 0 < repeated {
+		fmt.Fprintf(d.w, "%v (last message repeated %d times)\n", strings.TrimSuffix(b, "\n"), repeated)
 	}
-	return &Client{
-		client: &http.Client{
-			Transport: tr,
-			CheckRedirect: func(*http.Request, []*http.Request) error {
-				return http.ErrUseLastResponse // don't follow redirects
-			},
-		},
-		uri: uri,
-	}, nil
 }
 
-func (c *Client) Get(ctx context.Context) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", c.uri, nil)
+// LogTail reads the lines appended to a log file since the last read, following rotation and truncation. At most logTailMaxBytes are read per call, the remainder is read on the next call.
+type LogTail struct {
+	filename string
+	f        *os.File
+	partial  []byte
+}
+
+// NewLogTail opens the log file and starts reading at its end.
+func NewLogTail(filename string) (*LogTail, error) {
+	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &LogTail{
+		filename: filename,
+		f:        f,
+	}, nil
+}
+
+func (t *LogTail) Close() error {
+	if t.f == nil {
+		return nil
+	}
+	return t.f.Close()
+}
+
+// Lines returns the complete lines written since the last call.
+func (t *LogTail) Lines() ([]string, error) {
+	if t.f == nil {
+		// file was missing after rotation
+		f, err := os.Open(t.filename)
+		if err != nil {
+			return nil, err
+		}
+		t.f = f
+	}
 
-	resp, err := c.client.Do(req)
+	info, err := t.f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	offset, err := t.f.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return nil, err
 	}
-	return body, nil
+	if info.Size() < offset {
+		// truncated
+		if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		t.partial = t.partial[:0]
+	}
+
+	b, err := io.ReadAll(io.LimitReader(t.f, logTailMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < logTailMaxBytes {
+		// reached the end of the file, check whether it was rotated
+		if newInfo, err := os.Stat(t.filename); err != nil || !os.SameFile(info, newInfo) {
+			t.f.Close()
+			t.f = nil
+			if err == nil {
+				if t.f, err = os.Open(t.filename); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return t.split(b), nil
+}
+
+func (t *LogTail) split(b []byte) []string {
+	lines := []string{}
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i == -1 {
+			break
+		}
+		if 0 < len(t.partial) {
+			lines = append(lines, string(t.partial)+string(b[:i]))
+			t.partial = t.partial[:0]
+		} else {
+			lines = append(lines, string(b[:i]))
+		}
+		b = b[i+1:]
+	}
+	if len(t.partial)+len(b) <= logTailMaxBytes {
+		t.partial = append(t.partial, b...)
+	} else {
+		t.partial = t.partial[:0] // drop overlong line
+	}
+	return lines
 }
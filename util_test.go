@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseStatusAuto(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     string
+		expected map[string]string
+	}{
+		{"lighttpd", "Total Accesses: 1337\nTotal kBytes: 4096\nUptime: 86400\nBusyServers: 3\nIdleServers: 125\nScoreboard: hhhrw_____\n", map[string]string{
+			"Total Accesses": "1337",
+			"Total kBytes":   "4096",
+			"Uptime":         "86400",
+			"BusyServers":    "3",
+			"IdleServers":    "125",
+			"Scoreboard":     "hhhrw_____",
+		}},
+		{"apache", "localhost\r\nServerVersion: Apache/2.4.57 (Debian)\r\nCurrentTime: Friday, 16-Oct-2026 15:43:49 UTC\r\nTotal Accesses: 42\r\nTotal kBytes: 17\r\nCPULoad: .0123\r\nBusyWorkers: 1\r\nIdleWorkers: 74\r\nScoreboard: _W__....\r\n", map[string]string{
+			"ServerVersion":  "Apache/2.4.57 (Debian)",
+			"CurrentTime":    "Friday, 16-Oct-2026 15:43:49 UTC",
+			"Total Accesses": "42",
+			"Total kBytes":   "17",
+			"CPULoad":        ".0123",
+			"BusyWorkers":    "1",
+			"IdleWorkers":    "74",
+			"Scoreboard":     "_W__....",
+		}},
+		{"empty", "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := ParseStatusAuto([]byte(tt.page))
+			if len(status) != len(tt.expected) {
+				t.Errorf("got %d keys, expected %d: %v", len(status), len(tt.expected), status)
+			}
+			for key, val := range tt.expected {
+				if status[key] != val {
+					t.Errorf("%v: got %q, expected %q", key, status[key], val)
+				}
+			}
+		})
+	}
+}
+
+// output returns what the DedupWriter has written so far.
+func (d *DedupWriter) output(buf *bytes.Buffer) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return buf.String()
+}
+
+func TestDedupWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		expected string
+		closed   string // written by Close
+	}{
+		{"distinct", []string{"a", "b", "c"}, "a\nb\nc\n", ""},
+		{"repeated", []string{"a", "a", "a"}, "a\n", "a (last message repeated 2 times)\n"},
+		{"changed", []string{"a", "a", "a", "b"}, "a\na (last message repeated 2 times)\nb\n", ""},
+		{"changed twice", []string{"a", "a", "b", "b", "c"}, "a\na (last message repeated 1 times)\nb\nb (last message repeated 1 times)\nc\n", ""},
+		{"interleaved", []string{"a", "b", "a", "b", "a"}, "a\nb\n", "a (last message repeated 2 times)\nb (last message repeated 1 times)\n"},
+		{"repeated after change", []string{"a", "a", "b", "a", "a"}, "a\na (last message repeated 1 times)\nb\n", "a (last message repeated 2 times)\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			d := NewDedupWriter(buf, time.Hour)
+			for _, line := range tt.lines {
+				if n, err := fmt.Fprintln(d, line); err != nil {
+					t.Fatal(err)
+				} else if n != len(line)+1 {
+					t.Fatalf("wrote %v bytes of %q", n, line)
+				}
+			}
+			if output := d.output(buf); output != tt.expected {
+				t.Fatalf("output is %q, expected %q", output, tt.expected)
+			}
+			d.Close()
+
+			// the summaries written when closing are in arbitrary order
+			if closed := buf.String()[len(tt.expected):]; closed != tt.closed && closed != swapLines(tt.closed) {
+				t.Fatalf("close wrote %q, expected %q", closed, tt.closed)
+			}
+		})
+	}
+}
+
+// swapLines swaps the lines of a string with two lines, since the order of summaries that are written at the same time is arbitrary.
+func swapLines(s string) string {
+	lines := bytes.SplitAfter([]byte(s), []byte("\n"))
+	if len(lines) != 3 {
+		return s
+	}
+	return string(lines[1]) + string(lines[0])
+}
+
+func TestDedupWriterWindow(t *testing.T) {
+	buf := &bytes.Buffer{}
+	d := NewDedupWriter(buf, 50*time.Millisecond)
+	defer d.Close()
+	fmt.Fprintln(d, "a")
+	fmt.Fprintln(d, "a")
+	fmt.Fprintln(d, "b")
+	fmt.Fprintln(d, "a")
+
+	// the summary is written after the window without further writes
+	expected := "a\na (last message repeated 1 times)\nb\na (last message repeated 1 times)\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for d.output(buf) != expected {
+		if deadline.Before(time.Now()) {
+			t.Fatalf("output is %q, expected %q", d.output(buf), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and the line is written again in a new window
+	fmt.Fprintln(d, "a")
+	if output := d.output(buf); output != expected+"a\n" {
+		t.Fatalf("output is %q, expected %q", output, expected+"a\n")
+	}
+}
+
+func TestDedupWriterTinyWindow(t *testing.T) {
+	buf := &bytes.Buffer{}
+	d := NewDedupWriter(buf, time.Nanosecond)
+	fmt.Fprintln(d, "a")
+	time.Sleep(time.Millisecond)
+	fmt.Fprintln(d, "a")
+	d.Close()
+	if output := buf.String(); output != "a\na\n" {
+		t.Fatalf("output is %q", output)
+	}
+}
@@ -0,0 +1,114 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWriteFileMode(t *testing.T) {
+	umask := syscall.Umask(0077) // restrictive, so that the mode must be set explicitly
+	defer syscall.Umask(umask)
+
+	tests := []struct {
+		existing os.FileMode // mode of an existing file, zero if it doesn't exist
+		mode     os.FileMode
+	}{
+		{0, 0600},
+		{0, 0640},
+		{0, 0644},
+		{0666, 0600},
+		{0600, 0644},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "state")
+		if tt.existing != 0 {
+			if err := os.WriteFile(filename, []byte("old\n"), tt.existing); err != nil {
+				t.Fatal(err)
+			} else if err := os.Chmod(filename, tt.existing); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := WriteFile(filename, []byte("new\n"), tt.mode); err != nil {
+			t.Fatal(err)
+		}
+
+		if info, err := os.Stat(filename); err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != tt.mode {
+			t.Errorf("%#o over %#o: got mode %#o", tt.mode, tt.existing, info.Mode().Perm())
+		}
+		if b, err := os.ReadFile(filename); err != nil || string(b) != "new\n" {
+			t.Errorf("%#o over %#o: got %q %v", tt.mode, tt.existing, b, err)
+		}
+		if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%#o over %#o: temporary file left behind", tt.mode, tt.existing)
+		}
+	}
+}
+
+func TestWriteStateFileMode(t *testing.T) {
+	defer func(mode os.FileMode) { stateFileMode = mode }(stateFileMode)
+	umask := syscall.Umask(0)
+	defer syscall.Umask(umask)
+
+	for _, mode := range []os.FileMode{0600, 0640} {
+		stateFileMode = mode
+		filename := filepath.Join(t.TempDir(), "cursor")
+		if err := WriteStateFile(filename, []byte("cursor\n")); err != nil {
+			t.Fatal(err)
+		} else if info, err := os.Stat(filename); err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != mode {
+			t.Errorf("got mode %#o, expected %#o with a permissive umask", info.Mode().Perm(), mode)
+		}
+	}
+}
+
+func TestListenSocketMode(t *testing.T) {
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+
+	dir, err := os.MkdirTemp("", "dex") // short path, since socket paths are limited to 107 bytes
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "dex.sock")
+
+	for _, mode := range []os.FileMode{0770, 0660} {
+		server := NewServer(time.Second, time.Second)
+		if err := server.SetSocketPermissions(mode, ""); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- ListenAndServe(ctx, "unix://"+socket, "", "", server, nil, nil)
+		}()
+
+		// the mode is set right after the socket is created
+		var perm os.FileMode
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if info, err := os.Stat(socket); err == nil {
+				if perm = info.Mode().Perm(); perm == mode {
+					break
+				}
+			}
+		}
+		cancel()
+		if err := <-done; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Fatal(err)
+		}
+		if perm != mode {
+			t.Errorf("socket: got mode %#o, expected %#o", perm, mode)
+		}
+	}
+}
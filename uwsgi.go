@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tdewolff/dex_exporter/collector"
+)
+
+type UWSGIOptions struct {
+	StatsURI []string `desc:"A URI or unix socket path for connecting to the uWSGI stats server, can be repeated and can contain globs for unix sockets."`
+	Service  string   `desc:"Systemd service name the uWSGI collector depends on."`
+
+	Interval float64 `desc:"Seconds between collecting in the background, scrapes then return the last collection. Zero collects at scrape time."`
+}
+
+type UWSGI struct {
+	uris     collector.URIGlobs
+	counters *collector.CounterTracker
+
+	workers     *prometheus.GaugeVec
+	req         *prometheus.CounterVec
+	avgRespTime *prometheus.GaugeVec
+	listenQueue *prometheus.GaugeVec
+	harakiri    *prometheus.CounterVec
+}
+
+func NewUWSGI(opts UWSGIOptions) (*UWSGI, error) {
+	uris, err := collector.ParseURIGlobs(opts.StatsURI, logs())
+	if err != nil {
+		return nil, err
+	}
+	e := &UWSGI{
+		uris:     uris,
+		counters: collector.NewCounterTracker(),
+
+		workers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "uwsgi_workers",
+			Help: "Number of workers.",
+		}, []string{"instance", "status"}),
+		req: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "uwsgi_requests_total",
+			Help: "Total number of requests.",
+		}, []string{"instance"}),
+		avgRespTime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "uwsgi_worker_avg_response_time_seconds",
+			Help: "Average response time of the workers in seconds.",
+		}, []string{"instance"}),
+		listenQueue: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "uwsgi_listen_queue",
+			Help: "Number of connections waiting in the listen queue.",
+		}, []string{"instance"}),
+		harakiri: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "uwsgi_harakiri_total",
+			Help: "Total number of workers killed by harakiri.",
+		}, []string{"instance"}),
+	}
+	e.updateStats()
+	return e, nil
+}
+
+func (e *UWSGI) Close() error {
+	return nil
+}
+
+// Check reads the stats of all uWSGI instances.
+func (e *UWSGI) Check(ctx context.Context) error {
+	for _, uri := range e.uris.Get() {
+		if _, err := e.getStats(uri); err != nil {
+			return fmt.Errorf("%v: %w", e.uris.Name(uri), err)
+		}
+	}
+	return nil
+}
+
+func (e *UWSGI) Describe(ch chan<- *prometheus.Desc) {
+	e.workers.Describe(ch)
+	e.req.Describe(ch)
+	e.avgRespTime.Describe(ch)
+	e.listenQueue.Describe(ch)
+	e.harakiri.Describe(ch)
+}
+
+func (e *UWSGI) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+func (e *UWSGI) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := time.Now()
+	stats, err := e.updateStats()
+	if err != nil {
+		Error.Println(err)
+	}
+	e.workers.Reset()
+	e.avgRespTime.Reset()
+	e.listenQueue.Reset()
+	for instance, stat := range stats {
+		e.workers.WithLabelValues(instance, "idle").Set(float64(stat.IdleWorkers))
+		e.workers.WithLabelValues(instance, "busy").Set(float64(stat.BusyWorkers))
+		e.req.WithLabelValues(instance).Add(float64(stat.Requests))
+		e.avgRespTime.WithLabelValues(instance).Set(stat.AvgResponseTime)
+		e.listenQueue.WithLabelValues(instance).Set(float64(stat.ListenQueue))
+		e.harakiri.WithLabelValues(instance).Add(float64(stat.Harakiri))
+	}
+	e.workers.Collect(ch)
+	e.req.Collect(ch)
+	e.avgRespTime.Collect(ch)
+	e.listenQueue.Collect(ch)
+	e.harakiri.Collect(ch)
+	Debug.Println("collect duration for uwsgi:", time.Since(t))
+	return err
+}
+
+type uwsgiStats struct {
+	IdleWorkers     uint64
+	BusyWorkers     uint64
+	Requests        uint64
+	AvgResponseTime float64
+	ListenQueue     uint64
+	Harakiri        uint64
+}
+
+func (e *UWSGI) updateStats() (map[string]uwsgiStats, error) {
+	var firstErr error
+	diffs := map[string]uwsgiStats{}
+	for _, uri := range e.uris.Get() {
+		name := e.uris.Name(uri)
+		cur, err := e.getStats(uri)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("uwsgi %v: %w", name, err)
+			}
+			continue
+		}
+
+		// counters restart when workers are respawned
+		diff := cur
+		diff.Harakiri, _ = e.counters.Delta(cur.Harakiri, uri, "harakiri")
+		if requests, ok := e.counters.Delta(cur.Requests, uri, "requests"); ok {
+			diff.Requests = requests
+			diffs[name] = diff
+		}
+	}
+	return diffs, firstErr
+}
+
+func (e *UWSGI) getStats(uri string) (uwsgiStats, error) {
+	scheme, host, err := collector.ParseURI(uri)
+	if err != nil {
+		return uwsgiStats{}, err
+	}
+	conn, err := net.DialTimeout(scheme, host, 1*time.Second)
+	if err != nil {
+		return uwsgiStats{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		return uwsgiStats{}, err
+	}
+
+	doc := struct {
+		ListenQueue uint64 `json:"listen_queue"`
+		Workers     []struct {
+			Status        string  `json:"status"`
+			Requests      uint64  `json:"requests"`
+			AvgRT         float64 `json:"avg_rt"`
+			HarakiriCount uint64  `json:"harakiri_count"`
+		} `json:"workers"`
+	}{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return uwsgiStats{}, fmt.Errorf("failed to parse stats: %w", err)
+	}
+
+	n := 0
+	cur := uwsgiStats{
+		ListenQueue: doc.ListenQueue,
+	}
+	for _, worker := range doc.Workers {
+		switch worker.Status {
+		case "idle":
+			cur.IdleWorkers++
+		case "busy":
+			cur.BusyWorkers++
+		}
+		cur.Requests += worker.Requests
+		cur.Harakiri += worker.HarakiriCount
+		if 0 < worker.Requests {
+			cur.AvgResponseTime += worker.AvgRT / 1e6 // in microseconds
+			n++
+		}
+	}
+	if 0 < n {
+		cur.AvgResponseTime /= float64(n)
+	}
+	return cur, nil
+}
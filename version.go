@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Commit and BuildDate are set with -ldflags, otherwise they are taken from the VCS information embedded by the Go toolchain.
+var (
+	Commit    = ""
+	BuildDate = ""
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// GetBuildInfo returns the version, commit and build date of the exporter. The commit is suffixed by -dirty if the working tree had local modifications.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		modified := false
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && Commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	return info
+}
+
+func (info BuildInfo) String() string {
+	commit, date := info.Commit, info.Date
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("%v (commit %v, built %v, %v)", info.Version, commit, date, info.GoVersion)
+}
+
+// NewBuildInfoGauge returns the dex_exporter_build_info metric.
+func NewBuildInfoGauge(info BuildInfo) prometheus.Gauge {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dex_exporter_build_info",
+		Help: "Version, commit and build date of the exporter.",
+		ConstLabels: prometheus.Labels{
+			"version":   info.Version,
+			"commit":    info.Commit,
+			"date":      info.Date,
+			"goversion": info.GoVersion,
+		},
+	})
+	gauge.Set(1.0)
+	return gauge
+}
+
+// VersionHandler serves the build info as JSON. It doesn't require authentication, since the same information is exported by dex_exporter_build_info.
+func VersionHandler(info BuildInfo) http.Handler {
+	b, _ := json.Marshal(info)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}